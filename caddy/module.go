@@ -2,14 +2,12 @@ package varc
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
 	"reflect"
 	"runtime/debug"
 	"strconv"
-	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -107,7 +105,7 @@ func (h *Handler) Validate() error {
 		return fmt.Errorf("chunk_streams must be non-negative, got %d", h.CacheChunkStreams)
 	}
 
-	return nil
+	return h.Options.Validate()
 }
 
 // Cleanup cleans up the handler resources.
@@ -126,6 +124,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyht
 		h.handler.ServeMetrics(w)
 		return nil
 	}
+	if h.QueuePath != "" && r.URL.Path == h.QueuePath {
+		h.handler.ServeQueue(w, r)
+		return nil
+	}
 
 	// Resolve the target URL
 	targetURL := h.resolveTargetURL(r)
@@ -167,29 +169,15 @@ func (h *Handler) resolveTargetURL(r *http.Request) string {
 	if h.upstreamURL != nil {
 		// Static upstream: build URL from upstream base + request path
 		fullURL := h.upstreamURL.JoinPath(r.URL.Path).String()
-		if r.URL.RawQuery != "" {
-			fullURL += "?" + r.URL.RawQuery
+		if query := h.handler.TrimAccessParams(r.URL.RawQuery); query != "" {
+			fullURL += "?" + query
 		}
 		return fullURL
 	}
 
-	// Dynamic upstream: resolve from request
-	if targetURL := r.URL.Query().Get("url"); targetURL != "" {
-		return targetURL
-	}
-
-	// Check for Base64 URL in path (like standalone mode)
-	if strings.HasPrefix(r.URL.Path, "/stream/") {
-		encodedURL := strings.TrimPrefix(r.URL.Path, "/stream/")
-		if decoded, err := base64.RawURLEncoding.DecodeString(encodedURL); err == nil {
-			return string(decoded)
-		}
-		if decoded, err := base64.URLEncoding.DecodeString(encodedURL); err == nil {
-			return string(decoded)
-		}
-	}
-
-	return ""
+	// Dynamic upstream: resolve from request (query param or base64
+	// path like standalone mode)
+	return proxy.TargetURL(r)
 }
 
 // parseCaddyfile parses the Caddyfile configuration.
@@ -202,6 +190,10 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 }
 
 // UnmarshalCaddyfile sets up the handler from Caddyfile tokens.
+//
+// Options are taken from the config file given by the config
+// subdirective, then VARC_* environment variables, then the other
+// subdirectives.
 func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		// First positional arg is upstream (optional)
@@ -209,10 +201,28 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			h.Upstream = d.Val()
 		}
 
+		if err := proxy.ApplyEnv(&h.Options); err != nil {
+			return d.Errf("%v", err)
+		}
+
+		first := true
 		for d.NextBlock(0) {
 			directive := d.Val()
+			isFirst := first
+			first = false
 
 			switch directive {
+			case "config":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if !isFirst {
+					return d.Err("config must come before the other subdirectives")
+				}
+				if err := proxy.LoadConfig(d.Val(), &h.Options); err != nil {
+					return d.Errf("%v", err)
+				}
+				continue
 			case "passthrough":
 				h.Passthrough = true
 				continue
@@ -222,6 +232,12 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 				h.MetricsPath = d.Val()
 				continue
+			case "queue":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				h.QueuePath = d.Val()
+				continue
 			case "upstream":
 				if !d.NextArg() {
 					return d.ArgErr()
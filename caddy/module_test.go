@@ -1,6 +1,8 @@
 package varc
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -134,6 +136,51 @@ func TestUnmarshalCaddyfile(t *testing.T) {
 		}
 	})
 
+	t.Run("config file and environment", func(t *testing.T) {
+		config := filepath.Join(t.TempDir(), "varc.yaml")
+		err := os.WriteFile(config, []byte("max_size: 10G\nchunk_streams: 8\nstrip_query: true\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("VARC_MAX_AGE", "2h")
+		t.Setenv("VARC_CHUNK_STREAMS", "6")
+		d := caddyfile.NewTestDispenser(`
+			varc https://example.com {
+				config ` + config + `
+				chunk_streams 4
+			}
+		`)
+
+		v := &Handler{
+			Options: proxy.DefaultOptions(),
+		}
+
+		err = v.UnmarshalCaddyfile(d)
+		if err != nil {
+			t.Fatalf("failed to unmarshal caddyfile: %v", err)
+		}
+
+		if v.CacheMaxSize != "10G" || !v.StripQuery {
+			t.Errorf("expected options from the config file, got max_size %q strip_query %v", v.CacheMaxSize, v.StripQuery)
+		}
+		if v.CacheMaxAge != "2h" {
+			t.Errorf("expected CacheMaxAge '2h' from the environment, got '%s'", v.CacheMaxAge)
+		}
+		if v.CacheChunkStreams != 4 {
+			t.Errorf("expected CacheChunkStreams 4 from the subdirective, got %d", v.CacheChunkStreams)
+		}
+
+		d = caddyfile.NewTestDispenser(`
+			varc {
+				cache_dir /tmp/cache
+				config ` + config + `
+			}
+		`)
+		if err := (&Handler{}).UnmarshalCaddyfile(d); err == nil {
+			t.Fatal("expected error for config after other subdirectives, got nil")
+		}
+	})
+
 	t.Run("unknown subdirective returns error", func(t *testing.T) {
 		d := caddyfile.NewTestDispenser(`
 			varc https://example.com {
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/tgdrive/varc/pkg/proxy"
+
+	"github.com/spf13/pflag"
+)
+
+// Exit codes of the fsck subcommand
+const (
+	fsckOK       = 0 // no problems left
+	fsckProblems = 1 // problems found which weren't repaired
+	fsckError    = 2 // the check couldn't be completed
+)
+
+// runFsck runs "varc fsck [--repair] [flags]" which checks the cache
+// directories while the proxy isn't running, returning the exit code
+func runFsck(args []string) int {
+	repair := pflag.Bool("repair", false, "Repair, quarantine or remove the problems found instead of only reporting them")
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fsck [--repair] [flags]\n\nChecks the cache directories. The proxy must not be running.\n\n", os.Args[0])
+		pflag.PrintDefaults()
+	}
+	if err := pflag.CommandLine.Parse(args); err != nil {
+		return fsckError
+	}
+	opt, err := loadOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return fsckError
+	}
+	findings, err := proxy.Fsck(opt, *repair)
+	left := 0
+	for _, f := range findings {
+		fmt.Println(f)
+		if !f.Fixed() {
+			left++
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fsck failed: %v\n", err)
+		return fsckError
+	}
+	fmt.Printf("%d problems found, %d left\n", len(findings), left)
+	if left > 0 {
+		return fsckProblems
+	}
+	return fsckOK
+}
@@ -8,15 +8,16 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/tgdrive/varc/lib/file"
+	"github.com/tgdrive/varc/internal/cache/downloaders"
 	"github.com/tgdrive/varc/internal/cache/writeback"
 	"github.com/tgdrive/varc/internal/types"
+	"github.com/tgdrive/varc/lib/file"
 )
 
 // NB as Cache and Item are tightly linked it is necessary to have a
@@ -31,22 +32,44 @@ import (
 // Cache opened files
 type Cache struct {
 	// read only - no locking needed to read these
-	ctx       context.Context       // context for cache lifetime
-	opt       *types.Options
-	root      string                // OS path for cache data
-	metaRoot  string                // OS path for cache metadata
-	writeback *writeback.WriteBack  // holds Items for writeback
-	avFn      AddVirtualFn          // if set, can be called to add dir entries
-
-	mu            sync.Mutex        // protects the following variables
-	cond          sync.Cond         // cond lock for synchronous cache cleaning
-	item          map[string]*Item  // files/directories in the cache
-	errItems      map[string]error  // items in error state
-	used          int64             // total size of files in the cache
-	outOfSpace    bool              // out of space
-	cleanerKicked bool              // some thread kicked the cleaner upon out of space
-	kickerMu      sync.Mutex        // mutex for cleanerKicked
-	kick          chan struct{}     // channel for kicking cleaner to start
+	ctx                context.Context // context for cache lifetime
+	opt                *types.Options
+	roots              []*cacheRoot           // directories the cache is spread over
+	writeback          *writeback.WriteBack   // holds Items for writeback
+	avFn               AddVirtualFn           // if set, can be called to add dir entries
+	rmFn               RemoveFn               // if set, called when items are removed
+	completer          *completer             // background completion of partial items
+	scheduler          *downloaders.Scheduler // gives client reads priority over speculative ones
+	policy             EvictionPolicy         // chooses which items to evict first
+	groups             map[string]*quotaGroup // quota groups by name - their usage is protected by mu
+	mem                *memTier               // hot blocks kept in memory - nil if not enabled
+	lastClean          time.Time              // when the last clean started - only used by the cleaner
+	corruptChunks      atomic.Int64           // number of chunks which failed their checksums
+	scrubs             atomic.Int64           // number of times the scrubber has run
+	scrubFindings      atomic.Int64           // number of problems the scrubber has found
+	indexed            chan struct{}          // closed once the items on disk are all loaded
+	indexedItems       atomic.Int64           // number of items found on disk while loading
+	uploads            atomic.Int64           // number of items uploaded to the remote
+	uploadedBytes      atomic.Int64           // bytes uploaded to the remote
+	uploadErrors       atomic.Int64           // number of uploads which failed
+	downloadsCancelled atomic.Int64           // number of downloads stopped after their clients went away
+	subscribers        subscribers            // channels events are sent to
+
+	mu            sync.Mutex       // protects the following variables
+	cond          sync.Cond        // cond lock for synchronous cache cleaning
+	item          map[string]*Item // files/directories in the cache
+	errItems      map[string]error // items in error state
+	used          int64            // total size of files in the cache
+	outOfSpace    bool             // out of space
+	evictions     int64            // number of items evicted to free space
+	evictedBytes  int64            // bytes freed by evicting items
+	evictedRanges int64            // number of chunks evicted from inside items
+	noPunchHoles  bool             // set once the cache dir is found not to support evicting ranges
+	demotions     int64            // number of items moved to a slower tier
+	promotions    int64            // number of items moved to the fastest tier
+	cleanerKicked bool             // some thread kicked the cleaner upon out of space
+	kickerMu      sync.Mutex       // mutex for cleanerKicked
+	kick          chan struct{}    // channel for kicking cleaner to start
 }
 
 // AddVirtualFn if registered by the WithAddVirtual method, can be
@@ -57,50 +80,77 @@ type Cache struct {
 // go into the directory tree.
 type AddVirtualFn func(remote string, size int64, isDir bool) error
 
+// RemoveFn if passed to New is called with the name of each item
+// removed from the Cache, whether deleted or evicted, so anything kept
+// about it elsewhere can be released.
+//
+// It is called with Cache.mu held so must not call back into the Cache.
+type RemoveFn func(name string)
+
 // New creates a new cache hierarchy
 //
 // This starts background goroutines which can be cancelled with the
 // context passed in.
-func New(ctx context.Context, opt *types.Options, avFn AddVirtualFn) (*Cache, error) {
-	if opt.CacheDir == "" {
-		return nil, errors.New("cache: CacheDir not set")
+func New(ctx context.Context, opt *types.Options, avFn AddVirtualFn, rmFn RemoveFn) (*Cache, error) {
+	policy, err := NewEvictionPolicy(opt.EvictionPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+
+	groups, err := newGroups(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckMetaStore(opt.MetaStore); err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
 	}
-	root := filepath.Join(opt.CacheDir, "data")
-	metaRoot := filepath.Join(opt.CacheDir, "meta")
 
 	// Create directories
-	for _, d := range []string{root, metaRoot} {
-		if err := os.MkdirAll(d, 0700); err != nil {
-			return nil, fmt.Errorf("cache: failed to create cache directory %q: %w", d, err)
-		}
+	roots, err := newRoots(opt)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create the cache object
 	c := &Cache{
 		ctx:       ctx,
 		opt:       opt,
-		root:      root,
-		metaRoot:  metaRoot,
+		roots:     roots,
 		item:      make(map[string]*Item),
 		errItems:  make(map[string]error),
 		writeback: writeback.New(ctx, opt),
 		avFn:      avFn,
+		rmFn:      rmFn,
+		completer: newCompleter(),
+		scheduler: downloaders.NewScheduler(),
+		policy:    policy,
+		groups:    groups,
+		mem:       newMemTier(opt.MemCacheSize, opt.MemCacheMinHits),
+		lastClean: time.Now(),
+		indexed:   make(chan struct{}),
 	}
 
-	// load in the cache and metadata off disk
-	err := c.reload(ctx)
+	// open the metadata, migrating it if its layout has changed
+	err = c.openStores(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load cache: %w", err)
+		return nil, err
 	}
 
-	// Remove any empty directories
-	c.purgeEmptyDirs("", true)
-
 	// Create a channel for cleaner to be kicked upon out of space condition
 	c.kick = make(chan struct{}, 1)
 	c.cond = sync.Cond{L: &c.mu}
 
+	// load in the cache and metadata off disk, in the background if
+	// lazy so items are loaded as they are used meanwhile
+	if opt.LazyReload {
+		go c.indexer(ctx)
+	} else if err := c.index(ctx); err != nil {
+		return nil, err
+	}
+
 	go c.cleaner(ctx)
+	go c.scrubber(ctx)
 
 	return c, nil
 }
@@ -109,12 +159,55 @@ func New(ctx context.Context, opt *types.Options, avFn AddVirtualFn) (*Cache, er
 func (c *Cache) Stats() map[string]interface{} {
 	out := make(map[string]interface{})
 	// read only - no locking needed to read these
-	out["root"] = c.root
-	out["metaRoot"] = c.metaRoot
+	out["root"] = c.roots[0].data
+	out["metaRoot"] = c.roots[0].meta
+	out["metaStore"] = c.metaStoreName()
+	out["ready"] = c.Ready()
+	out["indexedItems"] = c.indexedItems.Load()
+	var logRecords, logItems, logSize int64
+	for _, root := range c.roots {
+		if log, ok := root.store.(*logStore); ok {
+			records, items, size := log.stats()
+			logRecords += int64(records)
+			logItems += int64(items)
+			logSize += size
+		}
+	}
+	out["metaLogRecords"] = logRecords
+	out["metaLogItems"] = logItems
+	out["metaLogBytes"] = logSize
+	out["evictionPolicy"] = c.policy.Name()
 
 	uploadsInProgress, uploadsQueued := c.writeback.Stats()
 	out["uploadsInProgress"] = uploadsInProgress
 	out["uploadsQueued"] = uploadsQueued
+	out["uploads"] = c.uploads.Load()
+	out["uploadedBytes"] = c.uploadedBytes.Load()
+	out["uploadErrors"] = c.uploadErrors.Load()
+	out["eventsDropped"] = c.eventsDropped()
+
+	clientsWaiting, preemptions := c.scheduler.Stats()
+	out["clientsWaiting"] = clientsWaiting
+	out["preemptions"] = preemptions
+
+	completionsRunning, completionsDone, completionsStopped := c.completer.stats()
+	out["completionsRunning"] = completionsRunning
+	out["completionsDone"] = completionsDone
+	out["completionsStopped"] = completionsStopped
+
+	if c.mem != nil {
+		memBlocks, memBytes, memHits, memMisses, memRejected := c.mem.stats()
+		out["memBlocks"] = memBlocks
+		out["memBytes"] = memBytes
+		out["memHits"] = memHits
+		out["memMisses"] = memMisses
+		out["memRejected"] = memRejected
+	}
+
+	out["corruptChunks"] = c.corruptChunks.Load()
+	out["scrubs"] = c.scrubs.Load()
+	out["scrubFindings"] = c.scrubFindings.Load()
+	out["downloadsCancelled"] = c.downloadsCancelled.Load()
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -123,6 +216,25 @@ func (c *Cache) Stats() map[string]interface{} {
 	out["erroredFiles"] = len(c.errItems)
 	out["bytesUsed"] = c.used
 	out["outOfSpace"] = c.outOfSpace
+	out["evictions"] = c.evictions
+	out["evictedBytes"] = c.evictedBytes
+	out["evictedRanges"] = c.evictedRanges
+	out["demotions"] = c.demotions
+	out["promotions"] = c.promotions
+	roots := make([]map[string]interface{}, len(c.roots))
+	for i, root := range c.roots {
+		roots[i] = map[string]interface{}{
+			"path":    root.path,
+			"tier":    root.tier,
+			"weight":  root.weight,
+			"maxSize": root.maxSize,
+			"used":    root.used,
+		}
+	}
+	out["roots"] = roots
+	if len(c.groups) > 0 {
+		out["groups"] = c._groupStats()
+	}
 
 	return out
 }
@@ -130,10 +242,16 @@ func (c *Cache) Stats() map[string]interface{} {
 // Queue returns info about the Cache
 func (c *Cache) Queue() map[string]interface{} {
 	out := make(map[string]interface{})
-	out["queue"] = c.writeback.Queue()
+	out["queue"] = c.QueueItems()
 	return out
 }
 
+// QueueItems returns the items in the upload queue, those being
+// uploaded first then in the order they will be uploaded
+func (c *Cache) QueueItems() []writeback.QueueInfo {
+	return c.writeback.Queue()
+}
+
 // QueueSetExpiry updates the expiry of a single item in the upload queue
 //
 // The expiry time is set to expiry + relative if expiry is passed in,
@@ -142,27 +260,39 @@ func (c *Cache) QueueSetExpiry(id writeback.Handle, expiry time.Time, relative t
 	return c.writeback.SetExpiry(id, expiry, relative)
 }
 
+// QueueUploadNow makes a single item in the upload queue eligible for
+// upload straight away
+func (c *Cache) QueueUploadNow(id writeback.Handle) error {
+	return c.writeback.SetExpiry(id, time.Now(), 0)
+}
+
+// QueueCancel cancels the upload in progress of a single item in the
+// upload queue, leaving it queued to be tried again later
+func (c *Cache) QueueCancel(id writeback.Handle) error {
+	return c.writeback.Cancel(id)
+}
+
 // createDir creates a directory path, along with any necessary parents
 func createDir(dir string) error {
 	return file.MkdirAll(dir, 0700)
 }
 
-// createItemDir creates the directory for named item in all cache roots
+// createItemDir creates the data and metadata directories for named
+// item in root
 //
 // Returns an os path for the data cache file.
-func (c *Cache) createItemDir(name string) (string, error) {
+func (c *Cache) createItemDir(root *cacheRoot, name string) (string, error) {
 	parent := types.FindParent(name)
-	parentPath := c.toOSPath(parent)
+	parentPath := root.toOSPath(parent)
 	err := createDir(parentPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to create data cache item directory: %w", err)
 	}
-	parentPathMeta := c.toOSPathMeta(parent)
-	err = createDir(parentPathMeta)
+	err = root.store.mkdir(name)
 	if err != nil {
 		return "", fmt.Errorf("failed to create metadata cache item directory: %w", err)
 	}
-	return c.toOSPath(name), nil
+	return root.toOSPath(name), nil
 }
 
 // clean returns the cleaned version of name for use in the index map
@@ -177,17 +307,6 @@ func clean(name string) string {
 	return name
 }
 
-// toOSPath turns a remote relative name into an OS path in the cache
-func (c *Cache) toOSPath(name string) string {
-	return filepath.Join(c.root, name)
-}
-
-// toOSPathMeta turns a remote relative name into an OS path in the
-// cache for the metadata
-func (c *Cache) toOSPathMeta(name string) string {
-	return filepath.Join(c.metaRoot, name)
-}
-
 // _get gets name from the cache or creates a new one
 //
 // It returns the item and found as to whether this item was found in
@@ -337,7 +456,7 @@ func (c *Cache) Rename(name string, newName string, newObj types.RemoteObject) (
 	c.mu.Lock()
 	if item, ok := c.item[name]; ok {
 		c.item[newName] = item
-		delete(c.item, name)
+		c._delete(name)
 	}
 	c.mu.Unlock()
 
@@ -347,9 +466,12 @@ func (c *Cache) Rename(name string, newName string, newObj types.RemoteObject) (
 
 // DirExists checks to see if the directory exists in the cache or not.
 func (c *Cache) DirExists(name string) bool {
-	path := c.toOSPath(name)
-	_, err := os.Stat(path)
-	return err == nil
+	for _, root := range c.roots {
+		if _, err := os.Stat(root.toOSPath(name)); err == nil {
+			return true
+		}
+	}
+	return false
 }
 
 // DirRename the dir in cache
@@ -397,15 +519,43 @@ func (c *Cache) Remove(name string) (wasWriting bool) {
 	c.mu.Lock()
 	item := c.item[name]
 	if item != nil {
-		delete(c.item, name)
+		c._delete(name)
+		c.publish(EventRemoved, name, 0)
 	}
 	c.mu.Unlock()
 	if item == nil {
 		return false
 	}
+	c.policy.Forget(name)
 	return item.remove("file deleted")
 }
 
+// dropRejected removes item from the cache after the remote refused
+// its upload so what it never accepted isn't served.
+//
+// It is called from the upload itself, which the write back queue
+// drops, so unlike Remove this leaves the queue alone. Items which
+// are open again or have changed since are left for their next
+// upload.
+func (c *Cache) dropRejected(item *Item) {
+	c.mu.Lock()
+	item.mu.Lock()
+	drop := c.item[item.name] == item && item.opens == 0 && !item.modified && item.info.Dirty
+	if drop {
+		c._delete(item.name)
+		c.publish(EventRemoved, item.name, 0)
+		item._invalidateMem()
+		item.info.clean()
+		item._removeFile("upload rejected")
+		item._removeMeta("upload rejected")
+	}
+	item.mu.Unlock()
+	c.mu.Unlock()
+	if drop {
+		c.policy.Forget(item.name)
+	}
+}
+
 // SetModTime should be called to set the modification time of the cache file
 func (c *Cache) SetModTime(name string, modTime time.Time) {
 	item, _ := c.get(name)
@@ -413,17 +563,20 @@ func (c *Cache) SetModTime(name string, modTime time.Time) {
 }
 
 // CleanUp empties the cache of everything
-func (c *Cache) CleanUp() error {
-	err1 := os.RemoveAll(c.root)
-	err2 := os.RemoveAll(c.metaRoot)
-	if err1 != nil {
-		return err1
+func (c *Cache) CleanUp() (err error) {
+	for _, root := range c.roots {
+		if removeErr := os.RemoveAll(root.data); removeErr != nil && err == nil {
+			err = removeErr
+		}
+		if clearErr := root.store.clear(); clearErr != nil && err == nil {
+			err = clearErr
+		}
 	}
-	return err2
+	return err
 }
 
 // walk walks the cache calling the function
-func (c *Cache) walk(dir string, fn func(osPath string, fi os.FileInfo, name string) error) error {
+func walk(dir string, fn func(osPath string, fi os.FileInfo, name string) error) error {
 	return filepath.Walk(dir, func(osPath string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -445,31 +598,137 @@ func (c *Cache) walk(dir string, fn func(osPath string, fi os.FileInfo, name str
 
 // reload walks the cache loading metadata files
 //
-// It iterates the files first then metadata trees. It doesn't expect
-// to find any new items iterating the metadata but it will clear up
-// orphan files.
+// It iterates the files first then the metadata of each root. It
+// doesn't expect to find any new items iterating the metadata but it
+// will clear up orphan files. Copies of an item on a root other than
+// the one it was loaded from are removed.
 func (c *Cache) reload(ctx context.Context) error {
-	for _, dir := range []string{c.root, c.metaRoot} {
-		err := c.walk(dir, func(osPath string, fi os.FileInfo, name string) error {
+	for _, root := range c.roots {
+		err := walk(root.data, func(osPath string, fi os.FileInfo, name string) error {
 			if fi.IsDir() {
 				return nil
 			}
-			item, found := c.get(name)
-			if !found {
-				err := item.reload(ctx)
-				if err != nil {
-					c.opt.Logger.Errorf("cache: failed to reload item %q: %v", name, err)
+			if strings.HasSuffix(name, dataTempSuffix) {
+				// left by a crash while moving an item
+				c.opt.Logger.Infof("cache: removing partially moved data %q", osPath)
+				if err := os.Remove(osPath); err != nil {
+					c.opt.Logger.Errorf("cache: failed to remove partially moved data %q: %v", osPath, err)
 				}
+				return nil
 			}
+			c.reloadItem(ctx, root, name, func() error {
+				return os.Remove(osPath)
+			})
 			return nil
 		})
 		if err != nil {
-			return fmt.Errorf("failed to walk cache %q: %w", dir, err)
+			return fmt.Errorf("failed to walk cache %q: %w", root.data, err)
+		}
+		names, err := root.store.names()
+		if err != nil {
+			return fmt.Errorf("failed to read metadata in %q: %w", root.path, err)
+		}
+		for _, name := range names {
+			c.reloadItem(ctx, root, name, func() error {
+				return root.store.remove(name)
+			})
 		}
 	}
 	return nil
 }
 
+// reloadItem loads the item called name found on root, calling
+// removeCopy to remove what was found if the item belongs on another
+// root
+func (c *Cache) reloadItem(ctx context.Context, root *cacheRoot, name string, removeCopy func() error) {
+	item, found := c.get(name)
+	if !found {
+		c.indexedItems.Add(1)
+		err := item.reload(ctx)
+		if err != nil {
+			c.opt.Logger.Errorf("cache: failed to reload item %q: %v", name, err)
+		}
+	}
+	if item.getRoot() != root {
+		c.opt.Logger.Infof("cache: removing stale copy of %q from %q", name, root.path)
+		if err := removeCopy(); err != nil {
+			c.opt.Logger.Errorf("cache: failed to remove stale copy of %q from %q: %v", name, root.path, err)
+		}
+	}
+}
+
+// index loads the items on disk then marks the cache as ready
+func (c *Cache) index(ctx context.Context) error {
+	err := c.reload(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load cache: %w", err)
+	}
+
+	// Remove any empty directories
+	c.purgeEmptyDirs("", true)
+
+	close(c.indexed)
+	return nil
+}
+
+// indexer loads the items on disk in the background so the cache can
+// be used straight away.
+//
+// Items used meanwhile are loaded when first looked up, but the totals
+// the quotas are enforced with are incomplete until it has finished.
+func (c *Cache) indexer(ctx context.Context) {
+	start := time.Now()
+	c.opt.Logger.Infof("cache: loading items in the background")
+	if err := c.index(ctx); err != nil {
+		// Serve what can be loaded rather than nothing
+		c.opt.Logger.Errorf("cache: %v", err)
+		close(c.indexed)
+		return
+	}
+	c.opt.Logger.Infof("cache: loaded %d items in %v", c.indexedItems.Load(), time.Since(start))
+}
+
+// Ready returns true once the items on disk are all loaded so the
+// usage totals are complete
+func (c *Cache) Ready() bool {
+	select {
+	case <-c.indexed:
+		return true
+	default:
+		return false
+	}
+}
+
+// openStores opens the metadata stores of the roots, closing them when
+// the context is cancelled
+func (c *Cache) openStores(ctx context.Context) error {
+	for _, root := range c.roots {
+		store, err := openStore(root, c.opt.MetaStore, c.opt.Logger)
+		if err != nil {
+			return err
+		}
+		root.store = store
+	}
+	go func() {
+		<-ctx.Done()
+		for _, root := range c.roots {
+			if err := root.store.close(); err != nil {
+				c.opt.Logger.Errorf("cache: failed to close metadata of %q: %v", root.path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// compactStores reclaims the space used by old metadata
+func (c *Cache) compactStores() {
+	for _, root := range c.roots {
+		if err := root.store.compact(); err != nil {
+			c.opt.Logger.Errorf("cache: failed to compact metadata of %q: %v", root.path, err)
+		}
+	}
+}
+
 // KickCleaner kicks cache cleaner upon out of space situation
 func (c *Cache) KickCleaner() {
 	/* Use a separate kicker mutex for the kick to go through without waiting for the
@@ -499,18 +758,56 @@ func (c *Cache) KickCleaner() {
 
 // removeNotInUse removes items not in use with a possible maxAge cutoff
 // called with cache mutex locked and up-to-date c.used (as we update it directly here)
-func (c *Cache) removeNotInUse(item *Item, maxAge time.Duration, emptyOnly bool) {
-	removed, spaceFreed := item.RemoveNotInUse(maxAge, emptyOnly)
+func (c *Cache) removeNotInUse(item *Item, maxAge time.Duration, emptyOnly bool) (removed bool, spaceFreed int64) {
+	removed, spaceFreed = item.RemoveNotInUse(maxAge, emptyOnly)
 	// The item space might be freed even if we get an error after the cache file is removed
 	// The item will not be removed or reset the cache data is dirty (DataDirty)
-	c.used -= spaceFreed
+	c._freed(item, spaceFreed)
 	if removed {
 		c.opt.Logger.Infof("cache RemoveNotInUse (maxAge=%d, emptyOnly=%v): item %s was removed, freed %d bytes", maxAge, emptyOnly, item.GetName(), spaceFreed)
 		// Remove the entry
-		delete(c.item, item.name)
+		c._delete(item.name)
+		c.publish(EventEvicted, item.name, spaceFreed)
 	} else {
 		c.opt.Logger.Debugf("cache RemoveNotInUse (maxAge=%d, emptyOnly=%v): item %s not removed, freed %d bytes", maxAge, emptyOnly, item.GetName(), spaceFreed)
 	}
+	return removed, spaceFreed
+}
+
+// _delete removes the item called name from the cache
+//
+// call with mu held
+func (c *Cache) _delete(name string) {
+	delete(c.item, name)
+	if c.rmFn != nil {
+		c.rmFn(name)
+	}
+}
+
+// _evicted records that item was removed or reset to free space
+//
+// call with mu held
+func (c *Cache) _evicted(item *Item, spaceFreed int64) {
+	c.evictions++
+	c.evictedBytes += spaceFreed
+	c.policy.Evicted(item.name)
+}
+
+// _sortForEviction orders items with the eviction policy so the one
+// to evict first is first
+//
+// call with mu held
+func (c *Cache) _sortForEviction(items Items) {
+	candidates := make([]Candidate, len(items))
+	byName := make(map[string]*Item, len(items))
+	for i, item := range items {
+		candidates[i] = item.candidate()
+		byName[item.name] = item
+	}
+	c.policy.Sort(candidates)
+	for i, candidate := range candidates {
+		items[i] = byName[candidate.Name]
+	}
 }
 
 // Retry failed resets during purgeClean()
@@ -539,6 +836,9 @@ func (c *Cache) retryFailedResets() {
 
 // Remove cache files that are not dirty until the quota is satisfied
 func (c *Cache) purgeClean() {
+	// Items demoted are moved once mu is released
+	var moves []tierMove
+	defer func() { c.moveItems(moves) }()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -548,27 +848,34 @@ func (c *Cache) purgeClean() {
 
 	var items Items
 
-	// Make a slice of clean cache files
+	// Make a slice of clean cache files on roots which need space
 	for _, item := range c.item {
-		if !item.IsDirty() {
+		if !item.IsDirty() && c._needsSpace(item) {
 			items = append(items, item)
 		}
 	}
 
-	sort.Sort(items)
+	c._sortForEviction(items)
 
 	// Reset items until the quota is OK
 	for _, item := range items {
 		if c.quotasOK() {
 			break
 		}
+		if !c._needsSpace(item) || c._demote(item, &moves) {
+			continue
+		}
 		resetResult, spaceFreed, err := item.Reset()
 		// The item space might be freed even if we get an error after the cache file is removed
 		// The item will not be removed or reset if the cache data is dirty (DataDirty)
-		c.used -= spaceFreed
+		c._freed(item, spaceFreed)
 		c.opt.Logger.Infof("cache purgeClean item.Reset %s: %s, freed %d bytes", item.GetName(), resetResult.String(), spaceFreed)
 		if resetResult == RemovedNotInUse {
-			delete(c.item, item.name)
+			c._delete(item.name)
+			c.publish(EventEvicted, item.name, spaceFreed)
+		}
+		if resetResult == RemovedNotInUse || resetResult == ResetComplete {
+			c._evicted(item, spaceFreed)
 		}
 		if err != nil {
 			c.opt.Logger.Errorf("cache purgeClean item.Reset %s reset failed, err = %v, freed %d bytes", item.GetName(), err, spaceFreed)
@@ -590,7 +897,9 @@ func (c *Cache) purgeOld(maxAge time.Duration) {
 	defer c.mu.Unlock()
 	// cutoff := time.Now().Add(-maxAge)
 	for _, item := range c.item {
-		c.removeNotInUse(item, maxAge, false)
+		if removed, _ := c.removeNotInUse(item, c.itemMaxAge(item, maxAge), false); removed {
+			c.policy.Forget(item.name)
+		}
 	}
 	if c.quotasOK() {
 		c.outOfSpace = false
@@ -622,8 +931,10 @@ func removeEmptyDir(root, dir string, leaveRoot bool) {
 
 // Purge any empty directories
 func (c *Cache) purgeEmptyDirs(dir string, leaveRoot bool) {
-	removeEmptyDir(c.root, dir, leaveRoot)
-	removeEmptyDir(c.metaRoot, dir, leaveRoot)
+	for _, root := range c.roots {
+		removeEmptyDir(root.data, dir, leaveRoot)
+		removeEmptyDir(root.meta, dir, leaveRoot)
+	}
 }
 
 // updateUsed updates c.used so it is accurate
@@ -632,8 +943,19 @@ func (c *Cache) updateUsed() (used int64) {
 	defer c.mu.Unlock()
 
 	newUsed := int64(0)
+	for _, root := range c.roots {
+		root.used = 0
+	}
+	for _, g := range c.groups {
+		g.used = 0
+	}
 	for _, item := range c.item {
-		newUsed += item.getDiskSize()
+		size := item.getDiskSize()
+		item.getRoot().used += size
+		if g := c.group(item); g != nil {
+			g.used += size
+		}
+		newUsed += size
 	}
 	c.used = newUsed
 	return newUsed
@@ -651,27 +973,34 @@ func getDiskUsage(path string) (total, free, avail int64, err error) {
 	return total, free, avail, nil
 }
 
-// Check the available space for a disk is in limits.
+// Check the available space for the disks of all the roots is in limits.
 func (c *Cache) minFreeSpaceQuotaOK() bool {
 	if c.opt.CacheMinFreeSpace <= 0 {
 		return true
 	}
-	_, _, avail, err := getDiskUsage(c.root)
-	if err != nil {
-		c.opt.Logger.Errorf("cache: disk usage returned error: %v", err)
-		return true
+	for _, root := range c.roots {
+		_, _, avail, err := getDiskUsage(root.path)
+		if err != nil {
+			c.opt.Logger.Errorf("cache: disk usage returned error: %v", err)
+			continue
+		}
+		if avail < c.opt.CacheMinFreeSpace {
+			return false
+		}
 	}
-	return avail >= c.opt.CacheMinFreeSpace
+	return true
 }
 
-// Check the available quota for a disk is in limits.
+// Check the size of the cache and of each root is in limits.
 //
 // must be called with mu held.
 func (c *Cache) maxSizeQuotaOK() bool {
-	if c.opt.CacheMaxSize <= 0 {
-		return true
+	for _, root := range c.roots {
+		if root.maxSize > 0 && root.used > root.maxSize {
+			return false
+		}
 	}
-	return c.used <= int64(c.opt.CacheMaxSize)
+	return c._globalQuotaOK()
 }
 
 // Check the available quotas for a disk is in limits.
@@ -683,6 +1012,11 @@ func (c *Cache) quotasOK() bool {
 
 // Return true if any quotas set
 func (c *Cache) haveQuotas() bool {
+	for _, root := range c.roots {
+		if root.maxSize > 0 {
+			return true
+		}
+	}
 	return c.opt.CacheMaxSize > 0 || c.opt.CacheMinFreeSpace > 0
 }
 
@@ -691,6 +1025,9 @@ func (c *Cache) haveQuotas() bool {
 func (c *Cache) purgeOverQuota() {
 	c.updateUsed()
 
+	// Items demoted are moved once mu is released
+	var moves []tierMove
+	defer func() { c.moveItems(moves) }()
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -707,11 +1044,18 @@ func (c *Cache) purgeOverQuota() {
 		}
 	}
 
-	sort.Sort(items)
+	c._sortForEviction(items)
 
-	// Remove items until the quota is OK
+	// Remove items until the quota is OK, moving them to a slower
+	// tier instead if there is one
 	for _, item := range items {
-		c.removeNotInUse(item, 0, c.quotasOK())
+		needsSpace := !c.quotasOK() && c._needsSpace(item)
+		if needsSpace && c._demote(item, &moves) {
+			continue
+		}
+		if removed, spaceFreed := c.removeNotInUse(item, 0, !needsSpace); removed {
+			c._evicted(item, spaceFreed)
+		}
 	}
 	if c.quotasOK() {
 		c.outOfSpace = false
@@ -722,7 +1066,7 @@ func (c *Cache) purgeOverQuota() {
 // clean empties the cache of stuff if it can
 func (c *Cache) clean(kicked bool) {
 	// Cache may be empty so end
-	_, err := os.Stat(c.root)
+	_, err := os.Stat(c.roots[0].data)
 	if os.IsNotExist(err) {
 		return
 	}
@@ -734,8 +1078,20 @@ func (c *Cache) clean(kicked bool) {
 	// Remove any files that are over age
 	c.purgeOld(time.Duration(c.opt.CacheMaxAge))
 
+	// Move items used since the last clean back to the fastest tier
+	// if it has room for them
+	start := time.Now()
+	c.promoteHot(c.lastClean)
+	c.lastClean = start
+
+	// Bring each quota group within its size limit
+	c.purgeGroups()
+
 	// If have a maximum cache size...
 	if c.haveQuotas() {
+		// Remove cold chunks of large files if enabled
+		c.purgeColdRanges()
+
 		// Remove files not in use until cache size is below quota starting from the oldest first
 		c.purgeOverQuota()
 
@@ -744,6 +1100,9 @@ func (c *Cache) clean(kicked bool) {
 		c.retryFailedResets()
 	}
 
+	// Reclaim the space used by old metadata
+	c.compactStores()
+
 	// Was kicked?
 	if kicked {
 		c.kickerMu.Lock() // Make sure this is called with cache mutex unlocked
@@ -777,17 +1136,23 @@ func (c *Cache) cleaner(ctx context.Context) {
 		c.opt.Logger.Debugf("cache: cleaning thread disabled because poll interval <= 0")
 		return
 	}
-	// Start cleaning the cache immediately
-	c.clean(false)
+	// Start cleaning the cache as soon as it is loaded
+	indexed := c.indexed
 	// Then every interval specified
 	timer := time.NewTicker(time.Duration(c.opt.CachePollInterval))
 	defer timer.Stop()
 	for {
 		select {
+		case <-indexed:
+			indexed = nil
+			c.clean(false)
 		case <-c.kick: // a thread encountering ENOSPC kicked me
 			c.clean(true) // kicked is true
 		case <-timer.C:
-			c.clean(false) // timer driven cache poll, kicked is false
+			// The quotas can't be enforced until the usage is known
+			if indexed == nil {
+				c.clean(false) // timer driven cache poll, kicked is false
+			}
 		case <-ctx.Done():
 			c.opt.Logger.Debugf("cache: cleaner exiting")
 			return
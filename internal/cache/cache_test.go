@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+func TestLazyReload(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	c, _, data := newScrubCache(t, ctx, dir, "a", "b", "dir/c")
+	assert.True(t, c.Ready())
+	assert.Equal(t, int64(0), c.Stats()["indexedItems"])
+	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	opt := &types.Options{
+		CacheDir:     dir,
+		CacheMaxAge:  time.Hour,
+		ChunkStreams: 1,
+		LazyReload:   true,
+	}
+	opt.Init()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+
+	// Items can be used while loading
+	item := c.Item("dir/c")
+	assert.Equal(t, int64(len(data)), item.getDiskSize())
+
+	require.Eventually(t, c.Ready, 5*time.Second, time.Millisecond)
+	stats := c.Stats()
+	assert.Equal(t, true, stats["ready"])
+	assert.LessOrEqual(t, stats["indexedItems"], int64(3))
+	for _, name := range []string{"a", "b", "dir/c"} {
+		assert.True(t, c.Exists(name), name)
+	}
+	assert.Same(t, item, c.Item("dir/c"))
+
+	// The usage is complete once loaded
+	c.updateUsed()
+	assert.Equal(t, int64(3*len(data)), c.Stats()["bytesUsed"])
+}
+
+// stallObject serves the first half of its data then waits for the
+// rest until the context it was opened with is done
+type stallObject struct {
+	data    []byte
+	reading atomic.Int64 // number of streams open
+}
+
+func (o *stallObject) Open(ctx context.Context, options ...types.OpenOption) (io.ReadCloser, error) {
+	start := int64(0)
+	for _, option := range options {
+		if r, ok := option.(*types.RangeOption); ok {
+			start = r.Start
+		}
+	}
+	o.reading.Add(1)
+	return &stallReader{ctx: ctx, o: o, off: start}, nil
+}
+
+func (o *stallObject) Size() int64    { return int64(len(o.data)) }
+func (o *stallObject) String() string { return "stallObject" }
+
+type stallReader struct {
+	ctx    context.Context
+	o      *stallObject
+	off    int64
+	closed bool
+}
+
+func (r *stallReader) Read(p []byte) (n int, err error) {
+	if half := int64(len(r.o.data) / 2); r.off < half {
+		n = copy(p, r.o.data[r.off:half])
+		r.off += int64(n)
+		return n, nil
+	}
+	<-r.ctx.Done()
+	return 0, r.ctx.Err()
+}
+
+func (r *stallReader) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.o.reading.Add(-1)
+	}
+	return nil
+}
+
+func TestDownloadLinger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opt := &types.Options{
+		CacheDir:       t.TempDir(),
+		CacheMaxAge:    time.Hour,
+		ChunkStreams:   1,
+		HandleCaching:  time.Hour,
+		DownloadLinger: 50 * time.Millisecond,
+	}
+	opt.Init()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	o := &stallObject{data: make([]byte, 1<<20)}
+	item := c.Item("a")
+
+	// Two clients share the download
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	require.NoError(t, item.Open(ctx1, o))
+	require.NoError(t, item.Open(ctx2, o))
+	n, err := item.ReadAtAhead(ctx1, make([]byte, 1024), 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1024, n)
+
+	// A read of the stalled part gives up when its client goes
+	done := make(chan error)
+	go func() {
+		_, err := item.ReadAtAhead(ctx1, make([]byte, 1024), int64(len(o.data))-1024, 0)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel1()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read didn't give up")
+	}
+
+	// The other client keeps the download going
+	time.Sleep(4 * opt.DownloadLinger)
+	assert.Equal(t, int64(1), o.reading.Load())
+	assert.Equal(t, int64(0), c.Stats()["downloadsCancelled"])
+
+	// Once it goes too the download stops after the linger period
+	cancel2()
+	require.Eventually(t, func() bool {
+		return c.Stats()["downloadsCancelled"] == int64(1)
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int64(0), o.reading.Load())
+
+	// Downloads start again for the next client
+	ctx3, cancel3 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel3()
+	require.NoError(t, item.Open(ctx3, o))
+	_, err = item.ReadAtAhead(ctx3, make([]byte, 1024), int64(len(o.data))-1024, 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	for range 3 {
+		require.NoError(t, item.Close(nil))
+	}
+}
@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+// size of the chunks of items checksums are kept for
+const checksumChunkSize = 1024 * 1024
+
+// checksums are CRC-32C which most CPUs compute in hardware
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkRange returns the part of the file chunk i of the checksums
+// covers, which is short for the last chunk
+func (info *Info) chunkRange(i int64) ranges.Range {
+	r := ranges.Range{Pos: i * checksumChunkSize, Size: checksumChunkSize}
+	r.Clip(info.Size)
+	return r
+}
+
+// dropChecksums forgets the checksums of the chunks overlapping the
+// bytes from offset up to end
+func (info *Info) dropChecksums(offset, end int64) (dropped []int64) {
+	for i := range info.Checksums {
+		if i*checksumChunkSize < end && (i+1)*checksumChunkSize > offset {
+			delete(info.Checksums, i)
+			dropped = append(dropped, i)
+		}
+	}
+	return dropped
+}
+
+// checksumRange returns the checksum of r of in
+func checksumRange(in io.ReaderAt, r ranges.Range) (sum uint32, err error) {
+	h := crc32.New(crc32c)
+	_, err = io.Copy(h, io.NewSectionReader(in, r.Pos, r.Size))
+	if err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+// _checksum returns the checksum of r of the backing file
+//
+// call with lock held
+func (item *Item) _checksum(r ranges.Range) (sum uint32, err error) {
+	if item.fd == nil {
+		return 0, errors.New("cache item checksum: internal error: didn't Open file")
+	}
+	return checksumRange(item.fd, r)
+}
+
+// _checksumWritten records the checksums of the chunks covering
+// (offset, size) which have just become complete
+//
+// Checksums are only kept for data from the remote. Chunks written
+// locally have theirs dropped by _dropChecksums.
+//
+// call with lock held
+func (item *Item) _checksumWritten(offset, size int64) {
+	if !item.c.opt.Checksums || item.info.Dirty || size <= 0 {
+		return
+	}
+	if item.info.ChecksumChunk != checksumChunkSize || item.info.Checksums == nil {
+		item.info.ChecksumChunk = checksumChunkSize
+		item.info.Checksums = make(map[int64]uint32)
+	}
+	for i := offset / checksumChunkSize; i <= (offset+size-1)/checksumChunkSize; i++ {
+		if _, found := item.info.Checksums[i]; found {
+			continue
+		}
+		r := item.info.chunkRange(i)
+		if r.IsEmpty() || !item.info.Rs.Present(r) {
+			continue
+		}
+		sum, err := item._checksum(r)
+		if err != nil {
+			item.c.opt.Logger.Debugf("%s: cache: failed to checksum chunk %v: %v", item.name, r, err)
+			continue
+		}
+		item.info.Checksums[i] = sum
+		item._setVerified(i)
+	}
+}
+
+// _setVerified records that chunk i matched its checksum since the
+// item was opened
+//
+// call with lock held
+func (item *Item) _setVerified(i int64) {
+	if item.verified == nil {
+		item.verified = make(map[int64]struct{})
+	}
+	item.verified[i] = struct{}{}
+}
+
+// _dropChecksums forgets the checksums of the chunks overlapping the
+// bytes from offset up to end as their contents have changed
+//
+// call with lock held
+func (item *Item) _dropChecksums(offset, end int64) {
+	for _, i := range item.info.dropChecksums(offset, end) {
+		delete(item.verified, i)
+	}
+}
+
+// _verifyRange checks the chunks covering (offset, size) which haven't
+// been checked since the item was opened against their checksums.
+//
+// Chunks which don't match are removed from the ranges present so
+// they are downloaded again. It returns the number of those.
+//
+// Dirty items aren't checked as the remote no longer has their data.
+//
+// call with lock held
+func (item *Item) _verifyRange(offset, size int64) (corrupt int) {
+	if !item.c.opt.Checksums || item.info.Dirty || item.info.ChecksumChunk != checksumChunkSize || size <= 0 {
+		return 0
+	}
+	for i := offset / checksumChunkSize; i <= (offset+size-1)/checksumChunkSize; i++ {
+		want, found := item.info.Checksums[i]
+		if !found {
+			continue
+		}
+		if _, found := item.verified[i]; found {
+			continue
+		}
+		r := item.info.chunkRange(i)
+		if r.IsEmpty() || !item.info.Rs.Present(r) {
+			continue
+		}
+		sum, err := item._checksum(r)
+		if err != nil {
+			item.c.opt.Logger.Errorf("%s: cache: failed to verify chunk %v: %v", item.name, r, err)
+			continue
+		}
+		if sum == want {
+			item._setVerified(i)
+			continue
+		}
+		item.c.opt.Logger.Errorf("%s: cache: chunk %v is corrupt (checksum %08x, expected %08x) - will download it again", item.name, r, sum, want)
+		item.info.Rs.Remove(r)
+		delete(item.info.Checksums, i)
+		item._invalidateMem()
+		item.c.corruptChunks.Add(1)
+		corrupt++
+	}
+	if corrupt > 0 {
+		if err := item._save(); err != nil {
+			item.c.opt.Logger.Errorf("%s: cache: failed to save metadata after removing corrupt chunks: %v", item.name, err)
+		}
+	}
+	return corrupt
+}
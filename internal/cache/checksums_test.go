@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+func TestChecksums(t *testing.T) {
+	dir := t.TempDir()
+	opt := &types.Options{
+		CacheDir:     dir,
+		CacheMaxAge:  time.Hour,
+		ChunkStreams: 1,
+		Checksums:    true,
+	}
+	opt.Init()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+
+	data := make([]byte, 5*checksumChunkSize/2)
+	for i := range data {
+		data[i] = byte(i / 5)
+	}
+	o := &memObject{data: data}
+	read := func(off, size int64) {
+		item := c.Item("file")
+		require.NoError(t, item.Open(context.Background(), o))
+		buf := make([]byte, size)
+		_, err := item.ReadAt(buf, off)
+		require.NoError(t, err)
+		assert.Equal(t, data[off:off+size], buf)
+		require.NoError(t, item.Close(nil))
+	}
+
+	// Every chunk gets a checksum including the short last one
+	read(0, int64(len(data)))
+	osPathMeta := filepath.Join(dir, "meta", "file")
+	in, err := os.ReadFile(osPathMeta)
+	require.NoError(t, err)
+	var info Info
+	require.NoError(t, json.Unmarshal(in, &info))
+	assert.Equal(t, int64(checksumChunkSize), info.ChecksumChunk)
+	assert.Len(t, info.Checksums, 3)
+	assert.NoFileExists(t, osPathMeta+metaTempSuffix)
+
+	// Corrupt the middle chunk on disk
+	fd, err := os.OpenFile(filepath.Join(dir, "data", "file"), os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = fd.WriteAt([]byte("garbage"), checksumChunkSize+100)
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	// Reading the first chunk is served from the cache
+	opens := o.opens.Load()
+	read(0, 1000)
+	assert.Equal(t, opens, o.opens.Load())
+	assert.Equal(t, int64(0), c.Stats()["corruptChunks"])
+
+	// Reading the corrupt chunk downloads it again
+	read(checksumChunkSize, checksumChunkSize)
+	assert.Greater(t, o.opens.Load(), opens)
+	assert.Equal(t, int64(1), c.Stats()["corruptChunks"])
+	opens = o.opens.Load()
+	read(checksumChunkSize+50, 1000)
+	assert.Equal(t, opens, o.opens.Load())
+
+	// Partially written metadata is removed on reload
+	stale := filepath.Join(dir, "meta", "other"+metaTempSuffix)
+	require.NoError(t, os.WriteFile(stale, []byte("{"), 0600))
+	c2, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	assert.NoFileExists(t, stale)
+	c2.mu.Lock()
+	assert.NotContains(t, c2.item, "other"+metaTempSuffix)
+	c2.mu.Unlock()
+	item := c2.Item("file")
+	item.mu.Lock()
+	assert.Len(t, item.info.Checksums, 3)
+	item.mu.Unlock()
+}
+
+func TestDropChecksums(t *testing.T) {
+	item := &Item{info: Info{
+		ChecksumChunk: checksumChunkSize,
+		Checksums:     map[int64]uint32{0: 1, 1: 2, 2: 3},
+	}}
+	item._dropChecksums(checksumChunkSize, checksumChunkSize+1)
+	assert.Equal(t, map[int64]uint32{0: 1, 2: 3}, item.info.Checksums)
+	item._dropChecksums(2*checksumChunkSize-1, 2*checksumChunkSize)
+	assert.Equal(t, map[int64]uint32{0: 1, 2: 3}, item.info.Checksums)
+	item._dropChecksums(checksumChunkSize, 1<<62)
+	assert.Equal(t, map[int64]uint32{0: 1}, item.info.Checksums)
+}
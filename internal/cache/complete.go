@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/tgdrive/varc/internal/cache/downloaders"
+	"github.com/tgdrive/varc/internal/types"
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+const (
+	// maximum number of items being completed in the background at once
+	maxCompletions = 2
+	// amount of an item fetched per step when completing it so the
+	// cache pressure is re-checked regularly
+	completeStep = 16 * 1024 * 1024
+	// maximum number of items whose partial reads are counted before
+	// the counts are forgotten
+	maxCompleteHits = 10000
+)
+
+// errCompleteStopped is returned when a completion is abandoned
+var errCompleteStopped = errors.New("background completion stopped")
+
+// completer tracks the items being filled in in the background after
+// they were only partially read.
+type completer struct {
+	mu      sync.Mutex
+	hits    map[string]int      // partial reads of items not yet being completed
+	running map[string]struct{} // items being completed
+	done    int64               // number of completions which finished
+	stopped int64               // number of completions abandoned
+}
+
+func newCompleter() *completer {
+	return &completer{
+		hits:    make(map[string]int),
+		running: make(map[string]struct{}),
+	}
+}
+
+// stats returns the number of completions running, finished and abandoned
+func (cm *completer) stats() (running, done, stopped int64) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return int64(len(cm.running)), cm.done, cm.stopped
+}
+
+// CompleteInBackground should be called when part of name has been
+// read from o. If the completion policy allows it, the rest of the
+// item is fetched in the background so later reads anywhere in it are
+// served from the cache.
+//
+// Items are only completed once they have had CompleteMinHits partial
+// reads, are within the CompleteMinSize and CompleteMaxSize limits and
+// fit in the cache without pushing it over quota.
+//
+// It returns true if a completion was started.
+func (c *Cache) CompleteInBackground(name string, o types.RemoteObject) bool {
+	if !c.opt.CompleteInBackground || o == nil {
+		return false
+	}
+	size := o.Size()
+	if size <= 0 || size < c.opt.CompleteMinSize || (c.opt.CompleteMaxSize > 0 && size > c.opt.CompleteMaxSize) {
+		return false
+	}
+	name = clean(name)
+	item := c.Item(name)
+	if item.present() {
+		return false
+	}
+
+	cm := c.completer
+	cm.mu.Lock()
+	if _, ok := cm.running[name]; ok {
+		cm.mu.Unlock()
+		return false
+	}
+	if len(cm.hits) >= maxCompleteHits {
+		clear(cm.hits)
+	}
+	cm.hits[name]++
+	if cm.hits[name] < max(c.opt.CompleteMinHits, 1) || len(cm.running) >= maxCompletions {
+		cm.mu.Unlock()
+		return false
+	}
+	delete(cm.hits, name)
+	cm.running[name] = struct{}{}
+	cm.mu.Unlock()
+
+	if c.underPressure(item.getRoot(), size-item.getDiskSize()) {
+		c.opt.Logger.Debugf("%s: cache: not completing in background as cache is under pressure", name)
+		cm.mu.Lock()
+		delete(cm.running, name)
+		cm.mu.Unlock()
+		return false
+	}
+
+	go c.complete(item, o)
+	return true
+}
+
+// complete fetches the missing parts of item from o, stopping early if
+// the cache comes under pressure or is shut down.
+//
+// The steps are fetched at Background priority so the downloader
+// gives way to clients and is stopped if they wait too long, the step
+// resuming from the first missing byte afterwards.
+func (c *Cache) complete(item *Item, o types.RemoteObject) {
+	name := item.GetName()
+	err := c.fill(item, o)
+
+	cm := c.completer
+	cm.mu.Lock()
+	delete(cm.running, name)
+	if err == nil {
+		cm.done++
+	} else {
+		cm.stopped++
+	}
+	cm.mu.Unlock()
+
+	if err != nil {
+		c.opt.Logger.Infof("%s: cache: background completion stopped: %v", name, err)
+	} else {
+		c.opt.Logger.Infof("%s: cache: background completion finished", name)
+	}
+}
+
+// fill opens item and downloads its missing parts
+func (c *Cache) fill(item *Item, o types.RemoteObject) (err error) {
+	if c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	if err = item.Open(ctx, o); err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := item.Close(nil)
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	size, err := item.GetSize()
+	if err != nil {
+		return err
+	}
+
+	var pos int64
+	for {
+		if c.ctx.Err() != nil {
+			return c.ctx.Err()
+		}
+		r := item.FindMissing(ranges.Range{Pos: pos, Size: size - pos})
+		if r.IsEmpty() {
+			return nil
+		}
+		if c.underPressure(item.getRoot(), 0) {
+			return errCompleteStopped
+		}
+		r.Size = min(r.Size, completeStep)
+		if err = item.ensureRange(ctx, r, downloaders.Background); err != nil {
+			return err
+		}
+		pos = r.End()
+	}
+}
+
+// underPressure returns true if the cache is out of space or it or
+// root would go over their quotas if need more bytes were added to
+// root.
+func (c *Cache) underPressure(root *cacheRoot, need int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.outOfSpace {
+		return true
+	}
+	if c.opt.CacheMaxSize > 0 && c.used+need > c.opt.CacheMaxSize {
+		return true
+	}
+	return !c.rootHasRoom(root, need)
+}
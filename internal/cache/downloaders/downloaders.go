@@ -20,13 +20,14 @@ import (
 const (
 	// max time a downloader can be idle before closing itself
 	maxDownloaderIdleTime = 5 * time.Second
-	// max number of bytes a reader should skip over before closing it
+	// max number of bytes a reader should skip over before closing it,
+	// unless it was started with a larger read ahead
 	maxSkipBytes = 1024 * 1024
 	// time between background kicks of waiters to pick up errors
 	backgroundKickerInterval = 5 * time.Second
 	// maximum number of errors before declaring dead
 	maxErrorCount = 10
-	// If a downloader is within this range or --buffer-size
+	// If a downloader is within this range or the read ahead
 	// whichever is the larger, we will reuse the downloader
 	minWindow = 1024 * 1024
 )
@@ -62,6 +63,7 @@ type Downloaders struct {
 	opt    *types.Options
 	src    types.RemoteObject // source object
 	remote string
+	sched  *Scheduler // shared priority scheduler - may be nil
 	wg     sync.WaitGroup
 
 	// Read write
@@ -75,17 +77,21 @@ type Downloaders struct {
 // waiter is a range we are waiting for and a channel to signal when
 // the range is found
 type waiter struct {
-	r       ranges.Range
-	errChan chan<- error
+	r         ranges.Range
+	readAhead int64
+	pri       Priority
+	errChan   chan<- error // buffered so sends never block
 }
 
 // downloader represents a running download for part of a file.
 type downloader struct {
 	// Write once
-	dls  *Downloaders   // parent structure
-	quit chan struct{}  // close to quit the downloader
-	wg   sync.WaitGroup // to keep track of downloader goroutine
-	kick chan struct{}  // kick the downloader when needed
+	dls    *Downloaders       // parent structure
+	ctx    context.Context    // context the source is read with
+	cancel context.CancelFunc // cancels reading the source
+	quit   chan struct{}      // close to quit the downloader
+	wg     sync.WaitGroup     // to keep track of downloader goroutine
+	kick   chan struct{}      // kick the downloader when needed
 
 	// Read write
 	mu        sync.Mutex
@@ -94,12 +100,16 @@ type downloader struct {
 	maxOffset int64 // maximum offset we are reading to
 	in        io.ReadCloser // input we are reading from
 	skipped   int64         // number of bytes we have skipped sequentially
+	maxSkip   int64         // number of bytes to skip before stopping
 	_closed   bool          // set to true if downloader is closed
 	stop      bool          // set to true if we have called _stop()
 }
 
 // New makes a downloader for item
-func New(ctx context.Context, item Item, opt *types.Options, remote string, src types.RemoteObject) (dls *Downloaders) {
+//
+// sched, if not nil, is used to give client reads priority over
+// speculative downloads across all the items sharing it.
+func New(ctx context.Context, item Item, opt *types.Options, remote string, src types.RemoteObject, sched *Scheduler) (dls *Downloaders) {
 	if src == nil {
 		panic("internal error: newDownloaders called with nil src object")
 	}
@@ -111,6 +121,7 @@ func New(ctx context.Context, item Item, opt *types.Options, remote string, src
 		opt:    opt,
 		src:    src,
 		remote: remote,
+		sched:  sched,
 	}
 	dls.wg.Go(func() {
 		ticker := time.NewTicker(backgroundKickerInterval)
@@ -166,16 +177,20 @@ func (dls *Downloaders) countErrors(n int64, err error) {
 // Make a new downloader, starting it to download r
 //
 // call with lock held
-func (dls *Downloaders) _newDownloader(r ranges.Range) (dl *downloader, err error) {
+func (dls *Downloaders) _newDownloader(r ranges.Range, readAhead int64) (dl *downloader, err error) {
 	// defer log.Trace(dls.src, "r=%v", r)("err=%v", &err)
 
+	ctx, cancel := context.WithCancel(dls.ctx)
 	dl = &downloader{
+		ctx:       ctx,
+		cancel:    cancel,
 		kick:      make(chan struct{}, 1),
 		quit:      make(chan struct{}),
 		dls:       dls,
 		start:     r.Pos,
 		offset:    r.Pos,
 		maxOffset: r.End(),
+		maxSkip:   max(maxSkipBytes, readAhead),
 	}
 
 	err = dl.open(dl.offset)
@@ -242,52 +257,134 @@ func (dls *Downloaders) Close(inErr error) (err error) {
 }
 
 // Download the range passed in returning when it has been downloaded
-// with an error from the downloading go routine.
-func (dls *Downloaders) Download(r ranges.Range) (err error) {
+// with an error from the downloading go routine, or when ctx is done
+// with its error.
+//
+// The downloader is asked to carry on for readAhead bytes past the
+// end of r but Download doesn't wait for those.
+//
+// The caller is taken to be a client blocked on the data so the range
+// is fetched in preference to any speculative downloads.
+func (dls *Downloaders) Download(ctx context.Context, r ranges.Range, readAhead int64) (err error) {
+	return dls.download(ctx, r, readAhead, Client)
+}
+
+// DownloadBackground downloads the range passed in like Download but
+// at Background priority, so the downloader gives way while clients
+// are waiting on any item sharing the Scheduler.
+func (dls *Downloaders) DownloadBackground(ctx context.Context, r ranges.Range) (err error) {
+	return dls.download(ctx, r, 0, Background)
+}
+
+// download the range passed in at priority pri
+func (dls *Downloaders) download(ctx context.Context, r ranges.Range, readAhead int64, pri Priority) (err error) {
 	// defer log.Trace(dls.src, "r=%+v", r)("err=%v", &err)
 
 	dls.mu.Lock()
 
-	errChan := make(chan error)
+	errChan := make(chan error, 1)
 	waiter := waiter{
-		r:       r,
-		errChan: errChan,
+		r:         r,
+		readAhead: readAhead,
+		pri:       pri,
+		errChan:   errChan,
 	}
 
-	err = dls._ensureDownloader(r)
+	err = dls._ensureDownloader(r, readAhead)
 	if err != nil {
 		dls.mu.Unlock()
 		return err
 	}
 
 	dls.waiters = append(dls.waiters, waiter)
+	if pri == Client && dls.sched != nil {
+		dls.sched.addClients(1)
+	}
 	dls.mu.Unlock()
+	select {
+	case err = <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stop waiting unless the result is already on its way. The
+	// downloader carries on as other waiters may share it.
+	dls.mu.Lock()
+	defer dls.mu.Unlock()
+	for i, w := range dls.waiters {
+		if w.errChan == errChan {
+			dls.waiters = append(dls.waiters[:i], dls.waiters[i+1:]...)
+			if pri == Client && dls.sched != nil {
+				dls.sched.addClients(-1)
+			}
+			return ctx.Err()
+		}
+	}
 	return <-errChan
 }
 
+// StopIdle stops the running downloaders if nobody is waiting for
+// them, returning how many were stopped. Later downloads start new
+// ones.
+func (dls *Downloaders) StopIdle() (stopped int) {
+	dls.mu.Lock()
+	defer dls.mu.Unlock()
+	dls._removeClosed()
+	if len(dls.waiters) > 0 {
+		return 0
+	}
+	running := dls.dls
+	dls.dls = nil
+	for _, dl := range running {
+		dls.mu.Unlock()
+		_ = dl.stopAndClose(nil)
+		dls.mu.Lock()
+	}
+	return len(running)
+}
+
 // close any waiters with the error passed in
 //
 // call with lock held
 func (dls *Downloaders) _closeWaiters(err error) {
+	clients := 0
 	for _, waiter := range dls.waiters {
+		if waiter.pri == Client {
+			clients++
+		}
 		waiter.errChan <- err
 	}
 	dls.waiters = nil
+	if dls.sched != nil {
+		dls.sched.addClients(-clients)
+	}
+}
+
+// clientWaiting returns true if a client is waiting for a range
+func (dls *Downloaders) clientWaiting() bool {
+	dls.mu.Lock()
+	defer dls.mu.Unlock()
+	for _, waiter := range dls.waiters {
+		if waiter.pri == Client {
+			return true
+		}
+	}
+	return false
 }
 
 // ensure a downloader is running for the range if required.  If one isn't found
 // then it starts it.
 //
 // call with lock held
-func (dls *Downloaders) _ensureDownloader(r ranges.Range) (err error) {
+func (dls *Downloaders) _ensureDownloader(r ranges.Range, readAhead int64) (err error) {
 	// defer log.Trace(dls.src, "r=%v", r)("err=%v", &err)
 
 	// The window includes potentially unread data in the buffer
-	window := int64(minWindow)
+	window := max(int64(minWindow), readAhead)
 
 	// Increase the read range by the read ahead if set
-	if dls.opt.ReadAhead > 0 {
-		r.Size += int64(dls.opt.ReadAhead)
+	if readAhead > 0 {
+		r.Size += readAhead
 	}
 
 	// We may be reopening a downloader after a failure here or
@@ -358,7 +455,7 @@ func (dls *Downloaders) _ensureDownloader(r ranges.Range) (err error) {
 		return nil
 	}
 	// Downloader not found so start a new one
-	_, err = dls._newDownloader(r)
+	_, err = dls._newDownloader(r, readAhead)
 	if err != nil {
 		dls._countErrors(0, err)
 		return fmt.Errorf("failed to start downloader: %w", err)
@@ -367,13 +464,13 @@ func (dls *Downloaders) _ensureDownloader(r ranges.Range) (err error) {
 }
 
 // EnsureDownloader makes sure a downloader is running for the range
-// passed in.  If one isn't found then it starts it.
+// passed in plus readAhead bytes.  If one isn't found then it starts it.
 //
 // It does not wait for the range to be downloaded
-func (dls *Downloaders) EnsureDownloader(r ranges.Range) (err error) {
+func (dls *Downloaders) EnsureDownloader(r ranges.Range, readAhead int64) (err error) {
 	dls.mu.Lock()
 	defer dls.mu.Unlock()
-	return dls._ensureDownloader(r)
+	return dls._ensureDownloader(r, readAhead)
 }
 
 // _dispatchWaiters() sends any waiters which have completed back to
@@ -385,18 +482,25 @@ func (dls *Downloaders) _dispatchWaiters() {
 		return
 	}
 
+	clients := 0
 	newWaiters := dls.waiters[:0]
 	for _, waiter := range dls.waiters {
 		// Clip the size against the actual size in case it has shrunk
 		r := waiter.r
 		r.Clip(dls.src.Size())
 		if dls.item.HasRange(r) {
+			if waiter.pri == Client {
+				clients++
+			}
 			waiter.errChan <- nil
 		} else {
 			newWaiters = append(newWaiters, waiter)
 		}
 	}
 	dls.waiters = newWaiters
+	if dls.sched != nil {
+		dls.sched.addClients(-clients)
+	}
 }
 
 // Send any waiters which have completed back to their callers and make sure
@@ -416,7 +520,7 @@ func (dls *Downloaders) kickWaiters() (err error) {
 	// However the number of waiters and the number of downloaders
 	// are both expected to be small.
 	for _, waiter := range dls.waiters {
-		err = dls._ensureDownloader(waiter.r)
+		err = dls._ensureDownloader(waiter.r, waiter.readAhead)
 		if err != nil {
 			// Failures here will be retried by background kicker
 			dls.opt.Logger.Infof("cache: restart download failed: %v", err)
@@ -460,6 +564,15 @@ func (dl *downloader) Write(p []byte) (n int, err error) {
 		}
 	}()
 
+	// Speculative downloads give way while clients are waiting
+	// and are stopped if that takes too long
+	if dl.dls.sched != nil && !dl.dls.clientWaiting() && !dl.dls.sched.yield(dl.quit) {
+		dl.mu.Lock()
+		dl._stop()
+		dl.mu.Unlock()
+		return 0, io.EOF
+	}
+
 	dl.mu.Lock()
 	defer dl.mu.Unlock()
 
@@ -498,7 +611,7 @@ loop:
 	dl.offset += int64(n)
 
 	// Kill this downloader if skipped too many bytes
-	if !dl.stop && dl.skipped > maxSkipBytes {
+	if !dl.stop && dl.skipped > dl.maxSkip {
 		dl._stop()
 	}
 
@@ -528,7 +641,7 @@ func (dl *downloader) open(offset int64) (err error) {
 	// }
 	// in0, err := operations.NewReOpen(dl.dls.ctx, dl.dls.src, ci.LowLevelRetries, dl.dls.item.c.hashOption, rangeOption)
 
-	in0 := chunkedreader.New(dl.dls.ctx, dl.dls.src, int64(dl.dls.opt.ChunkSize), int64(dl.dls.opt.ChunkSizeLimit), dl.dls.opt.ChunkStreams)
+	in0 := chunkedreader.New(dl.ctx, dl.dls.src, int64(dl.dls.opt.ChunkSize), int64(dl.dls.opt.ChunkSizeLimit), dl.dls.opt.ChunkStreams)
 	_, err = in0.Seek(offset, 0)
 	if err != nil {
 		return fmt.Errorf("cache reader: failed to open source file: %w", err)
@@ -552,6 +665,7 @@ func (dl *downloader) close(inErr error) (err error) {
 	}
 	dl._closed = true
 	dl.mu.Unlock()
+	dl.cancel()
 	return err
 }
 
@@ -577,7 +691,9 @@ func (dl *downloader) _stop() {
 	// Signal quit now to unblock the downloader
 	close(dl.quit)
 
-	// stop the downloader by closing the reader
+	// abandon any read of the source in progress then stop the
+	// downloader by closing the reader
+	dl.cancel()
 	if dl.in != nil {
 		dl.in.Close()
 	}
@@ -599,6 +715,13 @@ func (dl *downloader) download() (n int64, err error) {
 	// defer log.Trace(dl.dls.src, "")("err=%v", &err)
 	n, err = io.Copy(dl, dl.in)
 	if err != nil && err != io.EOF {
+		dl.mu.Lock()
+		stopped := dl.stop
+		dl.mu.Unlock()
+		if stopped {
+			// reading was abandoned on purpose
+			return n, nil
+		}
 		return n, fmt.Errorf("cache reader: failed to write to cache file: %w", err)
 	}
 
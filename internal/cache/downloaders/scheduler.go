@@ -0,0 +1,90 @@
+package downloaders
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// max time a speculative downloader will wait for clients to be served
+// before it is stopped to free its upstream connection
+const maxYieldTime = 2 * time.Second
+
+// Priority is how urgently a waiter needs its range
+type Priority int
+
+// Priorities for waiters, lowest first
+const (
+	Background Priority = iota // warming the cache - may be preempted
+	Client                     // a client is blocked waiting for the data
+)
+
+// Scheduler is shared by all the Downloaders in a cache so that
+// ranges clients are blocked on are fetched before speculative work.
+//
+// A downloader is speculative when no client is waiting on its
+// Downloaders, ie it is reading ahead or warming the cache. While
+// clients are waiting anywhere, speculative downloaders pause and if
+// that goes on too long they are stopped. The work is resumable as any
+// background waiters still outstanding start a new downloader from the
+// first missing byte when they are next kicked.
+type Scheduler struct {
+	clients     atomic.Int64 // number of client waiters outstanding
+	preemptions atomic.Int64 // number of speculative downloaders stopped
+
+	mu   sync.Mutex
+	idle chan struct{} // closed when there are no client waiters
+}
+
+// NewScheduler makes a new Scheduler
+func NewScheduler() *Scheduler {
+	s := &Scheduler{idle: make(chan struct{})}
+	close(s.idle)
+	return s
+}
+
+// addClients adjusts the number of client waiters by delta
+func (s *Scheduler) addClients(delta int) {
+	if delta == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.clients.Add(int64(delta))
+	switch {
+	case n == 0:
+		close(s.idle)
+	case n == int64(delta):
+		s.idle = make(chan struct{})
+	}
+}
+
+// yield blocks a speculative downloader while clients are waiting.
+//
+// It returns false if the downloader should stop because it waited
+// too long or quit was closed.
+func (s *Scheduler) yield(quit <-chan struct{}) bool {
+	if s.clients.Load() == 0 {
+		return true
+	}
+	s.mu.Lock()
+	idle := s.idle
+	s.mu.Unlock()
+	timer := time.NewTimer(maxYieldTime)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-quit:
+		return false
+	case <-timer.C:
+		s.preemptions.Add(1)
+		return false
+	}
+}
+
+// Stats returns the number of client waiters outstanding and the
+// number of speculative downloaders which have been preempted.
+func (s *Scheduler) Stats() (clientsWaiting, preemptions int64) {
+	return s.clients.Load(), s.preemptions.Load()
+}
@@ -0,0 +1,53 @@
+package downloaders
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerYield(t *testing.T) {
+	s := NewScheduler()
+	quit := make(chan struct{})
+
+	// Nothing waiting so speculative work carries on
+	assert.True(t, s.yield(quit))
+
+	// A client waiting blocks speculative work until it is served
+	s.addClients(2)
+	done := make(chan bool)
+	go func() { done <- s.yield(quit) }()
+	select {
+	case <-done:
+		t.Fatal("yield returned while clients were waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.addClients(-1)
+	s.addClients(-1)
+	select {
+	case ok := <-done:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("yield didn't return when clients were served")
+	}
+
+	// Quitting stops the wait without counting as a preemption
+	s.addClients(1)
+	close(quit)
+	assert.False(t, s.yield(quit))
+	clients, preemptions := s.Stats()
+	assert.Equal(t, int64(1), clients)
+	assert.Equal(t, int64(0), preemptions)
+}
+
+func TestSchedulerPreempt(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for maxYieldTime")
+	}
+	s := NewScheduler()
+	s.addClients(1)
+	assert.False(t, s.yield(make(chan struct{})))
+	_, preemptions := s.Stats()
+	assert.Equal(t, int64(1), preemptions)
+}
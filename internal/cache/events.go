@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventType is the kind of change to the cache an Event reports
+type EventType int
+
+// Kinds of Event
+const (
+	EventRemoved  EventType = iota + 1 // an item was deleted, eg purged
+	EventEvicted                       // the cleaner removed an item as it expired or to free space
+	EventUploaded                      // an item was uploaded to the remote
+)
+
+// String returns the name of the event type
+func (t EventType) String() string {
+	switch t {
+	case EventRemoved:
+		return "removed"
+	case EventEvicted:
+		return "evicted"
+	case EventUploaded:
+		return "uploaded"
+	}
+	return "unknown"
+}
+
+// Event is a change to an item in the cache sent to subscribers
+type Event struct {
+	Type EventType
+	Name string    // name of the item
+	Size int64     // bytes freed by an eviction or uploaded
+	Time time.Time // when it happened
+}
+
+// subscribers are the channels events are sent to
+//
+// Its lock is a leaf lock so events can be published with Cache.mu or
+// Item.mu held.
+type subscribers struct {
+	mu      sync.Mutex
+	chans   map[chan Event]struct{}
+	dropped int64 // events not sent because a subscriber was full
+}
+
+// Subscribe returns a channel the events of the cache are sent to and
+// a function to call to stop them, which closes the channel.
+//
+// Events are dropped rather than wait for a subscriber which is behind
+// by more than buffer events.
+func (c *Cache) Subscribe(buffer int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, buffer)
+	s := &c.subscribers
+	s.mu.Lock()
+	if s.chans == nil {
+		s.chans = make(map[chan Event]struct{})
+	}
+	s.chans[ch] = struct{}{}
+	s.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.chans, ch)
+			s.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publish sends an event to the subscribers without waiting for them
+func (c *Cache) publish(typ EventType, name string, size int64) {
+	s := &c.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.chans) == 0 {
+		return
+	}
+	ev := Event{Type: typ, Name: name, Size: size, Time: time.Now()}
+	for ch := range s.chans {
+		select {
+		case ch <- ev:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+// eventsDropped returns the number of events subscribers missed
+func (c *Cache) eventsDropped() int64 {
+	c.subscribers.mu.Lock()
+	defer c.subscribers.mu.Unlock()
+	return c.subscribers.dropped
+}
+
+// Entry describes an item stored in the cache, returned by Entries
+type Entry struct {
+	Name       string    // name of the item
+	Size       int64     // size of the file, -1 if not known
+	Cached     int64     // bytes of the file present in the cache
+	ATime      time.Time // last time it was accessed
+	ETag       string    // entity tag of the remote object, if any
+	RemoteTime time.Time // modification time of the remote object, if known
+	Group      string    // quota group it is in, if any
+	Dirty      bool      // set if it is waiting to be uploaded
+	InUse      bool      // set if it is open
+}
+
+// Entries calls fn with each item stored in the cache in name order
+// until it returns false.
+//
+// The items are listed before fn is called so it may use the cache.
+func (c *Cache) Entries(fn func(Entry) bool) {
+	c.mu.Lock()
+	items := make(Items, 0, len(c.item))
+	for _, item := range c.item {
+		items = append(items, item)
+	}
+	c.mu.Unlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+	for _, item := range items {
+		if entry, ok := item.entry(); ok && !fn(entry) {
+			return
+		}
+	}
+}
+
+// Entry returns the Entry describing the item called name, or false
+// if it isn't stored in the cache
+func (c *Cache) Entry(name string) (entry Entry, ok bool) {
+	c.mu.Lock()
+	item := c.item[clean(name)]
+	c.mu.Unlock()
+	if item == nil {
+		return entry, false
+	}
+	return item.entry()
+}
+
+// entry returns the Entry describing the item, or false if it isn't
+// stored in the cache
+func (item *Item) entry() (entry Entry, ok bool) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	if !item._exists() {
+		return entry, false
+	}
+	size, err := item._getSize()
+	if err != nil {
+		size = -1
+	}
+	return Entry{
+		Name:       item.name,
+		Size:       size,
+		Cached:     item.info.Rs.Size(),
+		ATime:      item.info.ATime,
+		ETag:       item.info.ETag,
+		RemoteTime: item.info.RemoteTime,
+		Group:      item.info.Group,
+		Dirty:      item.info.Dirty,
+		InUse:      item.opens > 0,
+	}, true
+}
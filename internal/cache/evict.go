@@ -0,0 +1,283 @@
+package cache
+
+import (
+	"fmt"
+	"hash/maphash"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the eviction policies understood by NewEvictionPolicy
+const (
+	PolicyLRU     = "lru"
+	PolicyLFU     = "lfu"
+	PolicyTinyLFU = "tinylfu"
+	PolicyGDSF    = "gdsf"
+)
+
+// Candidate describes an item which could be evicted from the cache
+type Candidate struct {
+	Name  string    // name of the item in the cache
+	Size  int64     // bytes of the item stored in the cache
+	ATime time.Time // last time the item was accessed
+}
+
+// EvictionPolicy decides which items are removed first when the cache
+// is over quota.
+//
+// Its methods may be called with Cache.mu or Item.mu held so they must
+// not call back into the Cache.
+type EvictionPolicy interface {
+	// Name returns the name of the policy
+	Name() string
+	// Touch records a request for the named item which is size bytes
+	// long, or -1 if that isn't known yet
+	Touch(name string, size int64)
+	// Evicted is called when an item has been removed to free space
+	Evicted(name string)
+	// Forget is called when an item has been removed for any other
+	// reason, eg purged or expired
+	Forget(name string)
+	// Sort orders candidates so the one to evict first is first
+	Sort(candidates []Candidate)
+}
+
+// NewEvictionPolicy returns the eviction policy called name, or LRU if
+// name is empty.
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", PolicyLRU:
+		return lruPolicy{}, nil
+	case PolicyLFU:
+		return newLFUPolicy(), nil
+	case PolicyTinyLFU, "w-tinylfu":
+		return newTinyLFUPolicy(), nil
+	case PolicyGDSF:
+		return newGDSFPolicy(), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q (want %s, %s, %s or %s)", name, PolicyLRU, PolicyLFU, PolicyTinyLFU, PolicyGDSF)
+}
+
+// sortByATime sorts candidates oldest access first
+func sortByATime(candidates []Candidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].ATime.Before(candidates[j].ATime)
+	})
+}
+
+// lruPolicy evicts the least recently used items first
+type lruPolicy struct{}
+
+func (lruPolicy) Name() string                  { return PolicyLRU }
+func (lruPolicy) Touch(name string, size int64) {}
+func (lruPolicy) Evicted(name string)           {}
+func (lruPolicy) Forget(name string)            {}
+func (lruPolicy) Sort(candidates []Candidate)   { sortByATime(candidates) }
+
+// lfuPolicy evicts the least frequently used items first, the least
+// recently used first among equals.
+type lfuPolicy struct {
+	mu    sync.Mutex
+	count map[string]int64 // requests for each item in the cache
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{count: make(map[string]int64)}
+}
+
+func (p *lfuPolicy) Name() string { return PolicyLFU }
+
+func (p *lfuPolicy) Touch(name string, size int64) {
+	p.mu.Lock()
+	p.count[name]++
+	p.mu.Unlock()
+}
+
+func (p *lfuPolicy) Evicted(name string) { p.Forget(name) }
+
+func (p *lfuPolicy) Forget(name string) {
+	p.mu.Lock()
+	delete(p.count, name)
+	p.mu.Unlock()
+}
+
+func (p *lfuPolicy) Sort(candidates []Candidate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sortByATime(candidates)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return p.count[candidates[i].Name] < p.count[candidates[j].Name]
+	})
+}
+
+const (
+	sketchDepth  = 4    // number of rows in the count-min sketch
+	sketchWidth  = 4096 // counters in each row - a power of 2
+	sketchMax    = 15   // counters saturate at this
+	sketchReset  = 10 * sketchWidth
+	windowFactor = 100 // 1/windowFactor of the items are in the window
+)
+
+// sketch is a count-min sketch estimating how often names were seen
+// recently. The counters are halved periodically so old popularity
+// fades.
+type sketch struct {
+	seed     maphash.Seed
+	counters [sketchDepth][sketchWidth]uint8
+	adds     int
+}
+
+// indexes returns the counter index of name in each row
+func (s *sketch) indexes(name string) (idx [sketchDepth]uint32) {
+	h := maphash.String(s.seed, name)
+	for i := range idx {
+		idx[i] = uint32(h>>(16*i)) & (sketchWidth - 1)
+	}
+	return idx
+}
+
+func (s *sketch) add(name string) {
+	for row, i := range s.indexes(name) {
+		if s.counters[row][i] < sketchMax {
+			s.counters[row][i]++
+		}
+	}
+	s.adds++
+	if s.adds >= sketchReset {
+		for row := range s.counters {
+			for i := range s.counters[row] {
+				s.counters[row][i] /= 2
+			}
+		}
+		s.adds /= 2
+	}
+}
+
+func (s *sketch) estimate(name string) (n uint8) {
+	n = sketchMax
+	for row, i := range s.indexes(name) {
+		n = min(n, s.counters[row][i])
+	}
+	return n
+}
+
+// tinyLFUPolicy is a W-TinyLFU style policy.
+//
+// A small window of the most recently used items is protected so new
+// items get a chance to build up a history. The rest are evicted
+// least frequently requested first, using a sketch which remembers
+// items after they have left the cache and ages its counts, so a
+// single scan through a large catalogue can't displace the items
+// which are popular.
+type tinyLFUPolicy struct {
+	mu     sync.Mutex
+	sketch sketch
+}
+
+func newTinyLFUPolicy() *tinyLFUPolicy {
+	return &tinyLFUPolicy{sketch: sketch{seed: maphash.MakeSeed()}}
+}
+
+func (p *tinyLFUPolicy) Name() string { return PolicyTinyLFU }
+
+func (p *tinyLFUPolicy) Touch(name string, size int64) {
+	p.mu.Lock()
+	p.sketch.add(name)
+	p.mu.Unlock()
+}
+
+func (p *tinyLFUPolicy) Evicted(name string) {}
+func (p *tinyLFUPolicy) Forget(name string)  {}
+
+func (p *tinyLFUPolicy) Sort(candidates []Candidate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sortByATime(candidates)
+	// The newest items form the window which goes last
+	window := max(len(candidates)/windowFactor, 1)
+	main := candidates[:max(len(candidates)-window, 0)]
+	sort.SliceStable(main, func(i, j int) bool {
+		return p.sketch.estimate(main[i].Name) < p.sketch.estimate(main[j].Name)
+	})
+}
+
+// gdsfPolicy is a Greedy-Dual-Size-Frequency policy.
+//
+// Each item has a priority of L + frequency/size where L is the
+// priority of the last item evicted when the item was last requested.
+// Small popular items are kept in preference to large ones which are
+// rarely requested, and L rising over time ages out items which were
+// once popular.
+//
+// Items are often requested before much of them has been downloaded,
+// so the priorities are worked out again from the bytes the
+// candidates have in the cache when they are sorted. Items which
+// haven't been requested since they were loaded count as requested
+// once.
+type gdsfPolicy struct {
+	mu       sync.Mutex
+	inflate  float64            // L - priority of the last item evicted
+	count    map[string]int64   // requests for each item in the cache
+	base     map[string]float64 // L when each item was last requested
+	priority map[string]float64 // priority of each item in the cache
+}
+
+func newGDSFPolicy() *gdsfPolicy {
+	return &gdsfPolicy{
+		count:    make(map[string]int64),
+		base:     make(map[string]float64),
+		priority: make(map[string]float64),
+	}
+}
+
+func (p *gdsfPolicy) Name() string { return PolicyGDSF }
+
+// _priority returns the priority of the named item of size bytes
+//
+// call with mu held
+func (p *gdsfPolicy) _priority(name string, size int64) float64 {
+	// Size in MiB so the priorities stay in a sensible range
+	sizeMiB := max(float64(size)/(1<<20), 1.0/(1<<10))
+	return p.base[name] + float64(max(p.count[name], 1))/sizeMiB
+}
+
+func (p *gdsfPolicy) Touch(name string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.count[name]++
+	p.base[name] = p.inflate
+	p.priority[name] = p._priority(name, size)
+}
+
+func (p *gdsfPolicy) Evicted(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pri, ok := p.priority[name]; ok && pri > p.inflate {
+		p.inflate = pri
+	}
+	delete(p.count, name)
+	delete(p.base, name)
+	delete(p.priority, name)
+}
+
+func (p *gdsfPolicy) Forget(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.count, name)
+	delete(p.base, name)
+	delete(p.priority, name)
+}
+
+func (p *gdsfPolicy) Sort(candidates []Candidate) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range candidates {
+		p.priority[c.Name] = p._priority(c.Name, c.Size)
+	}
+	sortByATime(candidates)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return p.priority[candidates[i].Name] < p.priority[candidates[j].Name]
+	})
+}
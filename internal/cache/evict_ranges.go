@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"errors"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tgdrive/varc/lib/file"
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+// default size of the chunks access is tracked and evicted in
+const defaultEvictRangeSize = 16 * 1024 * 1024
+
+// punchHole deallocates parts of files, replaceable for testing
+var punchHole = file.PunchHole
+
+// coldRange is a chunk of an item which could be evicted
+type coldRange struct {
+	item  *Item
+	r     ranges.Range // the chunk
+	atime int64        // last access of the chunk in UnixNano
+}
+
+// evictRangeSize returns the size of the chunks access is tracked in
+func (c *Cache) evictRangeSize() int64 {
+	if c.opt.EvictRangeSize > 0 {
+		return c.opt.EvictRangeSize
+	}
+	return defaultEvictRangeSize
+}
+
+// _touchRange records an access to (offset, size) in the access
+// times of the chunks it covers
+//
+// call with lock held
+func (item *Item) _touchRange(offset, size int64) {
+	if !item.c.opt.EvictRanges || size <= 0 || offset < 0 {
+		return
+	}
+	chunk := item.c.evictRangeSize()
+	if item.info.AccessChunk != chunk || item.info.AccessTimes == nil {
+		// The chunk size has changed so the old times are meaningless
+		item.info.AccessChunk = chunk
+		item.info.AccessTimes = make(map[int64]int64)
+	}
+	now := time.Now().UnixNano()
+	for i := offset / chunk; i <= (offset+size-1)/chunk; i++ {
+		item.info.AccessTimes[i] = now
+	}
+}
+
+// coldRanges returns the chunks of the item which are in the cache
+// with their last access times.
+//
+// It returns false if the item can't have ranges evicted, ie it is
+// dirty or isn't more than a single chunk.
+func (item *Item) coldRanges(chunk int64) (cold []coldRange, ok bool) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	if item.info.Dirty || item.info.Size <= chunk {
+		return nil, false
+	}
+	for pos := int64(0); pos < item.info.Size; pos += chunk {
+		r := ranges.Range{Pos: pos, Size: min(chunk, item.info.Size-pos)}
+		if item.info.Rs.Intersection(r).Size() == 0 {
+			continue
+		}
+		atime, found := item.info.AccessTimes[pos/chunk]
+		if !found || item.info.AccessChunk != chunk {
+			// Chunks fetched before the stats were kept
+			atime = item.info.ATime.UnixNano()
+		}
+		cold = append(cold, coldRange{item: item, r: r, atime: atime})
+	}
+	return cold, true
+}
+
+// evictRange punches a hole in the backing file where r is and marks
+// it as no longer present so it will be downloaded again if needed.
+//
+// Ranges are not evicted while the item is being accessed as a reader
+// may have released the lock between waiting for r and reading it.
+//
+// The metadata isn't saved, so the caller must do that with
+// saveEvicted once it has evicted all it is going to from the item.
+func (item *Item) evictRange(r ranges.Range) (spaceFreed int64, err error) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	if item.info.Dirty || item.beingReset || item.pendingAccesses > 0 {
+		return 0, nil
+	}
+	spaceFreed = item.info.Rs.Intersection(r).Size()
+	if spaceFreed == 0 {
+		return 0, nil
+	}
+	fd := item.fd
+	if fd == nil {
+		fd, err = file.OpenFile(item.root.toOSPath(item.name), os.O_WRONLY, 0600)
+		if err != nil {
+			return 0, err
+		}
+		defer checkCloseErr(fd, &err)
+	}
+	err = punchHole(fd, r.Pos, r.Size)
+	if err != nil {
+		return 0, err
+	}
+	item.info.Rs.Remove(r)
+	item._dropChecksums(r.Pos, r.Pos+r.Size)
+	if item.info.AccessChunk > 0 {
+		delete(item.info.AccessTimes, r.Pos/item.info.AccessChunk)
+	}
+	return spaceFreed, nil
+}
+
+// saveEvicted saves the metadata of items which had ranges evicted,
+// once each and without c.mu held as it syncs several files.
+//
+// Items which have left the cache meanwhile are skipped so their
+// metadata isn't written again.
+func (c *Cache) saveEvicted(items []*Item) {
+	for _, item := range items {
+		c.mu.Lock()
+		item.mu.Lock()
+		current := c.item[item.name] == item
+		c.mu.Unlock()
+		var err error
+		if current {
+			err = item._save()
+		}
+		item.mu.Unlock()
+		if err != nil {
+			c.opt.Logger.Errorf("%s: cache: failed to save metadata after evicting ranges: %v", item.name, err)
+		}
+	}
+}
+
+// purgeColdRanges evicts the least recently used chunks of large items
+// until the quota is OK.
+//
+// This keeps the parts of large files which are read, often their
+// openings, rather than removing the whole file when only its tail is
+// cold. It stops once the next chunk was used more recently than the
+// oldest item too small to split so those are evicted in turn by
+// purgeOverQuota.
+func (c *Cache) purgeColdRanges() {
+	if !c.opt.EvictRanges {
+		return
+	}
+	c.updateUsed()
+
+	var evicted []*Item
+	defer func() { c.saveEvicted(evicted) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.quotasOK() || c.noPunchHoles {
+		return
+	}
+
+	chunk := c.evictRangeSize()
+	var cold []coldRange
+	oldestWhole := int64(math.MaxInt64)
+	for _, item := range c.item {
+		itemCold, ok := item.coldRanges(chunk)
+		if ok {
+			cold = append(cold, itemCold...)
+		} else if !item.inUse() {
+			oldestWhole = min(oldestWhole, item.candidate().ATime.UnixNano())
+		}
+	}
+	sort.SliceStable(cold, func(i, j int) bool {
+		return cold[i].atime < cold[j].atime
+	})
+
+	changed := make(map[*Item]struct{})
+	for _, cr := range cold {
+		if c.quotasOK() || cr.atime > oldestWhole {
+			break
+		}
+		if !c._needsSpace(cr.item) {
+			continue
+		}
+		spaceFreed, err := cr.item.evictRange(cr.r)
+		c._freed(cr.item, spaceFreed)
+		if errors.Is(err, file.ErrPunchHoleUnsupported) {
+			// This won't change so leave all eviction to whole items
+			c.opt.Logger.Warnf("cache: can't evict ranges, only whole files will be evicted: %v", err)
+			c.noPunchHoles = true
+			break
+		}
+		if err != nil {
+			// Leave it to whole item eviction
+			c.opt.Logger.Errorf("%s: cache: failed to evict range %v: %v", cr.item.name, cr.r, err)
+			break
+		}
+		if spaceFreed > 0 {
+			if _, found := changed[cr.item]; !found {
+				changed[cr.item] = struct{}{}
+				evicted = append(evicted, cr.item)
+			}
+			c.evictedRanges++
+			c.evictedBytes += spaceFreed
+			c.opt.Logger.Debugf("%s: cache: evicted range %v, freed %d bytes", cr.item.name, cr.r, spaceFreed)
+		}
+	}
+	if c.quotasOK() {
+		c.outOfSpace = false
+		c.cond.Broadcast()
+	}
+}
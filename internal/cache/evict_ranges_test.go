@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+	"github.com/tgdrive/varc/lib/file"
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+// memObject is a RemoteObject backed by a byte slice
+type memObject struct {
+	data  []byte
+	opens atomic.Int64
+}
+
+func (o *memObject) Open(ctx context.Context, options ...types.OpenOption) (io.ReadCloser, error) {
+	o.opens.Add(1)
+	start, end := int64(0), int64(len(o.data))-1
+	for _, option := range options {
+		if r, ok := option.(*types.RangeOption); ok {
+			start = r.Start
+			if r.End >= 0 {
+				end = min(r.End, end)
+			}
+		}
+	}
+	return io.NopCloser(bytes.NewReader(o.data[start : end+1])), nil
+}
+
+func (o *memObject) Size() int64    { return int64(len(o.data)) }
+func (o *memObject) String() string { return "memObject" }
+
+func TestEvictColdRanges(t *testing.T) {
+	const chunk = 64 * 1024
+	dir := t.TempDir()
+
+	// Skip if the file system can't deallocate parts of files
+	probe, err := os.Create(filepath.Join(dir, "probe"))
+	require.NoError(t, err)
+	_, err = probe.WriteAt(make([]byte, chunk), 0)
+	require.NoError(t, err)
+	err = file.PunchHole(probe, 0, chunk)
+	require.NoError(t, probe.Close())
+	if err != nil {
+		t.Skipf("can't punch holes: %v", err)
+	}
+
+	opt := &types.Options{
+		CacheDir:       dir,
+		CacheMaxAge:    time.Hour,
+		ChunkStreams:   1,
+		EvictRanges:    true,
+		EvictRangeSize: chunk,
+	}
+	opt.Init()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+
+	data := make([]byte, 16*chunk)
+	for i := range data {
+		data[i] = byte(i / 7)
+	}
+	o := &memObject{data: data}
+
+	// Read the whole file then the opening again so it is the hottest
+	item := c.Item("big")
+	require.NoError(t, item.Open(context.Background(), o))
+	buf := make([]byte, len(data))
+	_, err = item.ReadAt(buf, 0)
+	require.NoError(t, err)
+	_, err = item.ReadAt(buf[:100], 0)
+	require.NoError(t, err)
+	require.NoError(t, item.Close(nil))
+
+	// Halve the quota - the oldest chunks after the opening go first
+	opt.CacheMaxSize = 8 * chunk
+	c.clean(false)
+
+	assert.Equal(t, ranges.Ranges{{Pos: 0, Size: chunk}, {Pos: 9 * chunk, Size: 7 * chunk}}, item.info.Rs)
+	stats := c.Stats()
+	assert.Equal(t, 1, stats["files"], "item should be kept")
+	assert.Equal(t, int64(8), stats["evictedRanges"])
+	assert.Equal(t, int64(8*chunk), stats["evictedBytes"])
+	assert.Equal(t, int64(8*chunk), stats["bytesUsed"])
+	fi, err := os.Stat(item.root.toOSPath("big"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), fi.Size(), "file size should be kept")
+	assert.Less(t, fi.Sys().(*syscall.Stat_t).Blocks*512, int64(len(data)), "holes should be punched")
+	var saved Info
+	_, err = item.root.store.load("big", &saved)
+	require.NoError(t, err)
+	assert.Equal(t, item.info.Rs, saved.Rs, "metadata should be saved")
+
+	// Evicted ranges are fetched again, the rest come from the cache
+	require.NoError(t, item.Open(context.Background(), o))
+	opens := o.opens.Load()
+	_, err = item.ReadAt(buf[:chunk], 0)
+	require.NoError(t, err)
+	assert.Equal(t, opens, o.opens.Load())
+	_, err = item.ReadAt(buf[:chunk], chunk)
+	if !errors.Is(err, io.EOF) {
+		require.NoError(t, err)
+	}
+	assert.Equal(t, data[chunk:2*chunk], buf[:chunk])
+	assert.Greater(t, o.opens.Load(), opens)
+	require.NoError(t, item.Close(nil))
+}
+
+// warnCounter is a Logger which counts its warnings
+type warnCounter struct {
+	types.Logger
+	warnings atomic.Int64
+}
+
+func (l *warnCounter) Warnf(format string, args ...any) { l.warnings.Add(1) }
+
+func TestEvictRangesUnsupported(t *testing.T) {
+	const chunk = 64 * 1024
+	punchHole = func(*os.File, int64, int64) error { return file.ErrPunchHoleUnsupported }
+	defer func() { punchHole = file.PunchHole }()
+
+	logger := &warnCounter{Logger: types.NopLogger()}
+	opt := &types.Options{
+		CacheDir:       t.TempDir(),
+		CacheMaxAge:    time.Hour,
+		ChunkStreams:   1,
+		EvictRanges:    true,
+		EvictRangeSize: chunk,
+		Logger:         logger,
+	}
+	opt.Init()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+
+	o := &memObject{data: make([]byte, 4*chunk)}
+	buf := make([]byte, len(o.data))
+	for _, name := range []string{"one", "two"} {
+		item := c.Item(name)
+		require.NoError(t, item.Open(context.Background(), o))
+		_, err = item.ReadAt(buf, 0)
+		require.NoError(t, err)
+		require.NoError(t, item.Close(nil))
+
+		// Whole files are evicted instead, with one warning in all
+		opt.CacheMaxSize = chunk
+		c.clean(false)
+		opt.CacheMaxSize = 0
+		stats := c.Stats()
+		assert.Equal(t, 0, stats["files"], name)
+		assert.Equal(t, int64(0), stats["evictedRanges"], name)
+		assert.Equal(t, int64(1), logger.warnings.Load(), name)
+	}
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+func names(candidates []Candidate) (out []string) {
+	for _, c := range candidates {
+		out = append(out, c.Name)
+	}
+	return out
+}
+
+func TestNewEvictionPolicy(t *testing.T) {
+	for _, name := range []string{"", "lru", "LFU", "tinylfu", "w-tinylfu", "gdsf"} {
+		_, err := NewEvictionPolicy(name)
+		assert.NoError(t, err, name)
+	}
+	_, err := NewEvictionPolicy("fifo")
+	assert.Error(t, err)
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	now := time.Now()
+	candidates := func() []Candidate {
+		return []Candidate{
+			{Name: "new", Size: 1 << 20, ATime: now},
+			{Name: "hot", Size: 100 << 20, ATime: now.Add(-time.Hour)},
+			{Name: "old", Size: 1 << 20, ATime: now.Add(-2 * time.Hour)},
+			{Name: "small", Size: 1 << 10, ATime: now.Add(-3 * time.Hour)},
+		}
+	}
+	touch := func(p EvictionPolicy) {
+		for range 10 {
+			p.Touch("hot", 100<<20)
+		}
+		for range 3 {
+			p.Touch("small", 1<<10)
+		}
+		p.Touch("old", 1<<20)
+		p.Touch("new", 1<<20)
+	}
+
+	for _, test := range []struct {
+		policy string
+		want   []string
+	}{
+		{PolicyLRU, []string{"small", "old", "hot", "new"}},
+		{PolicyLFU, []string{"old", "new", "small", "hot"}},
+		// new is in the window so is kept whatever its frequency
+		{PolicyTinyLFU, []string{"old", "small", "hot", "new"}},
+		// hot is popular but large so goes before small
+		{PolicyGDSF, []string{"hot", "old", "new", "small"}},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			p, err := NewEvictionPolicy(test.policy)
+			require.NoError(t, err)
+			assert.Equal(t, test.policy, p.Name())
+			touch(p)
+			cs := candidates()
+			p.Sort(cs)
+			assert.Equal(t, test.want, names(cs))
+		})
+	}
+}
+
+func TestTinyLFUScanResistance(t *testing.T) {
+	p := newTinyLFUPolicy()
+	for range 5 {
+		p.Touch("hot", 1)
+	}
+	// A scan touches lots of items once each after the hot one
+	now := time.Now()
+	candidates := []Candidate{{Name: "hot", ATime: now.Add(-time.Hour)}}
+	for i := range 200 {
+		name := string(rune('a'+i%26)) + string(rune('a'+i/26))
+		p.Touch(name, 1)
+		candidates = append(candidates, Candidate{Name: name, ATime: now.Add(time.Duration(i) * time.Second)})
+	}
+	p.Sort(candidates)
+	assert.Equal(t, "hot", candidates[len(candidates)-3].Name, "hot item should outlast the scan")
+}
+
+func TestGDSFInflation(t *testing.T) {
+	p := newGDSFPolicy()
+	p.Touch("a", 1<<20)
+	p.Touch("a", 1<<20)
+	p.Evicted("a")
+	assert.Equal(t, 2.0, p.inflate)
+
+	// New items start from the inflated priority so age out old ones
+	p.Touch("b", 1<<20)
+	assert.Equal(t, 3.0, p.priority["b"])
+}
+
+func TestGDSFObjectSizes(t *testing.T) {
+	dir := t.TempDir()
+	newCache := func(ctx context.Context) *Cache {
+		opt := &types.Options{CacheDir: dir, CacheMaxAge: time.Hour, ChunkStreams: 1, EvictionPolicy: PolicyGDSF}
+		opt.Init()
+		c, err := New(ctx, opt, nil, nil)
+		require.NoError(t, err)
+		return c
+	}
+	fetch := func(c *Cache, name string, size int) {
+		item := c.Item(name)
+		require.NoError(t, item.Open(context.Background(), &memObject{data: make([]byte, size)}))
+		item.Touch()
+		_, err := item.ReadAt(make([]byte, size), 0)
+		require.NoError(t, err)
+		require.NoError(t, item.Close(nil))
+	}
+
+	// Loaded at startup, so never touched
+	ctx, cancel := context.WithCancel(context.Background())
+	fetch(newCache(ctx), "loaded", 4<<10)
+	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	c := newCache(ctx)
+	fetch(c, "small", 4<<10)
+	fetch(c, "big", 4<<20)
+	c.mu.Lock()
+	items := Items{c.item["loaded"], c.item["small"], c.item["big"]}
+	require.NotContains(t, items, (*Item)(nil))
+	c._sortForEviction(items)
+	c.mu.Unlock()
+	got := make([]string, len(items))
+	for i, item := range items {
+		got[i] = item.name
+	}
+	assert.Equal(t, []string{"big", "loaded", "small"}, got)
+
+	// Opens by the cache itself, such as to check an item, aren't
+	// requests
+	item := c.Item("small")
+	require.NoError(t, item.Open(context.Background(), &memObject{data: make([]byte, 4<<10)}))
+	require.NoError(t, item.Close(nil))
+	p := c.policy.(*gdsfPolicy)
+	p.mu.Lock()
+	assert.Equal(t, int64(1), p.count["small"])
+	p.mu.Unlock()
+}
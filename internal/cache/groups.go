@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+// quotaGroup is a set of items with their own limits within the cache
+type quotaGroup struct {
+	// read only
+	name    string
+	maxSize int64         // if > 0 limit on the bytes stored by the group
+	maxAge  time.Duration // if > 0 used instead of CacheMaxAge
+
+	// protected by Cache.mu
+	used         int64 // bytes stored by the group
+	evictions    int64 // items evicted to bring the group within maxSize
+	evictedBytes int64 // bytes freed by those evictions
+}
+
+// newGroups makes the quota groups from the options
+func newGroups(opt *types.Options) (groups map[string]*quotaGroup, err error) {
+	groups = make(map[string]*quotaGroup, len(opt.QuotaGroups))
+	for _, gc := range opt.QuotaGroups {
+		if gc.Name == "" {
+			return nil, fmt.Errorf("cache: quota group has no name")
+		}
+		if _, found := groups[gc.Name]; found {
+			return nil, fmt.Errorf("cache: quota group %q listed twice", gc.Name)
+		}
+		if gc.MaxSize < 0 || gc.MaxAge < 0 {
+			return nil, fmt.Errorf("cache: quota group %q: max size and max age must not be negative", gc.Name)
+		}
+		groups[gc.Name] = &quotaGroup{
+			name:    gc.Name,
+			maxSize: gc.MaxSize,
+			maxAge:  gc.MaxAge,
+		}
+	}
+	return groups, nil
+}
+
+// SetGroup puts the item in the quota group called group, or takes it
+// out of any group if group is empty.
+//
+// The group is kept in the metadata so it is saved with the item.
+// Groups which aren't configured are ignored.
+func (item *Item) SetGroup(group string) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	item.info.Group = group
+}
+
+// GetGroup returns the name of the quota group the item is in
+func (item *Item) GetGroup() string {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	return item.info.Group
+}
+
+// group returns the quota group item is in or nil if none
+//
+// No locking in Cache
+func (c *Cache) group(item *Item) *quotaGroup {
+	if len(c.groups) == 0 {
+		return nil
+	}
+	return c.groups[item.GetGroup()]
+}
+
+// itemMaxAge returns the maximum age of item given the default maxAge
+//
+// No locking in Cache
+func (c *Cache) itemMaxAge(item *Item, maxAge time.Duration) time.Duration {
+	if g := c.group(item); g != nil && g.maxAge > 0 {
+		return g.maxAge
+	}
+	return maxAge
+}
+
+// _groupsOverQuota returns the quota groups which are over their size
+// limit
+//
+// must be called with mu held.
+func (c *Cache) _groupsOverQuota() (over map[*quotaGroup]struct{}) {
+	for _, g := range c.groups {
+		if g.maxSize > 0 && g.used > g.maxSize {
+			if over == nil {
+				over = make(map[*quotaGroup]struct{})
+			}
+			over[g] = struct{}{}
+		}
+	}
+	return over
+}
+
+// purgeGroups removes items not in use from quota groups over their
+// size limit, in the order chosen by the eviction policy, until each
+// group is within its limit.
+//
+// Unlike the global quota this applies even if the cache has room, so
+// one origin can't take the space of the others.
+func (c *Cache) purgeGroups() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	over := c._groupsOverQuota()
+	if len(over) == 0 {
+		return
+	}
+
+	var items Items
+	for _, item := range c.item {
+		if _, found := over[c.group(item)]; found && !item.inUse() {
+			items = append(items, item)
+		}
+	}
+
+	c._sortForEviction(items)
+
+	for _, item := range items {
+		g := c.group(item)
+		if g.used <= g.maxSize {
+			continue
+		}
+		if removed, spaceFreed := c.removeNotInUse(item, 0, false); removed {
+			c._evicted(item, spaceFreed)
+			g.evictions++
+			g.evictedBytes += spaceFreed
+		}
+	}
+}
+
+// _groupStats returns the usage of each quota group
+//
+// This counts the items rather than using quotaGroup.used so it is
+// current between cleans.
+//
+// must be called with mu held.
+func (c *Cache) _groupStats() map[string]map[string]int64 {
+	files := make(map[*quotaGroup]int64, len(c.groups))
+	used := make(map[*quotaGroup]int64, len(c.groups))
+	for _, item := range c.item {
+		if g := c.group(item); g != nil {
+			files[g]++
+			used[g] += item.getDiskSize()
+		}
+	}
+	out := make(map[string]map[string]int64, len(c.groups))
+	for name, g := range c.groups {
+		out[name] = map[string]int64{
+			"files":        files[g],
+			"bytesUsed":    used[g],
+			"maxSize":      g.maxSize,
+			"maxAge":       int64(g.maxAge / time.Second),
+			"evictions":    g.evictions,
+			"evictedBytes": g.evictedBytes,
+		}
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+func TestQuotaGroups(t *testing.T) {
+	const chunk = 64 * 1024
+	opt := &types.Options{
+		CacheDir:     t.TempDir(),
+		CacheMaxAge:  time.Hour,
+		ChunkStreams: 1,
+		QuotaGroups: []types.QuotaGroup{
+			{Name: "noisy", MaxSize: 2 * chunk},
+			{Name: "live", MaxAge: time.Millisecond},
+		},
+	}
+	opt.Init()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+
+	o := &memObject{data: make([]byte, chunk)}
+	read := func(name, group string) {
+		item := c.Item(name)
+		item.SetGroup(group)
+		require.NoError(t, item.Open(context.Background(), o))
+		_, err := item.ReadAt(make([]byte, chunk), 0)
+		require.NoError(t, err)
+		require.NoError(t, item.Close(nil))
+	}
+	for _, name := range []string{"n1", "n2", "n3"} {
+		read(name, "noisy")
+	}
+	read("other", "")
+	read("segment", "live")
+	time.Sleep(10 * time.Millisecond)
+
+	// The noisy group loses its oldest item and the live group its
+	// expired one, though the cache as a whole has no limit
+	c.clean(false)
+	assert.False(t, c.Exists("n1"))
+	assert.True(t, c.Exists("n2"))
+	assert.True(t, c.Exists("n3"))
+	assert.True(t, c.Exists("other"))
+	assert.False(t, c.Exists("segment"))
+
+	groups := c.Stats()["groups"].(map[string]map[string]int64)
+	assert.Equal(t, map[string]int64{
+		"files":        2,
+		"bytesUsed":    2 * chunk,
+		"maxSize":      2 * chunk,
+		"maxAge":       0,
+		"evictions":    1,
+		"evictedBytes": chunk,
+	}, groups["noisy"])
+	assert.Equal(t, int64(0), groups["live"]["bytesUsed"])
+
+	// The group is kept in the metadata
+	c2, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "noisy", c2.Item("n2").GetGroup())
+
+	_, err = New(ctx, &types.Options{CacheDir: t.TempDir(), QuotaGroups: []types.QuotaGroup{{Name: "a"}, {Name: "a"}}}, nil, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+// version of the binary encoding of Info
+const infoVersion = 1
+
+// errShortInfo is returned when binary Info is truncated
+var errShortInfo = errors.New("binary metadata too short")
+
+// infoEncoder appends the fields of Info to a buffer
+type infoEncoder []byte
+
+func (e *infoEncoder) uvarint(x uint64) { *e = binary.AppendUvarint(*e, x) }
+func (e *infoEncoder) varint(x int64)   { *e = binary.AppendVarint(*e, x) }
+
+func (e *infoEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	*e = append(*e, s...)
+}
+
+func (e *infoEncoder) bool(b bool) {
+	if b {
+		*e = append(*e, 1)
+	} else {
+		*e = append(*e, 0)
+	}
+}
+
+// time encodes t as nanoseconds since the epoch with the zero time as
+// a flag so it survives the round trip
+func (e *infoEncoder) time(t time.Time) {
+	e.bool(t.IsZero())
+	if !t.IsZero() {
+		e.varint(t.UnixNano())
+	}
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[int64]V) []int64 {
+	keys := make([]int64, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// encode returns the compact binary form of info.
+//
+// Ranges and chunk numbers are delta encoded as they are sorted, so
+// an item typically takes tens of bytes rather than the hundreds the
+// JSON form does.
+func (info *Info) encode() []byte {
+	e := make(infoEncoder, 0, 64+len(info.Rs)*4+len(info.AccessTimes)*8+len(info.Checksums)*6)
+	e.uvarint(infoVersion)
+	e.time(info.ModTime)
+	e.time(info.ATime)
+	e.varint(info.Size)
+	e.uvarint(uint64(len(info.Rs)))
+	var end int64
+	for _, r := range info.Rs {
+		e.varint(r.Pos - end)
+		e.varint(r.Size)
+		end = r.End()
+	}
+	e.string(info.Fingerprint)
+	e.string(info.ETag)
+	e.time(info.RemoteTime)
+	e.bool(info.Dirty)
+	e.varint(info.AccessChunk)
+	e.uvarint(uint64(len(info.AccessTimes)))
+	var prev int64
+	for _, k := range sortedKeys(info.AccessTimes) {
+		e.varint(k - prev)
+		e.varint(info.AccessTimes[k])
+		prev = k
+	}
+	e.string(info.Group)
+	e.varint(info.ChecksumChunk)
+	e.uvarint(uint64(len(info.Checksums)))
+	prev = 0
+	for _, k := range sortedKeys(info.Checksums) {
+		e.varint(k - prev)
+		e = binary.LittleEndian.AppendUint32(e, info.Checksums[k])
+		prev = k
+	}
+	return e
+}
+
+// infoDecoder reads the fields of Info from a buffer, remembering the
+// first error
+type infoDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *infoDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errShortInfo
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *infoDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errShortInfo
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+// count reads the length of a list of items at least min bytes each
+func (d *infoDecoder) count(min int) int {
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.b)/min) {
+		d.err = errShortInfo
+		return 0
+	}
+	return int(n)
+}
+
+func (d *infoDecoder) string() string {
+	n := d.count(1)
+	if d.err != nil {
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *infoDecoder) bool() bool {
+	if d.err != nil {
+		return false
+	}
+	if len(d.b) < 1 {
+		d.err = errShortInfo
+		return false
+	}
+	b := d.b[0] != 0
+	d.b = d.b[1:]
+	return b
+}
+
+func (d *infoDecoder) time() time.Time {
+	if d.bool() {
+		return time.Time{}
+	}
+	return time.Unix(0, d.varint())
+}
+
+func (d *infoDecoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 4 {
+		d.err = errShortInfo
+		return 0
+	}
+	x := binary.LittleEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return x
+}
+
+// decode sets info from its binary form made by encode
+func (info *Info) decode(b []byte) error {
+	d := &infoDecoder{b: b}
+	if version := d.uvarint(); d.err == nil && version != infoVersion {
+		return fmt.Errorf("unknown binary metadata version %d", version)
+	}
+	var out Info
+	out.ModTime = d.time()
+	out.ATime = d.time()
+	out.Size = d.varint()
+	if n := d.count(2); n > 0 {
+		out.Rs = make(ranges.Ranges, n)
+		var end int64
+		for i := range out.Rs {
+			out.Rs[i].Pos = end + d.varint()
+			out.Rs[i].Size = d.varint()
+			end = out.Rs[i].End()
+		}
+	}
+	out.Fingerprint = d.string()
+	out.ETag = d.string()
+	out.RemoteTime = d.time()
+	out.Dirty = d.bool()
+	out.AccessChunk = d.varint()
+	if n := d.count(2); n > 0 {
+		out.AccessTimes = make(map[int64]int64, n)
+		var k int64
+		for range n {
+			k += d.varint()
+			out.AccessTimes[k] = d.varint()
+		}
+	}
+	out.Group = d.string()
+	out.ChecksumChunk = d.varint()
+	if n := d.count(5); n > 0 {
+		out.Checksums = make(map[int64]uint32, n)
+		var k int64
+		for range n {
+			k += d.varint()
+			out.Checksums[k] = d.uint32()
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.b) != 0 {
+		return fmt.Errorf("%d bytes of junk after binary metadata", len(d.b))
+	}
+	*info = out
+	return nil
+}
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
@@ -27,8 +29,7 @@ import (
 //
 // A lot of the Cache methods do not require locking, these include
 //
-// - Cache.toOSPath
-// - Cache.toOSPathMeta
+// - Cache.locate
 // - Cache.createItemDir
 // - Cache.objectFingerprint
 // - Cache.AddVirtual
@@ -59,6 +60,7 @@ type Item struct {
 	mu              sync.Mutex               // protect the variables
 	cond            sync.Cond                // synchronize with cache cleaner
 	name            string                   // name in the cache
+	root            *cacheRoot               // cache root the item is stored on
 	opens           int                      // number of times file is open
 	downloaders     *downloaders.Downloaders // a record of the downloaders in action - may be nil
 	o               types.RemoteObject   // object we are caching - may be nil
@@ -69,6 +71,11 @@ type Item struct {
 	modified        bool                     // set if the file has been modified since the last Open
 	beingReset      bool                     // cache cleaner is resetting the cache file, access not allowed
 	graceTimer      *time.Timer              // timer for delayed close after grace period
+	unsynced        bool                     // set if data has been written since the file was last synced
+	verified        map[int64]struct{}       // chunks which matched their checksums since the file was opened
+	clients         int                      // number of contexts the item was opened with which aren't done
+	lingerTimer     *time.Timer              // timer to stop the downloaders once there are no clients
+	lingerGen       int                      // incremented each time lingerTimer is started
 }
 
 // Info is persisted to backing store
@@ -78,7 +85,16 @@ type Info struct {
 	Size        int64         // size of the file
 	Rs          ranges.Ranges // which parts of the file are present
 	Fingerprint string        // fingerprint of remote object
+	ETag        string        // entity tag of remote object, if any
+	RemoteTime  time.Time     // modification time of remote object, if known
 	Dirty       bool          // set if the backing file has been modified
+
+	AccessChunk int64           `json:",omitempty"` // size of the chunks AccessTimes is kept for
+	AccessTimes map[int64]int64 `json:",omitempty"` // last access of each chunk in UnixNano
+	Group       string          `json:",omitempty"` // quota group the item is in, if any
+
+	ChecksumChunk int64            `json:",omitempty"` // size of the chunks Checksums are kept for
+	Checksums     map[int64]uint32 `json:",omitempty"` // CRC-32C of each complete chunk from the remote
 }
 
 // Items are a slice of *Item ordered by ATime
@@ -120,8 +136,10 @@ func (v Items) Less(i, j int) bool {
 }
 
 // clean the item after its cache file has been deleted
+//
+// The quota group is kept as it belongs to the name not the data.
 func (info *Info) clean() {
-	*info = Info{}
+	*info = Info{Group: info.Group}
 	info.ModTime = time.Now()
 	info.ATime = info.ModTime
 }
@@ -142,7 +160,8 @@ func newItem(c *Cache, name string) (item *Item) {
 	}
 	item.cond = sync.Cond{L: &item.mu}
 	// check the cache file exists
-	osPath := c.toOSPath(name)
+	item.root = c.locate(name)
+	osPath := item.root.toOSPath(name)
 	fi, statErr := os.Stat(osPath)
 	if statErr != nil {
 		if os.IsNotExist(statErr) {
@@ -184,6 +203,17 @@ func (item *Item) getDiskSize() int64 {
 	return item.info.Rs.Size()
 }
 
+// candidate returns the item's details for the eviction policy
+func (item *Item) candidate() Candidate {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	return Candidate{
+		Name:  item.name,
+		Size:  item.info.Rs.Size(),
+		ATime: item.info.ATime,
+	}
+}
+
 // checkCloseErr closes a Closer and records the error if no error was already set.
 func checkCloseErr(c io.Closer, err *error) {
 	if cerr := c.Close(); cerr != nil && *err == nil {
@@ -195,7 +225,11 @@ func checkCloseErr(c io.Closer, err *error) {
 func (item *Item) load() (exists bool, err error) {
 	item.mu.Lock()
 	defer item.mu.Unlock()
-	osPathMeta := item.c.toOSPathMeta(item.name) // No locking in Cache
+	return item.root.store.load(item.name, &item.info)
+}
+
+// loadInfo reads info from the metadata file at osPathMeta
+func loadInfo(osPathMeta string, info *Info) (exists bool, err error) {
 	in, err := os.Open(osPathMeta)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -205,29 +239,80 @@ func (item *Item) load() (exists bool, err error) {
 	}
 	defer checkCloseErr(in, &err)
 	decoder := json.NewDecoder(in)
-	err = decoder.Decode(&item.info)
+	err = decoder.Decode(info)
 	if err != nil {
 		return true, fmt.Errorf("cache item: corrupt metadata: %w", err)
 	}
 	return true, nil
 }
 
+// suffix of the temporary file metadata is written to before it is
+// renamed into place
+const metaTempSuffix = ".tmp-meta"
+
 // save writes an item to the disk
 //
+// The data written to the backing file is synced first so the ranges
+// in the metadata are never ahead of what is on disk. The metadata is
+// written to a temporary file which is renamed over the old one so a
+// crash leaves either the old or the new metadata, never a mixture.
+//
 // call with the lock held
 func (item *Item) _save() (err error) {
-	osPathMeta := item.c.toOSPathMeta(item.name) // No locking in Cache
-	out, err := os.Create(osPathMeta)
+	err = item._syncData()
+	if err != nil {
+		return fmt.Errorf("cache item: failed to sync data: %w", err)
+	}
+	return item.root.store.save(item.name, &item.info)
+}
+
+// saveInfo writes info to the metadata file at osPathMeta atomically
+func saveInfo(osPathMeta string, info *Info) error {
+	osPathTemp := osPathMeta + metaTempSuffix
+	err := writeInfo(osPathTemp, info)
+	if err == nil {
+		err = os.Rename(osPathTemp, osPathMeta)
+	}
 	if err != nil {
+		_ = os.Remove(osPathTemp)
 		return fmt.Errorf("cache item: failed to write metadata: %w", err)
 	}
+	err = file.SyncDir(filepath.Dir(osPathMeta))
+	if err != nil {
+		return fmt.Errorf("cache item: failed to sync metadata directory: %w", err)
+	}
+	return nil
+}
+
+// writeInfo writes info to a new file at osPath and syncs it
+func writeInfo(osPath string, info *Info) (err error) {
+	out, err := os.OpenFile(osPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
 	defer checkCloseErr(out, &err)
 	encoder := json.NewEncoder(out)
 	encoder.SetIndent("", "\t")
-	err = encoder.Encode(item.info)
+	err = encoder.Encode(info)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	return out.Sync()
+}
+
+// _syncData syncs the backing file if data has been written to it
+// since it was last synced
+//
+// call with the lock held
+func (item *Item) _syncData() error {
+	if !item.unsynced || item.fd == nil {
+		return nil
+	}
+	err := item.fd.Sync()
 	if err != nil {
-		return fmt.Errorf("cache item: failed to encode metadata: %w", err)
+		return err
 	}
+	item.unsynced = false
 	return nil
 }
 
@@ -251,7 +336,7 @@ func (item *Item) _truncate(size int64) (err error) {
 		if item.info.Rs.Size() == 0 {
 			oFlags |= os.O_CREATE
 		}
-		osPath := item.c.toOSPath(item.name) // No locking in Cache
+		osPath := item.root.toOSPath(item.name) // No locking in Cache
 		fd, err = file.OpenFile(osPath, oFlags, 0600)
 		if err != nil && os.IsNotExist(err) {
 			// If the metadata has info but the file doesn't
@@ -259,6 +344,7 @@ func (item *Item) _truncate(size int64) (err error) {
 			item.c.opt.Logger.Errorf("%s: cache: detected external removal of cache file", item.name)
 			item.info.Rs = nil      // show we have no blocks cached
 			item.info.Dirty = false // file can't be dirty if it doesn't exist
+			item.info.Checksums = nil
 			item._removeMeta("cache file externally deleted")
 			fd, err = file.OpenFile(osPath, os.O_CREATE|os.O_WRONLY, 0600)
 		}
@@ -288,6 +374,7 @@ func (item *Item) _truncate(size int64) (err error) {
 		item.c.opt.Logger.Debugf("%s: cache: truncate to size=%d (not needed as size correct)", item.name, size)
 	} else {
 		item.c.opt.Logger.Debugf("%s: cache: truncate to size=%d", item.name, size)
+		item._invalidateMem()
 
 		err = fd.Truncate(size)
 		if err != nil {
@@ -295,6 +382,10 @@ func (item *Item) _truncate(size int64) (err error) {
 		}
 	}
 
+	if size != item.info.Size {
+		// The last chunk has changed length
+		item._dropChecksums(min(size, item.info.Size), math.MaxInt64)
+	}
 	item.info.Size = size
 
 	return nil
@@ -379,7 +470,7 @@ func (item *Item) _stat() (fi os.FileInfo, err error) {
 	if item.fd != nil {
 		return item.fd.Stat()
 	}
-	osPath := item.c.toOSPath(item.name) // No locking in Cache
+	osPath := item.root.toOSPath(item.name) // No locking in Cache
 	return os.Stat(osPath)
 }
 
@@ -420,7 +511,7 @@ func (item *Item) GetSize() (size int64, err error) {
 //
 // call with mutex held
 func (item *Item) _exists() bool {
-	osPath := item.c.toOSPath(item.name) // No locking in Cache
+	osPath := item.root.toOSPath(item.name) // No locking in Cache
 	_, err := os.Stat(osPath)
 	return err == nil
 }
@@ -508,12 +599,18 @@ var ErrorCantUploadEmptyFiles = errors.New("can't upload empty files")
 
 // Open the local file from the object passed in.  Wraps open()
 // to provide recovery from out of space error.
-func (item *Item) Open(o types.RemoteObject) (err error) {
+//
+// The caller counts as a client interested in the downloads of the
+// item until ctx is done. Once there are no clients left the
+// downloaders are stopped after the DownloadLinger period. A ctx which
+// is never done, like context.Background(), doesn't count.
+func (item *Item) Open(ctx context.Context, o types.RemoteObject) (err error) {
 	for range 3 {
 		item.preAccess()
 		err = item.open(o)
 		item.postAccess()
 		if err == nil {
+			item.addClient(ctx)
 			break
 		}
 		item.c.opt.Logger.Errorf("%s: cache: failed to open item: %v", item.name, err)
@@ -526,6 +623,19 @@ func (item *Item) Open(o types.RemoteObject) (err error) {
 	return err
 }
 
+// Touch records a read of the item by a client with the eviction
+// policy. It isn't done in Open, which the cache also uses to complete,
+// check and write items.
+func (item *Item) Touch() {
+	item.mu.Lock()
+	size := item.info.Size
+	if item.o != nil {
+		size = item.o.Size()
+	}
+	item.mu.Unlock()
+	item.c.policy.Touch(item.name, size)
+}
+
 // Open the local file from the object passed in (which may be nil)
 // which implies we are about to create the file
 func (item *Item) open(o types.RemoteObject) (err error) {
@@ -535,7 +645,7 @@ func (item *Item) open(o types.RemoteObject) (err error) {
 
 	item.info.ATime = time.Now()
 
-	osPath, err := item.c.createItemDir(item.name) // No locking in Cache
+	osPath, err := item.c.createItemDir(item.root, item.name) // No locking in Cache
 	if err != nil {
 		return fmt.Errorf("cache item: createItemDir failed: %w", err)
 	}
@@ -574,6 +684,12 @@ func (item *Item) open(o types.RemoteObject) (err error) {
 			_ = dls.Close(nil)
 			item.mu.Lock()
 		}
+		// the stale fd was truncated rather than a new file made
+		err = item._truncateToCurrentSize()
+		if err != nil {
+			item.opens--
+			return fmt.Errorf("cache item: open truncate failed: %w", err)
+		}
 	}
 
 	err = item._createFile(osPath)
@@ -608,12 +724,66 @@ func (item *Item) open(o types.RemoteObject) (err error) {
 
 	// Create the downloaders
 	if item.o != nil {
-		item.downloaders = downloaders.New(item.c.ctx, item, item.c.opt, item.name, item.o)
+		item.downloaders = downloaders.New(item.c.ctx, item, item.c.opt, item.name, item.o, item.c.scheduler)
 	}
 
 	return err
 }
 
+// addClient counts ctx as a client of the item until it is done
+func (item *Item) addClient(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	item.mu.Lock()
+	item.clients++
+	if item.lingerTimer != nil {
+		item.lingerTimer.Stop()
+		item.lingerTimer = nil
+	}
+	item.mu.Unlock()
+	context.AfterFunc(ctx, item.removeClient)
+}
+
+// removeClient is called when the context of a client is done. The
+// last one to go starts the timer to stop the downloaders.
+func (item *Item) removeClient() {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	item.clients--
+	if item.clients > 0 {
+		return
+	}
+	if item.lingerTimer != nil {
+		item.lingerTimer.Stop()
+	}
+	item.lingerGen++
+	gen := item.lingerGen
+	item.lingerTimer = time.AfterFunc(item.c.opt.DownloadLinger, func() {
+		item.stopDownloads(gen)
+	})
+}
+
+// stopDownloads stops the downloaders, unless a client has arrived or
+// something is still waiting for them, when linger timer gen fires
+func (item *Item) stopDownloads(gen int) {
+	item.mu.Lock()
+	if item.lingerGen != gen || item.lingerTimer == nil || item.clients > 0 {
+		item.mu.Unlock()
+		return
+	}
+	item.lingerTimer = nil
+	dls := item.downloaders
+	item.mu.Unlock()
+	if dls == nil {
+		return
+	}
+	if stopped := dls.StopIdle(); stopped > 0 {
+		item.c.downloadsCancelled.Add(int64(stopped))
+		item.c.opt.Logger.Debugf("%s: cache: stopped %d downloads after the last client went away", item.name, stopped)
+	}
+}
+
 // Calls f with mu unlocked, re-locking mu if a panic is raised
 //
 // mu must be locked when calling this function
@@ -628,7 +798,8 @@ func unlockMutexForCall(mu *sync.Mutex, f func()) {
 //
 // Call with lock held
 //
-// In our fork, writes stay in local cache — no remote writeback.
+// If the remote object can't be written to, e.g. because the item was
+// reloaded from disk after a restart, the changes stay in the cache.
 func (item *Item) _store(ctx context.Context, storeFn StoreFn) (err error) {
 	// defer log.Trace(item.name, "item=%p", item)("err=%v", &err)
 
@@ -636,16 +807,67 @@ func (item *Item) _store(ctx context.Context, storeFn StoreFn) (err error) {
 		return nil
 	}
 
-	// In our fork, writes stay in local cache — no remote writeback
+	updater, ok := item.o.(types.RemoteUpdater)
+	if !ok {
+		item.c.opt.Logger.Infof("%s: cache: no remote to upload to - keeping changes in the cache only", item.name)
+	} else {
+		modTime := item.info.ModTime
+		o, err := item._upload(ctx, updater)
+		if err != nil {
+			return fmt.Errorf("cache: failed to upload: %w", err)
+		}
+		item.o = o
+		item._updateFingerprint()
+		item._updateValidators(o)
+		// Changed again while uploading so needs another upload
+		if !item.info.ModTime.Equal(modTime) {
+			return nil
+		}
+	}
+
 	item.info.Dirty = false
 	err = item._save()
 	if err != nil {
 		item.c.opt.Logger.Errorf("%s: cache: failed to write metadata file: %v", item.name, err)
 	}
 
+	if storeFn != nil && item.o != nil {
+		o := item.o
+		unlockMutexForCall(&item.mu, func() { storeFn(o) })
+	}
+
 	return nil
 }
 
+// _upload writes the cache file to the remote with updater, returning
+// the remote object as it is after the upload.
+//
+// Call with lock held. The lock is released while uploading.
+func (item *Item) _upload(ctx context.Context, updater types.RemoteUpdater) (o types.RemoteObject, err error) {
+	err = item._syncData()
+	if err != nil {
+		return nil, err
+	}
+	in, err := file.Open(item.root.toOSPath(item.name))
+	if err != nil {
+		return nil, err
+	}
+	defer checkCloseErr(in, &err)
+	size := item.info.Size
+	item.c.opt.Logger.Infof("%s: cache: uploading %d bytes", item.name, size)
+	unlockMutexForCall(&item.mu, func() {
+		o, err = updater.Update(ctx, io.LimitReader(in, size), size)
+	})
+	if err != nil {
+		item.c.uploadErrors.Add(1)
+		return nil, err
+	}
+	item.c.uploads.Add(1)
+	item.c.uploadedBytes.Add(size)
+	item.c.publish(EventUploaded, item.name, size)
+	return o, nil
+}
+
 // Store stores the local cache file to the remote object, returning
 // the new remote object. objOld is the old object if known.
 func (item *Item) store(ctx context.Context, storeFn StoreFn) (err error) {
@@ -655,11 +877,52 @@ func (item *Item) store(ctx context.Context, storeFn StoreFn) (err error) {
 }
 
 // Close the cache file
+//
+// If the item was changed it is uploaded before returning if the write
+// back delay is 0 or queued for upload after it if not.
 func (item *Item) Close(storeFn StoreFn) (err error) {
+	return item.close(storeFn, item.c.opt.WriteBack <= 0)
+}
+
+// CloseUpload closes the cache file like Close, but uploads any changes
+// before returning if sync is set or queues them for upload after the
+// write back delay if not, whatever the delay is.
+func (item *Item) CloseUpload(storeFn StoreFn, sync bool) (err error) {
+	return item.close(storeFn, sync)
+}
+
+// Abort closes the cache file after writing to it failed part way,
+// removing it from the cache rather than uploading it.
+func (item *Item) Abort() (err error) {
+	item.preAccess()
+	defer item.postAccess()
+	item.mu.Lock()
+	id := item.writeBackID
+	item.mu.Unlock()
+	item.c.writeback.Remove(id)
+
+	item.mu.Lock()
+	// Nothing to upload
+	item.info.Dirty = false
+	item.opens--
+	if item.opens < 0 {
+		item.mu.Unlock()
+		return os.ErrClosed
+	}
+	if item.opens == 0 {
+		err = item._actualClose(nil, true)
+	}
+	item.mu.Unlock()
+	item.c.Remove(item.name)
+	return err
+}
+
+// close the cache file, uploading it before returning if it was
+// changed and syncWriteBack is set
+func (item *Item) close(storeFn StoreFn, syncWriteBack bool) (err error) {
 	// defer log.Trace(item.o, "Item.Close")("err=%v", &err)
 	item.preAccess()
 	defer item.postAccess()
-	syncWriteBack := item.c.opt.WriteBack <= 0
 	item.mu.Lock()
 	defer item.mu.Unlock()
 
@@ -720,7 +983,7 @@ func (item *Item) _actualClose(storeFn StoreFn, syncWriteBack bool) (err error)
 	// would require keeping the downloaders alive after the item
 	// has been closed
 	if item.info.Dirty && item.o != nil {
-		err = item._ensure(0, item.info.Size)
+		err = item._ensure(item.c.ctx, 0, item.info.Size, item.c.opt.ReadAhead, downloaders.Client)
 		if err != nil {
 			return fmt.Errorf("cache: failed to download missing parts of cache file: %w", err)
 		}
@@ -755,9 +1018,11 @@ func (item *Item) _actualClose(storeFn StoreFn, syncWriteBack bool) (err error)
 	if item.fd == nil {
 		checkErr(errors.New("cache item: internal error: didn't Open file"))
 	} else {
+		checkErr(item._syncData())
 		checkErr(item.fd.Close())
 		item.fd = nil
 	}
+	item.verified = nil
 
 	// save the metadata once more since it may be dirty
 	// after the downloader
@@ -783,13 +1048,18 @@ func (item *Item) _actualClose(storeFn StoreFn, syncWriteBack bool) (err error)
 		if syncWriteBack {
 			// do synchronous writeback
 			checkErr(item._store(item.c.ctx, storeFn))
-		} else {
-			// asynchronous writeback
+		} else if item.modified || item.writeBackID == 0 {
+			// asynchronous writeback - only if changed since
+			// queued so reading the item doesn't put it off
 			item.c.writeback.SetID(&item.writeBackID)
 			id := item.writeBackID
 			item.mu.Unlock()
 			item.c.writeback.Add(id, item.name, item.info.Size, item.modified, func(ctx context.Context) error {
-				return item.store(ctx, storeFn)
+				err := item.store(ctx, storeFn)
+				if errors.Is(err, types.ErrRejected) {
+					item.c.dropRejected(item)
+				}
+				return err
 			})
 			item.mu.Lock()
 		}
@@ -815,7 +1085,7 @@ func (item *Item) reload(ctx context.Context) error {
 		return nil
 	}
 	// In our fork, there is no remote object to check; open with nil
-	err := item.Open(nil)
+	err := item.Open(context.Background(), nil)
 	if err != nil {
 		return err
 	}
@@ -862,7 +1132,10 @@ func (item *Item) _checkObject(o types.RemoteObject) error {
 	} else {
 		remoteFingerprint := _fingerprint(o, item.c.opt.FastFingerprint)
 		item.c.opt.Logger.Debugf("%s: cache: checking remote fingerprint %q against cached fingerprint %q", item.name, remoteFingerprint, item.info.Fingerprint)
-		if item.info.Fingerprint != "" {
+		if remoteFingerprint == "" {
+			// remote object can't be identified (e.g. metadata
+			// request failed) so trust what we have cached
+		} else if item.info.Fingerprint != "" {
 			// remote object && local object
 			if remoteFingerprint != item.info.Fingerprint {
 				if !item.info.Dirty {
@@ -878,7 +1151,14 @@ func (item *Item) _checkObject(o types.RemoteObject) error {
 			// Set fingerprint
 			item.info.Fingerprint = remoteFingerprint
 		}
-		item.info.Size = o.Size()
+		// The size of a modified item is what was written to it
+		// until it has been uploaded
+		if !item.info.Dirty {
+			if remoteFingerprint != "" {
+				item._updateValidators(o)
+			}
+			item.info.Size = o.Size()
+		}
 	}
 	item.o = o
 
@@ -901,7 +1181,7 @@ func (item *Item) WrittenBack() bool {
 //
 // call with lock held
 func (item *Item) _removeFile(reason string) {
-	osPath := item.c.toOSPath(item.name) // No locking in Cache
+	osPath := item.root.toOSPath(item.name) // No locking in Cache
 	err := os.Remove(osPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -916,12 +1196,9 @@ func (item *Item) _removeFile(reason string) {
 //
 // call with lock held
 func (item *Item) _removeMeta(reason string) {
-	osPathMeta := item.c.toOSPathMeta(item.name) // No locking in Cache
-	err := os.Remove(osPathMeta)
+	err := item.root.store.remove(item.name)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			item.c.opt.Logger.Errorf("%s: cache: failed to remove metadata from cache as %s: %v", item.name, reason, err)
-		}
+		item.c.opt.Logger.Errorf("%s: cache: failed to remove metadata from cache as %s: %v", item.name, reason, err)
 	} else {
 		item.c.opt.Logger.Debugf("%s: cache: removed metadata from cache as %s", item.name, reason)
 	}
@@ -938,6 +1215,7 @@ func (item *Item) _remove(reason string) (wasWriting bool) {
 	item.mu.Unlock()
 	wasWriting = item.c.writeback.Remove(item.writeBackID)
 	item.mu.Lock()
+	item._invalidateMem()
 	item.info.clean()
 	item._removeFile(reason)
 	item._removeMeta(reason)
@@ -1101,7 +1379,7 @@ func (item *Item) Reset() (rr ResetResult, spaceFreed int64, err error) {
 		return ResetFailed, spaceFreed, err
 	}
 
-	osPath := item.c.toOSPath(item.name)
+	osPath := item.root.toOSPath(item.name)
 	checkErr(item._createFile(osPath))
 	if err != nil {
 		item._remove("cache reset failed on _createFile, removed cache data file")
@@ -1115,7 +1393,7 @@ func (item *Item) Reset() (rr ResetResult, spaceFreed int64, err error) {
 
 	// Create the downloaders
 	if item.o != nil {
-		item.downloaders = downloaders.New(item.c.ctx, item, item.c.opt, item.name, item.o)
+		item.downloaders = downloaders.New(item.c.ctx, item, item.c.opt, item.name, item.o, item.c.scheduler)
 	}
 
 	/* The item will stay in the beingReset state if we get an error that prevents us from
@@ -1187,10 +1465,40 @@ func (item *Item) FindMissing(r ranges.Range) (outr ranges.Range) {
 	return outr
 }
 
-// ensure the range from offset, size is present in the backing file
+// EnsureRange makes sure the range r is present in the backing file,
+// downloading any missing parts and blocking until they arrive.
+//
+// It is safe to call concurrently for different ranges, each of which
+// will be fetched by its own downloader if required. It gives up with
+// the error of ctx once it is done.
+func (item *Item) EnsureRange(ctx context.Context, r ranges.Range) (err error) {
+	return item.ensureRange(ctx, r, downloaders.Client)
+}
+
+// ensureRange makes sure the range r is present in the backing file
+// fetching it at priority pri
+func (item *Item) ensureRange(ctx context.Context, r ranges.Range, pri downloaders.Priority) (err error) {
+	item.preAccess()
+	defer item.postAccess()
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	if item.fd == nil {
+		return errors.New("cache item EnsureRange: internal error: didn't Open file")
+	}
+	if r.Pos < 0 || r.Pos >= item.info.Size {
+		return nil
+	}
+	return item._ensure(ctx, r.Pos, r.Size, item.c.opt.ReadAhead, pri)
+}
+
+// ensure the range from offset, size is present in the backing file,
+// asking the downloaders to fetch readAhead bytes beyond it too
+//
+// Background priority fetches give way to Client ones and don't read
+// ahead. Waiting stops with the error of ctx once it is done.
 //
 // call with the item lock held
-func (item *Item) _ensure(offset, size int64) (err error) {
+func (item *Item) _ensure(ctx context.Context, offset, size, readAhead int64, pri downloaders.Priority) (err error) {
 	// defer log.Trace(item.name, "offset=%d, size=%d", offset, size)("err=%v", &err)
 	if offset+size > item.info.Size {
 		size = item.info.Size - offset
@@ -1209,7 +1517,7 @@ func (item *Item) _ensure(offset, size int64) (err error) {
 			return nil
 		}
 		// Otherwise start the downloader for the future if required
-		return item.downloaders.EnsureDownloader(r)
+		return item.downloaders.EnsureDownloader(r, readAhead)
 	}
 	if item.downloaders == nil {
 		// Downloaders can be nil here if the file has been
@@ -1222,9 +1530,12 @@ func (item *Item) _ensure(offset, size int64) (err error) {
 		if item.o == nil {
 			return errors.New("cache: no remote object available for download")
 		}
-		item.downloaders = downloaders.New(item.c.ctx, item, item.c.opt, item.name, item.o)
+		item.downloaders = downloaders.New(item.c.ctx, item, item.c.opt, item.name, item.o, item.c.scheduler)
+	}
+	if pri == downloaders.Background {
+		return item.downloaders.DownloadBackground(ctx, r)
 	}
-	return item.downloaders.Download(r)
+	return item.downloaders.Download(ctx, r, readAhead)
 }
 
 // _written marks the (offset, size) as present in the backing file
@@ -1240,6 +1551,8 @@ func (item *Item) _ensure(offset, size int64) (err error) {
 func (item *Item) _written(offset, size int64) {
 	// defer log.Trace(item.name, "offset=%d, size=%d", offset, size)("")
 	item.info.Rs.Insert(ranges.Range{Pos: offset, Size: size})
+	item._touchRange(offset, size)
+	item.unsynced = true
 }
 
 // fingerprinter is an interface for objects that can provide a fingerprint.
@@ -1252,6 +1565,11 @@ type modTimer interface {
 	ModTime(ctx context.Context) time.Time
 }
 
+// etagger is an interface for objects that can provide an entity tag.
+type etagger interface {
+	ETag() string
+}
+
 // _fingerprint returns the fingerprint of an object, if available.
 func _fingerprint(o types.RemoteObject, fast bool) string {
 	if fp, ok := o.(fingerprinter); ok {
@@ -1274,12 +1592,36 @@ func (item *Item) _updateFingerprint() {
 	}
 }
 
+// update the validators (ETag and remote modification time) from the
+// object passed in
+//
+// call with lock held
+func (item *Item) _updateValidators(o types.RemoteObject) {
+	if et, ok := o.(etagger); ok {
+		item.info.ETag = et.ETag()
+	}
+	if mt, ok := o.(modTimer); ok {
+		item.info.RemoteTime = mt.ModTime(item.c.ctx)
+	}
+}
+
+// GetValidators returns the entity tag and modification time of the
+// remote object as recorded when the item was last opened with one.
+//
+// These are persisted with the metadata so are available for serving
+// stale content when the remote is unreachable.
+func (item *Item) GetValidators() (etag string, modTime time.Time) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	return item.info.ETag, item.info.RemoteTime
+}
+
 // setModTime of the cache file
 //
 // call with lock held
 func (item *Item) _setModTime(modTime time.Time) {
 	item.c.opt.Logger.Debugf("%s: cache: setting modification time to %v", item.name, modTime)
-	osPath := item.c.toOSPath(item.name) // No locking in Cache
+	osPath := item.root.toOSPath(item.name) // No locking in Cache
 	err := os.Chtimes(osPath, modTime, modTime)
 	if err != nil {
 		item.c.opt.Logger.Errorf("%s: cache: failed to set modification time of cached file: %v", item.name, err)
@@ -1314,11 +1656,31 @@ func (item *Item) GetModTime() (modTime time.Time, err error) {
 
 // ReadAt bytes from the file at off
 func (item *Item) ReadAt(b []byte, off int64) (n int, err error) {
+	return item.ReadAtAhead(item.c.ctx, b, off, item.c.opt.ReadAhead)
+}
+
+// ReadAtAhead reads bytes from the file at off like ReadAt, fetching
+// readAhead bytes past the end of b in the background in anticipation
+// of the next read.
+//
+// Waiting for missing data stops with the error of ctx once it is
+// done, though the download carries on for any other readers.
+func (item *Item) ReadAtAhead(ctx context.Context, b []byte, off int64, readAhead int64) (n int, err error) {
+	mem := item.c.mem
+	if mem != nil {
+		if n, ok := item.readMem(mem, b, off); ok {
+			if n < len(b) {
+				err = io.EOF
+			}
+			return n, err
+		}
+	}
+
 	n = 0
 	var expBackOff int
 	for retries := range 3 {
 		item.preAccess()
-		n, err = item.readAt(b, off)
+		n, err = item.readAt(ctx, b, off, readAhead)
 		item.postAccess()
 		if err == nil || err == io.EOF {
 			break
@@ -1337,11 +1699,15 @@ func (item *Item) ReadAt(b []byte, off int64) (n int, err error) {
 		item.c.opt.Logger.Errorf("%s: cache: failed to _ensure cache after retries %v", item.name, err)
 	}
 
+	if mem != nil && n > 0 && (err == nil || err == io.EOF) {
+		item.fillMem(mem, off, n)
+	}
+
 	return n, err
 }
 
 // ReadAt bytes from the file at off
-func (item *Item) readAt(b []byte, off int64) (n int, err error) {
+func (item *Item) readAt(ctx context.Context, b []byte, off int64, readAhead int64) (n int, err error) {
 	item.mu.Lock()
 	if item.fd == nil {
 		item.mu.Unlock()
@@ -1353,10 +1719,18 @@ func (item *Item) readAt(b []byte, off int64) (n int, err error) {
 	}
 	defer item.mu.Unlock()
 
-	err = item._ensure(off, int64(len(b)))
+	err = item._ensure(ctx, off, int64(len(b)), readAhead, downloaders.Client)
 	if err != nil {
 		return 0, err
 	}
+	if item._verifyRange(off, int64(len(b))) > 0 {
+		// Download the corrupt chunks again. These are checksummed
+		// as they arrive so they aren't checked again.
+		err = item._ensure(ctx, off, int64(len(b)), readAhead, downloaders.Client)
+		if err != nil {
+			return 0, err
+		}
+	}
 
 	// Check to see if object has shrunk - if so don't read too much.
 	if item.o != nil && !item.info.Dirty && item.o.Size() != item.info.Size {
@@ -1368,6 +1742,7 @@ func (item *Item) readAt(b []byte, off int64) (n int, err error) {
 	}
 
 	item.info.ATime = time.Now()
+	item._touchRange(off, int64(len(b)))
 	// Do the reading with Item.mu unlocked and cache protected by preAccess
 	n, err = item.fd.ReadAt(b, off)
 	return n, err
@@ -1389,6 +1764,8 @@ func (item *Item) WriteAt(b []byte, off int64) (n int, err error) {
 		err = fmt.Errorf("short write: tried to write %d but only %d written", len(b), n)
 	}
 	item.mu.Lock()
+	item._invalidateMem()
+	item._dropChecksums(off, off+int64(n))
 	item._written(off, int64(n))
 	if n > 0 {
 		item._dirty()
@@ -1403,6 +1780,7 @@ func (item *Item) WriteAt(b []byte, off int64) (n int, err error) {
 	}
 	// Update size
 	if end > item.info.Size {
+		item._dropChecksums(item.info.Size, end)
 		item.info.Size = end
 	}
 	item.mu.Unlock()
@@ -1451,6 +1829,7 @@ func (item *Item) WriteAtNoOverwrite(b []byte, off int64) (n int, skipped int, e
 				err = fmt.Errorf("downloader: short write: tried to write %d but only %d written", size, nn)
 			}
 			item._written(off, int64(nn))
+			item._checksumWritten(off, int64(nn))
 		}
 		off += int64(nn)
 		b = b[nn:]
@@ -1479,6 +1858,7 @@ func (item *Item) Sync() (err error) {
 	if err != nil {
 		return fmt.Errorf("cache item sync: failed to sync file: %w", err)
 	}
+	item.unsynced = false
 	err = item._save()
 	if err != nil {
 		return fmt.Errorf("cache item sync: failed to sync metadata: %w", err)
@@ -1500,15 +1880,16 @@ func (item *Item) rename(name string, newName string, newObj types.RemoteObject)
 	id := item.writeBackID
 
 	// Set internal state
+	item._invalidateMem()
 	item.name = newName
 	item.o = newObj
 	item._updateFingerprint()
 
 	// Rename cache file if it exists
-	err = rename(item.c.toOSPath(name), item.c.toOSPath(newName)) // No locking in Cache
+	err = rename(item.root.toOSPath(name), item.root.toOSPath(newName)) // No locking in Cache
 
-	// Rename meta file if it exists
-	err2 := rename(item.c.toOSPathMeta(name), item.c.toOSPathMeta(newName)) // No locking in Cache
+	// Rename metadata if it exists
+	err2 := item.root.store.rename(name, newName)
 	if err2 != nil {
 		err = err2
 	}
@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"container/list"
+	"hash/maphash"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+const (
+	// size of the blocks of items kept in memory
+	memBlockSize = 64 * 1024
+	// default number of reads of a block before it is kept in memory
+	defaultMemMinHits = 2
+)
+
+// memKey identifies a block of an item in memory
+type memKey struct {
+	name  string // name of the item in the cache
+	block int64  // offset of the block / memBlockSize
+}
+
+// String returns the key for the admission sketch
+func (k memKey) String() string {
+	return k.name + "\x00" + strconv.FormatInt(k.block, 10)
+}
+
+// memEntry is a block of an item kept in memory
+type memEntry struct {
+	key  memKey
+	data []byte
+}
+
+// memTier keeps hot blocks of items in memory in front of the disk
+// cache so small popular objects, or popular ranges of large ones,
+// aren't read from disk on every request.
+//
+// Blocks are admitted once they have been read minHits times recently
+// and, when the tier is full, only if they have been read more often
+// than the least recently used block they would displace. This stops a
+// large file being streamed from flushing the tier.
+//
+// memTier.mu is a leaf lock - it may be taken with Item.mu held.
+type memTier struct {
+	mu       sync.Mutex
+	max      int64                              // maximum bytes of data to keep
+	minHits  uint8                              // reads before a block is admitted
+	used     int64                              // bytes of data kept
+	lru      *list.List                         // of *memEntry, most recently used first
+	entries  map[memKey]*list.Element           // blocks kept by key
+	byName   map[string]map[int64]*list.Element // blocks kept by item name
+	sketch   sketch                             // recent reads of blocks, kept or not
+	hits     int64                              // reads served from memory
+	misses   int64                              // reads which went to disk
+	rejected int64                              // blocks not admitted as the tier was full
+}
+
+// newMemTier returns a memTier holding up to max bytes or nil if max
+// is not positive
+func newMemTier(max int64, minHits int) *memTier {
+	if max <= 0 {
+		return nil
+	}
+	if minHits <= 0 {
+		minHits = defaultMemMinHits
+	}
+	return &memTier{
+		max:     max,
+		minHits: uint8(min(minHits, sketchMax)),
+		lru:     list.New(),
+		entries: make(map[memKey]*list.Element),
+		byName:  make(map[string]map[int64]*list.Element),
+		sketch:  sketch{seed: maphash.MakeSeed()},
+	}
+}
+
+// get returns the block for key if it is in memory, recording the read
+func (m *memTier) get(key memKey) (data []byte, found bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sketch.add(key.String())
+	el, found := m.entries[key]
+	if !found {
+		m.misses++
+		return nil, false
+	}
+	m.hits++
+	m.lru.MoveToFront(el)
+	return el.Value.(*memEntry).data, true
+}
+
+// admit returns true if the block for key of size bytes should be
+// read into memory
+func (m *memTier) admit(key memKey, size int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if size > m.max {
+		return false
+	}
+	if _, found := m.entries[key]; found {
+		return false
+	}
+	freq := m.sketch.estimate(key.String())
+	if freq < m.minHits {
+		return false
+	}
+	// Check the blocks which would be evicted are less popular
+	need := m.used + size - m.max
+	for el := m.lru.Back(); need > 0 && el != nil; el = el.Prev() {
+		victim := el.Value.(*memEntry)
+		if m.sketch.estimate(victim.key.String()) >= freq {
+			m.rejected++
+			return false
+		}
+		need -= int64(len(victim.data))
+	}
+	return true
+}
+
+// put stores data as the block for key, evicting the least recently
+// used blocks to make room
+func (m *memTier) put(key memKey, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, found := m.entries[key]; found || int64(len(data)) > m.max {
+		return
+	}
+	for m.used+int64(len(data)) > m.max {
+		m._remove(m.lru.Back())
+	}
+	el := m.lru.PushFront(&memEntry{key: key, data: data})
+	m.entries[key] = el
+	blocks := m.byName[key.name]
+	if blocks == nil {
+		blocks = make(map[int64]*list.Element)
+		m.byName[key.name] = blocks
+	}
+	blocks[key.block] = el
+	m.used += int64(len(data))
+}
+
+// _remove removes the block in el
+//
+// call with mu held
+func (m *memTier) _remove(el *list.Element) {
+	entry := m.lru.Remove(el).(*memEntry)
+	delete(m.entries, entry.key)
+	if blocks := m.byName[entry.key.name]; blocks != nil {
+		delete(blocks, entry.key.block)
+		if len(blocks) == 0 {
+			delete(m.byName, entry.key.name)
+		}
+	}
+	m.used -= int64(len(entry.data))
+}
+
+// invalidate removes all the blocks of the item called name
+func (m *memTier) invalidate(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, el := range m.byName[name] {
+		m._remove(el)
+	}
+}
+
+// stats returns the number of blocks and bytes in memory and the
+// number of reads served from it and from disk
+func (m *memTier) stats() (blocks, bytes, hits, misses, rejected int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.entries)), m.used, m.hits, m.misses, m.rejected
+}
+
+// _invalidateMem removes the blocks of the item from memory
+//
+// call with lock held
+func (item *Item) _invalidateMem() {
+	if item.c.mem != nil {
+		item.c.mem.invalidate(item.name)
+	}
+}
+
+// readMem reads b at off from the blocks of the item in memory.
+//
+// It returns false if any of the blocks needed aren't in memory. The
+// read is recorded for all of them so they can be admitted.
+func (item *Item) readMem(mem *memTier, b []byte, off int64) (n int, ok bool) {
+	item.mu.Lock()
+	name, size := item.name, item.info.Size
+	ok = item.fd != nil && !item.info.Dirty
+	item.mu.Unlock()
+	if !ok || off < 0 || off >= size || len(b) == 0 {
+		return 0, false
+	}
+	end := min(off+int64(len(b)), size)
+	for block := off / memBlockSize; block*memBlockSize < end; block++ {
+		data, found := mem.get(memKey{name: name, block: block})
+		pos := max(off, block*memBlockSize)
+		if !found || int64(len(data)) < min(end, (block+1)*memBlockSize)-block*memBlockSize {
+			ok = false
+			continue
+		}
+		if ok {
+			copy(b[pos-off:end-off], data[pos-block*memBlockSize:])
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+	n = int(end - off)
+
+	item.mu.Lock()
+	item.info.ATime = time.Now()
+	item._touchRange(off, int64(n))
+	item.mu.Unlock()
+	return n, true
+}
+
+// fillMem reads the blocks of the item covering n bytes at off into
+// memory if they are admitted.
+//
+// The lock is held while the blocks are read and stored so they can't
+// be stored after the item has been invalidated.
+func (item *Item) fillMem(mem *memTier, off int64, n int) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	for block := off / memBlockSize; block*memBlockSize < off+int64(n); block++ {
+		r := ranges.Range{Pos: block * memBlockSize, Size: memBlockSize}
+		r.Clip(item.info.Size)
+		key := memKey{name: item.name, block: block}
+		if item.fd == nil || item.info.Dirty || r.IsEmpty() || !item.info.Rs.Present(r) || !mem.admit(key, r.Size) {
+			continue
+		}
+		data := make([]byte, r.Size)
+		_, err := item.fd.ReadAt(data, r.Pos)
+		if err != nil && err != io.EOF {
+			item.c.opt.Logger.Debugf("%s: cache: failed to read block into memory: %v", item.name, err)
+			continue
+		}
+		mem.put(key, data)
+	}
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+func TestMemTier(t *testing.T) {
+	assert.Nil(t, newMemTier(0, 0))
+
+	m := newMemTier(2*memBlockSize, 2)
+	block := func(name string, n int64) memKey { return memKey{name: name, block: n} }
+	data := make([]byte, memBlockSize)
+
+	// Not admitted until read twice
+	a := block("a", 0)
+	_, found := m.get(a)
+	assert.False(t, found)
+	assert.False(t, m.admit(a, memBlockSize))
+	_, _ = m.get(a)
+	require.True(t, m.admit(a, memBlockSize))
+	m.put(a, data)
+	_, found = m.get(a)
+	assert.True(t, found)
+
+	b := block("b", 0)
+	_, _ = m.get(b)
+	_, _ = m.get(b)
+	require.True(t, m.admit(b, memBlockSize))
+	m.put(b, data)
+
+	// The tier is full so a block read less often is rejected
+	c := block("c", 0)
+	_, _ = m.get(c)
+	_, _ = m.get(c)
+	assert.False(t, m.admit(c, memBlockSize))
+
+	// A block read more often displaces the least recently used
+	for range 5 {
+		_, _ = m.get(c)
+	}
+	require.True(t, m.admit(c, memBlockSize))
+	m.put(c, data)
+	blocks, used, _, _, rejected := m.stats()
+	assert.Equal(t, int64(2), blocks)
+	assert.Equal(t, int64(2*memBlockSize), used)
+	assert.Equal(t, int64(1), rejected)
+	_, found = m.get(a)
+	assert.False(t, found, "least recently used block should be evicted")
+
+	// Invalidating removes all the blocks of an item
+	m.invalidate("c")
+	_, found = m.get(c)
+	assert.False(t, found)
+	blocks, used, _, _, _ = m.stats()
+	assert.Equal(t, int64(1), blocks)
+	assert.Equal(t, int64(memBlockSize), used)
+	assert.Empty(t, m.byName["c"])
+}
+
+func TestMemTierItem(t *testing.T) {
+	opt := &types.Options{
+		CacheDir:        t.TempDir(),
+		CacheMaxAge:     time.Hour,
+		ChunkStreams:    1,
+		MemCacheSize:    4 * memBlockSize,
+		MemCacheMinHits: 2,
+	}
+	opt.Init()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+
+	data := []byte("#EXTM3U\n#EXT-X-VERSION:3\n")
+	o := &memObject{data: data}
+	read := func() []byte {
+		item := c.Item("manifest")
+		require.NoError(t, item.Open(context.Background(), o))
+		buf := make([]byte, 64)
+		n, _ := item.ReadAt(buf, 0)
+		require.NoError(t, item.Close(nil))
+		return buf[:n]
+	}
+
+	// Read twice from disk then it is admitted
+	assert.Equal(t, data, read())
+	assert.Equal(t, data, read())
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats["memBlocks"])
+	assert.Equal(t, int64(len(data)), stats["memBytes"])
+
+	// Change the file on disk to show reads come from memory
+	osPath := c.Item("manifest").root.toOSPath("manifest")
+	require.NoError(t, os.WriteFile(osPath, bytes.ToUpper(data), 0600))
+	assert.Equal(t, data, read())
+	assert.Equal(t, int64(1), c.Stats()["memHits"])
+
+	// Removing the item invalidates it
+	c.Remove("manifest")
+	stats = c.Stats()
+	assert.Equal(t, int64(0), stats["memBlocks"])
+	assert.Equal(t, int64(0), stats["memBytes"])
+	assert.Equal(t, data, read())
+}
@@ -0,0 +1,436 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/tgdrive/varc/internal/types"
+	"github.com/tgdrive/varc/lib/file"
+)
+
+const (
+	// name of the metadata log in a cache root
+	indexLogName = "index.log"
+	// first bytes of a metadata log
+	indexLogMagic = "VARCLOG1"
+	// record types in the log
+	logPut    = 1 // name followed by its binary Info
+	logDelete = 2 // name
+	// bytes before each record holding its length and checksum
+	logHeaderSize = 8
+	// the log isn't compacted until it has this many records
+	logCompactMin = 1024
+	// largest record accepted, to catch corrupt lengths
+	logMaxRecord = 64 * 1024 * 1024
+)
+
+var errLogClosed = errors.New("metadata log is closed")
+
+// logStore keeps the metadata of all the items on a cache root in a
+// single append-only log.
+//
+// Each save appends a record holding the name and binary Info of the
+// item and each remove a record holding just the name. Records have
+// their length and checksum in front so a record torn by a crash is
+// found and dropped when the log is next opened.
+//
+// Only the offset of the latest record of each name is kept in
+// memory. The log is compacted by copying those records to a new log
+// once most of it is out of date.
+type logStore struct {
+	mu      sync.Mutex
+	path    string           // OS path of the log
+	logger  types.Logger     // where to log
+	fd      *os.File         // handle of the log - nil if closed
+	size    int64            // offset of the end of the log
+	index   map[string]int64 // offset of the latest put record of each name
+	records int              // number of records in the log
+	noSync  bool             // set to skip syncing after each write while migrating
+	torn    int64            // offset the log was cut at when opened, or -1
+}
+
+// openLogStore opens the metadata log at path, creating it if needed,
+// and reads its index.
+//
+// If readOnly is set the log isn't created or changed, even if it
+// ends with a torn record.
+func openLogStore(path string, readOnly bool, logger types.Logger) (s *logStore, err error) {
+	s = &logStore{
+		path:   path,
+		logger: logger,
+		index:  make(map[string]int64),
+		torn:   -1,
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	s.fd, err = file.OpenFile(path, flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cache: failed to open metadata log: %w", err)
+	}
+	err = s.replay(readOnly)
+	if err != nil {
+		_ = s.fd.Close()
+		return nil, fmt.Errorf("cache: failed to read metadata log %q: %w", path, err)
+	}
+	return s, nil
+}
+
+// replay reads the records of the log to build the index
+func (s *logStore) replay(readOnly bool) error {
+	fi, err := s.fd.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		if readOnly {
+			return nil
+		}
+		if _, err := s.fd.WriteAt([]byte(indexLogMagic), 0); err != nil {
+			return err
+		}
+		if err := s.fd.Sync(); err != nil {
+			return err
+		}
+		s.size = int64(len(indexLogMagic))
+		return file.SyncDir(filepath.Dir(s.path))
+	}
+	in := bufio.NewReaderSize(io.NewSectionReader(s.fd, 0, fi.Size()), 1024*1024)
+	magic := make([]byte, len(indexLogMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != indexLogMagic {
+		return errors.New("not a metadata log")
+	}
+	off := int64(len(indexLogMagic))
+	for {
+		payload, err := readLogRecord(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.logger.Errorf("cache: metadata log %q: dropping %d bytes after offset %d: %v", s.path, fi.Size()-off, off, err)
+			s.torn = off
+			if !readOnly {
+				if err := s.fd.Truncate(off); err != nil {
+					return err
+				}
+				if err := s.fd.Sync(); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		op, name, _, err := parseLogRecord(payload)
+		if err != nil {
+			return fmt.Errorf("record at offset %d: %w", off, err)
+		}
+		if op == logPut {
+			s.index[name] = off
+		} else {
+			delete(s.index, name)
+		}
+		s.records++
+		off += logHeaderSize + int64(len(payload))
+	}
+	s.size = off
+	return nil
+}
+
+// readLogRecord reads the payload of the next record from in
+//
+// It returns io.EOF at the end of the log and another error if the
+// record is torn or corrupt.
+func readLogRecord(in io.Reader) (payload []byte, err error) {
+	var header [logHeaderSize]byte
+	n, err := io.ReadFull(in, header[:])
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("torn record header: %w", err)
+	}
+	size := binary.LittleEndian.Uint32(header[:4])
+	if size == 0 || size > logMaxRecord {
+		return nil, fmt.Errorf("bad record length %d", size)
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(in, payload); err != nil {
+		return nil, fmt.Errorf("torn record: %w", err)
+	}
+	if crc32.Checksum(payload, crc32c) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	return payload, nil
+}
+
+// parseLogRecord splits the payload of a record into its parts
+func parseLogRecord(payload []byte) (op byte, name string, info []byte, err error) {
+	op = payload[0]
+	if op != logPut && op != logDelete {
+		return 0, "", nil, fmt.Errorf("unknown record type %d", op)
+	}
+	d := &infoDecoder{b: payload[1:]}
+	name = d.string()
+	if d.err != nil {
+		return 0, "", nil, d.err
+	}
+	return op, name, d.b, nil
+}
+
+// makeLogRecord returns a record with header for the payload made of
+// op, name and info
+func makeLogRecord(op byte, name string, info []byte) []byte {
+	record := make(infoEncoder, logHeaderSize, logHeaderSize+1+binary.MaxVarintLen64+len(name)+len(info))
+	record = append(record, op)
+	record.string(name)
+	record = append(record, info...)
+	payload := record[logHeaderSize:]
+	binary.LittleEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crc32c))
+	return record
+}
+
+// _append writes record to the end of the log, returning its offset
+//
+// call with mu held
+func (s *logStore) _append(record []byte) (off int64, err error) {
+	if s.fd == nil {
+		return 0, errLogClosed
+	}
+	off = s.size
+	if _, err := s.fd.WriteAt(record, off); err != nil {
+		// Don't leave a partial record for the next one to follow
+		_ = s.fd.Truncate(off)
+		return 0, err
+	}
+	if !s.noSync {
+		if err := s.fd.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	s.size += int64(len(record))
+	s.records++
+	return off, nil
+}
+
+// _read returns the payload of the record at off
+//
+// call with mu held
+func (s *logStore) _read(off int64) ([]byte, error) {
+	if s.fd == nil {
+		return nil, errLogClosed
+	}
+	return readLogRecord(io.NewSectionReader(s.fd, off, s.size-off))
+}
+
+func (s *logStore) load(name string, info *Info) (exists bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	off, found := s.index[name]
+	if !found {
+		return false, os.ErrNotExist
+	}
+	payload, err := s._read(off)
+	if err != nil {
+		return true, fmt.Errorf("cache item: failed to read metadata: %w", err)
+	}
+	_, _, b, err := parseLogRecord(payload)
+	if err == nil {
+		err = info.decode(b)
+	}
+	if err != nil {
+		return true, fmt.Errorf("cache item: corrupt metadata: %w", err)
+	}
+	return true, nil
+}
+
+func (s *logStore) save(name string, info *Info) error {
+	record := makeLogRecord(logPut, name, info.encode())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	off, err := s._append(record)
+	if err != nil {
+		return fmt.Errorf("cache item: failed to write metadata: %w", err)
+	}
+	s.index[name] = off
+	return nil
+}
+
+// _remove appends a delete record for name if it has metadata
+//
+// call with mu held
+func (s *logStore) _remove(name string) error {
+	if _, found := s.index[name]; !found {
+		return nil
+	}
+	if _, err := s._append(makeLogRecord(logDelete, name, nil)); err != nil {
+		return err
+	}
+	delete(s.index, name)
+	return nil
+}
+
+func (s *logStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s._remove(name)
+}
+
+func (s *logStore) rename(name, newName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	off, found := s.index[name]
+	if !found {
+		return nil
+	}
+	payload, err := s._read(off)
+	if err != nil {
+		return err
+	}
+	_, _, info, err := parseLogRecord(payload)
+	if err != nil {
+		return err
+	}
+	off, err = s._append(makeLogRecord(logPut, newName, info))
+	if err != nil {
+		return err
+	}
+	s.index[newName] = off
+	return s._remove(name)
+}
+
+func (s *logStore) has(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.index[name]
+	return found
+}
+
+func (s *logStore) names() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.index))
+	for name := range s.index {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *logStore) mkdir(name string) error { return nil }
+
+// sync commits the log to stable storage, for use after writing with
+// noSync set
+func (s *logStore) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fd == nil {
+		return errLogClosed
+	}
+	return s.fd.Sync()
+}
+
+// compact rewrites the log with only the latest record of each name
+// if most of it is out of date.
+//
+// The new log is written alongside and renamed over the old one so a
+// crash leaves one or the other.
+func (s *logStore) compact() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fd == nil || s.records < logCompactMin || s.records < 2*len(s.index) {
+		return nil
+	}
+	tmpPath := s.path + metaTempSuffix
+	out, err := file.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	w := bufio.NewWriterSize(out, 1024*1024)
+	if _, err = w.WriteString(indexLogMagic); err != nil {
+		return err
+	}
+	index := make(map[string]int64, len(s.index))
+	off := int64(len(indexLogMagic))
+	for name, oldOff := range s.index {
+		payload, err := s._read(oldOff)
+		if err != nil {
+			return err
+		}
+		_, _, info, err := parseLogRecord(payload)
+		if err != nil {
+			return err
+		}
+		record := makeLogRecord(logPut, name, info)
+		if _, err = w.Write(record); err != nil {
+			return err
+		}
+		index[name] = off
+		off += int64(len(record))
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	if err := file.SyncDir(filepath.Dir(s.path)); err != nil {
+		s.logger.Errorf("cache: failed to sync directory of %q: %v", s.path, err)
+	}
+	s.logger.Infof("cache: compacted metadata log %q from %d to %d records", s.path, s.records, len(index))
+	_ = s.fd.Close()
+	s.fd, s.size, s.index, s.records = out, off, index, len(index)
+	return nil
+}
+
+func (s *logStore) clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fd == nil {
+		return errLogClosed
+	}
+	size := int64(len(indexLogMagic))
+	if err := s.fd.Truncate(size); err != nil {
+		return err
+	}
+	if err := s.fd.Sync(); err != nil {
+		return err
+	}
+	s.size, s.records = size, 0
+	s.index = make(map[string]int64)
+	return nil
+}
+
+func (s *logStore) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fd == nil {
+		return nil
+	}
+	err := s.fd.Close()
+	s.fd = nil
+	return err
+}
+
+// stats returns the number of records in the log, the number of items
+// they describe and the size of the log
+func (s *logStore) stats() (records, items int, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records, len(s.index), s.size
+}
@@ -0,0 +1,221 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+// Ways the metadata of the items on a cache root can be stored
+const (
+	MetaStoreFiles = "files" // a JSON file per item in the meta directory
+	MetaStoreLog   = "log"   // a single append-only log of binary records
+)
+
+// metaStore keeps the metadata of the items on a cache root.
+//
+// Its methods may be called with Item.mu held so its locks are leaf
+// locks.
+type metaStore interface {
+	// load reads the metadata of name into info, returning false
+	// if there is none
+	load(name string, info *Info) (exists bool, err error)
+	// save durably stores info as the metadata of name
+	save(name string, info *Info) error
+	// remove deletes the metadata of name if it exists
+	remove(name string) error
+	// rename moves the metadata of name to newName if it exists
+	rename(name, newName string) error
+	// has returns true if there is metadata for name
+	has(name string) bool
+	// names returns the names there is metadata for
+	names() ([]string, error)
+	// mkdir makes anything needed before the metadata of name is saved
+	mkdir(name string) error
+	// compact reclaims the space used by old metadata
+	compact() error
+	// clear deletes all the metadata
+	clear() error
+	// close releases the resources of the store
+	close() error
+}
+
+// CheckMetaStore returns an error if kind isn't a way of storing metadata
+func CheckMetaStore(kind string) error {
+	switch kind {
+	case "", MetaStoreFiles, MetaStoreLog:
+		return nil
+	}
+	return fmt.Errorf("unknown metadata store %q: expecting %s or %s", kind, MetaStoreFiles, MetaStoreLog)
+}
+
+// fileStore keeps the metadata of each item in a JSON file of the same
+// name in the meta directory of the root
+type fileStore struct {
+	root *cacheRoot
+}
+
+func (s *fileStore) load(name string, info *Info) (bool, error) {
+	return loadInfo(s.root.toOSPathMeta(name), info)
+}
+
+func (s *fileStore) save(name string, info *Info) error {
+	return saveInfo(s.root.toOSPathMeta(name), info)
+}
+
+func (s *fileStore) remove(name string) error {
+	err := os.Remove(s.root.toOSPathMeta(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStore) rename(name, newName string) error {
+	return rename(s.root.toOSPathMeta(name), s.root.toOSPathMeta(newName))
+}
+
+func (s *fileStore) has(name string) bool {
+	_, err := os.Stat(s.root.toOSPathMeta(name))
+	return err == nil
+}
+
+// names walks the meta directory skipping partially written files
+func (s *fileStore) names() (names []string, err error) {
+	err = walk(s.root.meta, func(osPath string, fi os.FileInfo, name string) error {
+		if !fi.IsDir() && !strings.HasSuffix(name, metaTempSuffix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (s *fileStore) mkdir(name string) error {
+	return createDir(s.root.toOSPathMeta(types.FindParent(name)))
+}
+
+func (s *fileStore) compact() error { return nil }
+
+func (s *fileStore) clear() error {
+	if err := os.RemoveAll(s.root.meta); err != nil {
+		return err
+	}
+	return createDir(s.root.meta)
+}
+
+func (s *fileStore) close() error { return nil }
+
+// removeTempMeta removes the metadata files in the meta directory of
+// root left partially written by a crash
+func removeTempMeta(root *cacheRoot, logger types.Logger) error {
+	return walk(root.meta, func(osPath string, fi os.FileInfo, name string) error {
+		if fi.IsDir() || !strings.HasSuffix(name, metaTempSuffix) {
+			return nil
+		}
+		logger.Infof("cache: removing partially written metadata %q", osPath)
+		if err := os.Remove(osPath); err != nil {
+			logger.Errorf("cache: failed to remove partially written metadata %q: %v", osPath, err)
+		}
+		return nil
+	})
+}
+
+// openStore opens the metadata store of kind for root, migrating the
+// metadata of the other kind into it if there is any.
+func openStore(root *cacheRoot, kind string, logger types.Logger) (store metaStore, err error) {
+	if err := removeTempMeta(root, logger); err != nil {
+		return nil, fmt.Errorf("cache: failed to walk %q: %w", root.meta, err)
+	}
+	files := &fileStore{root: root}
+	logPath := filepath.Join(root.path, indexLogName)
+	// left by a crash while compacting
+	if err := os.Remove(logPath + metaTempSuffix); err == nil {
+		logger.Infof("cache: removed partially written metadata %q", logPath+metaTempSuffix)
+	}
+	if kind != MetaStoreLog {
+		if _, err := os.Stat(logPath); err != nil {
+			return files, nil
+		}
+		log, err := openLogStore(logPath, false, logger)
+		if err != nil {
+			return nil, err
+		}
+		if err := migrateMeta(log, files, logger); err != nil {
+			_ = log.close()
+			return nil, fmt.Errorf("cache: failed to migrate metadata from %q: %w", logPath, err)
+		}
+		if err := log.close(); err != nil {
+			return nil, err
+		}
+		if err := os.Remove(logPath); err != nil {
+			return nil, err
+		}
+		return files, nil
+	}
+	log, err := openLogStore(logPath, false, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateMeta(files, log, logger); err != nil {
+		_ = log.close()
+		return nil, fmt.Errorf("cache: failed to migrate metadata from %q: %w", root.meta, err)
+	}
+	return log, nil
+}
+
+// migrateMeta moves all the metadata in from into to.
+//
+// Metadata which can't be read is dropped, as it would be when the
+// cache is loaded, so the data it described is removed later.
+func migrateMeta(from, to metaStore, logger types.Logger) error {
+	names, err := from.names()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	logger.Infof("cache: migrating the metadata of %d items", len(names))
+	log, toLog := to.(*logStore)
+	if toLog {
+		// Sync once at the end rather than after every record
+		log.noSync = true
+		defer func() { log.noSync = false }()
+	}
+	for _, name := range names {
+		var info Info
+		if _, err := from.load(name, &info); err != nil {
+			logger.Errorf("%s: cache: dropping metadata while migrating: %v", name, err)
+		} else if err := to.mkdir(name); err != nil {
+			return err
+		} else if err := to.save(name, &info); err != nil {
+			return err
+		}
+	}
+	// Only remove the old metadata once it is all safely stored
+	if toLog {
+		if err := log.sync(); err != nil {
+			return err
+		}
+	}
+	var errs []error
+	for _, name := range names {
+		if err := from.remove(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// metaStoreName returns the name of the way metadata is stored
+func (c *Cache) metaStoreName() string {
+	if c.opt.MetaStore == "" {
+		return MetaStoreFiles
+	}
+	return c.opt.MetaStore
+}
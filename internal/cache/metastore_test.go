@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+func testInfo() Info {
+	return Info{
+		ModTime:       time.Unix(1700000000, 123),
+		ATime:         time.Unix(1700000100, 0),
+		Size:          10 << 20,
+		Rs:            ranges.Ranges{{Pos: 0, Size: 1 << 20}, {Pos: 3 << 20, Size: 5 << 20}},
+		Fingerprint:   "10485760,2023-11-14",
+		ETag:          `"abc"`,
+		Dirty:         true,
+		AccessChunk:   1 << 20,
+		AccessTimes:   map[int64]int64{0: 5, 3: 7, 4: 9},
+		Group:         "videos",
+		ChecksumChunk: checksumChunkSize,
+		Checksums:     map[int64]uint32{0: 1, 3: 0xffffffff, 7: 42},
+	}
+}
+
+func TestInfoEncode(t *testing.T) {
+	for _, in := range []Info{{}, testInfo()} {
+		b := in.encode()
+		var out Info
+		require.NoError(t, out.decode(b))
+		assert.True(t, in.ModTime.Equal(out.ModTime))
+		assert.True(t, in.ATime.Equal(out.ATime))
+		out.ModTime, out.ATime = in.ModTime, in.ATime
+		assert.Equal(t, in, out)
+
+		// Truncated or extended encodings are rejected
+		for i := range b {
+			assert.Error(t, out.decode(b[:i]), "length %d", i)
+		}
+		assert.Error(t, out.decode(append(b, 0)))
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), indexLogName)
+	s, err := openLogStore(path, false, types.NopLogger())
+	require.NoError(t, err)
+
+	info := testInfo()
+	require.NoError(t, s.save("a", &info))
+	require.NoError(t, s.save("b", &info))
+	info.Size = 1
+	require.NoError(t, s.save("a", &info))
+	require.NoError(t, s.rename("b", "dir/c"))
+	require.NoError(t, s.save("d", &info))
+	require.NoError(t, s.remove("d"))
+	assert.True(t, s.has("dir/c"))
+	assert.False(t, s.has("b"))
+	require.NoError(t, s.close())
+
+	// Reopening replays the log
+	s, err = openLogStore(path, false, types.NopLogger())
+	require.NoError(t, err)
+	names, err := s.names()
+	require.NoError(t, err)
+	sort.Strings(names)
+	assert.Equal(t, []string{"a", "dir/c"}, names)
+	var got Info
+	exists, err := s.load("a", &got)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, int64(1), got.Size)
+	_, err = s.load("dir/c", &got)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10<<20), got.Size)
+	exists, err = s.load("b", &got)
+	assert.False(t, exists)
+	assert.True(t, os.IsNotExist(err))
+	records, items, size := s.stats()
+	assert.Equal(t, 7, records)
+	assert.Equal(t, 2, items)
+	require.NoError(t, s.close())
+
+	// A torn record at the end is cut off
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, fi.Size(), size)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	record := makeLogRecord(logPut, "e", info.encode())
+	_, err = fd.Write(record[:len(record)-3])
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	s, err = openLogStore(path, true, types.NopLogger())
+	require.NoError(t, err)
+	assert.Equal(t, size, s.torn)
+	require.NoError(t, s.close())
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, size+int64(len(record)-3), fi.Size(), "read only leaves the log alone")
+
+	s, err = openLogStore(path, false, types.NopLogger())
+	require.NoError(t, err)
+	assert.Equal(t, size, s.torn)
+	assert.False(t, s.has("e"))
+	require.NoError(t, s.save("e", &info))
+	require.NoError(t, s.close())
+	s, err = openLogStore(path, false, types.NopLogger())
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), s.torn)
+	assert.True(t, s.has("e"))
+	require.NoError(t, s.close())
+}
+
+func TestLogStoreCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), indexLogName)
+	s, err := openLogStore(path, false, types.NopLogger())
+	require.NoError(t, err)
+	s.noSync = true
+	info := testInfo()
+	for i := range logCompactMin {
+		info.Size = int64(i)
+		require.NoError(t, s.save("a", &info))
+	}
+	require.NoError(t, s.save("b", &info))
+	_, _, before := s.stats()
+
+	require.NoError(t, s.compact())
+	records, items, after := s.stats()
+	assert.Equal(t, 2, records)
+	assert.Equal(t, 2, items)
+	assert.Less(t, after, before/100)
+	require.NoError(t, s.close())
+
+	s, err = openLogStore(path, false, types.NopLogger())
+	require.NoError(t, err)
+	var got Info
+	_, err = s.load("a", &got)
+	require.NoError(t, err)
+	assert.Equal(t, int64(logCompactMin-1), got.Size)
+	records, _, _ = s.stats()
+	assert.Equal(t, 2, records)
+	require.NoError(t, s.close())
+}
+
+func TestMetaStoreMigrate(t *testing.T) {
+	dir := t.TempDir()
+	open := func(kind string) (*Cache, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		opt := &types.Options{
+			CacheDir:     dir,
+			CacheMaxAge:  time.Hour,
+			ChunkStreams: 1,
+			MetaStore:    kind,
+		}
+		opt.Init()
+		c, err := New(ctx, opt, nil, nil)
+		require.NoError(t, err)
+		return c, cancel
+	}
+	metaFiles := func() (names []string) {
+		require.NoError(t, walk(filepath.Join(dir, "meta"), func(osPath string, fi os.FileInfo, name string) error {
+			if !fi.IsDir() {
+				names = append(names, name)
+			}
+			return nil
+		}))
+		return names
+	}
+	data := []byte("hello world")
+	c, cancel := open(MetaStoreFiles)
+	for _, name := range []string{"a", "dir/b"} {
+		item := c.Item(name)
+		require.NoError(t, item.Open(context.Background(), &memObject{data: data}))
+		_, err := item.ReadAt(make([]byte, len(data)), 0)
+		require.NoError(t, err)
+		require.NoError(t, item.Close(nil))
+	}
+	cancel()
+	assert.Len(t, metaFiles(), 2)
+
+	check := func(c *Cache) {
+		for _, name := range []string{"a", "dir/b"} {
+			assert.True(t, c.Exists(name), name)
+			assert.Equal(t, int64(len(data)), c.Item(name).getDiskSize(), name)
+		}
+	}
+
+	// files to log
+	c, cancel = open(MetaStoreLog)
+	check(c)
+	assert.Empty(t, metaFiles())
+	assert.FileExists(t, filepath.Join(dir, indexLogName))
+	assert.Equal(t, int64(2), c.Stats()["metaLogItems"])
+	cancel()
+
+	// The log is used when reopened
+	c, cancel = open(MetaStoreLog)
+	check(c)
+	cancel()
+
+	// log to files
+	c, cancel = open(MetaStoreFiles)
+	check(c)
+	assert.Len(t, metaFiles(), 2)
+	assert.NoFileExists(t, filepath.Join(dir, indexLogName))
+	cancel()
+}
+
+func TestFsckLog(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opt := &types.Options{
+		CacheDir:     dir,
+		CacheMaxAge:  time.Hour,
+		ChunkStreams: 1,
+		MetaStore:    MetaStoreLog,
+	}
+	opt.Init()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	for _, name := range []string{"ok", "nodata"} {
+		item := c.Item(name)
+		require.NoError(t, item.Open(context.Background(), &memObject{data: []byte("hello")}))
+		_, err := item.ReadAt(make([]byte, 5), 0)
+		require.NoError(t, err)
+		require.NoError(t, item.Close(nil))
+	}
+	cancel()
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "data", "nodata")))
+	fd, err := os.OpenFile(filepath.Join(dir, indexLogName), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = fd.Write([]byte("torn"))
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	for _, repair := range []bool{false, true} {
+		findings, err := Fsck(opt, repair)
+		require.NoError(t, err)
+		got := map[string]Problem{}
+		for _, f := range findings {
+			got[f.Name] = f.Problem
+			assert.Equal(t, repair, f.Fixed(), f.String())
+		}
+		assert.Equal(t, map[string]Problem{"nodata": OrphanMeta, indexLogName: PartialMeta}, got)
+	}
+	findings, err := Fsck(opt, false)
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+}
@@ -0,0 +1,484 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/tgdrive/varc/internal/types"
+	"github.com/tgdrive/varc/lib/file"
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+// cacheRoot is one of the directories the cache is spread over
+type cacheRoot struct {
+	// read only
+	path    string    // OS path of the directory
+	data    string    // OS path for cache data
+	meta    string    // OS path for cache metadata
+	weight  float64   // share of the items placed on this root in its tier
+	maxSize int64     // if > 0 limit on the bytes stored here
+	tier    int       // lower tiers are faster
+	store   metaStore // where the metadata of the items is kept
+
+	used int64 // bytes stored here - protected by Cache.mu
+}
+
+// newRoots makes the cache roots from the options, creating their
+// directories
+func newRoots(opt *types.Options) (roots []*cacheRoot, err error) {
+	cfg := opt.CacheRoots
+	if len(cfg) == 0 {
+		if opt.CacheDir == "" {
+			return nil, errors.New("cache: CacheDir not set")
+		}
+		cfg = []types.CacheRoot{{Path: opt.CacheDir}}
+	}
+	seen := make(map[string]struct{}, len(cfg))
+	for _, rc := range cfg {
+		if rc.Path == "" {
+			return nil, errors.New("cache: cache root has no path")
+		}
+		path, err := filepath.Abs(rc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("cache: bad cache root %q: %w", rc.Path, err)
+		}
+		if _, found := seen[path]; found {
+			return nil, fmt.Errorf("cache: cache root %q listed twice", rc.Path)
+		}
+		seen[path] = struct{}{}
+		if rc.Weight < 0 || rc.MaxSize < 0 || rc.Tier < 0 {
+			return nil, fmt.Errorf("cache: cache root %q: weight, max size and tier must not be negative", rc.Path)
+		}
+		root := &cacheRoot{
+			path:    path,
+			data:    filepath.Join(path, "data"),
+			meta:    filepath.Join(path, "meta"),
+			weight:  float64(max(rc.Weight, 1)),
+			maxSize: rc.MaxSize,
+			tier:    rc.Tier,
+		}
+		for _, d := range []string{root.data, root.meta} {
+			if err := os.MkdirAll(d, 0700); err != nil {
+				return nil, fmt.Errorf("cache: failed to create cache directory %q: %w", d, err)
+			}
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// toOSPath turns a remote relative name into an OS path in the root
+func (r *cacheRoot) toOSPath(name string) string {
+	return filepath.Join(r.data, name)
+}
+
+// toOSPathMeta turns a remote relative name into an OS path in the
+// root for the metadata
+func (r *cacheRoot) toOSPathMeta(name string) string {
+	return filepath.Join(r.meta, name)
+}
+
+// score returns the rendezvous hashing score of name on the root
+func (r *cacheRoot) score(name string) float64 {
+	h := fnv.New64a()
+	_, _ = io.WriteString(h, r.path)
+	_, _ = h.Write([]byte{0})
+	_, _ = io.WriteString(h, name)
+	// mix the bits as FNV doesn't spread short suffixes into the top
+	// bits, then map the hash to (0, 1)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return -r.weight / math.Log(u)
+}
+
+// place returns the root name should be stored on out of roots.
+//
+// This uses weighted rendezvous hashing so each root gets a share of
+// the names in proportion to its weight, and adding or removing a
+// root only moves the names which go to or came from that root.
+func place(roots []*cacheRoot, name string) (best *cacheRoot) {
+	var bestScore float64
+	for _, root := range roots {
+		if s := root.score(name); best == nil || s > bestScore {
+			best, bestScore = root, s
+		}
+	}
+	return best
+}
+
+// tiers returns the tiers in use, fastest first
+func (c *Cache) tiers() (tiers []int) {
+	for _, root := range c.roots {
+		if !slices.Contains(tiers, root.tier) {
+			tiers = append(tiers, root.tier)
+		}
+	}
+	sort.Ints(tiers)
+	return tiers
+}
+
+// tierRoots returns the roots in tier
+func (c *Cache) tierRoots(tier int) (roots []*cacheRoot) {
+	for _, root := range c.roots {
+		if root.tier == tier {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// nextTier returns the next slower tier after tier, or false if it is
+// the slowest
+func (c *Cache) nextTier(tier int) (next int, ok bool) {
+	for _, t := range c.tiers() {
+		if t > tier {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// locate returns the root holding name, or the root it should be placed
+// on in the fastest tier if it isn't in the cache.
+//
+// Items stay on the root they were written to, so they may not be on
+// the root they hash to if they were demoted or the roots have changed.
+//
+// No locking in Cache
+func (c *Cache) locate(name string) *cacheRoot {
+	home := place(c.tierRoots(c.tiers()[0]), name)
+	if len(c.roots) == 1 {
+		return home
+	}
+	for _, root := range append([]*cacheRoot{home}, c.roots...) {
+		if _, err := os.Stat(root.toOSPath(name)); err == nil || root.store.has(name) {
+			return root
+		}
+	}
+	return home
+}
+
+// rootQuotaOK returns true if root is within its size limit and the
+// disk it is on has CacheMinFreeSpace available.
+//
+// must be called with mu held.
+func (c *Cache) rootQuotaOK(root *cacheRoot) bool {
+	return c.rootHasRoom(root, 0)
+}
+
+// rootHasRoom returns true if need bytes can be added to root without
+// it going over quota.
+//
+// must be called with mu held.
+func (c *Cache) rootHasRoom(root *cacheRoot, need int64) bool {
+	if root.maxSize > 0 && root.used+need > root.maxSize {
+		return false
+	}
+	if c.opt.CacheMinFreeSpace > 0 {
+		_, _, avail, err := getDiskUsage(root.path)
+		if err != nil {
+			c.opt.Logger.Errorf("cache: disk usage of %q returned error: %v", root.path, err)
+			return true
+		}
+		if avail-need < c.opt.CacheMinFreeSpace {
+			return false
+		}
+	}
+	return true
+}
+
+// _globalQuotaOK returns true if the cache as a whole is within
+// CacheMaxSize
+//
+// must be called with mu held.
+func (c *Cache) _globalQuotaOK() bool {
+	return c.opt.CacheMaxSize <= 0 || c.used <= c.opt.CacheMaxSize
+}
+
+// _needsSpace returns true if evicting item would help get the cache
+// back within quota, ie the whole cache or the root item is on is over
+// quota.
+//
+// must be called with mu held.
+func (c *Cache) _needsSpace(item *Item) bool {
+	return !c._globalQuotaOK() || !c.rootQuotaOK(item.getRoot())
+}
+
+// _freed accounts for spaceFreed bytes of item being removed from its
+// root and quota group
+//
+// must be called with mu held.
+func (c *Cache) _freed(item *Item, spaceFreed int64) {
+	c.used -= spaceFreed
+	item.getRoot().used -= spaceFreed
+	if g := c.group(item); g != nil {
+		g.used -= spaceFreed
+	}
+}
+
+// tierMove is an item being moved to a root on another tier. While
+// it is moved its size is accounted to the root it is going to.
+type tierMove struct {
+	item    *Item
+	from    *cacheRoot
+	to      *cacheRoot
+	size    int64 // bytes accounted to to rather than from
+	promote bool  // moving to a faster tier
+}
+
+// _planMove accounts for item moving from its root to to and returns
+// the move for moveItems to do once mu is released
+//
+// must be called with mu held.
+func (c *Cache) _planMove(item *Item, to *cacheRoot, promote bool) tierMove {
+	m := tierMove{item: item, from: item.getRoot(), to: to, size: item.getDiskSize(), promote: promote}
+	m.from.used -= m.size
+	m.to.used += m.size
+	return m
+}
+
+// _demote plans moving item to the next tier, adding it to moves, if
+// there is one with room for it instead of it being evicted. It is
+// only worth doing if the cache as a whole is within quota.
+//
+// It returns true if the item will be moved.
+//
+// must be called with mu held.
+func (c *Cache) _demote(item *Item, moves *[]tierMove) bool {
+	if !c._globalQuotaOK() || !item.movable() {
+		return false
+	}
+	tier, ok := c.nextTier(item.getRoot().tier)
+	if !ok {
+		return false
+	}
+	to := place(c.tierRoots(tier), item.name)
+	if !c.rootHasRoom(to, item.getDiskSize()) {
+		return false
+	}
+	*moves = append(*moves, c._planMove(item, to, false))
+	return true
+}
+
+// promoteHot moves items on slower tiers which have been used since
+// the last clean back to the fastest tier if it has room for them, the
+// most recently used first.
+func (c *Cache) promoteHot(since time.Time) {
+	tiers := c.tiers()
+	if len(tiers) < 2 {
+		return
+	}
+	c.mu.Lock()
+	var items Items
+	for _, item := range c.item {
+		if item.getRoot().tier != tiers[0] && !item.inUse() && item.movable() && item.candidate().ATime.After(since) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].candidate().ATime.After(items[j].candidate().ATime)
+	})
+
+	fast := c.tierRoots(tiers[0])
+	var moves []tierMove
+	for _, item := range items {
+		to := place(fast, item.name)
+		if c.rootHasRoom(to, item.getDiskSize()) {
+			moves = append(moves, c._planMove(item, to, true))
+		}
+	}
+	c.mu.Unlock()
+
+	c.moveItems(moves)
+}
+
+// moveItems does the moves planned with _planMove. The data is copied
+// without mu or the lock of the item held so the cache isn't held up
+// by large files. A move is abandoned if the item was used or changed
+// in the meantime.
+//
+// call with mu not held.
+func (c *Cache) moveItems(moves []tierMove) {
+	for _, m := range moves {
+		tmpPath, copied, err := m.item.copyTo(m.to)
+
+		c.mu.Lock()
+		moved := int64(-1)
+		if err == nil && tmpPath != "" {
+			moved, err = c._finishMove(m, tmpPath, copied)
+		}
+		// Account for what was moved rather than what was planned
+		done := int64(0)
+		if err == nil && moved >= 0 {
+			done = moved
+			if m.promote {
+				c.promotions++
+			} else {
+				c.demotions++
+			}
+		}
+		m.from.used += m.size - done
+		m.to.used += done - m.size
+		c.mu.Unlock()
+
+		direction := "demote"
+		if m.promote {
+			direction = "promote"
+		}
+		if err != nil {
+			c.opt.Logger.Errorf("%s: cache: failed to %s to %q: %v", m.item.name, direction, m.to.path, err)
+		} else if moved >= 0 {
+			c.opt.Logger.Infof("%s: cache: %sd from %q to %q, moved %d bytes", m.item.name, direction, m.from.path, m.to.path, moved)
+		}
+	}
+}
+
+// getRoot returns the root the item is stored on
+func (item *Item) getRoot() *cacheRoot {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	return item.root
+}
+
+// movable returns true if the item could be moved to another root
+func (item *Item) movable() bool {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	return item._movable()
+}
+
+// _movable returns true if the item could be moved to another root,
+// ie it isn't in use, dirty or being reset.
+//
+// call with lock held
+func (item *Item) _movable() bool {
+	return item.opens == 0 && !item.info.Dirty && item.graceTimer == nil && item.pendingAccesses == 0 && !item.beingReset && item.fd == nil
+}
+
+// suffix of the temporary file data is copied to when an item is moved
+// to another root before it is renamed into place
+const dataTempSuffix = ".tmp-move"
+
+// movedItem is what an item was like when it was copied to another
+// root, to check it hasn't changed before the copy is used
+type movedItem struct {
+	from    *cacheRoot
+	rs      ranges.Ranges
+	modTime time.Time
+}
+
+// copyTo copies the ranges of the item present to a temporary sparse
+// file on root, returning its path and what was copied. The path is
+// empty if the item can't be moved.
+//
+// The lock of the item is only held while looking at it so the item
+// can be opened meanwhile, which _finishMove checks for.
+func (item *Item) copyTo(root *cacheRoot) (tmpPath string, copied movedItem, err error) {
+	item.mu.Lock()
+	if !item._movable() || item.root == root {
+		item.mu.Unlock()
+		return "", copied, nil
+	}
+	copied = movedItem{from: item.root, rs: slices.Clone(item.info.Rs), modTime: item.info.ModTime}
+	item.mu.Unlock()
+
+	osPath, err := item.c.createItemDir(root, item.name)
+	if err != nil {
+		return "", copied, err
+	}
+	tmpPath = osPath + dataTempSuffix
+	err = copyData(copied.from.toOSPath(item.name), tmpPath, copied.rs, item.c.opt.Logger)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return "", copied, err
+	}
+	return tmpPath, copied, nil
+}
+
+// _finishMove switches the item in m over to the copy of its data at
+// tmpPath, returning the number of bytes moved. If the item has been
+// removed, opened or changed since it was copied the copy is removed
+// and -1 returned.
+//
+// must be called with mu held.
+func (c *Cache) _finishMove(m tierMove, tmpPath string, copied movedItem) (moved int64, err error) {
+	item := m.item
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	if c.item[item.name] != item || !item._movable() || item.root != copied.from ||
+		!slices.Equal(item.info.Rs, copied.rs) || !item.info.ModTime.Equal(copied.modTime) {
+		_ = os.Remove(tmpPath)
+		return -1, nil
+	}
+	osPath := m.to.toOSPath(item.name)
+	err = os.Rename(tmpPath, osPath)
+	if err == nil {
+		item.root = m.to
+		err = item._save()
+		if err != nil {
+			item.root = copied.from
+		}
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		_ = os.Remove(osPath)
+		_ = m.to.store.remove(item.name)
+		return 0, err
+	}
+	if err := os.Remove(copied.from.toOSPath(item.name)); err != nil && !os.IsNotExist(err) {
+		c.opt.Logger.Errorf("%s: cache: failed to remove old copy from %q: %v", item.name, copied.from.path, err)
+	}
+	if err := copied.from.store.remove(item.name); err != nil {
+		c.opt.Logger.Errorf("%s: cache: failed to remove old metadata from %q: %v", item.name, copied.from.path, err)
+	}
+	return item.info.Rs.Size(), nil
+}
+
+// copyData copies rs of the file at srcPath to a new sparse file at
+// dstPath which is synced
+func copyData(srcPath, dstPath string, rs ranges.Ranges, logger types.Logger) (err error) {
+	in, err := file.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer checkCloseErr(in, &err)
+	out, err := file.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer checkCloseErr(out, &err)
+	if err = file.SetSparse(out); err != nil {
+		logger.Errorf("%s: cache: failed to set as a sparse file: %v", dstPath, err)
+	}
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err = out.Truncate(fi.Size()); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		r.Clip(fi.Size())
+		if r.IsEmpty() {
+			continue
+		}
+		_, err = io.Copy(io.NewOffsetWriter(out, r.Pos), io.NewSectionReader(in, r.Pos, r.Size))
+		if err != nil {
+			return err
+		}
+	}
+	return out.Sync()
+}
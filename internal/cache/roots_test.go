@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+func TestPlace(t *testing.T) {
+	dir := t.TempDir()
+	roots := []*cacheRoot{
+		{path: filepath.Join(dir, "a"), weight: 1},
+		{path: filepath.Join(dir, "b"), weight: 1},
+		{path: filepath.Join(dir, "c"), weight: 2},
+	}
+	const n = 10000
+	placed := make(map[string]*cacheRoot, n)
+	counts := make(map[*cacheRoot]int)
+	for i := range n {
+		name := fmt.Sprintf("file%d", i)
+		root := place(roots, name)
+		placed[name] = root
+		counts[root]++
+	}
+	assert.InDelta(t, n/4, counts[roots[0]], n/20)
+	assert.InDelta(t, n/4, counts[roots[1]], n/20)
+	assert.InDelta(t, n/2, counts[roots[2]], n/20)
+
+	// Adding a root only moves names onto it
+	added := &cacheRoot{path: filepath.Join(dir, "d"), weight: 1}
+	moved := 0
+	for name, root := range placed {
+		newRoot := place(append(roots, added), name)
+		if newRoot != root {
+			assert.Equal(t, added, newRoot)
+			moved++
+		}
+	}
+	assert.InDelta(t, n/5, moved, n/20)
+}
+
+func TestNewRootsErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, roots := range [][]types.CacheRoot{
+		{{Path: ""}},
+		{{Path: dir}, {Path: dir}},
+		{{Path: dir, Weight: -1}},
+	} {
+		_, err := newRoots(&types.Options{CacheRoots: roots})
+		assert.Error(t, err, "%+v", roots)
+	}
+	_, err := newRoots(&types.Options{})
+	assert.Error(t, err)
+}
+
+func TestTiers(t *testing.T) {
+	const chunk = 64 * 1024
+	fastDir, slowDir := t.TempDir(), t.TempDir()
+	opt := &types.Options{
+		CacheMaxAge:  time.Hour,
+		ChunkStreams: 1,
+		CacheRoots: []types.CacheRoot{
+			{Path: fastDir, MaxSize: 3 * chunk},
+			{Path: slowDir, Tier: 1},
+		},
+	}
+	opt.Init()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	fast, slow := c.roots[0], c.roots[1]
+
+	objects := map[string]*memObject{}
+	read := func(name string) {
+		o := objects[name]
+		if o == nil {
+			data := make([]byte, 2*chunk)
+			for i := range data {
+				data[i] = byte(len(name) + i/3)
+			}
+			o = &memObject{data: data}
+			objects[name] = o
+		}
+		item := c.Item(name)
+		require.NoError(t, item.Open(context.Background(), o))
+		buf := make([]byte, len(o.data))
+		_, err := item.ReadAt(buf, 0)
+		require.NoError(t, err)
+		assert.Equal(t, o.data, buf)
+		require.NoError(t, item.Close(nil))
+	}
+
+	// New items go on the fast tier
+	read("a")
+	read("bb")
+	a := c.Item("a")
+	assert.Equal(t, fast, a.getRoot())
+
+	// The fast tier is over quota so the oldest item is demoted
+	c.clean(false)
+	assert.Equal(t, slow, a.getRoot())
+	assert.Equal(t, fast, c.Item("bb").getRoot())
+	assert.NoFileExists(t, filepath.Join(fastDir, "data", "a"))
+	assert.FileExists(t, filepath.Join(slowDir, "data", "a"))
+	assert.FileExists(t, filepath.Join(slowDir, "meta", "a"))
+	assert.Equal(t, int64(1), c.Stats()["demotions"])
+	assert.Equal(t, int64(2*chunk), fast.used)
+	assert.Equal(t, int64(2*chunk), slow.used)
+
+	// It is still served from the cache
+	opens := objects["a"].opens.Load()
+	read("a")
+	assert.Equal(t, opens, objects["a"].opens.Load())
+
+	// A reload finds it on the slow tier
+	c2, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, c2.roots[1].path, c2.Item("a").getRoot().path)
+	assert.Equal(t, c2.roots[0].path, c2.Item("bb").getRoot().path)
+
+	// Once there is room it is promoted as it was used
+	c.Remove("bb")
+	c.clean(false)
+	assert.Equal(t, fast, a.getRoot())
+	assert.FileExists(t, filepath.Join(fastDir, "data", "a"))
+	assert.NoFileExists(t, filepath.Join(slowDir, "data", "a"))
+	assert.Equal(t, int64(1), c.Stats()["promotions"])
+	read("a")
+	assert.Equal(t, opens, objects["a"].opens.Load())
+	_, err = os.Stat(filepath.Join(slowDir, "meta", "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTierMoveChanged(t *testing.T) {
+	const chunk = 64 * 1024
+	fastDir, slowDir := t.TempDir(), t.TempDir()
+	opt := &types.Options{
+		CacheMaxAge:  time.Hour,
+		ChunkStreams: 1,
+		ChunkSize:    chunk,
+		CacheRoots: []types.CacheRoot{
+			{Path: fastDir},
+			{Path: slowDir, Tier: 1},
+		},
+	}
+	opt.Init()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	fast, slow := c.roots[0], c.roots[1]
+
+	o := &memObject{data: make([]byte, 4*chunk)}
+	readAt := func(off int64) {
+		item := c.Item("a")
+		require.NoError(t, item.Open(context.Background(), o))
+		_, err := item.ReadAt(make([]byte, 100), off)
+		require.NoError(t, err)
+		require.NoError(t, item.Close(nil))
+	}
+	readAt(0)
+	item := c.Item("a")
+	size := item.getDiskSize()
+
+	c.mu.Lock()
+	m := c._planMove(item, slow, false)
+	c.mu.Unlock()
+	tmpPath, copied, err := item.copyTo(slow)
+	require.NoError(t, err)
+	require.FileExists(t, tmpPath)
+
+	// Reading more of it while it is copied means the copy is stale
+	readAt(2 * chunk)
+	c.mu.Lock()
+	moved, err := c._finishMove(m, tmpPath, copied)
+	c.mu.Unlock()
+	require.NoError(t, err)
+	assert.Equal(t, int64(-1), moved)
+	assert.NoFileExists(t, tmpPath)
+	assert.Equal(t, fast, item.getRoot())
+
+	// moveItems gives back the space accounted to a move not made
+	c.mu.Lock()
+	slowUsed := slow.used
+	m = c._planMove(item, slow, false)
+	c.mu.Unlock()
+	assert.Equal(t, slowUsed+m.size, slow.used)
+	item.mu.Lock()
+	item.opens++
+	item.mu.Unlock()
+	c.moveItems([]tierMove{m})
+	assert.Equal(t, slowUsed, slow.used)
+	assert.Equal(t, fast, item.getRoot())
+	assert.Greater(t, m.size, size)
+	item.mu.Lock()
+	item.opens--
+	item.mu.Unlock()
+
+	// A copy left by a crash is removed when the cache is reloaded
+	stale := filepath.Join(slowDir, "data", "b"+dataTempSuffix)
+	require.NoError(t, os.WriteFile(stale, []byte("partial"), 0600))
+	c2, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	assert.NoFileExists(t, stale)
+	assert.NotContains(t, c2.item, "b"+dataTempSuffix)
+}
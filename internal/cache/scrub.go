@@ -0,0 +1,538 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tgdrive/varc/internal/types"
+	"github.com/tgdrive/varc/lib/file"
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+// Problem is a kind of problem found in the cache by the scrubber
+type Problem int
+
+// Problems the scrubber looks for
+const (
+	OrphanData      Problem = iota // data file with no metadata
+	OrphanMeta                     // metadata with no data file
+	BadMeta                        // metadata which can't be read
+	PartialMeta                    // metadata left half written by a crash
+	SizeMismatch                   // data file isn't the size in the metadata
+	RangesBeyondEOF                // metadata claims data past the end of the data file
+	ChecksumFailure                // chunk doesn't match its checksum
+)
+
+func (p Problem) String() string {
+	return [...]string{"orphan data", "orphan metadata", "bad metadata", "partial metadata",
+		"size mismatch", "ranges beyond EOF", "checksum failure"}[p]
+}
+
+// Action is what the scrubber did about a Finding
+type Action int
+
+// Actions the scrubber takes
+const (
+	Reported    Action = iota // left as it is
+	Repaired                  // fixed in place
+	Quarantined               // moved to the quarantine directory of the root
+	Removed                   // deleted
+)
+
+func (a Action) String() string {
+	return [...]string{"reported", "repaired", "quarantined", "removed"}[a]
+}
+
+// Finding is a problem found in the cache by the scrubber
+type Finding struct {
+	Root    string  // cache root it was found on
+	Name    string  // name of the item in the cache
+	Problem Problem // what is wrong
+	Detail  string  // more about the problem
+	Action  Action  // what was done about it
+}
+
+// Fixed returns true if something was done about the problem
+func (f Finding) Fixed() bool {
+	return f.Action != Reported
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s: %s (%s)", f.Root, f.Name, f.Problem, f.Detail, f.Action)
+}
+
+// checker checks the files of the cache, repairing them if repair is set
+type checker struct {
+	repair   bool
+	findings []Finding
+}
+
+// found records a problem with the item called name on root.
+//
+// If repairing, fix is called to deal with it and the Action it
+// returns is recorded, or the error is added to the detail.
+func (s *checker) found(root *cacheRoot, name string, problem Problem, detail string, fix func() (Action, error)) {
+	action := Reported
+	if s.repair {
+		var err error
+		action, err = fix()
+		if err != nil {
+			action = Reported
+			detail += fmt.Sprintf(": failed to %s: %v", problem.fixVerb(), err)
+		}
+	}
+	s.findings = append(s.findings, Finding{
+		Root:    root.path,
+		Name:    name,
+		Problem: problem,
+		Detail:  detail,
+		Action:  action,
+	})
+}
+
+// fixVerb describes what is done about the problem
+func (p Problem) fixVerb() string {
+	switch p {
+	case OrphanData, BadMeta:
+		return "quarantine"
+	case OrphanMeta, PartialMeta:
+		return "remove"
+	}
+	return "repair"
+}
+
+// quarantine moves the files of the item called name on root into the
+// quarantine directory of the root so they can be looked at.
+//
+// Metadata in a log can't be moved so it is removed.
+func quarantine(root *cacheRoot, name string) (Action, error) {
+	osPaths := []string{root.toOSPath(name)}
+	if _, ok := root.store.(*fileStore); ok {
+		osPaths = append(osPaths, root.toOSPathMeta(name))
+	} else if err := root.store.remove(name); err != nil {
+		return Reported, err
+	}
+	for _, osPath := range osPaths {
+		rel, err := filepath.Rel(root.path, osPath)
+		if err != nil {
+			return Reported, err
+		}
+		dst := filepath.Join(root.path, "quarantine", rel)
+		if err := file.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return Reported, err
+		}
+		if err := os.Rename(osPath, dst); err != nil && !os.IsNotExist(err) {
+			return Reported, err
+		}
+	}
+	return Quarantined, nil
+}
+
+// remove deletes the file at osPath
+func remove(osPath string) (Action, error) {
+	if err := os.Remove(osPath); err != nil && !os.IsNotExist(err) {
+		return Reported, err
+	}
+	return Removed, nil
+}
+
+// checkData checks info of the item called name on root against its
+// data file fd, repairing both if repairing.
+//
+// It returns true if info was changed.
+func (s *checker) checkData(root *cacheRoot, name string, info *Info, fd *os.File) (changed bool, err error) {
+	size, changed, err := s.checkSize(root, name, info, fd)
+	if err != nil {
+		return changed, err
+	}
+	for _, i := range info.chunksToCheck(size) {
+		sum, err := checksumRange(fd, info.chunkRange(i))
+		if err != nil {
+			return changed, err
+		}
+		if s.checkChunk(root, name, info, i, sum) {
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// checkSize checks the size of the data file fd against info of the
+// item called name on root, repairing both if repairing.
+//
+// It returns the size of the file and true if info was changed.
+func (s *checker) checkSize(root *cacheRoot, name string, info *Info, fd *os.File) (size int64, changed bool, err error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+	size = fi.Size()
+
+	// Ranges past the end of the file were never written
+	if n := len(info.Rs); n > 0 && info.Rs[n-1].End() > size {
+		s.found(root, name, RangesBeyondEOF, fmt.Sprintf("ranges end at %d but the file is %d bytes", info.Rs[n-1].End(), size), func() (Action, error) {
+			info.Rs = info.Rs.Intersection(ranges.Range{Pos: 0, Size: size})
+			info.dropChecksums(size, info.Size)
+			changed = true
+			return Repaired, nil
+		})
+	}
+
+	// The file should be exactly the size of the item
+	if info.Size >= 0 && size != info.Size {
+		s.found(root, name, SizeMismatch, fmt.Sprintf("metadata says %d bytes but the file is %d bytes", info.Size, size), func() (Action, error) {
+			if err := fd.Truncate(info.Size); err != nil {
+				return Reported, err
+			}
+			info.Rs = info.Rs.Intersection(ranges.Range{Pos: 0, Size: info.Size})
+			changed = true
+			return Repaired, nil
+		})
+	}
+	return size, changed, nil
+}
+
+// chunksToCheck returns the chunks of the item which can be checked
+// against their checksums in a data file of size bytes, in order.
+//
+// Dirty items are skipped as their data can't be downloaded again.
+func (info *Info) chunksToCheck(size int64) []int64 {
+	if info.Dirty || info.ChecksumChunk != checksumChunkSize {
+		return nil
+	}
+	chunks := make([]int64, 0, len(info.Checksums))
+	for i := range info.Checksums {
+		// chunks past the end of the file are reported by checkSize
+		if r := info.chunkRange(i); !r.IsEmpty() && r.End() <= size && info.Rs.Present(r) {
+			chunks = append(chunks, i)
+		}
+	}
+	slices.Sort(chunks)
+	return chunks
+}
+
+// checkChunk checks the checksum sum of chunk i of the item called
+// name on root against info, dropping the chunk if repairing.
+//
+// It returns true if info was changed.
+func (s *checker) checkChunk(root *cacheRoot, name string, info *Info, i int64, sum uint32) (changed bool) {
+	want := info.Checksums[i]
+	if sum == want {
+		return false
+	}
+	r := info.chunkRange(i)
+	s.found(root, name, ChecksumFailure, fmt.Sprintf("chunk %v has checksum %08x, expected %08x", r, sum, want), func() (Action, error) {
+		info.Rs.Remove(r)
+		delete(info.Checksums, i)
+		changed = true
+		return Repaired, nil
+	})
+	return changed
+}
+
+// Fsck checks the cache directories of opt, which must not be in use,
+// returning the problems found.
+//
+// If repair is set the problems are dealt with: metadata is fixed to
+// match the data, corrupt chunks are dropped so they are downloaded
+// again and files which can't be trusted are quarantined or removed.
+func Fsck(opt *types.Options, repair bool) ([]Finding, error) {
+	roots, err := newRoots(opt)
+	if err != nil {
+		return nil, err
+	}
+	s := &checker{repair: repair}
+	for _, root := range roots {
+		if err := s.fsckRoot(root); err != nil {
+			return s.findings, err
+		}
+	}
+	return s.findings, nil
+}
+
+// fsckRoot checks the files of root
+func (s *checker) fsckRoot(root *cacheRoot) (err error) {
+	// Look for metadata files left by a crash
+	err = walk(root.meta, func(osPath string, fi os.FileInfo, name string) error {
+		if !fi.IsDir() && strings.HasSuffix(name, metaTempSuffix) {
+			s.found(root, strings.TrimSuffix(name, metaTempSuffix), PartialMeta, "left by a crash while saving", func() (Action, error) {
+				return remove(osPath)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk cache %q: %w", root.meta, err)
+	}
+
+	// Use the metadata store found on disk whatever is configured so
+	// nothing is migrated
+	root.store = &fileStore{root: root}
+	logPath := filepath.Join(root.path, indexLogName)
+	if _, err := os.Stat(logPath); err == nil {
+		log, err := openLogStore(logPath, !s.repair, types.NopLogger())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := log.close(); err == nil {
+				err = closeErr
+			}
+		}()
+		if log.torn >= 0 {
+			s.found(root, indexLogName, PartialMeta, fmt.Sprintf("torn record at offset %d", log.torn), func() (Action, error) {
+				// cut off when opened
+				return Removed, nil
+			})
+		}
+		root.store = log
+	}
+
+	// Check the metadata and the data it describes
+	names, err := root.store.names()
+	if err != nil {
+		return fmt.Errorf("failed to read metadata in %q: %w", root.path, err)
+	}
+	hasMeta := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		hasMeta[name] = struct{}{}
+		if err := s.fsckItem(root, name); err != nil {
+			return err
+		}
+	}
+
+	// Then look for data with no metadata
+	return s.findOrphanData(root, new(sync.Mutex), func(name string) bool {
+		_, found := hasMeta[name]
+		return found
+	})
+}
+
+// findOrphanData looks for data files on root which known returns
+// false for, quarantining them if repairing.
+//
+// mu is held while each file is looked at so it can stop the name
+// coming into use before the file is dealt with.
+func (s *checker) findOrphanData(root *cacheRoot, mu sync.Locker, known func(name string) bool) error {
+	err := walk(root.data, func(osPath string, fi os.FileInfo, name string) error {
+		if fi.IsDir() {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !known(name) {
+			s.found(root, name, OrphanData, fmt.Sprintf("%d bytes with no metadata", fi.Size()), func() (Action, error) {
+				return quarantine(root, name)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk cache %q: %w", root.data, err)
+	}
+	return nil
+}
+
+// fsckItem checks the item called name on root which has metadata
+func (s *checker) fsckItem(root *cacheRoot, name string) (err error) {
+	var info Info
+	if _, err := root.store.load(name, &info); err != nil {
+		s.found(root, name, BadMeta, err.Error(), func() (Action, error) {
+			return quarantine(root, name)
+		})
+		return nil
+	}
+	flags := os.O_RDONLY
+	if s.repair {
+		flags = os.O_RDWR
+	}
+	fd, err := file.OpenFile(root.toOSPath(name), flags, 0600)
+	if os.IsNotExist(err) {
+		s.found(root, name, OrphanMeta, "the data file is missing", func() (Action, error) {
+			return Removed, root.store.remove(name)
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer checkCloseErr(fd, &err)
+	changed, err := s.checkData(root, name, &info, fd)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if changed {
+		err = fd.Sync()
+		if err == nil {
+			err = root.store.save(name, &info)
+		}
+	}
+	return err
+}
+
+// _scrubbable returns true if the item isn't in use so can be scrubbed
+//
+// call with lock held
+func (item *Item) _scrubbable() bool {
+	return item.opens == 0 && item.fd == nil && item.graceTimer == nil && item.pendingAccesses == 0 && !item.beingReset && item.info.Rs.Size() != 0
+}
+
+// scrub checks the files of the item, repairing them if repairing.
+//
+// The lock is released while each chunk is checksummed, and the scrub
+// stops if the item is used or changed meanwhile. Items which are in
+// use are skipped. It returns true if the data file is missing.
+func (item *Item) scrub(s *checker) (missing bool, err error) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+	if !item._scrubbable() {
+		return false, nil
+	}
+	flags := os.O_RDONLY
+	if s.repair {
+		flags = os.O_RDWR
+	}
+	root, modTime := item.root, item.info.ModTime
+	fd, err := file.OpenFile(root.toOSPath(item.name), flags, 0600)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer checkCloseErr(fd, &err)
+	size, changed, err := s.checkSize(root, item.name, &item.info, fd)
+	if err != nil {
+		return false, err
+	}
+	for _, i := range item.info.chunksToCheck(size) {
+		if changed {
+			if err = item._saveScrubbed(fd); err != nil {
+				return false, err
+			}
+			changed = false
+		}
+		r := item.info.chunkRange(i)
+		var sum uint32
+		unlockMutexForCall(&item.mu, func() {
+			sum, err = checksumRange(fd, r)
+		})
+		if err != nil {
+			return false, err
+		}
+		if !item._scrubbable() || item.root != root || !item.info.ModTime.Equal(modTime) || !slices.Contains(item.info.chunksToCheck(size), i) {
+			return false, nil
+		}
+		changed = s.checkChunk(root, item.name, &item.info, i, sum)
+	}
+	if changed {
+		err = item._saveScrubbed(fd)
+	}
+	return false, err
+}
+
+// _saveScrubbed saves the repairs made by scrub to the item with data
+// file fd
+//
+// call with lock held
+func (item *Item) _saveScrubbed(fd *os.File) error {
+	item._invalidateMem()
+	item.verified = nil
+	if err := fd.Sync(); err != nil {
+		return err
+	}
+	return item._save()
+}
+
+// scrub checks the files of the items in the cache which aren't in use
+// and looks for data files with no item, repairing the problems found
+func (c *Cache) scrub(ctx context.Context) {
+	c.mu.Lock()
+	items := make([]*Item, 0, len(c.item))
+	for _, item := range c.item {
+		items = append(items, item)
+	}
+	c.mu.Unlock()
+
+	s := &checker{repair: true}
+	for _, item := range items {
+		if ctx.Err() != nil {
+			return
+		}
+		missing, err := item.scrub(s)
+		if err != nil {
+			c.opt.Logger.Errorf("%s: cache: scrub failed: %v", item.name, err)
+		}
+		if missing {
+			s.found(item.root, item.name, OrphanMeta, "the data file is missing", func() (Action, error) {
+				c.Remove(item.name)
+				return Removed, nil
+			})
+		}
+	}
+	for _, root := range c.roots {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := c.scrubOrphanData(s, root); err != nil {
+			c.opt.Logger.Errorf("cache: scrub failed: %v", err)
+		}
+	}
+	for _, f := range s.findings {
+		c.opt.Logger.Errorf("cache: scrub: %v", f)
+	}
+	c.scrubs.Add(1)
+	c.scrubFindings.Add(int64(len(s.findings)))
+	c.opt.Logger.Infof("cache: scrubbed %d items, %d problems found", len(items), len(s.findings))
+}
+
+// scrubOrphanData looks for data files on root which no item or
+// metadata is for, such as those left by a crash
+func (c *Cache) scrubOrphanData(s *checker, root *cacheRoot) error {
+	names, err := root.store.names()
+	if err != nil {
+		return fmt.Errorf("failed to read metadata in %q: %w", root.path, err)
+	}
+	hasMeta := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		hasMeta[name] = struct{}{}
+	}
+	// Names are only added to c.item with c.mu held
+	return s.findOrphanData(root, &c.mu, func(name string) bool {
+		if strings.HasSuffix(name, dataTempSuffix) {
+			// being moved to this root
+			return true
+		}
+		if _, found := c.item[name]; found {
+			return true
+		}
+		_, found := hasMeta[name]
+		return found
+	})
+}
+
+// scrubber calls scrub every ScrubInterval
+//
+// doesn't return until context is cancelled
+func (c *Cache) scrubber(ctx context.Context) {
+	if c.opt.ScrubInterval <= 0 {
+		return
+	}
+	timer := time.NewTicker(c.opt.ScrubInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			c.scrub(ctx)
+		case <-ctx.Done():
+			c.opt.Logger.Debugf("cache: scrubber exiting")
+			return
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+// newScrubCache makes a cache in dir holding the whole of each of names
+func newScrubCache(t *testing.T, ctx context.Context, dir string, names ...string) (*Cache, *types.Options, []byte) {
+	opt := &types.Options{
+		CacheDir:     dir,
+		CacheMaxAge:  time.Hour,
+		ChunkStreams: 1,
+		Checksums:    true,
+	}
+	opt.Init()
+	c, err := New(ctx, opt, nil, nil)
+	require.NoError(t, err)
+	data := make([]byte, 3*checksumChunkSize)
+	for i := range data {
+		data[i] = byte(i / 3)
+	}
+	for _, name := range names {
+		item := c.Item(name)
+		require.NoError(t, item.Open(context.Background(), &memObject{data: data}))
+		_, err := item.ReadAt(make([]byte, len(data)), 0)
+		require.NoError(t, err)
+		require.NoError(t, item.Close(nil))
+	}
+	return c, opt, data
+}
+
+func corruptFile(t *testing.T, osPath string, off int64) {
+	fd, err := os.OpenFile(osPath, os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = fd.WriteAt([]byte("garbage"), off)
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+}
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, opt, _ := newScrubCache(t, ctx, dir, "ok", "short", "corrupt", "nodata")
+	cancel()
+
+	dataDir, metaDir := filepath.Join(dir, "data"), filepath.Join(dir, "meta")
+	require.NoError(t, os.Truncate(filepath.Join(dataDir, "short"), checksumChunkSize))
+	corruptFile(t, filepath.Join(dataDir, "corrupt"), 2*checksumChunkSize+10)
+	require.NoError(t, os.Remove(filepath.Join(dataDir, "nodata")))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "nometa"), []byte("data"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(metaDir, "bad"), []byte("{"), 0600))
+
+	problems := func(findings []Finding) map[string][]Problem {
+		out := map[string][]Problem{}
+		for _, f := range findings {
+			out[f.Name] = append(out[f.Name], f.Problem)
+		}
+		return out
+	}
+	want := map[string][]Problem{
+		"short":   {RangesBeyondEOF, SizeMismatch},
+		"corrupt": {ChecksumFailure},
+		"nodata":  {OrphanMeta},
+		"nometa":  {OrphanData},
+		"bad":     {BadMeta},
+	}
+
+	// Only reporting changes nothing
+	findings, err := Fsck(opt, false)
+	require.NoError(t, err)
+	assert.Equal(t, want, problems(findings))
+	for _, f := range findings {
+		assert.False(t, f.Fixed(), f.String())
+	}
+	findings, err = Fsck(opt, false)
+	require.NoError(t, err)
+	assert.Equal(t, want, problems(findings))
+
+	// Repairing deals with everything
+	findings, err = Fsck(opt, true)
+	require.NoError(t, err)
+	assert.Equal(t, want, problems(findings))
+	for _, f := range findings {
+		assert.True(t, f.Fixed(), f.String())
+	}
+	assert.FileExists(t, filepath.Join(dir, "quarantine", "data", "nometa"))
+	assert.FileExists(t, filepath.Join(dir, "quarantine", "meta", "bad"))
+	assert.NoFileExists(t, filepath.Join(metaDir, "nodata"))
+	findings, err = Fsck(opt, false)
+	require.NoError(t, err)
+	assert.Empty(t, findings)
+
+	// The repaired metadata only claims what is on disk
+	var info Info
+	_, err = loadInfo(filepath.Join(metaDir, "short"), &info)
+	require.NoError(t, err)
+	assert.Equal(t, int64(checksumChunkSize), info.Rs.Size())
+	_, err = loadInfo(filepath.Join(metaDir, "corrupt"), &info)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*checksumChunkSize), info.Rs.Size())
+	assert.Len(t, info.Checksums, 2)
+}
+
+func TestScrub(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _, data := newScrubCache(t, ctx, dir, "ok", "corrupt")
+	corruptFile(t, filepath.Join(dir, "data", "corrupt"), 10)
+
+	c.scrub(ctx)
+	assert.Equal(t, int64(1), c.Stats()["scrubs"])
+	assert.Equal(t, int64(1), c.Stats()["scrubFindings"])
+	item := c.Item("corrupt")
+	assert.Equal(t, int64(2*checksumChunkSize), item.getDiskSize())
+
+	// The chunk is downloaded again when read
+	o := &memObject{data: data}
+	require.NoError(t, item.Open(context.Background(), o))
+	buf := make([]byte, 100)
+	_, err := item.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, data[:100], buf)
+	assert.Equal(t, int64(1), o.opens.Load())
+	require.NoError(t, item.Close(nil))
+
+	// Items in use are skipped
+	require.NoError(t, item.Open(context.Background(), o))
+	corruptFile(t, filepath.Join(dir, "data", "corrupt"), 2*checksumChunkSize)
+	c.scrub(ctx)
+	assert.Equal(t, int64(1), c.Stats()["scrubFindings"])
+	require.NoError(t, item.Close(nil))
+	c.scrub(ctx)
+	assert.Equal(t, int64(2), c.Stats()["scrubFindings"])
+}
+
+func TestScrubOrphans(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, _, _ := newScrubCache(t, ctx, dir, "ok", "nodata")
+	dataDir := filepath.Join(dir, "data")
+	require.NoError(t, os.Remove(filepath.Join(dataDir, "nodata")))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "nometa"), []byte("data"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dataDir, "moving"+dataTempSuffix), []byte("data"), 0600))
+
+	c.scrub(ctx)
+	assert.Equal(t, int64(2), c.Stats()["scrubFindings"])
+	assert.FileExists(t, filepath.Join(dir, "quarantine", "data", "nometa"))
+	assert.FileExists(t, filepath.Join(dataDir, "moving"+dataTempSuffix))
+	assert.FileExists(t, filepath.Join(dataDir, "ok"))
+	c.mu.Lock()
+	_, found := c.item["nodata"]
+	c.mu.Unlock()
+	assert.False(t, found, "item with no data is still in the cache")
+
+	c.scrub(ctx)
+	assert.Equal(t, int64(2), c.Stats()["scrubFindings"])
+}
@@ -73,6 +73,7 @@ type writeBackItem struct {
 	putFn     PutFn              // To write the object data
 	tries     int                // number of times we have tried to upload
 	delay     time.Duration      // delay between upload attempts
+	err       error              // error from the last upload attempt if it failed
 }
 
 // A writeBackItems implements a priority queue by implementing
@@ -359,7 +360,11 @@ func (wb *WriteBack) upload(ctx context.Context, wbItem *writeBackItem) {
 	wbItem.uploading = false
 	wb.uploads--
 
-	if err != nil {
+	if errors.Is(err, types.ErrRejected) {
+		// The upstream won't take it so there's no point retrying
+		wb.opt.Logger.Errorf("cache: upload rejected try #%d, dropping it: %v", wbItem.tries, err)
+		wb._delItem(wbItem)
+	} else if err != nil {
 		// FIXME should this have a max number of transfer attempts?
 		wbItem.delay *= 2
 		if wbItem.delay > maxUploadDelay {
@@ -371,6 +376,7 @@ func (wb *WriteBack) upload(ctx context.Context, wbItem *writeBackItem) {
 			wbItem.delay = time.Duration(wb.opt.WriteBack)
 		} else {
 			wb.opt.Logger.Infof("cache: failed to upload try #%d, will retry in %v: %v", wbItem.tries, wbItem.delay, err)
+			wbItem.err = err
 		}
 		// push the item back on the queue for retry
 		wb._pushItem(wbItem)
@@ -467,13 +473,14 @@ func (wb *WriteBack) Stats() (uploadsInProgress, uploadsQueued int) {
 // QueueInfo is information about an item queued for upload, returned
 // by Queue
 type QueueInfo struct {
-	Name      string  `json:"name"`      // name (full path) of the file,
-	ID        Handle  `json:"id"`        // id of queue item
-	Size      int64   `json:"size"`      // integer size of the file in bytes
-	Expiry    float64 `json:"expiry"`    // seconds from now which the file is eligible for transfer, oldest goes first
-	Tries     int     `json:"tries"`     // number of times we have tried to upload
-	Delay     float64 `json:"delay"`     // delay between upload attempts (s)
-	Uploading bool    `json:"uploading"` // true if item is being uploaded
+	Name      string  `json:"name"`            // name (full path) of the file,
+	ID        Handle  `json:"id"`              // id of queue item
+	Size      int64   `json:"size"`            // integer size of the file in bytes
+	Expiry    float64 `json:"expiry"`          // seconds from now which the file is eligible for transfer, oldest goes first
+	Tries     int     `json:"tries"`           // number of times we have tried to upload
+	Delay     float64 `json:"delay"`           // delay between upload attempts (s)
+	Uploading bool    `json:"uploading"`       // true if item is being uploaded
+	Error     string  `json:"error,omitempty"` // error from the last failed upload attempt
 }
 
 // Queue return info about the current upload queue
@@ -486,7 +493,7 @@ func (wb *WriteBack) Queue() []QueueInfo {
 
 	// Lookup all the items in no particular order
 	for _, wbItem := range wb.lookup {
-		items = append(items, QueueInfo{
+		info := QueueInfo{
 			Name:      wbItem.name,
 			ID:        wbItem.id,
 			Size:      wbItem.size,
@@ -494,7 +501,11 @@ func (wb *WriteBack) Queue() []QueueInfo {
 			Tries:     wbItem.tries,
 			Delay:     wbItem.delay.Seconds(),
 			Uploading: wbItem.uploading,
-		})
+		}
+		if wbItem.err != nil {
+			info.Error = wbItem.err.Error()
+		}
+		items = append(items, info)
 	}
 
 	// Sort by Uploading first then Expiry
@@ -508,9 +519,14 @@ func (wb *WriteBack) Queue() []QueueInfo {
 	return items
 }
 
-// ErrorIDNotFound is returned from SetExpiry when the item is not found
+// ErrorIDNotFound is returned from SetExpiry and Cancel when the item
+// is not found
 var ErrorIDNotFound = errors.New("id not found in queue")
 
+// ErrorNotUploading is returned from Cancel when the item is waiting
+// to be uploaded rather than being uploaded
+var ErrorNotUploading = errors.New("item is not being uploaded")
+
 // SetExpiry sets the expiry time for an item in the writeback queue.
 //
 // id should be as returned from the Queue call
@@ -534,8 +550,34 @@ func (wb *WriteBack) SetExpiry(id Handle, expiry time.Time, relative time.Durati
 	}
 	expiry = expiry.Add(relative)
 
-	// Update the expiry with the user requested value
-	wb.items._update(wbItem, expiry)
+	// Update the expiry with the user requested value - items being
+	// uploaded aren't on the heap and are given a new expiry if the
+	// upload fails
+	if wbItem.onHeap {
+		wb.items._update(wbItem, expiry)
+	} else {
+		wbItem.expiry = expiry
+	}
 	wb._resetTimer()
 	return nil
 }
+
+// Cancel cancels the upload of an item in the writeback queue.
+//
+// id should be as returned from the Queue call
+//
+// The item stays in the queue and the upload is tried again after the
+// write back delay. If the item isn't found then it will return
+// ErrorIDNotFound and if it isn't being uploaded ErrorNotUploading.
+func (wb *WriteBack) Cancel(id Handle) error {
+	wb.mu.Lock()
+	_, ok := wb.lookup[id]
+	wb.mu.Unlock()
+	if !ok {
+		return ErrorIDNotFound
+	}
+	if !wb.cancelUpload(id) {
+		return ErrorNotUploading
+	}
+	return nil
+}
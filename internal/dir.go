@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"container/list"
 	"fmt"
 	"os"
 	"strings"
@@ -17,6 +18,9 @@ type Dir struct {
 	name   string // the directory name relative to the root
 	modTime time.Time
 	children map[string]Node // direct children known to this engine
+	files    *list.List      // of the *File children, most recently used first
+	evicted  int64           // number of file nodes dropped to keep within Opt.MaxNodes
+	released int64           // number of file nodes dropped as their cache item was removed
 }
 
 // newDir creates a new directory
@@ -29,6 +33,7 @@ func newDir(eng *Engine, parent *Dir, name string) *Dir {
 		name:     name,
 		modTime:  time.Now(),
 		children: make(map[string]Node),
+		files:    list.New(),
 	}
 	return d
 }
@@ -127,10 +132,68 @@ func (d *Dir) Open(flags int) (Handle, error) {
 }
 
 // AddChild adds a child node to the directory
+//
+// If this takes the number of files over Opt.MaxNodes the least
+// recently used ones without open handles are dropped. They are made
+// again from the cache if they are used later.
 func (d *Dir) AddChild(name string, node Node) {
 	d.mu.Lock()
+	defer d.mu.Unlock()
+	d._removeChild(name)
 	d.children[name] = node
-	d.mu.Unlock()
+	if f, ok := node.(*File); ok {
+		f.elem = d.files.PushFront(f)
+	}
+	maxNodes := d.engine.Opt.MaxNodes
+	if maxNodes <= 0 {
+		return
+	}
+	for e := d.files.Back(); e != nil && d.files.Len() > maxNodes; {
+		prev := e.Prev()
+		if f := e.Value.(*File); f.opens.Load() == 0 {
+			d._removeChild(f.name)
+			d.evicted++
+		}
+		e = prev
+	}
+}
+
+// RemoveChild removes the child node called name from the directory,
+// returning false if there wasn't one
+//
+// Open handles on the node carry on working.
+func (d *Dir) RemoveChild(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d._removeChild(name) {
+		return false
+	}
+	d.released++
+	return true
+}
+
+// _removeChild removes the child node called name
+//
+// call with mu held
+func (d *Dir) _removeChild(name string) bool {
+	node, found := d.children[name]
+	if !found {
+		return false
+	}
+	delete(d.children, name)
+	if f, ok := node.(*File); ok && f.elem != nil {
+		d.files.Remove(f.elem)
+		f.elem = nil
+	}
+	return true
+}
+
+// nodeStats returns the number of child nodes and how many have been
+// dropped to keep within Opt.MaxNodes or as their cache item was removed
+func (d *Dir) nodeStats() (nodes, evicted, released int64) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return int64(len(d.children)), d.evicted, d.released
 }
 
 // Stat finds the Node by path starting from this directory
@@ -141,9 +204,12 @@ func (d *Dir) Stat(filePath string) (node Node, err error) {
 	}
 
 	// Look for the file directly
-	d.mu.RLock()
+	d.mu.Lock()
 	node, found := d.children[filePath]
-	d.mu.RUnlock()
+	if f, ok := node.(*File); ok && f.elem != nil {
+		d.files.MoveToFront(f.elem)
+	}
+	d.mu.Unlock()
 	if found {
 		return node, nil
 	}
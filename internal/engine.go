@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/tgdrive/varc/internal/cache"
+	"github.com/tgdrive/varc/internal/cache/writeback"
 	"github.com/tgdrive/varc/internal/types"
 )
 
@@ -125,15 +126,16 @@ var (
 
 // Engine represents the top level caching engine
 type Engine struct {
-	ctx         context.Context
-	root        *Dir
-	Opt         types.Options
-	cache       *cache.Cache
-	cancel      context.CancelFunc
-	usageMu     sync.Mutex
-	usageTime   time.Time
-	pollChan    chan time.Duration
-	inUse       atomic.Int32
+	ctx       context.Context
+	root      *Dir
+	Opt       types.Options
+	cache     *cache.Cache
+	cancel    context.CancelFunc
+	usageMu   sync.Mutex
+	usageTime time.Time
+	pollChan  chan time.Duration
+	inUse     atomic.Int32
+	readAhead *readAheadBudget
 }
 
 // New creates a new Engine and root directory.
@@ -150,18 +152,20 @@ func New(ctx context.Context, opt *types.Options) (*Engine, error) {
 	}
 
 	eng.Opt.Init()
+	eng.readAhead = &readAheadBudget{max: eng.Opt.ReadAheadTotal}
+
+	// Create root directory before the cache as it may release the
+	// nodes of the items it removes straight away
+	eng.root = newDir(eng, nil, "/")
 
 	// Create cache
-	ccache, err := cache.New(ctx, &eng.Opt, eng.addVirtual)
+	ccache, err := cache.New(ctx, &eng.Opt, eng.addVirtual, eng.removeNode)
 	if err != nil {
 		cancel()
 		return nil, fmt.Errorf("engine: failed to create cache: %w", err)
 	}
 	eng.cache = ccache
 
-	// Create root directory
-	eng.root = newDir(eng, nil, "/")
-
 	return eng, nil
 }
 
@@ -178,6 +182,12 @@ func (e *Engine) addVirtual(remote string, size int64, isDir bool) error {
 	return nil
 }
 
+// removeNode is called when the cache removes an item to release the
+// node of the item in the engine tree
+func (e *Engine) removeNode(remote string) {
+	e.root.RemoveChild(remote)
+}
+
 // Root returns the root directory
 func (e *Engine) Root() *Dir {
 	return e.root
@@ -247,7 +257,12 @@ func (e *Engine) Open(path string) (Handle, error) {
 
 // OpenCached opens a file for reading, optionally associating a RemoteObject
 // for cache population. If obj is nil, only the local cache is used.
-func (e *Engine) OpenCached(filePath string, obj types.RemoteObject) (Handle, error) {
+//
+// Reads through the handle give up when ctx is done. The downloads
+// they start are shared with the other readers of the file, and are
+// stopped after the DownloadLinger period once the contexts of all its
+// handles are done or the handles are closed.
+func (e *Engine) OpenCached(ctx context.Context, filePath string, obj types.RemoteObject) (Handle, error) {
 	filePath = strings.Trim(filePath, "/")
 	if filePath == "" {
 		return nil, os.ErrInvalid
@@ -260,24 +275,79 @@ func (e *Engine) OpenCached(filePath string, obj types.RemoteObject) (Handle, er
 	}
 
 	// Open the cache item with the remote object if provided
+	ctx, cancel := context.WithCancel(ctx)
 	if obj != nil {
-		if err := item.Open(obj); err != nil {
+		if err := item.Open(ctx, obj); err != nil {
+			cancel()
 			return nil, fmt.Errorf("failed to open cache item: %w", err)
 		}
 	}
 
 	// Ensure the file node exists in the engine tree
-	_, err := e.root.Stat(filePath)
+	f, err := e.file(filePath, item)
+	if err == nil {
+		var fh *ReadFileHandle
+		fh, err = newReadFileHandle(ctx, f)
+		if err == nil {
+			fh.cancel = cancel
+			if obj != nil {
+				// The handle closes the item when it is closed
+				fh.opened = item
+			}
+			return fh, nil
+		}
+	}
+	cancel()
+	if obj != nil {
+		_ = item.Close(nil)
+	}
+	return nil, err
+}
+
+// OpenWrite opens filePath for writing through the cache, replacing
+// its content. When the handle is closed what was written is uploaded
+// to obj, which must implement types.RemoteUpdater, before Close
+// returns if writeThrough is set or in the background after the write
+// back delay if not.
+func (e *Engine) OpenWrite(filePath string, obj types.RemoteObject, writeThrough bool) (*WriteFileHandle, error) {
+	filePath = strings.Trim(filePath, "/")
+	if filePath == "" {
+		return nil, os.ErrInvalid
+	}
+	if _, ok := obj.(types.RemoteUpdater); !ok {
+		return nil, fmt.Errorf("%w: %v can't be written to", os.ErrInvalid, obj)
+	}
+
+	item := e.cache.Item(filePath)
+	// Writers don't wait on downloads so don't hold them open
+	if err := item.Open(context.Background(), obj); err != nil {
+		return nil, fmt.Errorf("failed to open cache item: %w", err)
+	}
+	f, err := e.file(filePath, item)
 	if err != nil {
-		d := e.root
-		f := newFile(e.ctx, d, filePath)
+		_ = item.Abort()
+		return nil, err
+	}
+	return newWriteFileHandle(f, item, writeThrough)
+}
+
+// file returns the File for filePath in the engine tree, adding it if
+// it isn't there
+func (e *Engine) file(filePath string, item *cache.Item) (*File, error) {
+	node, err := e.root.Stat(filePath)
+	if err != nil {
+		f := newFile(e.ctx, e.root, filePath)
 		if size, err := item.GetSize(); err == nil {
 			f.size.Store(size)
 		}
-		d.AddChild(filePath, f)
+		e.root.AddChild(filePath, f)
+		return f, nil
 	}
-
-	return e.root.OpenFile(filePath, os.O_RDONLY, 0)
+	f, ok := node.(*File)
+	if !ok {
+		return nil, fmt.Errorf("%w: is a directory", os.ErrInvalid)
+	}
+	return f, nil
 }
 
 // CacheItem returns the cache item for a path, creating it if needed
@@ -285,6 +355,17 @@ func (e *Engine) CacheItem(path string) *cache.Item {
 	return e.cache.Item(path)
 }
 
+// CompleteInBackground records a partial read of filePath from obj,
+// fetching the rest of the file in the background if the completion
+// policy in the options allows it.
+func (e *Engine) CompleteInBackground(filePath string, obj types.RemoteObject) bool {
+	filePath = strings.Trim(filePath, "/")
+	if filePath == "" || e.cache == nil {
+		return false
+	}
+	return e.cache.CompleteInBackground(filePath, obj)
+}
+
 // Remove removes an item from the cache by name.
 // Returns nil on success. If the cache is nil, returns nil.
 func (e *Engine) Remove(name string) error {
@@ -295,10 +376,71 @@ func (e *Engine) Remove(name string) error {
 	return nil
 }
 
+// Ready returns true once the cache has loaded everything on disk so
+// its usage is accounted for.
+func (e *Engine) Ready() bool {
+	return e.cache == nil || e.cache.Ready()
+}
+
+// Entries calls fn with each item stored in the cache in name order
+// until it returns false.
+func (e *Engine) Entries(fn func(cache.Entry) bool) {
+	if e.cache != nil {
+		e.cache.Entries(fn)
+	}
+}
+
+// Entry returns the Entry describing the cached file at path, or false
+// if it isn't stored in the cache.
+func (e *Engine) Entry(path string) (entry cache.Entry, ok bool) {
+	path = strings.Trim(path, "/")
+	if e.cache == nil || path == "" {
+		return entry, false
+	}
+	return e.cache.Entry(path)
+}
+
+// Subscribe returns a channel the events of the cache are sent to and
+// a function to call to stop them. Events are dropped rather than wait
+// for a subscriber which is behind by more than buffer events.
+func (e *Engine) Subscribe(buffer int) (events <-chan cache.Event, cancel func()) {
+	return e.cache.Subscribe(buffer)
+}
+
+// Queue returns the items waiting to be uploaded or being uploaded,
+// those being uploaded first then in the order they will be uploaded.
+func (e *Engine) Queue() []writeback.QueueInfo {
+	if e.cache == nil {
+		return nil
+	}
+	return e.cache.QueueItems()
+}
+
+// QueueUploadNow makes the item with id in the upload queue eligible
+// for upload straight away.
+func (e *Engine) QueueUploadNow(id writeback.Handle) error {
+	if e.cache == nil {
+		return writeback.ErrorIDNotFound
+	}
+	return e.cache.QueueUploadNow(id)
+}
+
+// QueueCancel cancels the upload in progress of the item with id in
+// the upload queue, which is tried again after the write back delay.
+func (e *Engine) QueueCancel(id writeback.Handle) error {
+	if e.cache == nil {
+		return writeback.ErrorIDNotFound
+	}
+	return e.cache.QueueCancel(id)
+}
+
 // Stats returns cache statistics from the underlying cache engine.
 func (e *Engine) Stats() map[string]interface{} {
 	if e.cache == nil {
 		return map[string]interface{}{}
 	}
-	return e.cache.Stats()
+	out := e.cache.Stats()
+	out["readAheadInFlight"] = e.readAhead.inFlight()
+	out["nodes"], out["nodesEvicted"], out["nodesReleased"] = e.root.nodeStats()
+	return out
 }
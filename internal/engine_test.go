@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+func TestEngineNodes(t *testing.T) {
+	e, err := New(context.Background(), &types.Options{CacheDir: t.TempDir(), MaxNodes: 3})
+	require.NoError(t, err)
+	defer func() { _ = e.Close() }()
+
+	nodes := func() (n, evicted, released int64) {
+		stats := e.Stats()
+		return stats["nodes"].(int64), stats["nodesEvicted"].(int64), stats["nodesReleased"].(int64)
+	}
+	add := func(name string) *File {
+		f, err := e.file(name, e.CacheItem(name))
+		require.NoError(t, err)
+		return f
+	}
+	has := func(name string) bool {
+		e.root.mu.RLock()
+		defer e.root.mu.RUnlock()
+		_, found := e.root.children[name]
+		return found
+	}
+
+	// Files which are open are kept, the least recently used of the
+	// others are dropped
+	open := add("a")
+	open.opens.Add(1)
+	add("b")
+	add("c")
+	_, err = e.Stat("b")
+	require.NoError(t, err)
+	add("d0")
+	assert.True(t, has("a"))
+	assert.True(t, has("b"))
+	assert.False(t, has("c"))
+	for i := 1; i < 3; i++ {
+		add(fmt.Sprintf("d%d", i))
+	}
+	n, evicted, _ := nodes()
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, int64(3), evicted)
+	assert.True(t, has("a"))
+	assert.False(t, has("b"))
+
+	// Nodes are released with their cache items
+	require.NoError(t, e.Remove("d2"))
+	assert.False(t, has("d2"))
+	n, _, released := nodes()
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, int64(1), released)
+
+	// and made again when they are next used
+	f := add("d2")
+	assert.True(t, has("d2"))
+	assert.Same(t, f, add("d2"))
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"container/list"
 	"context"
 	"os"
 	"sync"
@@ -15,6 +16,8 @@ type File struct {
 	inode uint64          // inode number - read only
 	size  atomic.Int64    // size of file
 	ctx   context.Context // context for engine operations - read only
+	opens atomic.Int32    // number of open handles - the node isn't dropped while there are any
+	elem  *list.Element   // in the files of the parent - protected by d.mu
 
 	muRW sync.Mutex // synchronize RWFileHandle.openPending(), RWFileHandle.close() and File.Remove
 
@@ -109,7 +112,7 @@ func (f *File) DirEntry() os.FileInfo {
 func (f *File) Open(flags int) (fh Handle, err error) {
 	switch flags & accessModeMask {
 	case os.O_RDONLY:
-		return newReadFileHandle(f)
+		return newReadFileHandle(f.ctx, f)
 	// For simplicity, write modes return error
 	default:
 		return nil, EPERM
@@ -8,29 +8,35 @@ import (
 	"sync"
 	"time"
 
+	"github.com/tgdrive/varc/internal/cache"
 	"github.com/tgdrive/varc/internal/chunkedreader"
 )
 
 // ReadFileHandle represents a file handle for reading
 type ReadFileHandle struct {
 	*baseHandle
-	ctx        context.Context
-	mu         sync.Mutex
-	closed     bool
-	f          *File
-	offset     int64
-	size       int64
+	ctx           context.Context
+	mu            sync.Mutex
+	closed        bool
+	f             *File
+	offset        int64
+	size          int64
+	readAhead     readAhead
 	chunkedReader chunkedreader.ChunkedReader
+	opened        *cache.Item        // item opened for this handle, closed with it
+	cancel        context.CancelFunc // if set called on close to end the interest in the item's downloads
 }
 
-// newReadFileHandle creates a new read file handle
-func newReadFileHandle(f *File) (*ReadFileHandle, error) {
+// newReadFileHandle creates a new read file handle whose reads give up
+// when ctx is done
+func newReadFileHandle(ctx context.Context, f *File) (*ReadFileHandle, error) {
 	h := &ReadFileHandle{
 		baseHandle: &baseHandle{},
-		ctx:        f.ctx,
+		ctx:        ctx,
 		f:          f,
 		size:       f.Size(),
 		offset:     0,
+		readAhead:  newReadAhead(f.d.engine.readAhead, f.d.engine.Opt.ReadAheadMax),
 	}
 
 	// Try to open via cache first
@@ -42,8 +48,10 @@ func newReadFileHandle(f *File) (*ReadFileHandle, error) {
 
 	// Open the cache item with the remote object if available
 	if f.remote != nil {
-		err := item.Open(f.remote)
+		h.ctx, h.cancel = context.WithCancel(ctx)
+		err := item.Open(h.ctx, f.remote)
 		if err != nil {
+			h.cancel()
 			return nil, fmt.Errorf("cache read: failed to open cache item: %w", err)
 		}
 		h.size = f.remote.Size()
@@ -53,7 +61,9 @@ func newReadFileHandle(f *File) (*ReadFileHandle, error) {
 	if sz, err := item.GetSize(); err == nil {
 		h.size = sz
 	}
+	item.Touch()
 
+	f.opens.Add(1)
 	return h, nil
 }
 
@@ -101,7 +111,10 @@ func (fh *ReadFileHandle) ReadAt(p []byte, off int64) (n int, err error) {
 func (fh *ReadFileHandle) readAt(p []byte, off int64) (n int, err error) {
 	item := fh.f.d.engine.cache.Item(fh.f.Path())
 	if item != nil {
-		return item.ReadAt(p, off)
+		if fh.readAhead.enabled() {
+			return item.ReadAtAhead(fh.ctx, p, off, fh.readAhead.update(off, int64(len(p))))
+		}
+		return item.ReadAtAhead(fh.ctx, p, off, fh.f.d.engine.Opt.ReadAhead)
 	}
 	return 0, io.EOF
 }
@@ -136,6 +149,16 @@ func (fh *ReadFileHandle) Close() error {
 		return os.ErrClosed
 	}
 	fh.closed = true
+	fh.f.opens.Add(-1)
+	if fh.readAhead.enabled() {
+		fh.readAhead.release()
+	}
+	if fh.cancel != nil {
+		fh.cancel()
+	}
+	if fh.opened != nil {
+		return fh.opened.Close(nil)
+	}
 	return nil
 }
 
@@ -0,0 +1,95 @@
+package internal
+
+import "sync"
+
+// readAheadStart is the read ahead given to a handle once it has been
+// seen reading sequentially. It doubles each time the reader catches
+// up with it.
+const readAheadStart = 1024 * 1024
+
+// readAheadBudget caps the read ahead reserved by all the open handles
+// so many sequential readers can't flood the upstream between them.
+type readAheadBudget struct {
+	mu   sync.Mutex
+	max  int64 // maximum total read ahead, <= 0 for no limit
+	used int64 // read ahead reserved by open handles
+}
+
+// resize changes a reservation of have bytes to want bytes. It returns
+// the new reservation which may be less than want if the budget is
+// used up.
+func (b *readAheadBudget) resize(have, want int64) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if want > have && b.max > 0 {
+		want = min(want, have+max(b.max-b.used, 0))
+	}
+	b.used += want - have
+	return want
+}
+
+// inFlight returns the read ahead reserved by all the open handles
+func (b *readAheadBudget) inFlight() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// readAhead sizes the read ahead for a single handle from its access
+// pattern, growing it while the reads are sequential and shrinking it
+// when the reader seeks.
+type readAhead struct {
+	budget *readAheadBudget
+	max    int64 // maximum read ahead for this handle
+	next   int64 // offset just past the last read, -1 before the first
+	mark   int64 // offset which grows the window when reached
+	window int64 // current read ahead, reserved from budget
+}
+
+// newReadAhead returns the read ahead state for a new handle
+func newReadAhead(budget *readAheadBudget, maxReadAhead int64) readAhead {
+	return readAhead{
+		budget: budget,
+		max:    maxReadAhead,
+		next:   -1,
+	}
+}
+
+// enabled returns true if the read ahead is adaptive
+func (ra *readAhead) enabled() bool {
+	return ra.max > 0 && ra.budget != nil
+}
+
+// update records a read of size bytes at off and returns the read ahead
+// to use for it.
+func (ra *readAhead) update(off, size int64) int64 {
+	want := ra.window
+	switch {
+	case ra.next < 0:
+		// First read - nothing known about the pattern yet
+	case off == ra.next:
+		if want == 0 {
+			want = min(readAheadStart, ra.max)
+			ra.mark = off
+		} else if off >= ra.mark {
+			want = min(want*2, ra.max)
+		}
+		if off >= ra.mark {
+			ra.mark = off + want
+		}
+	default:
+		// A seek so the read ahead is likely to be wasted
+		want /= 2
+		if want < readAheadStart {
+			want = 0
+		}
+	}
+	ra.window = ra.budget.resize(ra.window, want)
+	ra.next = off + size
+	return ra.window
+}
+
+// release gives the read ahead back to the budget
+func (ra *readAhead) release() {
+	ra.window = ra.budget.resize(ra.window, 0)
+}
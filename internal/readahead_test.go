@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAheadGrowsAndShrinks(t *testing.T) {
+	const mib = 1024 * 1024
+	budget := &readAheadBudget{}
+	ra := newReadAhead(budget, 8*mib)
+
+	// The first read says nothing about the access pattern
+	assert.Equal(t, int64(0), ra.update(0, mib))
+
+	// Sequential reads start the read ahead then double it each
+	// time the reader catches up with it
+	assert.Equal(t, int64(mib), ra.update(mib, mib))
+	assert.Equal(t, int64(2*mib), ra.update(2*mib, mib))
+	assert.Equal(t, int64(2*mib), ra.update(3*mib, mib))
+	assert.Equal(t, int64(4*mib), ra.update(4*mib, mib))
+	var got int64
+	for off := int64(5 * mib); off < 32*mib; off += mib {
+		got = ra.update(off, mib)
+	}
+	assert.Equal(t, int64(8*mib), got, "read ahead should be capped")
+	assert.Equal(t, int64(8*mib), budget.inFlight())
+
+	// Seeks shrink it until it is turned off
+	assert.Equal(t, int64(4*mib), ra.update(100*mib, mib))
+	assert.Equal(t, int64(2*mib), ra.update(10*mib, mib))
+	assert.Equal(t, int64(mib), ra.update(50*mib, mib))
+	assert.Equal(t, int64(0), ra.update(0, mib))
+	assert.Equal(t, int64(0), budget.inFlight())
+}
+
+func TestReadAheadBudget(t *testing.T) {
+	const mib = 1024 * 1024
+	budget := &readAheadBudget{max: 3 * mib}
+	a := newReadAhead(budget, 2*mib)
+	b := newReadAhead(budget, 2*mib)
+
+	for off := int64(0); off < 8*mib; off += mib {
+		a.update(off, mib)
+	}
+	assert.Equal(t, int64(2*mib), a.window)
+
+	// b only gets what is left of the budget
+	for off := int64(0); off < 8*mib; off += mib {
+		b.update(off, mib)
+	}
+	assert.Equal(t, int64(mib), b.window)
+	assert.Equal(t, int64(3*mib), budget.inFlight())
+
+	// Closing a handle gives its read ahead back
+	a.release()
+	assert.Equal(t, int64(mib), budget.inFlight())
+	b.update(8*mib, mib)
+	b.update(9*mib, mib)
+	assert.Equal(t, int64(2*mib), b.window)
+	b.release()
+	assert.Equal(t, int64(0), budget.inFlight())
+}
@@ -15,14 +15,50 @@ type Options struct {
 	CachePollInterval time.Duration
 	WriteBack         time.Duration // time to wait before writing back dirty files
 	ReadAhead         int64         // bytes to read ahead in cache mode "full"
+	ReadAheadMax      int64         // if > 0 adapt read ahead per handle up to this for sequential reads
+	ReadAheadTotal    int64         // if > 0 limit on adaptive read ahead across all handles
 	FastFingerprint   bool          // if set use fast fingerprints
 	HandleCaching     time.Duration // time to keep handle alive after last close
+	DownloadLinger    time.Duration // time downloads carry on for after the last client has gone
 	CacheDir          string        // path to the cache directory on local disk
+	CacheRoots        []CacheRoot   // if set spread the cache over these instead of CacheDir
+	EvictionPolicy    string        // which items to evict first: lru (default), lfu, tinylfu or gdsf
+	EvictRanges       bool          // drop cold chunks of large files before evicting whole files
+	EvictRangeSize    int64         // size of the chunks access is tracked and evicted in
+	MemCacheSize      int64         // if > 0 keep hot blocks of items in this much memory
+	MemCacheMinHits   int           // reads of a block before it is kept in memory
+	QuotaGroups       []QuotaGroup  // groups of items with their own limits
+	Checksums         bool          // keep checksums of chunks from the remote and verify them when read
+	ScrubInterval     time.Duration // if > 0 check and repair the items not in use this often
+	MetaStore         string        // how item metadata is stored: files (default) or log
+	LazyReload        bool          // load the items on disk in the background rather than before starting
+	MaxNodes          int           // if > 0 limit on the file nodes the engine keeps in memory
+
+	CompleteInBackground bool  // fetch the rest of partially read files in the background
+	CompleteMinSize      int64 // don't complete files smaller than this
+	CompleteMaxSize      int64 // if > 0 don't complete files larger than this
+	CompleteMinHits      int   // number of partial reads before a file is completed
 
 	// Logger is the logging backend. If nil, all log output is suppressed.
 	Logger Logger
 }
 
+// CacheRoot is one of the directories the cache is spread over
+type CacheRoot struct {
+	Path    string // directory on local disk
+	Weight  int    // share of the new items in its tier placed here, 1 if not set
+	MaxSize int64  // if > 0 limit on the bytes stored here
+	Tier    int    // lower tiers are faster - items are demoted to the next tier when evicted
+}
+
+// QuotaGroup is a group of items in the cache, eg from one origin, with
+// its own limits enforced alongside the global ones
+type QuotaGroup struct {
+	Name    string        // name items are put in the group with
+	MaxSize int64         // if > 0 limit on the bytes stored by the group
+	MaxAge  time.Duration // if > 0 used for the group instead of CacheMaxAge
+}
+
 // Opt is the default options
 var Opt = Options{
 	CachePollInterval: 60 * time.Second,
@@ -33,6 +69,8 @@ var Opt = Options{
 	ChunkSizeLimit:    -1,
 	WriteBack:         5 * time.Second,
 	HandleCaching:     5 * time.Second,
+	DownloadLinger:    5 * time.Second,
+	MaxNodes:          100000,
 }
 
 // Init checks options and sets defaults
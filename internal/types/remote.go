@@ -2,6 +2,7 @@ package types
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -35,3 +36,16 @@ type RemoteObject interface {
 	// String returns a human-readable representation (e.g., the URL).
 	String() string
 }
+
+// ErrRejected is wrapped by errors from RemoteUpdater.Update when the
+// remote refused the upload, so trying it again won't help.
+var ErrRejected = errors.New("upload rejected")
+
+// RemoteUpdater is implemented by remote objects which can be written
+// to, so changes made in the cache can be uploaded.
+type RemoteUpdater interface {
+	// Update replaces the content of the remote file with size bytes
+	// read from in, returning the object as it is after the write.
+	// The error wraps ErrRejected if the remote refused it.
+	Update(ctx context.Context, in io.Reader, size int64) (RemoteObject, error)
+}
@@ -1,8 +1,26 @@
 package internal
 
-// WriteFileHandle is not yet implemented in the forked engine.
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tgdrive/varc/internal/cache"
+)
+
+// WriteFileHandle is an open for write handle on a File which writes
+// the new content into the cache and uploads it when closed.
 type WriteFileHandle struct {
 	*baseHandle
+	mu           sync.Mutex
+	closed       bool
+	f            *File
+	item         *cache.Item
+	offset       int64
+	writeThrough bool // upload before Close returns rather than in the background
 }
 
 // RWFileHandle is not yet implemented in the forked engine.
@@ -10,17 +28,176 @@ type RWFileHandle struct {
 	*baseHandle
 }
 
-func newWriteFileHandle(d *Dir, f *File, remote string) (*WriteFileHandle, error) {
-	return &WriteFileHandle{baseHandle: &baseHandle{}}, ENOSYS
+// newWriteFileHandle opens the cache item of f, which must already be
+// open with the remote object to upload to, and empties it ready for
+// the new content.
+func newWriteFileHandle(f *File, item *cache.Item, writeThrough bool) (*WriteFileHandle, error) {
+	err := item.Truncate(0)
+	if err != nil {
+		_ = item.Abort()
+		return nil, fmt.Errorf("cache write: failed to truncate cache item: %w", err)
+	}
+	f.size.Store(0)
+	f.opens.Add(1)
+	return &WriteFileHandle{
+		baseHandle:   &baseHandle{},
+		f:            f,
+		item:         item,
+		writeThrough: writeThrough,
+	}, nil
 }
 
 func newRWFileHandle(d *Dir, f *File, remote string) (*RWFileHandle, error) {
 	return &RWFileHandle{baseHandle: &baseHandle{}}, ENOSYS
 }
 
-func (fh *WriteFileHandle) Node() Node { return nil }
-func (fh *WriteFileHandle) Flush() error { return nil }
-func (fh *WriteFileHandle) Release() error { return nil }
-func (fh *RWFileHandle) Node() Node { return nil }
-func (fh *RWFileHandle) Flush() error { return nil }
+// String returns the file name
+func (fh *WriteFileHandle) String() string {
+	return fh.f.name
+}
+
+// Node returns the underlying File
+func (fh *WriteFileHandle) Node() Node {
+	return fh.f
+}
+
+// Write writes len(p) bytes to the file at the current offset
+func (fh *WriteFileHandle) Write(p []byte) (n int, err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	n, err = fh.writeAt(p, fh.offset)
+	fh.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes len(p) bytes to the file starting at byte offset off
+func (fh *WriteFileHandle) WriteAt(p []byte, off int64) (n int, err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	return fh.writeAt(p, off)
+}
+
+// WriteString writes the contents of s to the file
+func (fh *WriteFileHandle) WriteString(s string) (n int, err error) {
+	return fh.Write([]byte(s))
+}
+
+// writeAt writes to the cache item at the given offset
+//
+// call with mu held
+func (fh *WriteFileHandle) writeAt(p []byte, off int64) (n int, err error) {
+	if fh.closed {
+		return 0, os.ErrClosed
+	}
+	n, err = fh.item.WriteAt(p, off)
+	if end := off + int64(n); end > fh.f.size.Load() {
+		fh.f.size.Store(end)
+	}
+	return n, err
+}
+
+// ReadFrom writes everything read from r to the file
+func (fh *WriteFileHandle) ReadFrom(r io.Reader) (n int64, err error) {
+	return io.Copy(struct{ io.Writer }{fh}, r)
+}
+
+// Seek sets the offset for the next Write
+func (fh *WriteFileHandle) Seek(offset int64, whence int) (int64, error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.closed {
+		return 0, os.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekStart:
+		fh.offset = offset
+	case io.SeekEnd:
+		fh.offset = fh.f.size.Load() + offset
+	case io.SeekCurrent:
+		fh.offset += offset
+	}
+
+	return fh.offset, nil
+}
+
+// Close closes the file handle, uploading what was written
+//
+// With write through the upload is done before it returns and any
+// error uploading is returned, otherwise it is queued to be done in the
+// background after the write back delay and retried until it works.
+func (fh *WriteFileHandle) Close() error {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.closed {
+		return os.ErrClosed
+	}
+	fh.closed = true
+	fh.f.opens.Add(-1)
+	return fh.item.CloseUpload(nil, fh.writeThrough)
+}
+
+// Abort closes the file handle after a failed write, dropping what was
+// written rather than uploading it
+func (fh *WriteFileHandle) Abort() error {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.closed {
+		return os.ErrClosed
+	}
+	fh.closed = true
+	fh.f.opens.Add(-1)
+	fh.f.size.Store(0)
+	return fh.item.Abort()
+}
+
+// Flush flushes the file - the upload is done on Close
+func (fh *WriteFileHandle) Flush() error {
+	return nil
+}
+
+// Release releases the file handle
+func (fh *WriteFileHandle) Release() error {
+	err := fh.Close()
+	if errors.Is(err, os.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// Sync commits what has been written to the cache to stable storage
+func (fh *WriteFileHandle) Sync() error {
+	return fh.item.Sync()
+}
+
+// Stat returns file info
+func (fh *WriteFileHandle) Stat() (os.FileInfo, error) {
+	return fh.f, nil
+}
+
+// ModTime returns the modification time
+func (fh *WriteFileHandle) ModTime() time.Time {
+	return fh.f.ModTime()
+}
+
+// Name returns the file name
+func (fh *WriteFileHandle) Name() string {
+	return fh.f.Name()
+}
+
+// Read is not supported for write handles
+func (fh *WriteFileHandle) Read(p []byte) (n int, err error) {
+	return 0, EPERM
+}
+
+// ReadAt is not supported for write handles
+func (fh *WriteFileHandle) ReadAt(p []byte, off int64) (n int, err error) {
+	return 0, EPERM
+}
+
+func (fh *RWFileHandle) Node() Node     { return nil }
+func (fh *RWFileHandle) Flush() error   { return nil }
 func (fh *RWFileHandle) Release() error { return nil }
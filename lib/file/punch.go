@@ -0,0 +1,8 @@
+package file
+
+import "errors"
+
+// ErrPunchHoleUnsupported is returned by PunchHole where parts of a
+// file can't be deallocated, either on this platform or on the file
+// system the file is on.
+var ErrPunchHoleUnsupported = errors.New("punching holes in files is not supported")
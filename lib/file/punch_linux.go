@@ -0,0 +1,29 @@
+//go:build linux
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// PunchHoleSupported is set if PunchHole can work on this platform
+const PunchHoleSupported = true
+
+// PunchHole deallocates length bytes of out starting at offset so
+// they no longer take up space on disk. The size of the file is
+// unchanged and the range reads back as zeroes. It returns
+// ErrPunchHoleUnsupported if the file system can't do this.
+func PunchHole(out *os.File, offset, length int64) error {
+	err := unix.Fallocate(int(out.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		return fmt.Errorf("fallocate punch hole: %w", ErrPunchHoleUnsupported)
+	}
+	if err != nil {
+		return fmt.Errorf("fallocate punch hole: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package file
+
+import (
+	"os"
+)
+
+// PunchHoleSupported is set if PunchHole can work on this platform
+const PunchHoleSupported = false
+
+// PunchHole deallocates length bytes of out starting at offset
+// On this platform PunchHole is unsupported.
+func PunchHole(out *os.File, offset, length int64) error {
+	return ErrPunchHoleUnsupported
+}
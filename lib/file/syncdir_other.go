@@ -0,0 +1,19 @@
+//go:build !windows
+
+package file
+
+import "os"
+
+// SyncDir commits the entries of the directory dir, eg a file renamed
+// into it, to stable storage.
+func SyncDir(dir string) (err error) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package file
+
+// SyncDir commits the entries of the directory dir, eg a file renamed
+// into it, to stable storage.
+//
+// On Windows directories can't be synced and renames are committed
+// with the file so this does nothing.
+func SyncDir(dir string) error {
+	return nil
+}
@@ -127,6 +127,29 @@ func (rs *Ranges) Insert(r Range) {
 	rs.coalesce(i)
 }
 
+// Remove the Range r from a sorted and coalesced slice of Ranges,
+// splitting any segment it falls in the middle of. The result will be
+// sorted and coalesced.
+func (rs *Ranges) Remove(r Range) {
+	if r.IsEmpty() || len(*rs) == 0 {
+		return
+	}
+	var out Ranges
+	for _, curr := range *rs {
+		if curr.End() <= r.Pos || curr.Pos >= r.End() {
+			out = append(out, curr)
+			continue
+		}
+		if curr.Pos < r.Pos {
+			out = append(out, Range{Pos: curr.Pos, Size: r.Pos - curr.Pos})
+		}
+		if curr.End() > r.End() {
+			out = append(out, Range{Pos: r.End(), Size: curr.End() - r.End()})
+		}
+	}
+	*rs = out
+}
+
 // Find searches for r in rs and returns the next present or absent
 // Range. It returns:
 //
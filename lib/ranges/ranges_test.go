@@ -279,6 +279,57 @@ func TestRangeInsert(t *testing.T) {
 	}
 }
 
+func TestRangeRemove(t *testing.T) {
+	for _, test := range []struct {
+		old  Range
+		rs   Ranges
+		want Ranges
+	}{
+		{
+			old:  Range{Pos: 1, Size: 0},
+			rs:   Ranges{{Pos: 1, Size: 1}},
+			want: Ranges{{Pos: 1, Size: 1}},
+		},
+		{
+			old:  Range{Pos: 1, Size: 1},    // .O.......
+			rs:   Ranges{{Pos: 1, Size: 1}}, // .R.......
+			want: Ranges(nil),               // .........
+		},
+		{
+			old: Range{Pos: 3, Size: 2},    // ...OO....
+			rs:  Ranges{{Pos: 1, Size: 6}}, // .RRRRRR..
+			want: Ranges{ // .RR..RR..
+				{Pos: 1, Size: 2},
+				{Pos: 5, Size: 2},
+			},
+		},
+		{
+			old: Range{Pos: 2, Size: 5},                       // ..OOOOO..
+			rs:  Ranges{{Pos: 1, Size: 2}, {Pos: 5, Size: 3}}, // .RR..RRR.
+			want: Ranges{ // .R.....R.
+				{Pos: 1, Size: 1},
+				{Pos: 7, Size: 1},
+			},
+		},
+		{
+			old:  Range{Pos: 0, Size: 100},
+			rs:   Ranges{{38, 8}, {57, 2}, {60, 3}},
+			want: Ranges(nil),
+		},
+		{
+			old:  Range{Pos: 46, Size: 11},
+			rs:   Ranges{{38, 8}, {57, 2}, {60, 3}},
+			want: Ranges{{38, 8}, {57, 2}, {60, 3}},
+		},
+	} {
+		got := slices.Clone(test.rs)
+		got.Remove(test.old)
+		what := fmt.Sprintf("test old=%v, rs=%v", test.old, test.rs)
+		assert.Equal(t, test.want, got, what)
+		checkRanges(t, got, what)
+	}
+}
+
 func TestRangeInsertRandom(t *testing.T) {
 	for range 100 {
 		var rs Ranges
@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -19,17 +19,132 @@ import (
 )
 
 var (
-	port = pflag.String("port", "8080", "Port to listen on")
-	cacheDir = pflag.String("cache-dir", filepath.Join(os.TempDir(), "varc_cache"), "Cache directory")
-	chunkSize = pflag.String("chunk-size", "", "Chunk size for reading (e.g., 4M)")
-	chunkStreams = pflag.Int("chunk-streams", 2, "Number of parallel chunk streams")
-	stripQuery = pflag.Bool("strip-query", false, "Strip query parameters from URL for caching")
-	stripDomain = pflag.Bool("strip-domain", false, "Strip domain from URL for caching")
-	shardLevel = pflag.Int("shard-level", 1, "Number of shard levels for cache paths")
+	port       = pflag.String("port", "8080", "Port to listen on (env VARC_PORT)")
+	configFile = pflag.String("config", "", "YAML or JSON file to read the options from (env VARC_CONFIG)")
 )
 
+// The options below are applied on top of the config file and the
+// environment if they are given on the command line. Their names are
+// the option names with - for _.
+func init() {
+	pflag.String("cache-dir", filepath.Join(os.TempDir(), "varc_cache"), "Cache directory")
+	pflag.String("cache-dirs", "", "Cache directories to use instead of --cache-dir (e.g., /nvme:max_size=100G,/hdd:tier=1)")
+	pflag.String("max-age", "1h", "Maximum time since last access before a cached file is removed")
+	pflag.String("max-size", "", "Maximum cache size (e.g., 10G), unlimited if not set")
+	pflag.String("min-free-space", "", "Evict to keep this much space free on each cache disk (e.g., 5G)")
+	pflag.String("poll-interval", "1m", "How often the cache is cleaned, 0 to never clean")
+	pflag.String("chunk-size", "128M", "Chunk size for reading (e.g., 4M)")
+	pflag.String("chunk-size-limit", "", "Double the chunk size of single stream reads up to this, unlimited if not set")
+	pflag.Int("chunk-streams", 2, "Number of parallel chunk streams")
+	pflag.String("handle-caching", "5s", "How long a file is kept open after its last reader")
+	pflag.String("download-linger", "5s", "How long downloads carry on for after their last client has gone")
+	pflag.String("write-back", "5s", "How long to wait before uploading changed files")
+	pflag.String("write-cache", "off", "Cache PUT uploads: off, through (upload before replying) or back (upload in the background after --write-back)")
+	pflag.String("queue-path", "", "Path to serve the upload queue admin API on, disabled if not set (e.g., /admin/queue)")
+	pflag.Bool("fast-fingerprint", false, "Use fast (less accurate) fingerprints for change detection")
+	pflag.Bool("strip-query", false, "Strip query parameters from URL for caching")
+	pflag.Bool("strip-domain", false, "Strip domain from URL for caching")
+	pflag.Int("shard-level", 1, "Number of shard levels for cache paths")
+	pflag.Bool("passthrough", false, "Proxy every request directly without caching")
+	pflag.Int("max-ranges", proxy.DefaultMaxRanges, "Maximum number of ranges in a multi-range request")
+	pflag.String("read-ahead-fixed", "", "Read ahead for every read when adaptive read ahead is off (e.g., 1M)")
+	pflag.String("read-ahead", "", "Maximum read ahead for a client reading sequentially (e.g., 64M)")
+	pflag.String("read-ahead-total", "", "Maximum read ahead across all clients (e.g., 1G)")
+	pflag.String("eviction-policy", "lru", "Cache eviction policy: lru, lfu, tinylfu or gdsf")
+	pflag.Bool("evict-ranges", false, "Evict the cold chunks of large files before whole files")
+	pflag.String("evict-range-size", "16M", "Size of the chunks access is tracked and evicted in")
+	pflag.String("mem-cache-size", "", "Memory to keep hot blocks of cached files in (e.g. 256M), disabled if not set")
+	pflag.Int("mem-cache-min-hits", 2, "Number of reads of a block before it is kept in memory")
+	pflag.Bool("checksums", false, "Checksum cached chunks and download them again if they are corrupt when read")
+	pflag.String("scrub-interval", "", "How often to check and repair the cached files not in use (e.g., 24h), off if not set")
+	pflag.String("meta-store", "files", "How to store cache metadata: files (a file per entry) or log (a single index)")
+	pflag.Bool("lazy-reload", false, "Start serving straight away and load the cache in the background")
+	pflag.Int("max-nodes", 100000, "Maximum number of files the engine keeps in its in-memory index")
+	pflag.String("quota-groups", "", "Groups with their own limits, as name:host=H:prefix=P:site=S:max_size=N:max_age=D,...")
+	pflag.Bool("background-complete", false, "Fetch the rest of partially read files in the background")
+	pflag.String("complete-min-size", "", "Don't complete files smaller than this in the background (e.g., 1M)")
+	pflag.String("complete-max-size", "", "Don't complete files larger than this in the background (e.g., 2G)")
+	pflag.Int("complete-min-hits", 1, "Number of partial reads of a file before it is completed in the background")
+	pflag.String("connect-timeout", "10s", "How long to wait for a connection to the upstream")
+	pflag.String("tls-handshake-timeout", "10s", "How long to wait for the TLS handshake with the upstream")
+	pflag.String("response-header-timeout", "30s", "How long to wait for the upstream response headers after sending a request")
+	pflag.String("idle-conn-timeout", "90s", "How long idle upstream connections are kept open")
+	pflag.Int("max-conns-per-host", 0, "Maximum connections to each upstream host, unlimited if 0")
+	pflag.Bool("disable-http2", false, "Only use HTTP/1.1 to the upstream")
+	pflag.String("ca-cert", "", "PEM file of CA certificates to trust for the upstream as well as the system ones")
+	pflag.String("client-cert", "", "PEM client certificate for upstreams which require mTLS")
+	pflag.String("client-key", "", "PEM key of --client-cert")
+	pflag.String("upstream-proxy", "", "Proxy URL to reach the upstream through, from HTTP_PROXY etc if not set")
+	pflag.String("bind-address", "", "Local IP address to connect to the upstream from")
+	pflag.String("credential-hosts", "", "Comma separated hosts (host, *.domain or *) the upstream credentials are sent to")
+	pflag.String("upstream-headers", "", "Headers added to reads from the upstream (e.g., 'X-Api-Key: abc; X-Tenant: 7')")
+	pflag.String("bearer-token-file", "", "File holding a token sent as Authorization: Bearer, reloaded when it changes")
+	pflag.String("sigv4-region", "", "Sign reads from the upstream with AWS SigV4 for this region")
+	pflag.String("sigv4-service", "s3", "Service name requests are signed for")
+	pflag.String("sigv4-access-key", "", "SigV4 access key, AWS_ACCESS_KEY_ID if not set")
+	pflag.String("sigv4-secret-key", "", "SigV4 secret key, AWS_SECRET_ACCESS_KEY if not set")
+	pflag.String("sigv4-session-token", "", "SigV4 session token, AWS_SESSION_TOKEN if the keys aren't set")
+	pflag.String("allow-hosts", "", "Comma separated upstream hosts (host, *.domain) and CIDRs clients may fetch from, any if not set")
+	pflag.Bool("block-private", false, "Refuse upstreams on private, loopback and link local addresses not in --allow-hosts")
+	pflag.String("signing-keys", "", "Comma separated HMAC keys signed URLs are checked with (env VARC_SIGNING_KEYS)")
+	pflag.String("api-keys", "", "API keys clients may use (e.g., alice:key=K:quota=100G:period=24h,bob:key=K2) (env VARC_API_KEYS)")
+	pflag.String("jwt-secret", "", "HMAC secret of HS256 JWTs clients may use (env VARC_JWT_SECRET)")
+	pflag.String("jwt-public-key", "", "PEM file of the key of RS256, ES256 or EdDSA JWTs clients may use")
+	pflag.String("jwt-audience", "", "aud claim JWTs must have, not checked if not set")
+	pflag.String("trusted-proxies", "", "Comma separated CIDRs of proxies whose X-Forwarded-For gives the client address")
+	pflag.String("admin-keys", "", "Comma separated keys the admin APIs may be used with (env VARC_ADMIN_KEYS)")
+	pflag.String("client-rate-limit", "", "Requests each client may make per window as N/duration (e.g., 100/1m)")
+	pflag.String("client-byte-limit", "", "Bytes each client may be sent per window as size/duration (e.g., 10G/1h)")
+	pflag.Int("client-max-conns", 0, "Requests each client may have in flight, unlimited if 0")
+	pflag.String("client-miss-limit", "", "Distinct uncached files each client may ask for per window as N/duration (e.g., 30/1m)")
+}
+
+// notOptions are the flags of the commands which aren't proxy options
+var notOptions = map[string]bool{
+	"port": true, "config": true,
+	"repair":  true,
+	"expires": true, "client-ip": true, "byte-range": true, "base-url": true,
+}
+
+// loadOptions builds the options from the defaults, then the config
+// file, then the environment, then the flags given on the command line
+func loadOptions() (opt proxy.Options, err error) {
+	opt = proxy.DefaultOptions()
+	path := *configFile
+	if !pflag.CommandLine.Changed("config") {
+		path = os.Getenv(proxy.EnvPrefix + "CONFIG")
+	}
+	if err := proxy.LoadConfig(path, &opt); err != nil {
+		return opt, err
+	}
+	var errs []error
+	pflag.Visit(func(f *pflag.Flag) {
+		if notOptions[f.Name] {
+			return
+		}
+		if err := proxy.SetOption(&opt, strings.ReplaceAll(f.Name, "-", "_"), f.Value.String()); err != nil {
+			errs = append(errs, fmt.Errorf("--%s: %w", f.Name, err))
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return opt, err
+	}
+	return opt, opt.Validate()
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(runFsck(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		os.Exit(runSign(os.Args[2:]))
+	}
 	pflag.Parse()
+	if !pflag.CommandLine.Changed("port") {
+		if p, ok := os.LookupEnv(proxy.EnvPrefix + "PORT"); ok {
+			*port = p
+		}
+	}
 
 	zapLogger, err := zap.NewProduction()
 	if err != nil {
@@ -37,15 +152,11 @@ func main() {
 	}
 	defer zapLogger.Sync()
 
-	opt := proxy.Options{
-		CacheDir:          *cacheDir,
-		CacheChunkSize:    *chunkSize,
-		CacheChunkStreams: *chunkStreams,
-		StripQuery:        *stripQuery,
-		StripDomain:       *stripDomain,
-		ShardLevel:        *shardLevel,
-		Logger:            zapLogger.Sugar(),
+	opt, err := loadOptions()
+	if err != nil {
+		zapLogger.Fatal("Invalid configuration", zap.Error(err))
 	}
+	opt.Logger = zapLogger.Sugar()
 
 	handler, err := proxy.NewHandler(opt)
 	if err != nil {
@@ -55,18 +166,8 @@ func main() {
 	mux := http.NewServeMux()
 
 	mainHandler := func(w http.ResponseWriter, r *http.Request) {
-		targetURL := r.URL.Query().Get("url")
-
-		// Check for Base64 URL in path
-		if targetURL == "" && strings.HasPrefix(r.URL.Path, "/stream/") {
-			encodedURL := strings.TrimPrefix(r.URL.Path, "/stream/")
-			if decoded, err := base64.RawURLEncoding.DecodeString(encodedURL); err == nil {
-				targetURL = string(decoded)
-			} else if decoded, err := base64.URLEncoding.DecodeString(encodedURL); err == nil {
-				targetURL = string(decoded)
-			}
-		}
-
+		// From the url query param or a base64 URL in the path
+		targetURL := proxy.TargetURL(r)
 		if targetURL == "" {
 			http.Error(w, "Missing 'url' parameter or base64 path", http.StatusBadRequest)
 			return
@@ -78,11 +179,21 @@ func main() {
 	mux.HandleFunc("/stream", mainHandler)
 	mux.HandleFunc("/stream/", mainHandler)
 
-	// Health check endpoint
+	if opt.QueuePath != "" {
+		mux.HandleFunc(opt.QueuePath, handler.ServeQueue)
+	}
+
+	// Health check endpoint - not ready until the cache is loaded
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status":"ok","cache_dir":"%s"}`, handler.Engine.Opt.CacheDir)
+		status := "ok"
+		if handler.Ready() {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			status = "loading"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintf(w, `{"status":"%s","cache_dir":"%s"}`, status, handler.Engine.Opt.CacheDir)
 	})
 
 	srv := &http.Server{
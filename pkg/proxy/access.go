@@ -0,0 +1,491 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Query parameters which carry the access credentials of a request.
+// They are for varc so aren't passed upstream.
+const (
+	paramExpires = "expires" // unix time a signed URL expires at
+	paramSig     = "sig"     // signature of a signed URL
+	paramAPIKey  = "api_key"
+)
+
+// DefaultQuotaPeriod is how often API key quotas are reset if they
+// don't set a period
+const DefaultQuotaPeriod = 24 * time.Hour
+
+// errForbidden is the reason given for requests which had no valid
+// credentials
+var errForbidden = errors.New("valid signature, API key or token required")
+
+// jwtAdminScope is the scope a JWT needs to use the admin APIs
+const jwtAdminScope = "varc:admin"
+
+// accessControl decides which clients may fetch which upstream URLs
+type accessControl struct {
+	hosts        []string       // upstream host patterns allowed, as in matchHost
+	nets         []netip.Prefix // upstream addresses allowed
+	blockPrivate bool           // refuse upstreams on non-public addresses not in nets
+
+	signingKeys    [][]byte       // keys signed URLs may be signed with
+	trustedProxies []netip.Prefix // proxies whose X-Forwarded-For is believed
+	apiKeys        map[string]*apiKey
+	jwt            *jwtVerifier
+	adminKeys      [][]byte // keys the admin APIs may be used with
+}
+
+// apiKey is a named API key, optionally limited to serving quota
+// bytes every period
+type apiKey struct {
+	name   string
+	quota  int64
+	period time.Duration
+
+	mu    sync.Mutex
+	start time.Time // when the current period began
+	used  int64     // bytes served in the current period
+}
+
+// accessControl builds the access control of clients from the options,
+// returning nil if there is none. All the problems found are returned
+// together.
+func (opt *Options) accessControl() (*accessControl, error) {
+	var errs []error
+	invalid := func(name, value string, err error) {
+		errs = append(errs, fmt.Errorf("invalid %s %q: %w", name, value, err))
+	}
+	a := &accessControl{blockPrivate: opt.BlockPrivate}
+
+	var err error
+	a.hosts, a.nets, err = parseAllowHosts(opt.AllowHosts)
+	if err != nil {
+		invalid("allow_hosts", opt.AllowHosts, err)
+	}
+	if a.trustedProxies, err = opt.trustedProxies(); err != nil {
+		errs = append(errs, err)
+	}
+	for key := range strings.SplitSeq(opt.SigningKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			a.signingKeys = append(a.signingKeys, []byte(key))
+		}
+	}
+	for key := range strings.SplitSeq(opt.AdminKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			a.adminKeys = append(a.adminKeys, []byte(key))
+		}
+	}
+	if opt.APIKeys != "" {
+		if a.apiKeys, err = parseAPIKeys(opt.APIKeys); err != nil {
+			// Not invalid as that would log the keys
+			errs = append(errs, fmt.Errorf("invalid api_keys: %w", err))
+		}
+	}
+	if opt.JWTSecret != "" || opt.JWTPublicKey != "" {
+		if a.jwt, err = newJWTVerifier([]byte(opt.JWTSecret), opt.JWTPublicKey, opt.JWTAudience); err != nil {
+			invalid("jwt_public_key", opt.JWTPublicKey, err)
+		}
+	} else if opt.JWTAudience != "" {
+		invalid("jwt_audience", opt.JWTAudience, errors.New("needs jwt_secret or jwt_public_key"))
+	}
+	if opt.QueuePath != "" && len(a.adminKeys) == 0 && a.jwt == nil {
+		invalid("queue_path", opt.QueuePath, errors.New("needs admin_keys or JWTs to check admins with"))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if len(a.hosts)+len(a.nets) == 0 && !a.blockPrivate && !a.authenticates() && len(a.adminKeys) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// trustedProxies parses the addresses of the proxies whose
+// X-Forwarded-For gives the client address
+func (opt *Options) trustedProxies() (prefixes []netip.Prefix, err error) {
+	var errs []error
+	for entry := range strings.SplitSeq(opt.TrustedProxies, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		prefix, err := parseClientIP(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid trusted_proxies %q: %w", entry, err))
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, errors.Join(errs...)
+}
+
+// parseAllowHosts parses a comma separated list of upstream host
+// patterns, as in matchHost, and CIDR address ranges
+func parseAllowHosts(s string) (hosts []string, nets []netip.Prefix, err error) {
+	for entry := range strings.SplitSeq(s, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, prefix.Masked())
+		default:
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				nets = append(nets, netip.PrefixFrom(addr, addr.BitLen()))
+				continue
+			}
+			hosts = append(hosts, entry)
+		}
+	}
+	return hosts, nets, nil
+}
+
+// parseAPIKeys parses a comma separated list of API keys, each a name
+// followed by colon separated options, eg
+//
+//	alice:key=s3cr3t:quota=100G:period=24h,bob:key=0th3r
+func parseAPIKeys(s string) (map[string]*apiKey, error) {
+	keys := make(map[string]*apiKey)
+	names := make(map[string]bool)
+	for entry := range strings.SplitSeq(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		k := &apiKey{name: fields[0], period: DefaultQuotaPeriod}
+		if k.name == "" || strings.Contains(k.name, "=") {
+			return nil, errors.New("API key has no name")
+		}
+		if names[k.name] {
+			return nil, fmt.Errorf("%q: API key name used twice", k.name)
+		}
+		names[k.name] = true
+		var secret string
+		for _, field := range fields[1:] {
+			option, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("%q: expecting key=value", k.name)
+			}
+			var err error
+			switch option {
+			case "key":
+				secret = value
+			case "quota":
+				k.quota, err = parseSize(value)
+			case "period":
+				k.period, err = time.ParseDuration(value)
+				if err == nil && k.period <= 0 {
+					err = errors.New("must be positive")
+				}
+			default:
+				return nil, fmt.Errorf("%q: unknown option %q (want key, quota or period)", k.name, option)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%q: bad %s: %w", k.name, option, err)
+			}
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("%q: API key needs a key", k.name)
+		}
+		if _, ok := keys[secret]; ok {
+			return nil, fmt.Errorf("%q: key used by another API key", k.name)
+		}
+		keys[secret] = k
+	}
+	return keys, nil
+}
+
+// authenticates returns true if clients must present credentials
+func (a *accessControl) authenticates() bool {
+	return len(a.signingKeys) > 0 || len(a.apiKeys) > 0 || a.jwt != nil
+}
+
+// check decides whether the request r for targetURL is allowed,
+// returning the API key it was made with if any, or why it was
+// refused.
+//
+// The credentials used are removed from r so they aren't sent
+// upstream.
+func (a *accessControl) check(r *http.Request, targetURL string) (*apiKey, error) {
+	key, err := a.authenticate(r, targetURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkUpstream(r.Context(), targetURL); err != nil {
+		return nil, err
+	}
+	if key != nil && !key.allow() {
+		return nil, fmt.Errorf("quota of API key %q used up", key.name)
+	}
+	return key, nil
+}
+
+// authenticate checks the credentials of r, if any are needed
+func (a *accessControl) authenticate(r *http.Request, targetURL string) (*apiKey, error) {
+	if !a.authenticates() {
+		return nil, nil
+	}
+	query := r.URL.Query()
+
+	if query.Get(paramSig) != "" && len(a.signingKeys) > 0 {
+		return nil, verifyLink(r, targetURL, a.signingKeys, a.trustedProxies)
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		r.Header.Del("Authorization")
+		token = strings.TrimSpace(token)
+		if a.jwt != nil && strings.Count(token, ".") == 2 {
+			if err := a.jwt.verify(token, time.Now()); err != nil {
+				return nil, fmt.Errorf("invalid token: %w", err)
+			}
+			return nil, nil
+		}
+		return a.apiKey(token)
+	}
+	if token := r.Header.Get("X-Api-Key"); token != "" {
+		r.Header.Del("X-Api-Key")
+		return a.apiKey(token)
+	}
+	if token := query.Get(paramAPIKey); token != "" {
+		return a.apiKey(token)
+	}
+	return nil, errForbidden
+}
+
+// checkAdmin checks r has credentials which may use the admin APIs:
+// one of the admin keys as a bearer token or X-Api-Key, or a JWT with
+// the varc:admin scope
+func (a *accessControl) checkAdmin(r *http.Request) error {
+	if a == nil || (len(a.adminKeys) == 0 && a.jwt == nil) {
+		return errors.New("no admin credentials configured")
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.Header.Get("X-Api-Key")
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return errors.New("admin key or token required")
+	}
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		claims, err := a.jwt.claims(token, time.Now())
+		if err != nil {
+			return fmt.Errorf("invalid token: %w", err)
+		}
+		if !slices.Contains(strings.Fields(claims.Scope), jwtAdminScope) {
+			return errors.New("token lacks the " + jwtAdminScope + " scope")
+		}
+		return nil
+	}
+	for _, key := range a.adminKeys {
+		if hmac.Equal(key, []byte(token)) {
+			return nil
+		}
+	}
+	return errors.New("invalid admin key")
+}
+
+// apiKey looks up the API key token
+func (a *accessControl) apiKey(token string) (*apiKey, error) {
+	for secret, key := range a.apiKeys {
+		if hmac.Equal([]byte(secret), []byte(token)) {
+			return key, nil
+		}
+	}
+	return nil, errors.New("invalid API key")
+}
+
+// checkUpstream checks that targetURL is on an allowed upstream,
+// resolving its host if the addresses it is on matter
+func (a *accessControl) checkUpstream(ctx context.Context, targetURL string) error {
+	u, err := url.Parse(targetURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("upstream URL must be http or https")
+	}
+	for _, pattern := range a.hosts {
+		if matchHost(pattern, u.Host) {
+			return a.checkAddrs(ctx, u.Hostname(), false)
+		}
+	}
+	return a.checkAddrs(ctx, u.Hostname(), len(a.hosts)+len(a.nets) > 0)
+}
+
+// checkAddrs checks the addresses host is on. If mustAllow is set they
+// must all be in the allowed ranges.
+func (a *accessControl) checkAddrs(ctx context.Context, host string, mustAllow bool) error {
+	if !mustAllow && !a.blockPrivate {
+		return nil
+	}
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		if mustAllow {
+			return fmt.Errorf("upstream host %q not allowed", host)
+		}
+		// It can't be reached either, so let the fetch fail
+		return nil
+	}
+	for _, addr := range addrs {
+		if !a.allowAddr(addr, mustAllow) {
+			return fmt.Errorf("upstream host %q not allowed", host)
+		}
+	}
+	return nil
+}
+
+// allowAddr returns true if upstreams at addr may be used
+func (a *accessControl) allowAddr(addr netip.Addr, mustAllow bool) bool {
+	addr = addr.Unmap()
+	for _, prefix := range a.nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return !mustAllow && !(a.blockPrivate && isPrivateAddr(addr))
+}
+
+// sharedAddrSpace is the carrier grade NAT range, RFC 6598
+var sharedAddrSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPrivateAddr returns true if addr isn't a public unicast address
+func isPrivateAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsGlobalUnicast() || addr.IsPrivate() || sharedAddrSpace.Contains(addr)
+}
+
+// dialHostKey is the context key of the host:port being dialled
+type dialHostKey struct{}
+
+// dialContext returns a dial function for dialer which refuses
+// connections to the addresses a refuses, so names which resolve to
+// other addresses when connecting can't be used to reach them
+func (a *accessControl) dialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer.ControlContext = a.dialControl
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dialer.DialContext(context.WithValue(ctx, dialHostKey{}, address), network, address)
+	}
+}
+
+// dialControl checks the address being connected to for the host
+// being dialled as checkUpstream does
+func (a *accessControl) dialControl(ctx context.Context, network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	host, _ := ctx.Value(dialHostKey{}).(string)
+	mustAllow := len(a.hosts)+len(a.nets) > 0
+	for _, pattern := range a.hosts {
+		if matchHost(pattern, host) {
+			mustAllow = false
+			break
+		}
+	}
+	if !a.allowAddr(addrPort.Addr(), mustAllow) {
+		return fmt.Errorf("connecting to %s not allowed", addrPort.Addr())
+	}
+	return nil
+}
+
+// checkRedirect checks each upstream redirected to may be used, as
+// http.Client.CheckRedirect
+func (a *accessControl) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return a.checkUpstream(req.Context(), req.URL.String())
+}
+
+// allow returns true if the key has some of its quota left
+func (k *apiKey) allow() bool {
+	if k.quota <= 0 {
+		return true
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k._resetExpired()
+	return k.used < k.quota
+}
+
+// use adds n bytes served to the key's usage
+func (k *apiKey) use(n int64) {
+	if k.quota <= 0 {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k._resetExpired()
+	k.used += n
+}
+
+// _resetExpired starts a new period if the current one is over
+//
+// call with k.mu held
+func (k *apiKey) _resetExpired() {
+	if now := time.Now(); now.Sub(k.start) >= k.period {
+		k.start, k.used = now, 0
+	}
+}
+
+// trimQuery removes the access credentials from the query string
+// rawQuery, leaving it untouched if it has none
+func (a *accessControl) trimQuery(rawQuery string) string {
+	if a == nil || !a.authenticates() || rawQuery == "" {
+		return rawQuery
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	trimmed := false
+	if len(a.signingKeys) > 0 && query.Has(paramSig) {
+		query.Del(paramSig)
+		query.Del(paramExpires)
+		query.Del(paramClientIP)
+		query.Del(paramRange)
+		trimmed = true
+	}
+	if len(a.apiKeys) > 0 && query.Has(paramAPIKey) {
+		query.Del(paramAPIKey)
+		trimmed = true
+	}
+	if !trimmed {
+		return rawQuery
+	}
+	return query.Encode()
+}
+
+// countingResponseWriter counts the bytes of the body written through
+// it
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// accessUpstream serves data, recording the Authorization headers it is
+// sent
+func accessUpstream(t *testing.T, data []byte) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var auth []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), auth...)
+	}
+}
+
+// serveStream serves a request made with method for the proxy URL
+// target through handler
+func serveStream(handler *Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for k, vv := range header {
+		r.Header[k] = vv
+	}
+	w := httptest.NewRecorder()
+	handler.Serve(w, r, TargetURL(r))
+	return w
+}
+
+// streamPath returns the /stream/ path of targetURL
+func streamPath(targetURL string) string {
+	return "/stream/" + base64.RawURLEncoding.EncodeToString([]byte(targetURL))
+}
+
+func TestAccessSignedURLs(t *testing.T) {
+	upstream, _ := accessUpstream(t, []byte("signed content"))
+	handler, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1, SigningKeys: "old-key, new-key"})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	target := upstream.URL + "/video.mp4"
+	signed := func(key, target string, expires time.Time) string {
+		link, err := SignLink(key, Link{URL: target, Expires: expires})
+		require.NoError(t, err)
+		return link
+	}
+	later := time.Now().Add(time.Hour)
+	// The query string of the signed /stream/ link for target
+	signature := "&" + signed("new-key", target, later)[len(streamPath(target))+1:]
+
+	for name, test := range map[string]struct {
+		method string
+		target string
+		status int
+	}{
+		"valid":          {http.MethodGet, signed("new-key", target, later), http.StatusOK},
+		"old key":        {http.MethodHead, signed("old-key", target, later), http.StatusOK},
+		"unsigned":       {http.MethodGet, streamPath(target), http.StatusForbidden},
+		"expired":        {http.MethodGet, signed("new-key", target, time.Now().Add(-time.Minute)), http.StatusForbidden},
+		"other key":      {http.MethodGet, signed("guess", target, later), http.StatusForbidden},
+		"other target":   {http.MethodGet, streamPath(upstream.URL+"/other") + "?" + signature[1:], http.StatusForbidden},
+		"not a read":     {"PURGE", signed("new-key", target, later), http.StatusForbidden},
+		"query form url": {http.MethodGet, "/stream?url=" + url.QueryEscape(target) + signature, http.StatusOK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := serveStream(handler, test.method, test.target, nil)
+			assert.Equal(t, test.status, w.Code)
+		})
+	}
+	assert.Equal(t, int64(5), handler.Metrics().Snapshot()["denied"])
+}
+
+func TestAccessAPIKeys(t *testing.T) {
+	data := []byte("0123456789")
+	upstream, auth := accessUpstream(t, data)
+	handler, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1, APIKeys: "alice:key=a1:quota=15:period=1h,bob:key=b1"})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	target := "/stream?url=" + url.QueryEscape(upstream.URL+"/file")
+	w := serveStream(handler, http.MethodGet, target, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveStream(handler, http.MethodGet, target, http.Header{"X-Api-Key": {"nope"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// The key used isn't sent upstream and the request is cached
+	w = serveStream(handler, http.MethodGet, target, http.Header{"Authorization": {"Bearer b1"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+	for _, a := range auth() {
+		assert.Empty(t, a)
+	}
+	w = serveStream(handler, http.MethodGet, target+"&api_key=b1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(1), handler.Metrics().Hits)
+
+	// alice may be served 15 bytes, and can finish the request which
+	// goes over
+	for range 2 {
+		w = serveStream(handler, http.MethodGet, target, http.Header{"X-Api-Key": {"a1"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w = serveStream(handler, http.MethodGet, target, http.Header{"X-Api-Key": {"a1"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), `quota of API key "alice" used up`)
+	w = serveStream(handler, http.MethodGet, target, http.Header{"X-Api-Key": {"b1"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(3), handler.Metrics().Snapshot()["denied"])
+}
+
+// hs256 signs JWTs made by makeJWT with secret
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+// makeJWT makes a token with claims signed by sign for alg
+func makeJWT(t *testing.T, alg string, claims map[string]any, sign func(signed []byte) []byte) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestJWTVerifier(t *testing.T) {
+	now := time.Now()
+	valid := map[string]any{"sub": "alice", "aud": "varc", "exp": now.Add(time.Hour).Unix()}
+
+	v, err := newJWTVerifier([]byte("secret"), "", "varc")
+	require.NoError(t, err)
+	assert.NoError(t, v.verify(makeJWT(t, "HS256", valid, hs256("secret")), now))
+	assert.ErrorContains(t, v.verify(makeJWT(t, "HS256", valid, hs256("other")), now), "bad signature")
+	assert.ErrorContains(t, v.verify(makeJWT(t, "none", valid, func([]byte) []byte { return nil }), now), "bad signature")
+	assert.ErrorContains(t, v.verify(makeJWT(t, "HS256", map[string]any{"aud": []string{"varc"}, "exp": now.Add(-time.Hour).Unix()}, hs256("secret")), now), "expired")
+	assert.ErrorContains(t, v.verify(makeJWT(t, "HS256", map[string]any{"aud": "varc", "nbf": now.Add(time.Hour).Unix()}, hs256("secret")), now), "not valid yet")
+	assert.ErrorContains(t, v.verify(makeJWT(t, "HS256", map[string]any{"aud": []string{"web", "api"}}, hs256("secret")), now), "audience")
+	assert.ErrorContains(t, v.verify("a.b", now), "malformed")
+
+	// ES256 with the public key in a PEM file
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	es256 := func(signed []byte) []byte {
+		hash := sha256.Sum256(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+		require.NoError(t, err)
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	v, err = newJWTVerifier(nil, keyFile, "")
+	require.NoError(t, err)
+	assert.NoError(t, v.verify(makeJWT(t, "ES256", valid, es256), now))
+	// The public key can't be used as an HMAC secret
+	pemData, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	assert.Error(t, v.verify(makeJWT(t, "HS256", valid, hs256(string(pemData))), now))
+
+	_, err = newJWTVerifier(nil, filepath.Join(t.TempDir(), "missing.pem"), "")
+	assert.Error(t, err)
+}
+
+func TestAccessJWT(t *testing.T) {
+	upstream, _ := accessUpstream(t, []byte("for token holders"))
+	handler, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1, JWTSecret: "secret"})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	token := makeJWT(t, "HS256", map[string]any{"exp": time.Now().Add(time.Minute).Unix()}, func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	})
+	target := "/stream?url=" + url.QueryEscape(upstream.URL+"/file")
+	w := serveStream(handler, http.MethodGet, target, http.Header{"Authorization": {"Bearer " + token}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveStream(handler, http.MethodGet, target, http.Header{"Authorization": {"Bearer " + token + "x"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestAccessUpstreams(t *testing.T) {
+	ctx := context.Background()
+	a := &accessControl{}
+	a.hosts, a.nets, _ = parseAllowHosts("cdn.example.com, *.media.example.com, 10.0.0.0/8, 192.0.2.7")
+	for target, allowed := range map[string]bool{
+		"https://cdn.example.com/video.mp4":    true,
+		"https://eu.media.example.com/a":       true,
+		"http://10.1.2.3:8080/file":            true,
+		"http://192.0.2.7/file":                true,
+		"http://192.0.2.8/file":                false,
+		"https://example.com/video.mp4":        false,
+		"http://127.0.0.1/file":                false,
+		"ftp://cdn.example.com/file":           false,
+		"https://attacker.example/cdn.example": false,
+	} {
+		assert.Equal(t, allowed, a.checkUpstream(ctx, target) == nil, target)
+	}
+
+	a = &accessControl{blockPrivate: true}
+	for target, allowed := range map[string]bool{
+		"http://8.8.8.8/file":                true,
+		"http://10.0.0.1/file":               false,
+		"http://127.0.0.1/file":              false,
+		"http://localhost/file":              false,
+		"http://[::1]/file":                  false,
+		"http://[::ffff:127.0.0.1]/file":     false,
+		"http://169.254.169.254/latest/meta": false,
+		"http://192.168.1.1/file":            false,
+		"http://100.64.0.1/file":             false,
+		"http://[fd00::1]/file":              false,
+		"http://0.0.0.0/file":                false,
+	} {
+		assert.Equal(t, allowed, a.checkUpstream(ctx, target) == nil, target)
+	}
+
+	// Allowed ranges may be private
+	a.nets = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	assert.NoError(t, a.checkUpstream(ctx, "http://10.0.0.1/file"))
+	assert.Error(t, a.dialControl(ctx, "tcp", "127.0.0.1:80", nil))
+	assert.NoError(t, a.dialControl(ctx, "tcp", "10.0.0.1:80", nil))
+	assert.Error(t, a.dialControl(ctx, "tcp", "[2001:4860:4860::8888]:443", nil))
+
+	// Hosts allowed by name may connect anywhere unless it's private
+	a.hosts = []string{"cdn.example.com"}
+	named := context.WithValue(ctx, dialHostKey{}, "cdn.example.com:443")
+	assert.NoError(t, a.dialControl(named, "tcp", "[2001:4860:4860::8888]:443", nil))
+	assert.Error(t, a.dialControl(named, "tcp", "127.0.0.1:443", nil))
+	assert.Error(t, a.dialControl(ctx, "tcp", "[2001:4860:4860::8888]:443", nil))
+
+	// Through the handler
+	upstream, _ := accessUpstream(t, []byte("internal"))
+	handler, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1, BlockPrivate: true})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+	w := serveStream(handler, http.MethodGet, "/stream?url="+url.QueryEscape(upstream.URL+"/file"), nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, int64(1), handler.Metrics().Snapshot()["denied"])
+
+	// Connections are checked too, for names which resolve again
+	tr, err := (&Options{BlockPrivate: true}).upstreamTransport()
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: tr}).Get(upstream.URL)
+	assert.ErrorContains(t, err, "not allowed")
+
+	// Allowed ranges are checked on connecting without block_private
+	tr, err = (&Options{AllowHosts: "localhost,10.0.0.0/8"}).upstreamTransport()
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: tr}).Get(upstream.URL)
+	assert.ErrorContains(t, err, "not allowed")
+	resp, err := (&http.Client{Transport: tr}).Get(strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1))
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestAccessRedirects(t *testing.T) {
+	internal, _ := accessUpstream(t, []byte("INTERNAL-SECRET"))
+	redirector := httptest.NewServer(http.RedirectHandler(internal.URL+"/secret", http.StatusFound))
+	defer redirector.Close()
+	handler, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1, AllowHosts: "localhost"})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	target := strings.Replace(redirector.URL, "127.0.0.1", "localhost", 1) + "/file"
+	assert.Equal(t, http.StatusForbidden, serveStream(handler, http.MethodGet, streamPath(internal.URL+"/secret"), nil).Code)
+	w := serveStream(handler, http.MethodGet, streamPath(target), nil)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "INTERNAL-SECRET")
+}
+
+func TestTrimAccessParams(t *testing.T) {
+	a := &accessControl{signingKeys: [][]byte{[]byte("k")}}
+	assert.Equal(t, "a=1&b=2", a.trimQuery("a=1&b=2"))
+	assert.Equal(t, "a=1&expires=5", a.trimQuery("a=1&expires=5"))
+	assert.Equal(t, "a=1", a.trimQuery("a=1&expires=5&sig=abc"))
+	// API keys are only removed if varc checks them
+	assert.Equal(t, "a=1&api_key=x", a.trimQuery("a=1&api_key=x"))
+	assert.Equal(t, "api_key=x", (*accessControl)(nil).trimQuery("api_key=x"))
+}
+
+func TestAccessOptions(t *testing.T) {
+	a, err := (&Options{}).accessControl()
+	require.NoError(t, err)
+	assert.Nil(t, a)
+
+	opt := Options{
+		AllowHosts:   "cdn.example.com,10.0.0.0/33",
+		APIKeys:      "alice:key=secret-one:quota=lots",
+		JWTPublicKey: filepath.Join(t.TempDir(), "missing.pem"),
+	}
+	err = opt.Validate()
+	require.Error(t, err)
+	for _, name := range []string{"allow_hosts", "api_keys", "jwt_public_key"} {
+		assert.Contains(t, err.Error(), "invalid "+name, name)
+	}
+	assert.NotContains(t, err.Error(), "secret-one")
+
+	for _, keys := range []string{"alice:key=k1,alice:key=k2", "alice:key=k1,bob:key=k1", "alice", "alice:quota=1G", ":key=k1", "alice:key=k1:period=0s"} {
+		_, err := parseAPIKeys(keys)
+		assert.Error(t, err, keys)
+	}
+	_, err = (&Options{JWTAudience: "varc"}).accessControl()
+	assert.ErrorContains(t, err, "invalid jwt_audience")
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackgroundComplete(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	upstream, stats := trackedUpstream(t, data)
+	defer upstream.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:           t.TempDir(),
+		CacheChunkSize:     "64K",
+		CacheChunkStreams:  1,
+		BackgroundComplete: true,
+		CompleteMinHits:    2,
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	rangeGet := func(rangeHeader string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Range", rangeHeader)
+		handler.Serve(w, r, upstream.URL)
+		require.Equal(t, http.StatusPartialContent, w.Code)
+	}
+
+	// The first partial read isn't popular enough to complete
+	rangeGet("bytes=0-99")
+	assert.Equal(t, int64(0), handler.Engine.Stats()["completionsRunning"])
+
+	rangeGet("bytes=100-199")
+	require.Eventually(t, func() bool {
+		return handler.Engine.Stats()["completionsDone"] == int64(1)
+	}, 10*time.Second, 10*time.Millisecond, "background completion didn't finish")
+
+	// The whole file should now come from the cache
+	gets := stats.getTotal.Load()
+	w := httptest.NewRecorder()
+	handler.Serve(w, httptest.NewRequest("GET", "/", nil), upstream.URL)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+	assert.Equal(t, gets, stats.getTotal.Load(), "unexpected upstream fetches: %s", stats)
+	assert.Equal(t, int64(0), handler.Engine.Stats()["clientsWaiting"])
+}
+
+func TestBackgroundCompleteSizeLimits(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 64*1024)
+	upstream := testUpstream(t, data)
+	defer upstream.Close()
+
+	for _, opt := range []Options{
+		{CompleteMaxSize: "32K"},
+		{CompleteMinSize: "1M"},
+	} {
+		opt.CacheDir = t.TempDir()
+		opt.CacheChunkStreams = 1
+		opt.BackgroundComplete = true
+		handler, err := NewHandler(opt)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Range", "bytes=0-9")
+		handler.Serve(w, r, upstream.URL)
+		assert.Equal(t, http.StatusPartialContent, w.Code)
+		stats := handler.Engine.Stats()
+		assert.Equal(t, int64(0), stats["completionsRunning"], "%+v", opt)
+		assert.Equal(t, int64(0), stats["completionsDone"], "%+v", opt)
+		handler.Shutdown()
+	}
+
+	_, err := NewHandler(Options{CacheDir: t.TempDir(), CompleteMaxSize: "lots"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// condResult is the result of an HTTP request precondition check.
+//
+// See https://www.rfc-editor.org/rfc/rfc9110#section-13
+type condResult int
+
+const (
+	condNone  condResult = iota // header not present or not applicable
+	condTrue                    // precondition passed
+	condFalse                   // precondition failed
+)
+
+// entityTag returns the ETag to send for a cached object.
+//
+// If the upstream sent an ETag it is passed through unchanged, keeping
+// its strong or weak status, as it is the best statement of content
+// identity we have. Otherwise a weak ETag is derived from the
+// Last-Modified time and size, since a one second resolution date can't
+// guarantee byte-for-byte equality. If neither is known no ETag is sent.
+func entityTag(upstreamETag string, size int64, modTime time.Time) string {
+	if upstreamETag != "" {
+		if tag, remain := scanETag(upstreamETag); tag != "" && remain == "" {
+			return upstreamETag
+		}
+	}
+	if modTime.IsZero() || size < 0 {
+		return ""
+	}
+	return fmt.Sprintf(`W/"%x-%x"`, modTime.Unix(), size)
+}
+
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming ETag is returned. Otherwise,
+// it returns "", "".
+func scanETag(s string) (etag string, remain string) {
+	s = textproto.TrimString(s)
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+	// ETag is either W/"text" or "text".
+	// See RFC 7232 2.3.
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		// Character values allowed in ETags.
+		case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+// Assumes a and b are valid ETags.
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && a[0] == '"'
+}
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison.
+// Assumes a and b are valid ETags.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// matchETags checks the comma separated list of ETags in header against
+// etag using the match function passed in.
+func matchETags(header, etag string, match func(a, b string) bool) condResult {
+	for {
+		header = textproto.TrimString(header)
+		if len(header) == 0 {
+			break
+		}
+		if header[0] == ',' {
+			header = header[1:]
+			continue
+		}
+		if header[0] == '*' {
+			if etag != "" {
+				return condTrue
+			}
+			return condFalse
+		}
+		candidate, remain := scanETag(header)
+		if candidate == "" {
+			break
+		}
+		if etag != "" && match(candidate, etag) {
+			return condTrue
+		}
+		header = remain
+	}
+	return condFalse
+}
+
+// checkIfMatch evaluates If-Match which uses strong comparison
+func checkIfMatch(r *http.Request, etag string) condResult {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return condNone
+	}
+	return matchETags(im, etag, etagStrongMatch)
+}
+
+// checkIfUnmodifiedSince evaluates If-Unmodified-Since
+func checkIfUnmodifiedSince(r *http.Request, modTime time.Time) condResult {
+	ius := r.Header.Get("If-Unmodified-Since")
+	if ius == "" || modTime.IsZero() {
+		return condNone
+	}
+	t, err := http.ParseTime(ius)
+	if err != nil {
+		return condNone
+	}
+	// The Last-Modified header truncates sub-second precision so
+	// the modtime needs to be truncated too.
+	if !modTime.Truncate(time.Second).After(t) {
+		return condTrue
+	}
+	return condFalse
+}
+
+// checkIfNoneMatch evaluates If-None-Match which uses weak comparison.
+//
+// condFalse means the client already has a matching representation.
+func checkIfNoneMatch(r *http.Request, etag string) condResult {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return condNone
+	}
+	if matchETags(inm, etag, etagWeakMatch) == condTrue {
+		return condFalse
+	}
+	return condTrue
+}
+
+// checkIfModifiedSince evaluates If-Modified-Since which only applies
+// to GET and HEAD
+func checkIfModifiedSince(r *http.Request, modTime time.Time) condResult {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return condNone
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() {
+		return condNone
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return condNone
+	}
+	if !modTime.Truncate(time.Second).After(t) {
+		return condFalse
+	}
+	return condTrue
+}
+
+// checkIfRange evaluates If-Range.
+//
+// An entity tag must match strongly and a date must match exactly,
+// otherwise the Range header is to be ignored and the whole
+// representation sent.
+func checkIfRange(r *http.Request, etag string, modTime time.Time) condResult {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return condNone
+	}
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return condNone
+	}
+	if candidate, _ := scanETag(ir); candidate != "" {
+		if etag != "" && etagStrongMatch(candidate, etag) {
+			return condTrue
+		}
+		return condFalse
+	}
+	// The If-Range value is typically the ETag value, but it may also be
+	// the modtime date. See golang.org/issue/8367.
+	if modTime.IsZero() {
+		return condFalse
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return condFalse
+	}
+	if t.Unix() == modTime.Unix() {
+		return condTrue
+	}
+	return condFalse
+}
+
+// writePreconditions sets the ETag and Last-Modified headers for the
+// cached object and evaluates the request preconditions against them.
+//
+// If a precondition means the request must not be served, the 304 or
+// 412 response is written and its status returned. Otherwise it
+// returns 0, having removed the Range header if If-Range didn't match
+// so the full object is served.
+func writePreconditions(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) (status int) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	ch := checkIfMatch(r, etag)
+	if ch == condNone {
+		ch = checkIfUnmodifiedSince(r, modTime)
+	}
+	if ch == condFalse {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return http.StatusPreconditionFailed
+	}
+
+	switch checkIfNoneMatch(r, etag) {
+	case condFalse:
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			writeNotModified(w)
+			return http.StatusNotModified
+		}
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return http.StatusPreconditionFailed
+	case condNone:
+		if checkIfModifiedSince(r, modTime) == condFalse {
+			writeNotModified(w)
+			return http.StatusNotModified
+		}
+	}
+
+	if checkIfRange(r, etag, modTime) == condFalse {
+		r.Header.Del("Range")
+	}
+	return 0
+}
+
+// writeNotModified writes a 304 removing the headers which RFC 9110
+// section 15.4.5 says shouldn't be sent with it.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	if h.Get("Etag") != "" {
+		delete(h, "Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
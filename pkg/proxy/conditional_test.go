@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// versionedUpstream is a test origin whose content and ETag can be
+// replaced while it is running.
+type versionedUpstream struct {
+	mu   sync.Mutex
+	data []byte
+	etag string
+}
+
+func (v *versionedUpstream) set(data []byte, etag string) {
+	v.mu.Lock()
+	v.data, v.etag = data, etag
+	v.mu.Unlock()
+}
+
+func (v *versionedUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	data, etag := v.data, v.etag
+	v.mu.Unlock()
+	w.Header().Set("ETag", etag)
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func TestEntityTag(t *testing.T) {
+	modTime := time.Unix(0x5f000000, 0)
+	assert.Equal(t, `"abc"`, entityTag(`"abc"`, 10, modTime))
+	assert.Equal(t, `W/"abc"`, entityTag(`W/"abc"`, 10, modTime))
+	assert.Equal(t, `W/"5f000000-a"`, entityTag("", 10, modTime))
+	assert.Equal(t, `W/"5f000000-a"`, entityTag("not-quoted", 10, modTime))
+	assert.Equal(t, "", entityTag("", 10, time.Time{}))
+	assert.Equal(t, "", entityTag("", -1, modTime))
+}
+
+func TestWritePreconditions(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+	after := modTime.Add(time.Hour).Format(http.TimeFormat)
+	exact := modTime.Format(http.TimeFormat)
+
+	tests := []struct {
+		name      string
+		method    string
+		etag      string
+		header    map[string]string
+		want      int
+		keepRange bool
+	}{
+		{"no preconditions", "GET", `"a"`, nil, 0, true},
+		{"if-match strong hit", "GET", `"a"`, map[string]string{"If-Match": `"b", "a"`}, 0, true},
+		{"if-match miss", "GET", `"a"`, map[string]string{"If-Match": `"b"`}, 412, true},
+		{"if-match weak never matches", "GET", `W/"a"`, map[string]string{"If-Match": `W/"a"`}, 412, true},
+		{"if-match star", "GET", `"a"`, map[string]string{"If-Match": "*"}, 0, true},
+		{"if-match star without etag", "GET", "", map[string]string{"If-Match": "*"}, 412, true},
+		{"if-unmodified-since passes", "GET", `"a"`, map[string]string{"If-Unmodified-Since": after}, 0, true},
+		{"if-unmodified-since fails", "GET", `"a"`, map[string]string{"If-Unmodified-Since": before}, 412, true},
+		{"if-match overrides if-unmodified-since", "GET", `"a"`, map[string]string{"If-Match": `"a"`, "If-Unmodified-Since": before}, 0, true},
+		{"if-none-match weak hit", "GET", `"a"`, map[string]string{"If-None-Match": `W/"a"`}, 304, true},
+		{"if-none-match miss", "GET", `"a"`, map[string]string{"If-None-Match": `"b"`}, 0, true},
+		{"if-none-match on unsafe method", "DELETE", `"a"`, map[string]string{"If-None-Match": `"a"`}, 412, true},
+		{"if-modified-since not modified", "GET", `"a"`, map[string]string{"If-Modified-Since": exact}, 304, true},
+		{"if-modified-since modified", "GET", `"a"`, map[string]string{"If-Modified-Since": before}, 0, true},
+		{"if-none-match overrides if-modified-since", "GET", `"a"`, map[string]string{"If-None-Match": `"b"`, "If-Modified-Since": exact}, 0, true},
+		{"if-range etag match", "GET", `"a"`, map[string]string{"If-Range": `"a"`}, 0, true},
+		{"if-range etag mismatch", "GET", `"a"`, map[string]string{"If-Range": `"b"`}, 0, false},
+		{"if-range weak etag", "GET", `W/"a"`, map[string]string{"If-Range": `W/"a"`}, 0, false},
+		{"if-range date match", "GET", `"a"`, map[string]string{"If-Range": exact}, 0, true},
+		{"if-range date mismatch", "GET", `"a"`, map[string]string{"If-Range": before}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			r.Header.Set("Range", "bytes=0-1")
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			status := writePreconditions(w, r, tt.etag, modTime)
+			assert.Equal(t, tt.want, status)
+			if tt.want != 0 {
+				assert.Equal(t, tt.want, w.Code)
+			}
+			assert.Equal(t, tt.keepRange, r.Header.Get("Range") != "")
+		})
+	}
+}
+
+func TestETagFromUpstream(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	origin := &versionedUpstream{}
+	origin.set(data, `"v1"`)
+	upstream := httptest.NewServer(origin)
+	defer upstream.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	do := func(header map[string]string) (*http.Response, []byte) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		handler.Serve(w, r, upstream.URL)
+		resp := w.Result()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := do(nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	assert.Equal(t, data, body)
+
+	resp, _ = do(map[string]string{"If-Match": `"v0"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, _ = do(map[string]string{"If-None-Match": `W/"v1"`})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+
+	resp, body = do(map[string]string{"Range": "bytes=0-3", "If-Range": `"v1"`})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "0123", string(body))
+
+	resp, body = do(map[string]string{"Range": "bytes=0-3", "If-Range": `"v0"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+}
+
+func TestETagChangesWhenOriginReplaced(t *testing.T) {
+	v1 := []byte("first version of the file")
+	v2 := []byte("other version of the file")
+	require.Equal(t, len(v1), len(v2))
+
+	origin := &versionedUpstream{}
+	origin.set(v1, `"v1"`)
+	upstream := httptest.NewServer(origin)
+	defer upstream.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	get := func() (string, []byte) {
+		w := httptest.NewRecorder()
+		handler.Serve(w, httptest.NewRequest("GET", "/", nil), upstream.URL)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Header().Get("ETag"), body
+	}
+
+	etag, body := get()
+	assert.Equal(t, `"v1"`, etag)
+	assert.Equal(t, v1, body)
+
+	// Replace the origin content with something of equal size
+	origin.set(v2, `"v2"`)
+
+	etag, body = get()
+	assert.Equal(t, `"v2"`, etag)
+	assert.Equal(t, v2, body, fmt.Sprintf("stale content served after origin changed (etag %s)", etag))
+}
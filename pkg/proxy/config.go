@@ -0,0 +1,313 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/tgdrive/varc/internal/cache"
+	"github.com/tgdrive/varc/internal/types"
+	"github.com/tgdrive/varc/lib/file"
+)
+
+// EnvPrefix is put in front of the upper cased name of an option to
+// make the environment variable which overrides it, eg VARC_MAX_SIZE
+const EnvPrefix = "VARC_"
+
+// maxShardLevel is the most shard levels an MD5 hash can be split into
+const maxShardLevel = 16
+
+// Validate checks the options, returning all the problems found
+func (opt *Options) Validate() error {
+	_, _, err := opt.engineOptions()
+	_, transportErr := opt.upstreamTransport()
+	_, credentialsErr := opt.upstreamCredentials()
+	_, accessErr := opt.accessControl()
+	_, limitsErr := opt.rateLimits()
+	return errors.Join(err, transportErr, credentialsErr, accessErr, limitsErr)
+}
+
+// engineOptions checks the options and converts them into options for
+// the cache engine, parsing the quota group rules on the way.
+//
+// Options which aren't set keep the engine defaults in types.Opt. All
+// the problems found are returned together.
+func (opt *Options) engineOptions() (engOpt *types.Options, quotaRules []quotaRule, err error) {
+	o := types.Opt
+	engOpt = &o
+	var errs []error
+	invalid := func(name, value string, err error) {
+		errs = append(errs, fmt.Errorf("invalid %s %q: %w", name, value, err))
+	}
+	size := func(name, value string, dst *int64) {
+		if value == "" {
+			return
+		}
+		s, err := parseSize(value)
+		if err != nil {
+			invalid(name, value, err)
+			return
+		}
+		*dst = s
+	}
+	duration := func(name, value string, dst *time.Duration) {
+		if value == "" {
+			return
+		}
+		d, err := time.ParseDuration(value)
+		if err == nil && d < 0 {
+			err = errors.New("must not be negative")
+		}
+		if err != nil {
+			invalid(name, value, err)
+			return
+		}
+		*dst = d
+	}
+	notNegative := func(name string, value int) {
+		if value < 0 {
+			invalid(name, strconv.Itoa(value), errors.New("must not be negative"))
+		}
+	}
+
+	engOpt.CacheDir = opt.CacheDir
+	if engOpt.CacheDir == "" {
+		engOpt.CacheDir = filepath.Join(os.TempDir(), "varc_cache")
+	}
+	if opt.CacheDirs != "" {
+		roots, err := parseCacheDirs(opt.CacheDirs)
+		if err != nil {
+			invalid("cache_dirs", opt.CacheDirs, err)
+		}
+		engOpt.CacheRoots = roots
+	}
+
+	duration("max_age", opt.CacheMaxAge, &engOpt.CacheMaxAge)
+	if opt.CacheMaxAge != "" && engOpt.CacheMaxAge == 0 {
+		invalid("max_age", opt.CacheMaxAge, errors.New("must be more than 0"))
+	}
+	size("max_size", opt.CacheMaxSize, &engOpt.CacheMaxSize)
+	size("min_free_space", opt.CacheMinFreeSpace, &engOpt.CacheMinFreeSpace)
+	duration("poll_interval", opt.CachePollInterval, &engOpt.CachePollInterval)
+
+	size("chunk_size", opt.CacheChunkSize, &engOpt.ChunkSize)
+	size("chunk_size_limit", opt.ChunkSizeLimit, &engOpt.ChunkSizeLimit)
+	if opt.ChunkSizeLimit != "" && engOpt.ChunkSizeLimit < engOpt.ChunkSize {
+		invalid("chunk_size_limit", opt.ChunkSizeLimit, fmt.Errorf("must be at least chunk_size (%d)", engOpt.ChunkSize))
+	}
+	notNegative("chunk_streams", opt.CacheChunkStreams)
+	engOpt.ChunkStreams = opt.CacheChunkStreams
+	duration("handle_caching", opt.HandleCaching, &engOpt.HandleCaching)
+	duration("download_linger", opt.DownloadLinger, &engOpt.DownloadLinger)
+	duration("write_back", opt.WriteBack, &engOpt.WriteBack)
+	engOpt.FastFingerprint = opt.FastFingerprint
+
+	size("read_ahead_fixed", opt.ReadAheadFixed, &engOpt.ReadAhead)
+	size("read_ahead", opt.ReadAhead, &engOpt.ReadAheadMax)
+	size("read_ahead_total", opt.ReadAheadTotal, &engOpt.ReadAheadTotal)
+	if engOpt.ReadAheadTotal > 0 && engOpt.ReadAheadMax <= 0 {
+		invalid("read_ahead_total", opt.ReadAheadTotal, errors.New("has no effect without read_ahead"))
+	}
+
+	if _, err := cache.NewEvictionPolicy(opt.EvictionPolicy); err != nil {
+		invalid("eviction_policy", opt.EvictionPolicy, err)
+	}
+	engOpt.EvictionPolicy = opt.EvictionPolicy
+	if opt.EvictRanges && !file.PunchHoleSupported {
+		invalid("evict_ranges", "true", fmt.Errorf("%w on this platform", file.ErrPunchHoleUnsupported))
+	}
+	engOpt.EvictRanges = opt.EvictRanges
+	size("evict_range_size", opt.EvictRangeSize, &engOpt.EvictRangeSize)
+	size("mem_cache_size", opt.MemCacheSize, &engOpt.MemCacheSize)
+	notNegative("mem_cache_min_hits", opt.MemCacheMinHits)
+	engOpt.MemCacheMinHits = opt.MemCacheMinHits
+	engOpt.Checksums = opt.Checksums
+	duration("scrub_interval", opt.ScrubInterval, &engOpt.ScrubInterval)
+	if err := cache.CheckMetaStore(opt.MetaStore); err != nil {
+		invalid("meta_store", opt.MetaStore, err)
+	}
+	engOpt.MetaStore = opt.MetaStore
+	engOpt.LazyReload = opt.LazyReload
+	notNegative("max_nodes", opt.MaxNodes)
+	if opt.MaxNodes > 0 {
+		engOpt.MaxNodes = opt.MaxNodes
+	}
+	if opt.QuotaGroups != "" {
+		rules, groups, err := parseQuotaGroups(opt.QuotaGroups)
+		if err != nil {
+			invalid("quota_groups", opt.QuotaGroups, err)
+		}
+		quotaRules = rules
+		engOpt.QuotaGroups = groups
+	}
+
+	engOpt.CompleteInBackground = opt.BackgroundComplete
+	notNegative("complete_min_hits", opt.CompleteMinHits)
+	engOpt.CompleteMinHits = opt.CompleteMinHits
+	size("complete_min_size", opt.CompleteMinSize, &engOpt.CompleteMinSize)
+	size("complete_max_size", opt.CompleteMaxSize, &engOpt.CompleteMaxSize)
+	if engOpt.CompleteMaxSize > 0 && engOpt.CompleteMaxSize < engOpt.CompleteMinSize {
+		invalid("complete_max_size", opt.CompleteMaxSize, errors.New("must be at least complete_min_size"))
+	}
+
+	if opt.ShardLevel < 0 || opt.ShardLevel > maxShardLevel {
+		invalid("shard_level", strconv.Itoa(opt.ShardLevel), fmt.Errorf("must be between 0 and %d", maxShardLevel))
+	}
+	notNegative("max_ranges", opt.MaxRanges)
+	switch opt.WriteCache {
+	case "", WriteCacheOff, WriteCacheThrough, WriteCacheBack:
+	default:
+		invalid("write_cache", opt.WriteCache, fmt.Errorf("expecting %s, %s or %s", WriteCacheOff, WriteCacheThrough, WriteCacheBack))
+	}
+
+	if len(errs) > 0 {
+		return nil, nil, errors.Join(errs...)
+	}
+	engOpt.Logger = opt.Logger
+	engOpt.Init()
+	return engOpt, quotaRules, nil
+}
+
+// optionField returns the field of opt for the option called name, the
+// name used in the Caddyfile, config files and environment variables
+func optionField(opt *Options, name string) (reflect.Value, bool) {
+	val := reflect.ValueOf(opt).Elem()
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		tag := typ.Field(i).Tag.Get("caddy")
+		if tag != "" && tag != "-" && tag == name {
+			return val.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// SetOption sets the option called name in opt from its text form
+func SetOption(opt *Options, name, value string) error {
+	f, ok := optionField(opt, name)
+	if !ok {
+		return fmt.Errorf("unknown option %q", name)
+	}
+	switch f.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: expecting true or false", name, value)
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: expecting a whole number", name, value)
+		}
+		f.SetInt(int64(i))
+	case reflect.String:
+		f.SetString(value)
+	}
+	return nil
+}
+
+// ApplyEnv sets the options in opt which have an environment variable
+// set, eg VARC_MAX_SIZE=10G
+func ApplyEnv(opt *Options) error {
+	var errs []error
+	typ := reflect.TypeOf(*opt)
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Tag.Get("caddy")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := EnvPrefix + strings.ToUpper(name)
+		if value, ok := os.LookupEnv(key); ok {
+			if err := SetOption(opt, name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadConfig sets the options in opt from the config file at path, if
+// path is not empty, then from the environment with ApplyEnv.
+//
+// The file is JSON if it ends in .json and YAML otherwise. It holds a
+// map of option names, as used in the Caddyfile, to values. Lists are
+// joined with commas, so cache_dirs and quota_groups may be given as
+// one entry per line.
+func LoadConfig(path string, opt *Options) error {
+	if path != "" {
+		if err := loadConfigFile(path, opt); err != nil {
+			return fmt.Errorf("config file %q: %w", path, err)
+		}
+	}
+	return ApplyEnv(opt)
+}
+
+// loadConfigFile sets the options in opt from the file at path
+func loadConfigFile(path string, opt *Options) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]any
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &config)
+	} else {
+		err = yaml.Unmarshal(data, &config)
+	}
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		value, err := configValue(config[name])
+		if err == nil {
+			err = SetOption(opt, name, value)
+		} else {
+			err = fmt.Errorf("%s: %w", name, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// configValue returns the text form of a value from a config file
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64:
+		return fmt.Sprint(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case nil:
+		return "", errors.New("no value")
+	}
+	return "", fmt.Errorf("unexpected %T value", v)
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "varc.yaml")
+	require.NoError(t, os.WriteFile(yamlFile, []byte(`
+cache_dir: /var/cache/varc
+max_size: 10G
+max_age: 24h
+chunk_streams: 4
+strip_query: true
+quota_groups:
+  - video:host=cdn.example.com:max_size=5G
+  - api:prefix=https://example.com/api/
+`), 0600))
+	t.Setenv("VARC_MAX_AGE", "2h")
+	t.Setenv("VARC_EVICT_RANGES", "true")
+
+	opt := DefaultOptions()
+	require.NoError(t, LoadConfig(yamlFile, &opt))
+	assert.Equal(t, "/var/cache/varc", opt.CacheDir)
+	assert.Equal(t, "10G", opt.CacheMaxSize)
+	assert.Equal(t, "2h", opt.CacheMaxAge, "environment should override the file")
+	assert.Equal(t, 4, opt.CacheChunkStreams)
+	assert.Equal(t, 1, opt.ShardLevel, "defaults should be kept")
+	assert.True(t, opt.StripQuery)
+	assert.True(t, opt.EvictRanges)
+	assert.Equal(t, "video:host=cdn.example.com:max_size=5G,api:prefix=https://example.com/api/", opt.QuotaGroups)
+
+	jsonFile := filepath.Join(dir, "varc.json")
+	require.NoError(t, os.WriteFile(jsonFile, []byte(`{"min_free_space": "1G", "mem_cache_min_hits": 3}`), 0600))
+	opt = Options{}
+	require.NoError(t, LoadConfig(jsonFile, &opt))
+	assert.Equal(t, "1G", opt.CacheMinFreeSpace)
+	assert.Equal(t, 3, opt.MemCacheMinHits)
+
+	for _, bad := range []string{"unknown_option: 1\n", "chunk_streams: lots\n", "strip_query: maybe\n", "cache_dir: {a: b}\n", "max_size: [\n"} {
+		require.NoError(t, os.WriteFile(yamlFile, []byte(bad), 0600))
+		assert.Error(t, LoadConfig(yamlFile, &Options{}), bad)
+	}
+	assert.Error(t, LoadConfig(filepath.Join(dir, "missing.yaml"), &Options{}))
+
+	t.Setenv("VARC_SHARD_LEVEL", "deep")
+	err := ApplyEnv(&Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "VARC_SHARD_LEVEL")
+}
+
+func TestEngineOptions(t *testing.T) {
+	// Unset options keep the engine defaults
+	engOpt, _, err := (&Options{CacheDir: t.TempDir()}).engineOptions()
+	require.NoError(t, err)
+	assert.Equal(t, types.Opt.CacheMaxAge, engOpt.CacheMaxAge)
+	assert.Equal(t, types.Opt.CachePollInterval, engOpt.CachePollInterval)
+	assert.Equal(t, types.Opt.ChunkSize, engOpt.ChunkSize)
+	assert.Equal(t, types.Opt.HandleCaching, engOpt.HandleCaching)
+	assert.Equal(t, types.Opt.DownloadLinger, engOpt.DownloadLinger)
+
+	engOpt, _, err = (&Options{
+		CacheMinFreeSpace: "2G",
+		CachePollInterval: "0",
+		CacheChunkSize:    "4M",
+		ChunkSizeLimit:    "64M",
+		HandleCaching:     "0s",
+		DownloadLinger:    "30s",
+		WriteBack:         "1m",
+		FastFingerprint:   true,
+		ReadAheadFixed:    "1M",
+	}).engineOptions()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2<<30), engOpt.CacheMinFreeSpace)
+	assert.Equal(t, time.Duration(0), engOpt.CachePollInterval)
+	assert.Equal(t, int64(4<<20), engOpt.ChunkSize)
+	assert.Equal(t, int64(64<<20), engOpt.ChunkSizeLimit)
+	assert.Equal(t, time.Duration(0), engOpt.HandleCaching)
+	assert.Equal(t, 30*time.Second, engOpt.DownloadLinger)
+	assert.Equal(t, time.Minute, engOpt.WriteBack)
+	assert.True(t, engOpt.FastFingerprint)
+	assert.Equal(t, int64(1<<20), engOpt.ReadAhead)
+
+	// All the problems are reported together
+	opt := Options{
+		CacheMaxSize:   "10X",
+		CacheChunkSize: "lots",
+		CacheMaxAge:    "0s",
+		ChunkSizeLimit: "1M",
+		ShardLevel:     17,
+		EvictionPolicy: "fifo",
+		ReadAheadTotal: "1G",
+	}
+	err = opt.Validate()
+	require.Error(t, err)
+	for _, name := range []string{"max_size", "chunk_size", "max_age", "chunk_size_limit", "shard_level", "eviction_policy", "read_ahead_total"} {
+		assert.Contains(t, err.Error(), "invalid "+name+" ")
+	}
+	_, err = NewHandler(opt)
+	assert.Error(t, err)
+
+	for _, opt := range []Options{
+		{CacheMinFreeSpace: "-1G"},
+		{CachePollInterval: "-1m"},
+		{CacheChunkStreams: -1},
+		{MaxRanges: -1},
+		{CompleteMinSize: "2G", CompleteMaxSize: "1G"},
+		{MetaStore: "sqlite"},
+		{MaxNodes: -1},
+	} {
+		assert.Error(t, opt.Validate(), "%+v", opt)
+	}
+}
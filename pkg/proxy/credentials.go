@@ -0,0 +1,375 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentials are varc's own credentials for the origin. They are
+// added to reads from the hosts they are for in place of any the
+// client sent, so what those hosts serve can be cached for everyone.
+//
+// Other requests, uploads included, keep the client's credentials so
+// anyone able to reach varc can't change the origin with varc's.
+type credentials struct {
+	hosts   []string // host names, *.domain for its subdomains or * for all
+	headers http.Header
+	token   *tokenFile
+	signer  *sigV4Signer
+}
+
+// upstreamCredentials builds the credentials added to upstream
+// requests from the options, returning nil if none are set. All the
+// problems found are returned together.
+func (opt *Options) upstreamCredentials() (*credentials, error) {
+	var errs []error
+	invalid := func(name, value string, err error) {
+		errs = append(errs, fmt.Errorf("invalid %s %q: %w", name, value, err))
+	}
+	c := &credentials{}
+
+	if opt.UpstreamHeaders != "" {
+		c.headers = make(http.Header)
+		for entry := range strings.FieldsFuncSeq(opt.UpstreamHeaders, func(r rune) bool { return r == ';' || r == '\n' }) {
+			name, value, ok := strings.Cut(entry, ":")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" || strings.ContainsAny(name, " \t") {
+				invalid("upstream_headers", entry, errors.New("expecting Name: value"))
+				continue
+			}
+			c.headers.Add(name, strings.TrimSpace(value))
+		}
+	}
+
+	if opt.BearerTokenFile != "" {
+		c.token = &tokenFile{path: opt.BearerTokenFile}
+		if _, err := c.token.get(); err != nil {
+			invalid("bearer_token_file", opt.BearerTokenFile, err)
+		}
+	}
+
+	switch {
+	case opt.SigV4Region != "":
+		s := &sigV4Signer{
+			region:       opt.SigV4Region,
+			service:      opt.SigV4Service,
+			accessKey:    opt.SigV4AccessKey,
+			secretKey:    opt.SigV4SecretKey,
+			sessionToken: opt.SigV4SessionToken,
+			now:          time.Now,
+		}
+		if s.service == "" {
+			s.service = "s3"
+		}
+		if s.accessKey == "" && s.secretKey == "" {
+			s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+			s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		}
+		if s.accessKey == "" || s.secretKey == "" {
+			invalid("sigv4_region", opt.SigV4Region, errors.New("needs sigv4_access_key and sigv4_secret_key, or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY"))
+		}
+		if c.token != nil {
+			invalid("bearer_token_file", opt.BearerTokenFile, errors.New("can't be used with sigv4_region"))
+		}
+		c.signer = s
+	case opt.SigV4Service != "" || opt.SigV4AccessKey != "" || opt.SigV4SecretKey != "" || opt.SigV4SessionToken != "":
+		invalid("sigv4_region", "", errors.New("must be set to sign requests"))
+	}
+
+	if c.headers == nil && c.token == nil && c.signer == nil {
+		return nil, errors.Join(errs...)
+	}
+	for host := range strings.SplitSeq(opt.CredentialHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			c.hosts = append(c.hosts, host)
+		}
+	}
+	if len(c.hosts) == 0 {
+		// Clients choose the URLs, so sending credentials everywhere
+		// must be asked for
+		invalid("credential_hosts", opt.CredentialHosts, errors.New("must list the hosts credentials are sent to, or * for all"))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+// covers returns true if the credentials are for rawURL's host
+func (c *credentials) covers(rawURL string) bool {
+	if c == nil {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return c.coversHost(u.Hostname())
+}
+
+// coversHost returns true if the credentials are for host
+func (c *credentials) coversHost(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range c.hosts {
+		switch {
+		case pattern == "*", pattern == host:
+			return true
+		case strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]):
+			return true
+		}
+	}
+	return false
+}
+
+// apply replaces the client's credentials in req with the origin's
+func (c *credentials) apply(req *http.Request) error {
+	req.Header.Del("Authorization")
+	for k, vv := range c.headers {
+		req.Header[k] = append([]string(nil), vv...)
+	}
+	if c.token != nil {
+		token, err := c.token.get()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if c.signer != nil {
+		c.signer.sign(req)
+	}
+	return nil
+}
+
+// credentialTransport adds the credentials to the reads going through
+// it, redirects included, which are for their hosts
+type credentialTransport struct {
+	base  http.RoundTripper
+	creds *credentials
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *credentialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRead(req.Method) || !t.creds.coversHost(req.URL.Hostname()) {
+		return t.base.RoundTrip(req)
+	}
+	// A RoundTripper mustn't change the request it was given
+	req = req.Clone(req.Context())
+	if err := t.creds.apply(req); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("upstream credentials: %w", err)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// isRead returns true if method only reads
+func isRead(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// tokenFile is a bearer token read from a file, which is read again
+// whenever it changes so rotated tokens are picked up
+type tokenFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+// get returns the current token
+func (t *tokenFile) get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fi, err := os.Stat(t.path)
+	if err != nil {
+		if t.token != "" {
+			// Keep using the old token while the file is replaced
+			return t.token, nil
+		}
+		return "", err
+	}
+	if t.token != "" && fi.ModTime().Equal(t.modTime) && fi.Size() == t.size {
+		return t.token, nil
+	}
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		if t.token != "" {
+			return t.token, nil
+		}
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		if t.token != "" {
+			return t.token, nil
+		}
+		return "", errors.New("token file is empty")
+	}
+	t.token, t.modTime, t.size = token, fi.ModTime(), fi.Size()
+	return t.token, nil
+}
+
+// sigV4Signer signs requests with AWS Signature Version 4, as used by
+// S3 and the stores compatible with it
+type sigV4Signer struct {
+	region       string
+	service      string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	now          func() time.Time
+}
+
+// emptyPayloadHash is the SHA-256 of an empty body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds the signature headers to req.
+//
+// Bodies are streamed so aren't hashed, they are sent with
+// UNSIGNED-PAYLOAD which S3 accepts. The host, Range and x-amz-*
+// headers are signed.
+func (s *sigV4Signer) sign(req *http.Request) {
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	scope := t.Format("20060102") + "/" + s.region + "/" + s.service + "/aws4_request"
+
+	payloadHash := emptyPayloadHash
+	if req.Body != nil && req.Body != http.NoBody {
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// Send the path encoded the way it is signed
+	segments := strings.Split(req.URL.EscapedPath(), "/")
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = unescaped
+		}
+		segments[i] = awsEscape(segment)
+	}
+	path := strings.Join(segments, "/")
+	if path == "" {
+		path = "/"
+	}
+	if p, err := url.PathUnescape(path); err == nil {
+		req.URL.Path, req.URL.RawPath = p, path
+	}
+	canonicalURI := path
+	if s.service != "s3" {
+		// Only S3 skips encoding the path a second time
+		canonicalURI = strings.ReplaceAll(awsEscape(path), "%2F", "/")
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, vv := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			values := make([]string, len(vv))
+			for i, v := range vv {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			headers[k] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery returns the query rawQuery as SigV4 signs it: the
+// encoded parameters sorted by key, then by value. Sorting the joined
+// key=value strings instead would put a=1 after a-b=1.
+func canonicalQuery(rawQuery string) string {
+	query, _ := url.ParseQuery(rawQuery)
+	type param struct{ k, v string }
+	var params []param
+	for k, vv := range query {
+		for _, v := range vv {
+			params = append(params, param{awsEscape(k), awsEscape(v)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].k != params[j].k {
+			return params[i].k < params[j].k
+		}
+		return params[i].v < params[j].v
+	})
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p.k + "=" + p.v
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent encodes everything in s except the unreserved
+// characters, as SigV4 expects
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
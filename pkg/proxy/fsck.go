@@ -0,0 +1,19 @@
+package proxy
+
+import "github.com/tgdrive/varc/internal/cache"
+
+// Finding is a problem found in the cache by Fsck
+type Finding = cache.Finding
+
+// Fsck checks the cache directories of opt for orphaned files, size
+// mismatches, ranges beyond the end of files and chunks which fail
+// their checksums, repairing them if repair is set.
+//
+// The cache must not be in use by a Handler while this runs.
+func Fsck(opt Options, repair bool) ([]Finding, error) {
+	engOpt, _, err := opt.engineOptions()
+	if err != nil {
+		return nil, err
+	}
+	return cache.Fsck(engOpt, repair)
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tgdrive/varc/internal/types"
+)
+
+// quotaRule puts the requests matching it into a quota group
+type quotaRule struct {
+	group    string
+	hosts    []string // upstream hosts, "*.example.com" matches subdomains
+	prefixes []string // upstream URL prefixes
+	sites    []string // hosts the client requested, eg Caddy site addresses
+}
+
+// parseQuotaGroups parses a comma separated list of quota groups, each
+// a name followed by colon separated options, eg
+//
+//	video:host=cdn.example.com:host=*.video.example.com:max_size=500G,api:prefix=https://example.com/api/:max_age=10m
+//
+// Values may contain colons, as in URL prefixes and ports.
+func parseQuotaGroups(s string) (rules []quotaRule, groups []types.QuotaGroup, err error) {
+	for entry := range strings.SplitSeq(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, _ := strings.Cut(entry, ":")
+		if name == "" || strings.Contains(name, "=") {
+			return nil, nil, fmt.Errorf("%q: quota group has no name", entry)
+		}
+		// Join fields which don't start with an option onto the value
+		// before, as they were split at a colon inside it
+		var fields []string
+		if rest != "" {
+			for field := range strings.SplitSeq(rest, ":") {
+				if len(fields) > 0 && !isQuotaOption(field) {
+					fields[len(fields)-1] += ":" + field
+					continue
+				}
+				fields = append(fields, field)
+			}
+		}
+		rule := quotaRule{group: name}
+		group := types.QuotaGroup{Name: name}
+		for _, field := range fields {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, nil, fmt.Errorf("%q: expecting key=value but got %q", name, field)
+			}
+			switch key {
+			case "host":
+				rule.hosts = append(rule.hosts, strings.ToLower(value))
+			case "prefix":
+				rule.prefixes = append(rule.prefixes, value)
+			case "site":
+				rule.sites = append(rule.sites, strings.ToLower(value))
+			case "max_size":
+				group.MaxSize, err = parseSize(value)
+			case "max_age":
+				group.MaxAge, err = time.ParseDuration(value)
+			default:
+				return nil, nil, fmt.Errorf("%q: unknown option %q (want host, prefix, site, max_size or max_age)", name, key)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("%q: bad %s: %w", name, key, err)
+			}
+		}
+		if len(rule.hosts)+len(rule.prefixes)+len(rule.sites) == 0 {
+			return nil, nil, fmt.Errorf("%q: quota group needs a host, prefix or site to match", name)
+		}
+		rules = append(rules, rule)
+		groups = append(groups, group)
+	}
+	if len(rules) == 0 {
+		return nil, nil, errors.New("no quota groups")
+	}
+	return rules, groups, nil
+}
+
+// isQuotaOption returns true if field looks like key=value with a key
+// made of lower case letters and underscores
+func isQuotaOption(field string) bool {
+	key, _, ok := strings.Cut(field, "=")
+	if !ok || key == "" {
+		return false
+	}
+	for _, c := range key {
+		if (c < 'a' || c > 'z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHost returns true if host matches pattern. The port is only
+// compared if pattern has one.
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(host)
+	if !strings.Contains(pattern, ":") {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// matches returns true if the request r for targetURL is in the rule's
+// quota group
+func (rule *quotaRule) matches(r *http.Request, targetURL string) bool {
+	for _, prefix := range rule.prefixes {
+		if strings.HasPrefix(targetURL, prefix) {
+			return true
+		}
+	}
+	if len(rule.hosts) > 0 {
+		if u, err := url.Parse(targetURL); err == nil {
+			for _, host := range rule.hosts {
+				if matchHost(host, u.Host) {
+					return true
+				}
+			}
+		}
+	}
+	for _, site := range rule.sites {
+		if matchHost(site, r.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaGroup returns the quota group of the first rule the request r
+// for targetURL matches or "" if none
+func (h *Handler) quotaGroup(r *http.Request, targetURL string) string {
+	for i := range h.quotaRules {
+		if h.quotaRules[i].matches(r, targetURL) {
+			return h.quotaRules[i].group
+		}
+	}
+	return ""
+}
@@ -1,37 +1,44 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/tgdrive/varc/internal/types"
 )
 
 // testUpstream creates a test HTTP server that serves a file with Range support
 func testUpstream(t *testing.T, data []byte) *httptest.Server {
 	t.Helper()
+	lastModified := time.Now().UTC().Format(http.TimeFormat)
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Handle HEAD requests
 		if r.Method == "HEAD" {
 			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
 			w.Header().Set("Accept-Ranges", "bytes")
-			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Last-Modified", lastModified)
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
 		// Handle GET with optional Range
 		w.Header().Set("Accept-Ranges", "bytes")
-		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Last-Modified", lastModified)
 
 		rangeHeader := r.Header.Get("Range")
 		if rangeHeader == "" {
@@ -368,6 +375,125 @@ func TestParseSize(t *testing.T) {
 	}
 }
 
+func TestParseCacheDirs(t *testing.T) {
+	roots, err := parseCacheDirs("/mnt/nvme:max_size=100G, /mnt/hdd1:tier=1,/mnt/hdd2:tier=1:weight=2")
+	require.NoError(t, err)
+	assert.Equal(t, []types.CacheRoot{
+		{Path: "/mnt/nvme", MaxSize: 100 << 30},
+		{Path: "/mnt/hdd1", Tier: 1},
+		{Path: "/mnt/hdd2", Tier: 1, Weight: 2},
+	}, roots)
+
+	for _, bad := range []string{"", ",", "/a:tier", "/a:speed=1", "/a:weight=x", "/a:max_size=lots"} {
+		_, err := parseCacheDirs(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestCacheDirs(t *testing.T) {
+	data := []byte("spread over several cache directories")
+	upstream := testUpstream(t, data)
+	defer upstream.Close()
+
+	fast, slow := t.TempDir(), t.TempDir()
+	handler, err := NewHandler(Options{
+		CacheDirs:         fast + ":max_size=1M," + slow + ":tier=1",
+		CacheChunkStreams: 1,
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	w := httptest.NewRecorder()
+	handler.Serve(w, httptest.NewRequest("GET", "/", nil), upstream.URL)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+
+	// New items land on the fast tier
+	var files []string
+	require.NoError(t, filepath.WalkDir(filepath.Join(fast, "data"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	}))
+	assert.Len(t, files, 1)
+
+	_, err = NewHandler(Options{CacheDirs: fast + ":tier=x"})
+	assert.Error(t, err)
+}
+
+func TestParseQuotaGroups(t *testing.T) {
+	rules, groups, err := parseQuotaGroups("video:host=*.cdn.example.com:host=media.example.com:8443:max_size=500G, api:prefix=https://example.com/api/?v=2:max_age=10m,site:site=a.example.org")
+	require.NoError(t, err)
+	assert.Equal(t, []quotaRule{
+		{group: "video", hosts: []string{"*.cdn.example.com", "media.example.com:8443"}},
+		{group: "api", prefixes: []string{"https://example.com/api/?v=2"}},
+		{group: "site", sites: []string{"a.example.org"}},
+	}, rules)
+	assert.Equal(t, []types.QuotaGroup{
+		{Name: "video", MaxSize: 500 << 30},
+		{Name: "api", MaxAge: 10 * time.Minute},
+		{Name: "site"},
+	}, groups)
+
+	for _, bad := range []string{"", ",", "video", ":host=a", "video:max_size=1G", "video:host=a:colour=red", "video:host=a:max_size=lots", "video:host=a:max_age=1y"} {
+		_, _, err := parseQuotaGroups(bad)
+		assert.Error(t, err, bad)
+	}
+
+	r := httptest.NewRequest("GET", "http://a.example.org:8080/", nil)
+	for _, test := range []struct {
+		url  string
+		want bool
+	}{
+		{"https://x.cdn.example.com/a.ts", true},
+		{"https://cdn.example.com/a.ts", false},
+		{"https://media.example.com:8443/a.ts", true},
+		{"https://media.example.com/a.ts", false},
+	} {
+		assert.Equal(t, test.want, rules[0].matches(r, test.url), test.url)
+	}
+	assert.True(t, rules[2].matches(r, "https://example.net/"))
+}
+
+func TestQuotaGroups(t *testing.T) {
+	data := []byte("quota groups")
+	noisy := testUpstream(t, data)
+	defer noisy.Close()
+	quiet := testUpstream(t, data)
+	defer quiet.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+		QuotaGroups:       "noisy:prefix=" + noisy.URL + "/:max_size=1M,quiet:site=quiet.example.com",
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	for _, target := range []string{noisy.URL + "/a", noisy.URL + "/b", quiet.URL + "/c"} {
+		w := httptest.NewRecorder()
+		handler.Serve(w, httptest.NewRequest("GET", "http://quiet.example.com/", nil), target)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Equal(t, "noisy", handler.Engine.CacheItem(handler.hashCachePath(noisy.URL+"/a")).GetGroup())
+	assert.Equal(t, "quiet", handler.Engine.CacheItem(handler.hashCachePath(quiet.URL+"/c")).GetGroup())
+
+	mw := httptest.NewRecorder()
+	handler.ServeMetrics(mw)
+	var stats struct {
+		QuotaGroups map[string]map[string]int64 `json:"quota_groups"`
+	}
+	require.NoError(t, json.Unmarshal(mw.Body.Bytes(), &stats))
+	assert.Equal(t, int64(2), stats.QuotaGroups["noisy"]["files"])
+	assert.Equal(t, int64(2*len(data)), stats.QuotaGroups["noisy"]["bytesUsed"])
+	assert.Equal(t, int64(1<<20), stats.QuotaGroups["noisy"]["maxSize"])
+	assert.Equal(t, int64(1), stats.QuotaGroups["quiet"]["files"])
+
+	_, err = NewHandler(Options{CacheDir: t.TempDir(), QuotaGroups: "noisy:max_size=1M"})
+	assert.Error(t, err)
+}
+
 func TestOptionsNewHandler(t *testing.T) {
 	cacheDir := filepath.Join(t.TempDir(), "test-cache")
 	opt := Options{
@@ -686,3 +812,110 @@ func TestConcurrentRangeRequests(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestEvictionPolicyMetrics(t *testing.T) {
+	data := []byte("eviction policy metrics test")
+	upstream := testUpstream(t, data)
+	defer upstream.Close()
+
+	_, err := NewHandler(Options{CacheDir: t.TempDir(), EvictionPolicy: "random"})
+	assert.Error(t, err)
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+		EvictionPolicy:    "tinylfu",
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		handler.Serve(w, httptest.NewRequest("GET", "/", nil), upstream.URL)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	mw := httptest.NewRecorder()
+	handler.ServeMetrics(mw)
+	var stats map[string]any
+	require.NoError(t, json.Unmarshal(mw.Body.Bytes(), &stats))
+	assert.Equal(t, "tinylfu", stats["eviction_policy"])
+	assert.Equal(t, 0.5, stats["hit_ratio"])
+	assert.Equal(t, float64(0), stats["evictions"])
+}
+
+func TestClientDisconnect(t *testing.T) {
+	data := make([]byte, 1<<20)
+	var stallHead atomic.Bool
+	cancelled := make(chan string, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going once the body is read
+		io.Copy(io.Discard, r.Body)
+		if r.Method == http.MethodHead && !stallHead.Load() {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		if r.Method == http.MethodGet {
+			// Send the first half then stall
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+		cancelled <- r.Method
+	}))
+	defer upstream.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+		ShardLevel:        0,
+		DownloadLinger:    "50ms",
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	// serve makes a request which the client gives up on
+	serve := func(method, rangeHeader string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		r := httptest.NewRequest(method, "/", strings.NewReader("body")).WithContext(ctx)
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handler.Serve(httptest.NewRecorder(), r, upstream.URL)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s %s: request didn't finish", method, rangeHeader)
+		}
+	}
+	wantCancelled := func(method string) {
+		select {
+		case got := <-cancelled:
+			assert.Equal(t, method, got)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("upstream %s wasn't cancelled", method)
+		}
+	}
+
+	// Passthrough requests are cancelled with the client
+	serve(http.MethodPost, "")
+	wantCancelled(http.MethodPost)
+
+	// So is the HEAD for the size of the file
+	stallHead.Store(true)
+	serve(http.MethodGet, "")
+	wantCancelled(http.MethodHead)
+	stallHead.Store(false)
+
+	// The download carries on for the linger period then stops
+	serve(http.MethodGet, "bytes=900000-900999")
+	wantCancelled(http.MethodGet)
+	assert.Equal(t, int64(1), handler.Engine.Stats()["downloadsCancelled"])
+}
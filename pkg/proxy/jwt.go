@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is how far clocks may disagree when checking the times in
+// a token
+const jwtLeeway = 30 * time.Second
+
+// jwtVerifier checks JSON Web Tokens signed with HS256 using secret, or
+// with RS256, ES256 or EdDSA using publicKey
+type jwtVerifier struct {
+	secret    []byte
+	publicKey crypto.PublicKey
+	audience  string // required aud claim, any if ""
+}
+
+// newJWTVerifier makes a jwtVerifier for tokens signed with secret or
+// the public key in the PEM file publicKeyFile, either of which may be
+// empty
+func newJWTVerifier(secret []byte, publicKeyFile, audience string) (*jwtVerifier, error) {
+	v := &jwtVerifier{secret: secret, audience: audience}
+	if publicKeyFile == "" {
+		return v, nil
+	}
+	data, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey = cert.PublicKey
+	default:
+		if v.publicKey, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	switch key := v.publicKey.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+	case *ecdsa.PublicKey:
+		if key.Curve.Params().BitSize != 256 {
+			return nil, errors.New("only P-256 ECDSA keys are supported")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", v.publicKey)
+	}
+	return v, nil
+}
+
+// jwtClaims are the registered claims checked
+type jwtClaims struct {
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Audience  json.RawMessage `json:"aud"`   // a string or a list of them
+	Scope     string          `json:"scope"` // space separated
+}
+
+// verify checks the signature of token and that it is valid at now
+func (v *jwtVerifier) verify(token string, now time.Time) error {
+	_, err := v.claims(token, now)
+	return err
+}
+
+// claims verifies token as verify does, returning its claims
+func (v *jwtVerifier) claims(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := parts[0] + "." + parts[1]
+	hash := sha256.Sum256([]byte(signed))
+
+	// The algorithm must match the key so a public key can't be used
+	// as an HMAC secret
+	valid := false
+	switch key := v.publicKey.(type) {
+	case *rsa.PublicKey:
+		valid = header.Alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	case *ecdsa.PublicKey:
+		valid = header.Alg == "ES256" && len(sig) == 64 &&
+			ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case ed25519.PublicKey:
+		valid = header.Alg == "EdDSA" && ed25519.Verify(key, []byte(signed), sig)
+	}
+	if !valid && header.Alg == "HS256" && len(v.secret) > 0 {
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		valid = hmac.Equal(sig, mac.Sum(nil))
+	}
+	if !valid {
+		return nil, errors.New("bad signature")
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt != nil && now.After(time.Unix(int64(*claims.ExpiresAt), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Before(time.Unix(int64(*claims.NotBefore), 0).Add(-jwtLeeway)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if v.audience != "" {
+		var audience []string
+		if err := json.Unmarshal(claims.Audience, &audience); err != nil {
+			var single string
+			if json.Unmarshal(claims.Audience, &single) == nil {
+				audience = []string{single}
+			}
+		}
+		if !slices.Contains(audience, v.audience) {
+			return nil, errors.New("token is for another audience")
+		}
+	}
+	return &claims, nil
+}
+
+// decodeJWTPart decodes a base64 encoded JSON part of a token into v
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters binding a signed link to a client and a part of
+// the file
+const (
+	paramClientIP = "ip"
+	paramRange    = "range"
+)
+
+// Link is a signed link reading an upstream URL through varc
+type Link struct {
+	URL      string    // upstream URL
+	Expires  time.Time // when the link stops working
+	ClientIP string    // address or CIDR the link may only be used from, any if ""
+	Range    string    // bytes the link may read as first-last or first-, all if ""
+}
+
+// SignLink returns the /stream/ path and query of link signed with
+// key, to be appended to the address varc is served on
+func SignLink(key string, link Link) (string, error) {
+	if key == "" {
+		return "", errors.New("no signing key")
+	}
+	if u, err := url.Parse(link.URL); err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid upstream URL %q", link.URL)
+	}
+	if link.Expires.IsZero() {
+		return "", errors.New("signed links must expire")
+	}
+	if link.ClientIP != "" {
+		if _, err := parseClientIP(link.ClientIP); err != nil {
+			return "", err
+		}
+	}
+	if link.Range != "" {
+		if _, _, err := parseLinkRange(link.Range); err != nil {
+			return "", err
+		}
+	}
+	query := url.Values{}
+	query.Set(paramExpires, strconv.FormatInt(link.Expires.Unix(), 10))
+	if link.ClientIP != "" {
+		query.Set(paramClientIP, link.ClientIP)
+	}
+	if link.Range != "" {
+		query.Set(paramRange, link.Range)
+	}
+	query.Set(paramSig, linkSignature([]byte(key), link))
+	return "/stream/" + base64.RawURLEncoding.EncodeToString([]byte(link.URL)) + "?" + query.Encode(), nil
+}
+
+// SignLink signs link with the first of the signing keys, see SignLink
+func (h *Handler) SignLink(link Link) (string, error) {
+	if h.access == nil || len(h.access.signingKeys) == 0 {
+		return "", errors.New("no signing keys configured")
+	}
+	return SignLink(string(h.access.signingKeys[0]), link)
+}
+
+// linkSignature returns the signature of link made with key.
+//
+// It is the HMAC-SHA256 of the expiry time and the upstream URL on
+// separate lines, followed by a line for each of the client address
+// and range which are set.
+func linkSignature(key []byte, link Link) string {
+	msg := strconv.FormatInt(link.Expires.Unix(), 10) + "\n" + link.URL
+	if link.ClientIP != "" {
+		msg += "\n" + paramClientIP + "=" + link.ClientIP
+	}
+	if link.Range != "" {
+		msg += "\n" + paramRange + "=" + link.Range
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyLink checks the signed link r for targetURL was made with one
+// of keys and is being used as it allows, limiting the Range of r to
+// the bytes it may read
+func verifyLink(r *http.Request, targetURL string, keys [][]byte, trustedProxies []netip.Prefix) error {
+	if !isRead(r.Method) {
+		return errors.New("signed URLs can only be read")
+	}
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get(paramExpires), 10, 64)
+	if err != nil {
+		return errors.New("signed URL has no expiry")
+	}
+	link := Link{
+		URL:      targetURL,
+		Expires:  time.Unix(expires, 0),
+		ClientIP: query.Get(paramClientIP),
+		Range:    query.Get(paramRange),
+	}
+	sig := []byte(query.Get(paramSig))
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal(sig, []byte(linkSignature(key, link))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return errors.New("invalid URL signature")
+	}
+	if time.Now().After(link.Expires) {
+		return errors.New("signed URL has expired")
+	}
+	if link.ClientIP != "" {
+		allowed, err := parseClientIP(link.ClientIP)
+		if err != nil || !allowed.Contains(clientIP(r, trustedProxies)) {
+			return errors.New("signed URL is for another client")
+		}
+	}
+	if link.Range != "" {
+		first, last, err := parseLinkRange(link.Range)
+		if err != nil {
+			return err
+		}
+		limited, err := limitRange(r.Header.Get("Range"), first, last)
+		if err != nil {
+			return err
+		}
+		// If-Range failing to match would have the whole file sent
+		r.Header.Set("Range", limited)
+		r.Header.Del("If-Range")
+	}
+	return nil
+}
+
+// limitsRange returns true if r is a signed link limited to a range of
+// the file. Only varc can be trusted to keep to the range, so these
+// are always served from the cache rather than passed through.
+func (a *accessControl) limitsRange(r *http.Request) bool {
+	if a == nil || len(a.signingKeys) == 0 {
+		return false
+	}
+	query := r.URL.Query()
+	return query.Get(paramSig) != "" && query.Get(paramRange) != ""
+}
+
+// parseClientIP parses the address or CIDR a link is bound to
+func parseClientIP(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return prefix, fmt.Errorf("invalid client IP %q: %w", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid client IP %q: %w", s, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parseLinkRange parses the bytes a link may read, first-last or
+// first-, returning -1 for last if it is open ended
+func parseLinkRange(s string) (first, last int64, err error) {
+	firstStr, lastStr, ok := strings.Cut(s, "-")
+	if first, err = strconv.ParseInt(firstStr, 10, 64); !ok || err != nil || first < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q: expecting first-last or first-", s)
+	}
+	if lastStr == "" {
+		return first, -1, nil
+	}
+	if last, err = strconv.ParseInt(lastStr, 10, 64); err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid range %q: expecting first-last or first-", s)
+	}
+	return first, last, nil
+}
+
+// limitRange returns the Range header rangeHeader limited to the bytes
+// from first to last, or to the end if last is -1. Without a Range
+// header it asks for all of those bytes.
+//
+// Suffix ranges can't be checked before the size is known so are
+// refused, as are ranges entirely outside the limits.
+func limitRange(rangeHeader string, first, last int64) (string, error) {
+	limit := func(a, b int64) string {
+		if b < 0 {
+			return strconv.FormatInt(a, 10) + "-"
+		}
+		return strconv.FormatInt(a, 10) + "-" + strconv.FormatInt(b, 10)
+	}
+	if rangeHeader == "" {
+		return "bytes=" + limit(first, last), nil
+	}
+	specs, ok := strings.CutPrefix(rangeHeader, "bytes=")
+	if !ok {
+		return "", errors.New("invalid Range header")
+	}
+	var limited []string
+	for spec := range strings.SplitSeq(specs, ",") {
+		startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+		start, err := strconv.ParseInt(startStr, 10, 64)
+		if !ok || err != nil || start < 0 {
+			return "", errors.New("signed URL only allows ranges with a start")
+		}
+		end := int64(-1)
+		if endStr != "" {
+			if end, err = strconv.ParseInt(endStr, 10, 64); err != nil || end < start {
+				return "", errors.New("invalid Range header")
+			}
+		}
+		start = max(start, first)
+		if last >= 0 && (end < 0 || end > last) {
+			end = last
+		}
+		if end >= 0 && start > end {
+			return "", errors.New("range outside the bytes the signed URL allows")
+		}
+		limited = append(limited, limit(start, end))
+	}
+	return "bytes=" + strings.Join(limited, ","), nil
+}
+
+// clientIP returns the address of the client making r. Requests from
+// trustedProxies are taken to be from the last address before them in
+// X-Forwarded-For.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr := addrPort.Addr().Unmap()
+	trusted := func(addr netip.Addr) bool {
+		for _, prefix := range trustedProxies {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	if !trusted(addr) {
+		return addr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !trusted(addr) {
+			break
+		}
+	}
+	return addr
+}
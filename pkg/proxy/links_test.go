@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignLink(t *testing.T) {
+	expires := time.Unix(1700000000, 0)
+	link, err := SignLink("key", Link{URL: "https://example.com/video.mp4", Expires: expires})
+	require.NoError(t, err)
+	assert.Equal(t, "/stream/aHR0cHM6Ly9leGFtcGxlLmNvbS92aWRlby5tcDQ?expires=1700000000&sig="+
+		linkSignature([]byte("key"), Link{URL: "https://example.com/video.mp4", Expires: expires}), link)
+
+	bound, err := SignLink("key", Link{URL: "https://example.com/video.mp4", Expires: expires, ClientIP: "192.0.2.0/24", Range: "0-1023"})
+	require.NoError(t, err)
+	assert.Contains(t, bound, "ip=192.0.2.0%2F24")
+	assert.Contains(t, bound, "range=0-1023")
+	assert.NotEqual(t, link[strings.Index(link, "sig="):], bound[strings.Index(bound, "sig="):])
+
+	for _, bad := range []Link{
+		{URL: "https://example.com/a"},
+		{URL: "not a url", Expires: expires},
+		{URL: "https://example.com/a", Expires: expires, ClientIP: "somewhere"},
+		{URL: "https://example.com/a", Expires: expires, Range: "-500"},
+		{URL: "https://example.com/a", Expires: expires, Range: "10-5"},
+	} {
+		_, err := SignLink("key", bad)
+		assert.Error(t, err, bad)
+	}
+	_, err = SignLink("", Link{URL: "https://example.com/a", Expires: expires})
+	assert.Error(t, err)
+}
+
+func TestLimitRange(t *testing.T) {
+	for _, test := range []struct {
+		header      string
+		first, last int64
+		want        string // "" for an error
+	}{
+		{"", 0, 1023, "bytes=0-1023"},
+		{"", 100, -1, "bytes=100-"},
+		{"bytes=0-", 0, 1023, "bytes=0-1023"},
+		{"bytes=10-20", 0, 1023, "bytes=10-20"},
+		{"bytes=1000-2000", 0, 1023, "bytes=1000-1023"},
+		{"bytes=0-99, 200-", 100, -1, ""}, // the first range is before the limit
+		{"bytes=0-99,200-", 50, 299, "bytes=50-99,200-299"},
+		{"bytes=2000-", 0, 1023, ""},
+		{"bytes=-500", 0, 1023, ""},
+		{"items=0-1", 0, 1023, ""},
+	} {
+		got, err := limitRange(test.header, test.first, test.last)
+		if test.want == "" {
+			assert.Error(t, err, test.header)
+		} else {
+			require.NoError(t, err, test.header)
+			assert.Equal(t, test.want, got, test.header)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	for _, test := range []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"}, // not from a trusted proxy
+		{"10.0.0.5:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"10.0.0.5:1234", []string{"6.6.6.6, 198.51.100.7, 10.0.0.9"}, "198.51.100.7"},
+		{"10.0.0.5:1234", []string{"6.6.6.6", "198.51.100.7"}, "198.51.100.7"},
+		{"[::ffff:192.0.2.1]:1234", nil, "192.0.2.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		for _, f := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		assert.Equal(t, test.want, clientIP(r, trusted).String(), test)
+	}
+}
+
+func TestSignedLinkBindings(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	upstream, _ := accessUpstream(t, data)
+	handler, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1, SigningKeys: "k1,k0", TrustedProxies: "10.0.0.0/8"})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	serve := func(link, remote string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, link, nil)
+		r.RemoteAddr = remote
+		for k, vv := range header {
+			r.Header[k] = vv
+		}
+		w := httptest.NewRecorder()
+		handler.Serve(w, r, TargetURL(r))
+		return w
+	}
+	expires := time.Now().Add(time.Hour)
+
+	link, err := handler.SignLink(Link{URL: upstream.URL + "/ip", Expires: expires, ClientIP: "192.0.2.1"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve(link, "192.0.2.1:1000", nil).Code)
+	assert.Equal(t, http.StatusForbidden, serve(link, "198.51.100.1:1000", nil).Code)
+	assert.Equal(t, http.StatusOK, serve(link, "10.1.1.1:1000", http.Header{"X-Forwarded-For": {"192.0.2.1"}}).Code)
+	assert.Equal(t, http.StatusForbidden, serve(strings.Replace(link, "ip=192.0.2.1", "ip=198.51.100.1", 1), "198.51.100.1:1000", nil).Code)
+	assert.Equal(t, http.StatusForbidden, serve(strings.Replace(link, "&ip=192.0.2.1", "", 1), "198.51.100.1:1000", nil).Code)
+
+	link, err = handler.SignLink(Link{URL: upstream.URL + "/range", Expires: expires, Range: "0-9"})
+	require.NoError(t, err)
+	w := serve(link, "192.0.2.1:1000", nil)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, data[:10], w.Body.Bytes())
+	w = serve(link, "192.0.2.1:1000", http.Header{"Range": {"bytes=5-"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, data[5:10], w.Body.Bytes())
+	assert.Equal(t, http.StatusForbidden, serve(link, "192.0.2.1:1000", http.Header{"Range": {"bytes=-5"}}).Code)
+	// Neither a failed If-Range nor being passed through gets round it
+	for _, header := range []http.Header{
+		{"Range": {"bytes=0-"}, "If-Range": {`"nope"`}},
+		{"Range": {"bytes=0-"}, "If-Range": {`"nope"`}, "Cookie": {"session=1"}},
+		{"Cookie": {"session=1"}},
+	} {
+		w = serve(link, "192.0.2.1:1000", header)
+		assert.Equal(t, http.StatusPartialContent, w.Code, header)
+		assert.Equal(t, data[:10], w.Body.Bytes(), header)
+	}
+	assert.Equal(t, http.StatusForbidden, serve(link, "192.0.2.1:1000", http.Header{"Range": {"bytes=20-30"}}).Code)
+
+	// Links signed with any of the keys are accepted
+	old, err := SignLink("k0", Link{URL: upstream.URL + "/old", Expires: expires})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve(old, "192.0.2.1:1000", nil).Code)
+
+	noKeys, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1})
+	require.NoError(t, err)
+	defer noKeys.Shutdown()
+	_, err = noKeys.SignLink(Link{URL: upstream.URL, Expires: expires})
+	assert.Error(t, err)
+}
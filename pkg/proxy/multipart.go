@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tgdrive/varc/internal/cache"
+	"github.com/tgdrive/varc/lib/ranges"
+)
+
+// DefaultMaxRanges is the number of ranges a client may ask for in a
+// single multi-range request if Options.MaxRanges isn't set.
+const DefaultMaxRanges = 16
+
+// errNoOverlap is returned by parseRange if none of the ranges overlap
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// httpRange specifies the byte range to be sent to the client.
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange parses a Range header string as per RFC 7233.
+// errNoOverlap is returned if none of the ranges overlap.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil // header not present
+	}
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errors.New("invalid range")
+	}
+	var rs []httpRange
+	noOverlap := false
+	for ra := range strings.SplitSeq(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errors.New("invalid range")
+		}
+		start, end = textproto.TrimString(start), textproto.TrimString(end)
+		var r httpRange
+		if start == "" {
+			// If no start is specified, end specifies the
+			// range start relative to the end of the file,
+			// and we are dealing with <suffix-length>
+			// which has to be a non-negative integer as per
+			// RFC 7233 Section 2.1 "Byte-Ranges".
+			if end == "" || end[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if i < 0 || err != nil {
+				return nil, errors.New("invalid range")
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if i >= size {
+				// If the range begins after the size of the content,
+				// then it does not overlap.
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				// If no end is specified, range extends to end of the file.
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errors.New("invalid range")
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		rs = append(rs, r)
+	}
+	if noOverlap && len(rs) == 0 {
+		// The specified ranges did not overlap with the content.
+		return nil, errNoOverlap
+	}
+	return rs, nil
+}
+
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// rangesMIMESize returns the number of bytes it takes to encode the
+// provided ranges as a multipart response.
+func rangesMIMESize(rs []httpRange, contentType string, size int64) (encSize int64) {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	for _, ra := range rs {
+		_, _ = mw.CreatePart(ra.mimeHeader(contentType, size))
+		encSize += ra.length
+	}
+	_ = mw.Close()
+	encSize += int64(w)
+	return encSize
+}
+
+// sumRangesSize returns the total number of bytes in the ranges
+func sumRangesSize(rs []httpRange) (size int64) {
+	for _, ra := range rs {
+		size += ra.length
+	}
+	return size
+}
+
+// fetchRanges makes sure every range is present in the cache item,
+// fetching the missing parts of each from upstream concurrently. It
+// stops waiting once ctx is done.
+func fetchRanges(ctx context.Context, item *cache.Item, rs []httpRange) error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(rs))
+	)
+	for i, ra := range rs {
+		r := ranges.Range{Pos: ra.start, Size: ra.length}
+		if item.FindMissing(r).IsEmpty() {
+			continue
+		}
+		wg.Go(func() {
+			errs[i] = item.EnsureRange(ctx, r)
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// serveMultipart writes a multipart/byteranges response for rs.
+//
+// All the ranges are brought into the cache before the response is
+// started so an upstream failure can still be reported with a proper
+// status code. It returns the number of bytes sent and the status.
+func (h *Handler) serveMultipart(w http.ResponseWriter, r *http.Request, item *cache.Item, content io.ReaderAt, rs []httpRange, contentType string, size int64) (sent int64, status int) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	sendSize := rangesMIMESize(rs, contentType, size)
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	writeHeader := func() {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+		w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	// The headers don't depend on the data so a HEAD fetches nothing
+	if r.Method == http.MethodHead {
+		writeHeader()
+		return 0, http.StatusPartialContent
+	}
+	if err := fetchRanges(r.Context(), item, rs); err != nil {
+		http.Error(w, "Failed to fetch ranges: "+err.Error(), http.StatusBadGateway)
+		return 0, http.StatusBadGateway
+	}
+
+	go func() {
+		for _, ra := range rs {
+			part, err := mw.CreatePart(ra.mimeHeader(contentType, size))
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(part, io.NewSectionReader(content, ra.start, ra.length)); err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+		_ = mw.Close()
+		_ = pw.Close()
+	}()
+	defer func() { _ = pr.Close() }()
+
+	writeHeader()
+	sent, _ = io.CopyN(w, pr, sendSize)
+	return sent, http.StatusPartialContent
+}
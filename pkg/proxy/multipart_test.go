@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	rs, err := parseRange("bytes=0-9, 20-, -5", 100)
+	require.NoError(t, err)
+	assert.Equal(t, []httpRange{{0, 10}, {20, 80}, {95, 5}}, rs)
+
+	_, err = parseRange("bytes=200-300", 100)
+	assert.Equal(t, errNoOverlap, err)
+
+	_, err = parseRange("items=0-1", 100)
+	assert.Error(t, err)
+}
+
+func TestMultipartByteranges(t *testing.T) {
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	upstream, stats := trackedUpstream(t, data)
+	defer upstream.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+		ShardLevel:        0,
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=0-99,500-599,-10")
+	handler.Serve(w, r, upstream.URL)
+
+	resp := w.Result()
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode, w.Body.String())
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	assert.Equal(t, strconv.Itoa(w.Body.Len()), resp.Header.Get("Content-Length"))
+
+	want := []struct {
+		contentRange string
+		body         []byte
+	}{
+		{"bytes 0-99/4096", data[0:100]},
+		{"bytes 500-599/4096", data[500:600]},
+		{"bytes 4086-4095/4096", data[4086:]},
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for i, wantPart := range want {
+		part, err := mr.NextPart()
+		require.NoError(t, err, "part %d", i)
+		assert.Equal(t, wantPart.contentRange, part.Header.Get("Content-Range"))
+		body, err := io.ReadAll(part)
+		require.NoError(t, err)
+		assert.Equal(t, wantPart.body, body)
+	}
+	_, err = mr.NextPart()
+	assert.Equal(t, io.EOF, err)
+	assert.NotZero(t, stats.rangeCount.Load(), "expected ranged upstream fetches: %s", stats)
+
+	// The same ranges are now cached so shouldn't cause upstream GETs
+	gets := stats.getTotal.Load()
+	w = httptest.NewRecorder()
+	handler.Serve(w, r, upstream.URL)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, gets, stats.getTotal.Load(), "unexpected upstream fetches: %s", stats)
+}
+
+func TestMultipartHead(t *testing.T) {
+	data := make([]byte, 4096)
+	upstream, stats := trackedUpstream(t, data)
+	defer upstream.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+		ShardLevel:        0,
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	serve := func(method string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set("Range", "bytes=0-99,500-599")
+		handler.Serve(w, r, upstream.URL)
+		return w
+	}
+	head := serve(http.MethodHead)
+	assert.Equal(t, http.StatusPartialContent, head.Code)
+	assert.Zero(t, head.Body.Len())
+	assert.Contains(t, head.Header().Get("Content-Type"), "multipart/byteranges")
+	assert.Zero(t, stats.getTotal.Load(), "HEAD fetched data: %s", stats)
+
+	get := serve(http.MethodGet)
+	assert.Equal(t, http.StatusPartialContent, get.Code)
+	assert.Equal(t, strconv.Itoa(get.Body.Len()), head.Header().Get("Content-Length"))
+}
+
+func TestMultipartTooManyRanges(t *testing.T) {
+	data := []byte(strings.Repeat("x", 1000))
+	upstream := testUpstream(t, data)
+	defer upstream.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+		MaxRanges:         2,
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=0-1,10-11,20-21")
+	handler.Serve(w, r, upstream.URL)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, w.Code)
+	assert.Equal(t, "bytes */1000", w.Header().Get("Content-Range"))
+}
@@ -3,23 +3,28 @@ package proxy
 import (
 	"context"
 	"crypto/md5"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
-	"os"
 	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/tgdrive/varc/internal"
+	"github.com/tgdrive/varc/internal/cache"
 	"github.com/tgdrive/varc/internal/types"
 )
 
+// statusClientClosedRequest is logged for requests abandoned by the
+// client before a response was sent
+const statusClientClosedRequest = 499
+
 // Metrics tracks cache proxy performance counters.
 type Metrics struct {
 	mu   sync.Mutex
@@ -28,7 +33,11 @@ type Metrics struct {
 	Misses          int64 `json:"misses"`
 	BytesServed     int64 `json:"bytes_served"`
 	BytesFromUpstream int64 `json:"bytes_from_upstream"`
-	Purges          int64 `json:"purges"`
+	Purges            int64 `json:"purges"`
+	Writes            int64 `json:"writes"`
+	BytesWritten      int64 `json:"bytes_written"`
+	Denied            int64 `json:"denied"`       // requests refused by the access control
+	RateLimited       int64 `json:"rate_limited"` // requests refused for going over a client limit
 }
 
 // Snapshot returns a copy of the current metrics as a map.
@@ -42,6 +51,10 @@ func (m *Metrics) Snapshot() map[string]int64 {
 		"bytes_served":        m.BytesServed,
 		"bytes_from_upstream": m.BytesFromUpstream,
 		"purges":              m.Purges,
+		"writes":              m.Writes,
+		"bytes_written":       m.BytesWritten,
+		"denied":              m.Denied,
+		"rate_limited":        m.RateLimited,
 	}
 }
 
@@ -63,16 +76,88 @@ func (m *Metrics) add(field *int64, n int64) {
 
 // Options holds configuration for the cache proxy handler
 type Options struct {
-	CacheDir          string       `caddy:"cache_dir"`
-	CacheMaxAge       string       `caddy:"max_age"`
-	CacheMaxSize      string       `caddy:"max_size"`
-	CacheChunkSize    string       `caddy:"chunk_size"`
-	CacheChunkStreams int          `caddy:"chunk_streams"`
-	StripQuery        bool         `caddy:"strip_query"`
-	StripDomain       bool         `caddy:"strip_domain"`
-	ShardLevel        int          `caddy:"shard_level"`
-	Passthrough       bool         `caddy:"passthrough"`
-	Logger            types.Logger `caddy:"-"`
+	CacheDir          string `caddy:"cache_dir"`
+	CacheDirs         string `caddy:"cache_dirs"` // path[:weight=N][:max_size=S][:tier=N],... used instead of CacheDir
+	CacheMaxAge       string `caddy:"max_age"`
+	CacheMaxSize      string `caddy:"max_size"`
+	CacheMinFreeSpace string `caddy:"min_free_space"` // evict to keep this much space free on each cache disk
+	CachePollInterval string `caddy:"poll_interval"`  // how often the cache is cleaned, 0 to never clean
+	CacheChunkSize    string `caddy:"chunk_size"`
+	ChunkSizeLimit    string `caddy:"chunk_size_limit"` // double single stream chunks up to this
+	CacheChunkStreams int    `caddy:"chunk_streams"`
+	HandleCaching     string `caddy:"handle_caching"`   // how long files are kept open after the last reader
+	DownloadLinger    string `caddy:"download_linger"`  // how long downloads carry on for after their clients have gone
+	WriteBack         string `caddy:"write_back"`       // how long to wait before uploading changed files
+	FastFingerprint   bool   `caddy:"fast_fingerprint"` // don't use slow to fetch details in fingerprints
+	StripQuery        bool   `caddy:"strip_query"`
+	StripDomain       bool   `caddy:"strip_domain"`
+	ShardLevel        int    `caddy:"shard_level"`
+	Passthrough       bool   `caddy:"passthrough"`
+	MaxRanges         int    `caddy:"max_ranges"`
+	ReadAheadFixed    string `caddy:"read_ahead_fixed"`   // read ahead for every read when not adaptive
+	ReadAhead         string `caddy:"read_ahead"`         // max adaptive read ahead per reader
+	ReadAheadTotal    string `caddy:"read_ahead_total"`   // max read ahead across all readers
+	EvictionPolicy    string `caddy:"eviction_policy"`    // lru, lfu, tinylfu or gdsf
+	EvictRanges       bool   `caddy:"evict_ranges"`       // evict cold chunks of large files first
+	EvictRangeSize    string `caddy:"evict_range_size"`   // size of the chunks evicted
+	MemCacheSize      string `caddy:"mem_cache_size"`     // memory for hot blocks, off if not set
+	MemCacheMinHits   int    `caddy:"mem_cache_min_hits"` // reads of a block before it is kept in memory
+	Checksums         bool   `caddy:"checksums"`          // verify cached chunks against their checksums
+	ScrubInterval     string `caddy:"scrub_interval"`     // how often to check the cache, off if not set
+	MetaStore         string `caddy:"meta_store"`         // files or log
+	LazyReload        bool   `caddy:"lazy_reload"`        // serve while the cache is loaded in the background
+	MaxNodes          int    `caddy:"max_nodes"`          // files kept in the engine index, 100000 if not set
+	QuotaGroups       string `caddy:"quota_groups"`       // name:host=H:prefix=P:site=S:max_size=N:max_age=D,...
+	WriteCache        string `caddy:"write_cache"`        // off, through or back
+	QueuePath         string `caddy:"queue_path"`         // path the upload queue admin API is served on, off if not set
+
+	// BackgroundComplete fetches the rest of a file in the background
+	// after it has been read partially, so later seeks are cache hits.
+	BackgroundComplete bool   `caddy:"background_complete"`
+	CompleteMinSize    string `caddy:"complete_min_size"`
+	CompleteMaxSize    string `caddy:"complete_max_size"`
+	CompleteMinHits    int    `caddy:"complete_min_hits"`
+
+	// Transport of the requests to the upstream, see upstreamTransport
+	ConnectTimeout        string `caddy:"connect_timeout"`         // 10s if not set
+	TLSHandshakeTimeout   string `caddy:"tls_handshake_timeout"`   // 10s if not set
+	ResponseHeaderTimeout string `caddy:"response_header_timeout"` // 30s if not set
+	IdleConnTimeout       string `caddy:"idle_conn_timeout"`       // 90s if not set
+	MaxConnsPerHost       int    `caddy:"max_conns_per_host"`      // unlimited if not set
+	DisableHTTP2          bool   `caddy:"disable_http2"`           // only speak HTTP/1.1 to the upstream
+	CACert                string `caddy:"ca_cert"`                 // PEM bundle of CAs trusted as well as the system ones
+	ClientCert            string `caddy:"client_cert"`             // PEM certificate for mTLS origins
+	ClientKey             string `caddy:"client_key"`              // PEM key of client_cert
+	UpstreamProxy         string `caddy:"upstream_proxy"`          // proxy URL, from HTTP_PROXY etc if not set
+	BindAddress           string `caddy:"bind_address"`            // local IP address to connect from
+
+	// Credentials for the origin, see upstreamCredentials
+	CredentialHosts   string `caddy:"credential_hosts"`    // host,*.domain,... credentials are sent to, * for all
+	UpstreamHeaders   string `caddy:"upstream_headers"`    // Name: value;... added to upstream requests
+	BearerTokenFile   string `caddy:"bearer_token_file"`   // file of a token sent as Authorization: Bearer
+	SigV4Region       string `caddy:"sigv4_region"`        // sign requests with AWS SigV4 for this region
+	SigV4Service      string `caddy:"sigv4_service"`       // s3 if not set
+	SigV4AccessKey    string `caddy:"sigv4_access_key"`    // AWS_ACCESS_KEY_ID if not set
+	SigV4SecretKey    string `caddy:"sigv4_secret_key"`    // AWS_SECRET_ACCESS_KEY if not set
+	SigV4SessionToken string `caddy:"sigv4_session_token"` // AWS_SESSION_TOKEN if the keys aren't set
+
+	// Access control of clients, see accessControl
+	AllowHosts     string `caddy:"allow_hosts"`     // upstream host,*.domain,CIDR,... which may be used, any if not set
+	BlockPrivate   bool   `caddy:"block_private"`   // refuse upstreams on private, loopback and link local addresses
+	SigningKeys    string `caddy:"signing_keys"`    // comma separated HMAC keys signed URLs are checked with
+	APIKeys        string `caddy:"api_keys"`        // name:key=K[:quota=S][:period=D],...
+	JWTSecret      string `caddy:"jwt_secret"`      // HMAC secret of HS256 tokens
+	JWTPublicKey   string `caddy:"jwt_public_key"`  // PEM file of the key of RS256, ES256 or EdDSA tokens
+	JWTAudience    string `caddy:"jwt_audience"`    // aud claim tokens must have, not checked if not set
+	TrustedProxies string `caddy:"trusted_proxies"` // CIDRs of proxies whose X-Forwarded-For gives the client address
+	AdminKeys      string `caddy:"admin_keys"`      // comma separated keys the admin APIs may be used with
+
+	// Limits on each client, see rateLimits
+	ClientRateLimit string       `caddy:"client_rate_limit"` // requests per window as N/duration, eg 100/1m
+	ClientByteLimit string       `caddy:"client_byte_limit"` // bytes sent per window as size/duration, eg 10G/1h
+	ClientMaxConns  int          `caddy:"client_max_conns"`  // requests in flight, unlimited if not set
+	ClientMissLimit string       `caddy:"client_miss_limit"` // distinct uncached files per window as N/duration, eg 30/1m
+	Logger          types.Logger `caddy:"-"`
 }
 
 // DefaultOptions returns Options with sensible defaults
@@ -118,54 +203,55 @@ type Handler struct {
 	mapping     *mapping
 	client      *http.Client
 	metrics     *Metrics
+	credentials *credentials   // added to upstream requests, nil if none
+	access      *accessControl // checks clients and upstreams, nil if anything is allowed
+	limits      *rateLimits    // limits on each client, nil if none
 
 	stripQuery  bool
 	stripDomain bool
 	shardLevel  int
 	passthrough bool
+	maxRanges   int
+	quotaRules  []quotaRule
+	writeCache  string // how PUTs are cached, one of the WriteCache constants
 }
 
 // NewHandler creates a new Handler
 func NewHandler(opt Options) (*Handler, error) {
 	ctx := context.Background()
 
-	cacheDir := opt.CacheDir
-	if cacheDir == "" {
-		cacheDir = filepath.Join(os.TempDir(), "varc_cache")
+	engOpt, quotaRules, err := opt.engineOptions()
+	if err != nil {
+		return nil, err
 	}
-
-	// Build engine options
-	engOpt := &types.Options{
-		CacheDir: cacheDir,
+	transport, err := opt.upstreamTransport()
+	if err != nil {
+		return nil, err
 	}
-
-	if opt.Logger != nil {
-		engOpt.Logger = opt.Logger
+	creds, err := opt.upstreamCredentials()
+	if err != nil {
+		return nil, err
 	}
-
-	if opt.CacheMaxAge != "" {
-		d, err := time.ParseDuration(opt.CacheMaxAge)
-		if err == nil {
-			engOpt.CacheMaxAge = d
-		} else {
-			return nil, fmt.Errorf("invalid cache-max-age: %w", err)
-		}
+	access, err := opt.accessControl()
+	if err != nil {
+		return nil, err
 	}
-	if opt.CacheMaxSize != "" {
-		s, err := parseSize(opt.CacheMaxSize)
-		if err == nil {
-			engOpt.CacheMaxSize = s
-		}
+	limits, err := opt.rateLimits()
+	if err != nil {
+		return nil, err
 	}
-	if opt.CacheChunkSize != "" {
-		s, err := parseSize(opt.CacheChunkSize)
-		if err == nil {
-			engOpt.ChunkSize = s
-		}
+	client := &http.Client{Transport: transport}
+	if creds != nil {
+		client.Transport = &credentialTransport{base: transport, creds: creds}
+	}
+	if access != nil {
+		client.CheckRedirect = access.checkRedirect
 	}
-	engOpt.ChunkStreams = opt.CacheChunkStreams
 
-	engOpt.Init()
+	maxRanges := opt.MaxRanges
+	if maxRanges <= 0 {
+		maxRanges = DefaultMaxRanges
+	}
 
 	engInstance, err := internal.New(ctx, engOpt)
 	if err != nil {
@@ -175,15 +261,29 @@ func NewHandler(opt Options) (*Handler, error) {
 	return &Handler{
 		Engine:      engInstance,
 		mapping:     newMapping(),
-		client:      &http.Client{Timeout: 30 * time.Second},
+		client:      client,
 		metrics:     &Metrics{},
+		credentials: creds,
+		access:      access,
+		limits:      limits,
 		stripQuery:  opt.StripQuery,
 		stripDomain: opt.StripDomain,
 		shardLevel:  opt.ShardLevel,
 		passthrough: opt.Passthrough,
+		maxRanges:   maxRanges,
+		quotaRules:  quotaRules,
+		writeCache:  opt.writeCacheMode(),
 	}, nil
 }
 
+// TrimAccessParams removes the query parameters carrying varc's access
+// credentials, such as the signature of a signed URL, from rawQuery.
+// Front ends which pass the query string of the request on to the
+// upstream should use it first.
+func (h *Handler) TrimAccessParams(rawQuery string) string {
+	return h.access.trimQuery(rawQuery)
+}
+
 // Shutdown shuts down the handler
 func (h *Handler) Shutdown() {
 	h.Engine.Close()
@@ -194,15 +294,39 @@ func (h *Handler) Metrics() *Metrics {
 	return h.metrics
 }
 
+// Ready returns true once the cache has finished loading, which is
+// straight away unless lazy_reload is set
+func (h *Handler) Ready() bool {
+	return h.Engine.Ready()
+}
+
 // ServeMetrics writes a JSON snapshot of the current metrics to w
 func (h *Handler) ServeMetrics(w http.ResponseWriter) {
-	stats := h.metrics.Snapshot()
+	snap := h.metrics.Snapshot()
+	stats := make(map[string]any, len(snap))
+	for k, v := range snap {
+		stats[k] = v
+	}
 	engineStats := h.Engine.Stats()
 	for k, v := range engineStats {
 		if vi, ok := v.(int64); ok {
 			stats[k] = vi
 		}
 	}
+	// Show the usage of each quota group
+	if groups, ok := engineStats["groups"]; ok {
+		stats["quota_groups"] = groups
+	}
+	if ready, ok := engineStats["ready"].(bool); ok {
+		stats["ready"] = ready
+	}
+	// Show the hit ratio alongside the policy which produced it
+	if policy, ok := engineStats["evictionPolicy"].(string); ok {
+		stats["eviction_policy"] = policy
+	}
+	if lookups := snap["hits"] + snap["misses"]; lookups > 0 {
+		stats["hit_ratio"] = float64(snap["hits"]) / float64(lookups)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(stats)
 }
@@ -239,13 +363,56 @@ func (h *Handler) hashCachePath(targetURL string) string {
 	return hash
 }
 
-// shouldPassthrough returns true if the request should bypass the cache
-func (h *Handler) shouldPassthrough(r *http.Request) bool {
+// TargetURL returns the upstream URL r asks for, from the url query
+// parameter or else a base64 encoded path after /stream/, or "" if it
+// has neither
+func TargetURL(r *http.Request) string {
+	if targetURL := r.URL.Query().Get("url"); targetURL != "" {
+		return targetURL
+	}
+	if encodedURL, ok := strings.CutPrefix(r.URL.Path, "/stream/"); ok {
+		if decoded, err := base64.RawURLEncoding.DecodeString(encodedURL); err == nil {
+			return string(decoded)
+		}
+		if decoded, err := base64.URLEncoding.DecodeString(encodedURL); err == nil {
+			return string(decoded)
+		}
+	}
+	return ""
+}
+
+// upstreamHeaders returns the headers of r to send upstream, leaving
+// out the per-request ones
+func upstreamHeaders(r *http.Request) http.Header {
+	headers := make(http.Header)
+	for k, vv := range r.Header {
+		switch k {
+		case "Range", "If-Range", "If-Modified-Since", "If-Unmodified-Since", "If-None-Match", "If-Match", "Expect":
+			continue
+		}
+		for _, v := range vv {
+			headers.Add(k, v)
+		}
+	}
+	return headers
+}
+
+// shouldPassthrough returns true if the request for targetURL should
+// bypass the cache.
+//
+// The Authorization of reads from hosts varc has its own credentials
+// for is replaced by them, so those can be cached.
+func (h *Handler) shouldPassthrough(r *http.Request, targetURL string) bool {
 	switch r.Method {
-	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	case http.MethodPut:
+		// Only uploads of a known length can be written to the cache
+		if h.writeCache == WriteCacheOff || r.ContentLength < 0 {
+			return true
+		}
+	case http.MethodPost, http.MethodPatch, http.MethodDelete:
 		return true
 	}
-	if r.Header.Get("Authorization") != "" {
+	if r.Header.Get("Authorization") != "" && !(isRead(r.Method) && h.credentials.covers(targetURL)) {
 		return true
 	}
 	if r.Header.Get("Cookie") != "" {
@@ -256,7 +423,7 @@ func (h *Handler) shouldPassthrough(r *http.Request) bool {
 
 // proxyDirect proxies a request directly to the upstream without caching
 func (h *Handler) proxyDirect(w http.ResponseWriter, r *http.Request, targetURL string) {
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -285,6 +452,18 @@ func (h *Handler) proxyDirect(w http.ResponseWriter, r *http.Request, targetURL
 
 // handlePurge handles PURGE requests to remove items from cache
 func (h *Handler) handlePurge(w http.ResponseWriter, r *http.Request, targetURL string) {
+	if err := h.Purge(targetURL); err != nil {
+		http.Error(w, "Purge failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Purged"))
+}
+
+// Purge removes targetURL from the cache so the next request for it
+// is a miss
+func (h *Handler) Purge(targetURL string) error {
 	cachePath := h.hashCachePath(targetURL)
 
 	// Remove from mapping
@@ -293,18 +472,44 @@ func (h *Handler) handlePurge(w http.ResponseWriter, r *http.Request, targetURL
 	h.mapping.mu.Unlock()
 
 	// Remove from cache
-	err := h.Engine.Remove(cachePath)
-	if err != nil {
-		http.Error(w, "Purge failed: "+err.Error(), http.StatusInternalServerError)
-		return
+	if err := h.Engine.Remove(cachePath); err != nil {
+		return err
 	}
 
-	h.metrics.mu.Lock()
-	h.metrics.Purges++
-	h.metrics.mu.Unlock()
+	h.metrics.inc(&h.metrics.Purges)
+	return nil
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Purged"))
+// CachePath returns the path targetURL is cached under
+func (h *Handler) CachePath(targetURL string) string {
+	return h.hashCachePath(targetURL)
+}
+
+// URL returns the upstream URL cached under cachePath, if it has been
+// requested since the handler was created
+func (h *Handler) URL(cachePath string) (url string, ok bool) {
+	entry, ok := h.mapping.get(cachePath)
+	return entry.url, ok
+}
+
+// Open opens targetURL for reading through the cache, fetching what
+// isn't cached from the upstream with headers. ctx is used for the
+// HEAD request which finds out the size and validators of the file,
+// and reads through the handle give up once it is done.
+//
+// The handle must be closed after use.
+func (h *Handler) Open(ctx context.Context, targetURL string, headers http.Header) (internal.Handle, error) {
+	if targetURL == "" {
+		return nil, errors.New("target URL is required")
+	}
+	cachePath := h.hashCachePath(targetURL)
+	h.mapping.put(targetURL, cachePath, headers)
+	obj := newHTTPFile(targetURL, headers, -1, time.Time{}, "", h.client)
+	obj.stat(ctx)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return h.Engine.OpenCached(ctx, cachePath, obj)
 }
 
 // tryStaleServe attempts to serve stale data from cache when upstream is unavailable.
@@ -316,7 +521,7 @@ func (h *Handler) tryStaleServe(w http.ResponseWriter, r *http.Request, cachePat
 	}
 
 	// Open cached file handle (no upstream fetch)
-	fh, err := h.Engine.OpenCached(cachePath, nil)
+	fh, err := h.Engine.OpenCached(r.Context(), cachePath, nil)
 	if err != nil {
 		return false
 	}
@@ -324,13 +529,13 @@ func (h *Handler) tryStaleServe(w http.ResponseWriter, r *http.Request, cachePat
 
 	info, _ := fh.Stat()
 	size := info.Size()
-	modTime := info.ModTime()
 
-	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	w.Header().Set("X-Cache", "STALE")
-	if !modTime.IsZero() {
-		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	etag, modTime := h.validators(item, size)
+	if status := writePreconditions(w, r, etag, modTime); status != 0 {
+		return true
 	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 
 	if size >= 0 {
 		http.ServeContent(w, r, cachePath, modTime, fh)
@@ -340,11 +545,32 @@ func (h *Handler) tryStaleServe(w http.ResponseWriter, r *http.Request, cachePat
 	return true
 }
 
+// validators returns the ETag and Last-Modified time to send for the
+// cached item. They come from the item's persisted metadata so fresh
+// and stale serves of the same content agree.
+func (h *Handler) validators(item *cache.Item, size int64) (etag string, modTime time.Time) {
+	upstreamETag, modTime := item.GetValidators()
+	return entityTag(upstreamETag, size, modTime), modTime
+}
+
 // accessLog logs an HTTP request to the engine's logger if available
 func (h *Handler) accessLog(r *http.Request, status int, size int64, duration time.Duration) {
 	if h.Engine != nil && h.Engine.Opt.Logger != nil {
-		h.Engine.Opt.Logger.Infof("[proxy] %s %s %d %d %v", r.Method, r.URL.String(), status, size, duration)
+		u := *r.URL
+		u.RawQuery = h.access.trimQuery(u.RawQuery) // don't log credentials
+		h.Engine.Opt.Logger.Infof("[proxy] %s %s %d %d %v", r.Method, u.String(), status, size, duration)
+	}
+}
+
+// tooManyRequests refuses a request which went over a client limit
+func (h *Handler) tooManyRequests(w http.ResponseWriter, r *http.Request, err error, start time.Time) {
+	h.metrics.inc(&h.metrics.RateLimited)
+	var limitErr *rateLimitError
+	if errors.As(err, &limitErr) {
+		w.Header().Set("Retry-After", limitErr.retryAfterSeconds())
 	}
+	http.Error(w, "Too Many Requests: "+err.Error(), http.StatusTooManyRequests)
+	h.accessLog(r, http.StatusTooManyRequests, 0, time.Since(start))
 }
 
 // Serve handles an HTTP request for the given targetURL.
@@ -362,6 +588,35 @@ func (h *Handler) Serve(w http.ResponseWriter, r *http.Request, targetURL string
 	cachePath := h.hashCachePath(targetURL)
 	start := time.Now()
 
+	var key *apiKey
+	if h.access != nil {
+		var err error
+		key, err = h.access.check(r, targetURL)
+		if err != nil {
+			h.metrics.inc(&h.metrics.Denied)
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			h.accessLog(r, http.StatusForbidden, 0, time.Since(start))
+			return
+		}
+		if key != nil && key.quota > 0 {
+			cw := &countingResponseWriter{ResponseWriter: w}
+			defer func() { key.use(cw.n) }()
+			w = cw
+		}
+	}
+
+	var client string
+	if h.limits != nil {
+		client = h.limits.clientID(r, key)
+		if err := h.limits.begin(client, start); err != nil {
+			h.tooManyRequests(w, r, err, start)
+			return
+		}
+		cw := &countingResponseWriter{ResponseWriter: w}
+		defer func() { h.limits.end(client, cw.n, time.Now()) }()
+		w = cw
+	}
+
 	// Handle PURGE requests
 	if r.Method == "PURGE" {
 		h.handlePurge(w, r, targetURL)
@@ -370,32 +625,59 @@ func (h *Handler) Serve(w http.ResponseWriter, r *http.Request, targetURL string
 	}
 
 	// Check if request should bypass cache
-	if h.passthrough || h.shouldPassthrough(r) {
+	if (h.passthrough || h.shouldPassthrough(r, targetURL)) && !h.access.limitsRange(r) {
 		h.proxyDirect(w, r, targetURL)
 		h.accessLog(r, http.StatusOK, 0, time.Since(start))
 		return
 	}
 
-	// Build upstream headers by combining request headers (minus per-request ones)
-	upstreamHeaders := make(http.Header)
-	for k, vv := range r.Header {
-		switch k {
-		case "Range", "If-Range", "If-Modified-Since", "If-Unmodified-Since", "If-None-Match", "If-Match":
-			continue
+	// Uploads are written into the cache on their way upstream
+	if r.Method == http.MethodPut {
+		status, size := h.serveWrite(w, r, targetURL, cachePath)
+		h.accessLog(r, status, size, time.Since(start))
+		return
+	}
+
+	// Changes not yet uploaded may still be rejected, so until the
+	// upstream has them it is asked instead. Range-bound links can't
+	// be passed through, so they have to wait.
+	if h.Engine.CacheItem(cachePath).IsDirty() {
+		if h.access.limitsRange(r) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "File is being uploaded", http.StatusServiceUnavailable)
+			h.accessLog(r, http.StatusServiceUnavailable, 0, time.Since(start))
+			return
 		}
-		for _, v := range vv {
-			upstreamHeaders.Add(k, v)
+		h.proxyDirect(w, r, targetURL)
+		h.accessLog(r, http.StatusOK, 0, time.Since(start))
+		return
+	}
+
+	// Walking through uncached files would churn the cache, so clients
+	// may only ask for so many before the upstream is asked about them
+	if h.limits != nil && !h.Engine.CacheItem(cachePath).Exists() {
+		if err := h.limits.miss(client, cachePath, start); err != nil {
+			h.tooManyRequests(w, r, err, start)
+			return
 		}
 	}
 
-	h.mapping.put(targetURL, cachePath, upstreamHeaders)
+	h.mapping.put(targetURL, cachePath, upstreamHeaders(r))
 
 	// Create an httpFile to associate with this cache path
-	httpFile := h.newHTTPFile(cachePath)
+	httpFile := h.newHTTPFile(r.Context(), cachePath)
+	if r.Context().Err() != nil {
+		// The client went away during the HEAD request
+		h.accessLog(r, statusClientClosedRequest, 0, time.Since(start))
+		return
+	}
 
 	// Track cache hit/miss
 	cachedItem := h.Engine.CacheItem(cachePath)
 	isCached := cachedItem.Exists()
+	if len(h.quotaRules) > 0 {
+		cachedItem.SetGroup(h.quotaGroup(r, targetURL))
+	}
 
 	h.metrics.mu.Lock()
 	h.metrics.Requests++
@@ -407,7 +689,7 @@ func (h *Handler) Serve(w http.ResponseWriter, r *http.Request, targetURL string
 	h.metrics.mu.Unlock()
 
 	// Open through disk cache with the httpFile
-	fh, err := h.Engine.OpenCached(cachePath, httpFile)
+	fh, err := h.Engine.OpenCached(r.Context(), cachePath, httpFile)
 	if err != nil {
 		// Try stale-serve if upstream is unavailable
 		if h.tryStaleServe(w, r, cachePath) {
@@ -430,24 +712,17 @@ func (h *Handler) Serve(w http.ResponseWriter, r *http.Request, targetURL string
 	}
 
 	size := info.Size()
-	modTime := info.ModTime()
 
 	// Handle conditional requests
-	if !modTime.IsZero() {
-		if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.After(t) {
-			w.WriteHeader(http.StatusNotModified)
-			h.accessLog(r, http.StatusNotModified, 0, time.Since(start))
-			return
-		}
+	etag, modTime := h.validators(h.Engine.CacheItem(cachePath), size)
+	if status := writePreconditions(w, r, etag, modTime); status != 0 {
+		h.accessLog(r, status, 0, time.Since(start))
+		return
 	}
-	if !modTime.IsZero() && size >= 0 {
-		etag := fmt.Sprintf(`"%s-%x"`, cachePath, size)
-		w.Header().Set("ETag", etag)
-		if r.Header.Get("If-None-Match") == etag {
-			w.WriteHeader(http.StatusNotModified)
-			h.accessLog(r, http.StatusNotModified, 0, time.Since(start))
-			return
-		}
+
+	// A partial read may start filling in the rest of the file
+	if size > 0 && r.Header.Get("Range") != "" {
+		h.Engine.CompleteInBackground(cachePath, httpFile)
 	}
 
 	// Set response headers
@@ -458,8 +733,26 @@ func (h *Handler) Serve(w http.ResponseWriter, r *http.Request, targetURL string
 	if mimeType != "" {
 		w.Header().Set("Content-Type", mimeType)
 	}
-	if !modTime.IsZero() {
-		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+
+	// Multiple ranges are served natively so their missing parts can
+	// be fetched concurrently rather than seek by seek
+	if size >= 0 {
+		if rs, err := parseRange(r.Header.Get("Range"), size); err == nil && len(rs) > 1 {
+			if len(rs) > h.maxRanges {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				http.Error(w, "Too many ranges requested", http.StatusRequestedRangeNotSatisfiable)
+				h.accessLog(r, http.StatusRequestedRangeNotSatisfiable, 0, time.Since(start))
+				return
+			}
+			// Ranges adding up to more than the file fall through to
+			// ServeContent which sends the whole file instead
+			if sumRangesSize(rs) <= size {
+				sent, status := h.serveMultipart(w, r, h.Engine.CacheItem(cachePath), fh, rs, mimeType, size)
+				h.metrics.add(&h.metrics.BytesServed, sent)
+				h.accessLog(r, status, sent, time.Since(start))
+				return
+			}
+		}
 	}
 
 	// Serve content (handles Range requests via http.ServeContent)
@@ -481,43 +774,18 @@ func (h *Handler) Serve(w http.ResponseWriter, r *http.Request, targetURL string
 }
 
 // newHTTPFile creates an httpFile for the given cache path, looking up
-// the upstream URL and headers from the mapping.
-func (h *Handler) newHTTPFile(cachePath string) *remoteFile {
+// the upstream URL and headers from the mapping. The HEAD request for
+// its metadata is abandoned when ctx is done.
+func (h *Handler) newHTTPFile(ctx context.Context, cachePath string) *remoteFile {
 	entry, ok := h.mapping.get(cachePath)
 	if !ok {
 		return &remoteFile{size: -1}
 	}
 
 	// First do a HEAD request to get metadata
-	size := int64(-1)
-	modTime := time.Time{}
-
-	req, err := http.NewRequest("HEAD", entry.url, nil)
-	if err == nil {
-		for k, vv := range entry.headers {
-			for _, v := range vv {
-				req.Header.Add(k, v)
-			}
-		}
-		resp, err := h.client.Do(req)
-		if err == nil {
-			if resp.StatusCode == http.StatusOK {
-				if cl := resp.Header.Get("Content-Length"); cl != "" {
-					if parsed, err := strconv.ParseInt(cl, 10, 64); err == nil {
-						size = parsed
-					}
-				}
-				if lm := resp.Header.Get("Last-Modified"); lm != "" {
-					if parsed, err := http.ParseTime(lm); err == nil {
-						modTime = parsed
-					}
-				}
-			}
-			resp.Body.Close()
-		}
-	}
-
-	return newHTTPFile(entry.url, entry.headers, size, modTime, h.client)
+	f := newHTTPFile(entry.url, entry.headers, -1, time.Time{}, "", h.client)
+	f.stat(ctx)
+	return f
 }
 
 // parseSize parses a size string like "100M", "1G", etc.
@@ -547,5 +815,47 @@ func parseSize(s string) (int64, error) {
 	if err != nil {
 		return 0, fmt.Errorf("invalid size: %w", err)
 	}
+	if v < 0 {
+		return 0, errors.New("invalid size: must not be negative")
+	}
 	return v * multiplier, nil
 }
+
+// parseCacheDirs parses a comma separated list of cache directories,
+// each of which may be followed by colon separated options, eg
+//
+//	/mnt/nvme:max_size=100G,/mnt/hdd1:tier=1,/mnt/hdd2:tier=1:weight=2
+func parseCacheDirs(s string) (roots []types.CacheRoot, err error) {
+	for entry := range strings.SplitSeq(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Split(entry, ":")
+		root := types.CacheRoot{Path: fields[0]}
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("%q: expecting key=value but got %q", root.Path, field)
+			}
+			switch key {
+			case "weight":
+				root.Weight, err = strconv.Atoi(value)
+			case "max_size":
+				root.MaxSize, err = parseSize(value)
+			case "tier":
+				root.Tier, err = strconv.Atoi(value)
+			default:
+				return nil, fmt.Errorf("%q: unknown option %q (want weight, max_size or tier)", root.Path, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%q: bad %s: %w", root.Path, key, err)
+			}
+		}
+		roots = append(roots, root)
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("no directories")
+	}
+	return roots, nil
+}
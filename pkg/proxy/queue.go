@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/tgdrive/varc/internal/cache/writeback"
+)
+
+// queueEntry is an upload in the queue shown by ServeQueue
+type queueEntry struct {
+	writeback.QueueInfo
+	URL string `json:"url,omitempty"` // upstream URL the file is uploaded to
+}
+
+// ServeQueue serves the admin API of the queue of write back uploads.
+//
+// GET lists the uploads waiting or in progress, those in progress
+// first then in the order they will be done, with the size, number of
+// tries, seconds until the next try and the error from the last one.
+//
+// POST with the id of an upload and action=upload tries it straight
+// away, and with action=cancel stops it if it is in progress, leaving
+// it queued to be tried again after the write back delay.
+//
+// Requests must carry one of the admin_keys, or a JWT with the
+// varc:admin scope.
+func (h *Handler) ServeQueue(w http.ResponseWriter, r *http.Request) {
+	if err := h.access.checkAdmin(r); err != nil {
+		h.metrics.inc(&h.metrics.Denied)
+		http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		queue := h.Engine.Queue()
+		entries := make([]queueEntry, 0, len(queue))
+		for _, info := range queue {
+			entry := queueEntry{QueueInfo: info}
+			if e, ok := h.mapping.get(info.Name); ok {
+				entry.URL = e.url
+			}
+			entries = append(entries, entry)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"queue": entries})
+	case http.MethodPost:
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid upload id: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch action := r.FormValue("action"); action {
+		case "upload":
+			err = h.Engine.QueueUploadNow(writeback.Handle(id))
+		case "cancel":
+			err = h.Engine.QueueCancel(writeback.Handle(id))
+		default:
+			http.Error(w, "Unknown action "+strconv.Quote(action)+": expecting upload or cancel", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case errors.Is(err, writeback.ErrorIDNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, writeback.ErrorNotUploading):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func queue(t *testing.T, handler *Handler) []queueEntry {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/queue", nil)
+	r.Header.Set("Authorization", "Bearer admin-key")
+	handler.ServeQueue(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	var out struct {
+		Queue []queueEntry `json:"queue"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&out))
+	return out.Queue
+}
+
+func queueAction(handler *Handler, id uint64, action string) int {
+	form := url.Values{"id": {strconv.FormatUint(id, 10)}, "action": {action}}
+	r := httptest.NewRequest(http.MethodPost, "/queue", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Api-Key", "admin-key")
+	w := httptest.NewRecorder()
+	handler.ServeQueue(w, r)
+	return w.Code
+}
+
+func TestUploadQueue(t *testing.T) {
+	origin := &writableUpstream{data: []byte("old"), fail: http.StatusServiceUnavailable}
+	upstream := httptest.NewServer(origin)
+	defer upstream.Close()
+	handler := newWriteHandler(t, WriteCacheBack, "1h")
+
+	data := []byte("the new content of the file")
+	assert.Equal(t, http.StatusAccepted, put(handler, upstream.URL, data).StatusCode)
+	entries := queue(t, handler)
+	require.Len(t, entries, 1)
+	entry := entries[0]
+	assert.Equal(t, upstream.URL, entry.URL)
+	assert.Equal(t, int64(len(data)), entry.Size)
+	assert.Equal(t, 0, entry.Tries)
+	assert.False(t, entry.Uploading)
+	assert.Greater(t, entry.Expiry, float64(time.Minute/time.Second))
+	id := uint64(entry.ID)
+
+	// Bump it to upload now, which fails
+	assert.Equal(t, http.StatusNoContent, queueAction(handler, id, "upload"))
+	require.Eventually(t, func() bool {
+		entries := queue(t, handler)
+		return len(entries) == 1 && entries[0].Tries == 1 && !entries[0].Uploading
+	}, 5*time.Second, 10*time.Millisecond)
+	entry = queue(t, handler)[0]
+	assert.Contains(t, entry.Error, "503")
+	assert.Greater(t, entry.Expiry, float64(0))
+
+	// Nothing to cancel while it waits
+	assert.Equal(t, http.StatusConflict, queueAction(handler, id, "cancel"))
+	assert.Equal(t, http.StatusNotFound, queueAction(handler, id+1, "upload"))
+	assert.Equal(t, http.StatusBadRequest, queueAction(handler, id, "explode"))
+
+	origin.mu.Lock()
+	origin.fail = 0
+	origin.mu.Unlock()
+	assert.Equal(t, http.StatusNoContent, queueAction(handler, id, "upload"))
+	require.Eventually(t, func() bool {
+		got, _, _ := origin.state()
+		return bytes.Equal(got, data) && len(queue(t, handler)) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUploadQueueAdmin(t *testing.T) {
+	serve := func(handler *Handler, header http.Header) int {
+		r := httptest.NewRequest(http.MethodGet, "/queue", nil)
+		for k, vv := range header {
+			r.Header[k] = vv
+		}
+		w := httptest.NewRecorder()
+		handler.ServeQueue(w, r)
+		return w.Code
+	}
+	handler := newWriteHandler(t, WriteCacheBack, "1h")
+	assert.Equal(t, http.StatusForbidden, serve(handler, nil))
+	assert.Equal(t, http.StatusForbidden, serve(handler, http.Header{"Authorization": {"Bearer other-key"}}))
+	assert.Equal(t, http.StatusOK, serve(handler, http.Header{"Authorization": {"Bearer admin-key"}}))
+	assert.Equal(t, http.StatusOK, serve(handler, http.Header{"X-Api-Key": {"admin-key"}}))
+	assert.Equal(t, int64(2), handler.Metrics().Snapshot()["denied"])
+
+	// Tokens need the admin scope
+	jwtHandler, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1, JWTSecret: "secret"})
+	require.NoError(t, err)
+	defer jwtHandler.Shutdown()
+	admin := makeJWT(t, "HS256", map[string]any{"scope": "read varc:admin"}, hs256("secret"))
+	reader := makeJWT(t, "HS256", map[string]any{"scope": "read"}, hs256("secret"))
+	assert.Equal(t, http.StatusOK, serve(jwtHandler, http.Header{"Authorization": {"Bearer " + admin}}))
+	assert.Equal(t, http.StatusForbidden, serve(jwtHandler, http.Header{"Authorization": {"Bearer " + reader}}))
+
+	// Without admin credentials nothing may use it
+	open, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1})
+	require.NoError(t, err)
+	defer open.Shutdown()
+	assert.Equal(t, http.StatusForbidden, serve(open, http.Header{"Authorization": {"Bearer admin-key"}}))
+	assert.ErrorContains(t, (&Options{QueuePath: "/admin/queue"}).Validate(), "invalid queue_path")
+	assert.NoError(t, (&Options{QueuePath: "/admin/queue", AdminKeys: "admin-key"}).Validate())
+}
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateWindow is the window of client limits which don't give one
+const DefaultRateWindow = time.Minute
+
+// sweepInterval is how often clients which have gone quiet are forgotten
+const sweepInterval = time.Minute
+
+// rate is a limit of n every window
+type rate struct {
+	n      int64 // no limit if 0
+	window time.Duration
+}
+
+// rateLimits limits what each client may do. Clients are known by the
+// name of the API key they used, or else by their address.
+type rateLimits struct {
+	requests rate // requests made
+	bytes    rate // bytes sent
+	misses   rate // distinct uncached files asked for
+	maxConns int  // requests in flight, no limit if 0
+
+	trustedProxies []netip.Prefix // proxies whose X-Forwarded-For is believed
+	idle           time.Duration  // how long clients are remembered after their last request
+
+	mu        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+// client is what one client has done
+type client struct {
+	conns    int
+	requests window
+	bytes    window
+	misses   window
+	missed   map[string]time.Time // cache paths counted in misses, and when
+	seen     time.Time            // when the last request began
+}
+
+// rateLimitError is returned when a client has gone over one of its
+// limits
+type rateLimitError struct {
+	limit      string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return "too many " + e.limit
+}
+
+// retryAfterSeconds returns the Retry-After header for e, which is at
+// least a second
+func (e *rateLimitError) retryAfterSeconds() string {
+	return strconv.FormatInt(max(int64(math.Ceil(e.retryAfter.Seconds())), 1), 10)
+}
+
+// rateLimits builds the limits on clients from the options, returning
+// nil if there are none. All the problems found are returned together.
+func (opt *Options) rateLimits() (*rateLimits, error) {
+	var errs []error
+	invalid := func(name, value string, err error) {
+		errs = append(errs, fmt.Errorf("invalid %s %q: %w", name, value, err))
+	}
+	l := &rateLimits{maxConns: opt.ClientMaxConns, clients: make(map[string]*client)}
+	limit := func(name, value string, sizes bool, dst *rate) {
+		if value == "" {
+			return
+		}
+		r, err := parseRate(value, sizes)
+		if err != nil {
+			invalid(name, value, err)
+			return
+		}
+		*dst = r
+	}
+	limit("client_rate_limit", opt.ClientRateLimit, false, &l.requests)
+	limit("client_byte_limit", opt.ClientByteLimit, true, &l.bytes)
+	limit("client_miss_limit", opt.ClientMissLimit, false, &l.misses)
+	if opt.ClientMaxConns < 0 {
+		invalid("client_max_conns", strconv.Itoa(opt.ClientMaxConns), errors.New("must not be negative"))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if l.requests.n == 0 && l.bytes.n == 0 && l.misses.n == 0 && l.maxConns == 0 {
+		return nil, nil
+	}
+	// Problems with these are reported by accessControl
+	l.trustedProxies, _ = opt.trustedProxies()
+	l.idle = 2 * max(l.requests.window, l.bytes.window, l.misses.window, DefaultRateWindow)
+	return l, nil
+}
+
+// parseRate parses a limit given as N/window, eg 100/10s, or as N for
+// a window of DefaultRateWindow. N may have a size suffix if sizes is
+// set.
+func parseRate(s string, sizes bool) (rate, error) {
+	nStr, windowStr, hasWindow := strings.Cut(strings.TrimSpace(s), "/")
+	r := rate{window: DefaultRateWindow}
+	var err error
+	if sizes {
+		r.n, err = parseSize(nStr)
+	} else {
+		r.n, err = strconv.ParseInt(strings.TrimSpace(nStr), 10, 64)
+	}
+	if err != nil || r.n <= 0 {
+		return rate{}, errors.New("expecting N/window, eg 100/1m")
+	}
+	if hasWindow {
+		if r.window, err = time.ParseDuration(strings.TrimSpace(windowStr)); err != nil || r.window <= 0 {
+			return rate{}, errors.New("expecting N/window, eg 100/1m")
+		}
+	}
+	return r, nil
+}
+
+// clientID returns who r is from: the API key it was made with, if
+// any, or else the address of the client
+func (l *rateLimits) clientID(r *http.Request, key *apiKey) string {
+	if key != nil {
+		return "key:" + key.name
+	}
+	return "ip:" + clientIP(r, l.trustedProxies).String()
+}
+
+// begin starts a request by the client id at now. If it is allowed end
+// must be called when it is done.
+func (l *rateLimits) begin(id string, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l._sweep(now)
+	}
+	c := l.clients[id]
+	if c == nil {
+		c = &client{}
+		l.clients[id] = c
+	}
+	c.seen = now
+	if l.maxConns > 0 && c.conns >= l.maxConns {
+		return &rateLimitError{limit: "connections", retryAfter: time.Second}
+	}
+	if err := c.requests.check(now, l.requests, "requests"); err != nil {
+		return err
+	}
+	if err := c.bytes.check(now, l.bytes, "bytes"); err != nil {
+		return err
+	}
+	c.conns++
+	c.requests.add(now, l.requests, 1)
+	return nil
+}
+
+// end finishes a request by the client id which sent it sent bytes
+func (l *rateLimits) end(id string, sent int64, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.clients[id]
+	c.conns--
+	c.bytes.add(now, l.bytes, sent)
+}
+
+// miss records that the client id asked at now for cachePath which
+// isn't cached. Asking again for a file already counted within the
+// window is free, so reading one file in many ranges is one miss.
+func (l *rateLimits) miss(id, cachePath string, now time.Time) error {
+	if l.misses.n == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.clients[id]
+	if at, ok := c.missed[cachePath]; ok && now.Sub(at) < l.misses.window {
+		return nil
+	}
+	if err := c.misses.check(now, l.misses, "cache misses"); err != nil {
+		return err
+	}
+	c.misses.add(now, l.misses, 1)
+	if c.missed == nil {
+		c.missed = make(map[string]time.Time)
+	}
+	for path, at := range c.missed {
+		if now.Sub(at) >= l.misses.window {
+			delete(c.missed, path)
+		}
+	}
+	c.missed[cachePath] = now
+	return nil
+}
+
+// _sweep forgets the clients which have been quiet for long enough
+// that their use has left all the windows
+//
+// call with lock held
+func (l *rateLimits) _sweep(now time.Time) {
+	for id, c := range l.clients {
+		if c.conns == 0 && now.Sub(c.seen) >= l.idle {
+			delete(l.clients, id)
+		}
+	}
+	l.lastSweep = now
+}
+
+// window counts use over a sliding window. It is estimated from the
+// counts of the current and previous fixed windows, the previous one
+// weighted by how much of it the sliding window still covers.
+type window struct {
+	start time.Time // of the current fixed window
+	prev  int64
+	curr  int64
+}
+
+// roll moves w on to the fixed window of length containing now
+func (w *window) roll(now time.Time, length time.Duration) {
+	elapsed := now.Sub(w.start)
+	if elapsed < length {
+		return
+	}
+	if elapsed < 2*length {
+		w.prev = w.curr
+	} else {
+		w.prev = 0
+	}
+	w.curr = 0
+	w.start = now.Truncate(length)
+}
+
+// add adds n to the use at now
+func (w *window) add(now time.Time, r rate, n int64) {
+	if r.n == 0 {
+		return
+	}
+	w.roll(now, r.window)
+	w.curr += n
+}
+
+// check returns an error saying when to retry if the use at now has
+// reached the limit r
+func (w *window) check(now time.Time, r rate, limit string) error {
+	if r.n == 0 {
+		return nil
+	}
+	w.roll(now, r.window)
+	elapsed := float64(now.Sub(w.start)) / float64(r.window)
+	used := float64(w.prev)*(1-elapsed) + float64(w.curr)
+	n := float64(r.n)
+	if used < n {
+		return nil
+	}
+	// Wait, in windows, until the estimate falls back below the limit
+	var wait float64
+	if float64(w.curr) >= n {
+		// The current window has to end then slide out far enough
+		wait = 1 - elapsed + 1 - n/float64(w.curr)
+	} else {
+		wait = 1 - (n-float64(w.curr))/float64(w.prev) - elapsed
+	}
+	return &rateLimitError{limit: limit, retryAfter: time.Duration(max(wait, 0) * float64(r.window))}
+}
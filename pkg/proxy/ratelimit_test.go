@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// retryAfter returns how long err says to wait, failing the test if it
+// isn't a rateLimitError
+func retryAfter(t *testing.T, err error) time.Duration {
+	t.Helper()
+	var limitErr *rateLimitError
+	require.True(t, errors.As(err, &limitErr), err)
+	return limitErr.retryAfter
+}
+
+func TestRateWindow(t *testing.T) {
+	r := rate{n: 10, window: time.Minute}
+	t0 := time.Unix(6000, 0) // on a window boundary
+	var w window
+
+	w.add(t0, r, 10)
+	err := w.check(t0, r, "requests")
+	assert.EqualError(t, err, "too many requests")
+	assert.Equal(t, time.Minute, retryAfter(t, err))
+
+	// A quarter into the next window three quarters of the previous
+	// one are still counted
+	at := t0.Add(75 * time.Second)
+	require.NoError(t, w.check(at, r, "requests"))
+	w.add(at, r, 2)
+	require.NoError(t, w.check(at, r, "requests")) // 7.5 + 2
+	w.add(at, r, 1)
+	assert.Equal(t, 3*time.Second, retryAfter(t, w.check(at, r, "requests"))) // 7.5 + 3
+	require.NoError(t, w.check(at.Add(3*time.Second+time.Millisecond), r, "requests"))
+
+	// Windows long gone are forgotten
+	require.NoError(t, w.check(t0.Add(time.Hour), r, "requests"))
+	assert.Zero(t, w.prev)
+	assert.Zero(t, w.curr)
+
+	// No limit
+	var unlimited window
+	unlimited.add(t0, rate{}, 1000)
+	assert.NoError(t, unlimited.check(t0, rate{}, "requests"))
+}
+
+func TestRateLimitsClients(t *testing.T) {
+	l, err := (&Options{ClientRateLimit: "3/1m", ClientByteLimit: "1k/1m", ClientMaxConns: 2, ClientMissLimit: "2"}).rateLimits()
+	require.NoError(t, err)
+	require.NotNil(t, l)
+	assert.Equal(t, rate{n: 2, window: DefaultRateWindow}, l.misses)
+	t0 := time.Unix(6000, 0)
+
+	// Connections are limited while they are open
+	require.NoError(t, l.begin("a", t0))
+	require.NoError(t, l.begin("a", t0))
+	err = l.begin("a", t0)
+	assert.EqualError(t, err, "too many connections")
+	assert.Equal(t, time.Second, retryAfter(t, err))
+	require.NoError(t, l.begin("b", t0)) // others aren't affected
+	l.end("a", 100, t0)
+	l.end("b", 0, t0)
+
+	// Refused requests don't count
+	require.NoError(t, l.begin("a", t0))
+	l.end("a", 100, t0)
+	assert.EqualError(t, l.begin("a", t0), "too many requests")
+	l.end("a", 0, t0)
+
+	// Bytes are counted when requests end
+	t1 := t0.Add(time.Hour)
+	require.NoError(t, l.begin("a", t1))
+	l.end("a", 2000, t1)
+	assert.EqualError(t, l.begin("a", t1), "too many bytes")
+
+	// Misses of the same file count once
+	require.NoError(t, l.begin("c", t1))
+	require.NoError(t, l.miss("c", "one", t1))
+	require.NoError(t, l.miss("c", "one", t1))
+	require.NoError(t, l.miss("c", "two", t1))
+	err = l.miss("c", "three", t1)
+	assert.EqualError(t, err, "too many cache misses")
+	assert.Equal(t, time.Minute, retryAfter(t, err))
+	require.NoError(t, l.miss("c", "two", t1.Add(time.Second)))
+	l.end("c", 0, t1)
+
+	// Clients are forgotten once they have gone quiet
+	l.mu.Lock()
+	l._sweep(t1.Add(l.idle))
+	assert.Empty(t, l.clients)
+	l.mu.Unlock()
+}
+
+func TestClientRateLimits(t *testing.T) {
+	upstream, _ := accessUpstream(t, []byte("limited"))
+	handler, err := NewHandler(Options{
+		CacheDir:        t.TempDir(),
+		ShardLevel:      1,
+		ClientRateLimit: "3/1h",
+		ClientMissLimit: "1/1h",
+		APIKeys:         "alice:key=alice-key,bob:key=bob-key",
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	serve := func(target, remote, apiKey string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Api-Key", apiKey)
+		w := httptest.NewRecorder()
+		handler.Serve(w, r, TargetURL(r))
+		return w
+	}
+	one, two := streamPath(upstream.URL+"/one"), streamPath(upstream.URL+"/two")
+
+	w := serve(one, "192.0.2.1:1000", "alice-key")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "limited", w.Body.String())
+
+	// Another uncached file is one miss too many, but the cached one
+	// can still be read
+	w = serve(two, "192.0.2.1:1000", "alice-key")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "too many cache misses")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, serve(one, "192.0.2.1:1000", "alice-key").Code)
+
+	// Clients are known by their key rather than their address
+	assert.Equal(t, http.StatusOK, serve(two, "192.0.2.1:1000", "bob-key").Code)
+
+	// The request refused for its miss still counted
+	w = serve(one, "198.51.100.1:1000", "alice-key")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "too many requests")
+	assert.Equal(t, int64(2), handler.Metrics().Snapshot()["rate_limited"])
+
+	// Without a key clients are known by their address
+	anonymous, err := NewHandler(Options{CacheDir: t.TempDir(), ShardLevel: 1, ClientRateLimit: "1/1h", TrustedProxies: "10.0.0.0/8"})
+	require.NoError(t, err)
+	defer anonymous.Shutdown()
+	handler = anonymous
+	assert.Equal(t, http.StatusOK, serve(one, "10.0.0.1:1000", "").Code)
+	assert.Equal(t, http.StatusTooManyRequests, serve(one, "10.0.0.1:1000", "").Code)
+	assert.Equal(t, http.StatusOK, serve(one, "192.0.2.1:1000", "").Code)
+	r := httptest.NewRequest(http.MethodGet, one, nil)
+	r.RemoteAddr = "10.0.0.2:1000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	w = httptest.NewRecorder()
+	anonymous.Serve(w, r, TargetURL(r))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRateLimitOptions(t *testing.T) {
+	l, err := (&Options{}).rateLimits()
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	l, err = (&Options{ClientByteLimit: "10G/1h"}).rateLimits()
+	require.NoError(t, err)
+	assert.Equal(t, rate{n: 10 << 30, window: time.Hour}, l.bytes)
+
+	opt := Options{
+		ClientRateLimit: "lots",
+		ClientByteLimit: "1G/never",
+		ClientMaxConns:  -1,
+		ClientMissLimit: "0/1m",
+	}
+	err = opt.Validate()
+	require.Error(t, err)
+	for _, name := range []string{"client_rate_limit", "client_byte_limit", "client_max_conns", "client_miss_limit"} {
+		assert.Contains(t, err.Error(), "invalid "+name, name)
+	}
+}
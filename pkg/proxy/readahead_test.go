@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveReadAhead(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 512*1024)
+	upstream := testUpstream(t, data)
+	defer upstream.Close()
+
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkSize:    "256K",
+		CacheChunkStreams: 1,
+		ReadAhead:         "4M",
+		ReadAheadTotal:    "6M",
+	})
+	require.NoError(t, err)
+	defer handler.Shutdown()
+
+	w := httptest.NewRecorder()
+	handler.Serve(w, httptest.NewRequest("GET", "/", nil), upstream.URL)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Range", "bytes=1000000-1999999")
+	handler.Serve(w, r, upstream.URL)
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, data[1000000:2000000], w.Body.Bytes())
+
+	// The handles are closed so their read ahead is given back
+	assert.Equal(t, int64(0), handler.Engine.Stats()["readAheadInFlight"])
+
+	_, err = NewHandler(Options{CacheDir: t.TempDir(), ReadAhead: "fast"})
+	assert.Error(t, err)
+}
@@ -5,13 +5,19 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tgdrive/varc/internal/types"
 )
 
-// Compile-time check that remoteFile implements RemoteObject
-var _ types.RemoteObject = (*remoteFile)(nil)
+// Compile-time check that remoteFile implements RemoteObject and
+// RemoteUpdater
+var (
+	_ types.RemoteObject  = (*remoteFile)(nil)
+	_ types.RemoteUpdater = (*remoteFile)(nil)
+)
 
 // remoteFile is an HTTP-backed RemoteObject used by the proxy
 // to fetch files from upstream URLs through the disk cache.
@@ -20,15 +26,17 @@ type remoteFile struct {
 	headers http.Header
 	size    int64
 	modTime time.Time
+	etag    string
 	client  *http.Client
 }
 
-func newHTTPFile(url string, headers http.Header, size int64, modTime time.Time, client *http.Client) *remoteFile {
+func newHTTPFile(url string, headers http.Header, size int64, modTime time.Time, etag string, client *http.Client) *remoteFile {
 	return &remoteFile{
 		url:     url,
 		headers: headers,
 		size:    size,
 		modTime: modTime,
+		etag:    etag,
 		client:  client,
 	}
 }
@@ -43,6 +51,120 @@ func (f *remoteFile) Size() int64 {
 	return f.size
 }
 
+// ModTime returns the upstream Last-Modified time, or the zero time
+// if unknown
+func (f *remoteFile) ModTime(ctx context.Context) time.Time {
+	return f.modTime
+}
+
+// ETag returns the upstream entity tag, or "" if the upstream didn't
+// send one
+func (f *remoteFile) ETag() string {
+	return f.etag
+}
+
+// Fingerprint identifies the content of the upstream object so the
+// cache can detect when it has been replaced.
+//
+// It is built from the size and the strongest validator available
+// (ETag, else Last-Modified). It returns "" if nothing is known about
+// the object, e.g. because the HEAD request failed.
+func (f *remoteFile) Fingerprint() string {
+	var fp []string
+	if f.size >= 0 {
+		fp = append(fp, strconv.FormatInt(f.size, 10))
+	}
+	if f.etag != "" {
+		fp = append(fp, f.etag)
+	} else if !f.modTime.IsZero() {
+		fp = append(fp, f.modTime.UTC().Format(time.RFC3339))
+	}
+	return strings.Join(fp, ",")
+}
+
+// stat fills in the size and validators of the file with a HEAD
+// request, leaving them alone if it fails
+func (f *remoteFile) stat(ctx context.Context) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, f.url, nil)
+	if err != nil {
+		return
+	}
+	f.setHeaders(req)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+	if cl := resp.Header.Get("Content-Length"); cl != "" {
+		if parsed, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			f.size = parsed
+		}
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if parsed, err := http.ParseTime(lm); err == nil {
+			f.modTime = parsed
+		}
+	}
+	f.etag = resp.Header.Get("ETag")
+}
+
+// setHeaders applies the stored headers to req
+func (f *remoteFile) setHeaders(req *http.Request) {
+	for k, vv := range f.headers {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+}
+
+// Update uploads size bytes read from in to the upstream URL with a
+// PUT, returning the file as the upstream describes it afterwards.
+//
+// The validators come from a HEAD request after the upload rather
+// than the PUT response so they match what a GET will see.
+func (f *remoteFile) Update(ctx context.Context, in io.Reader, size int64) (types.RemoteObject, error) {
+	if size == 0 {
+		in = http.NoBody
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, f.url, in)
+	if err != nil {
+		return nil, fmt.Errorf("remoteFile.Update: %w", err)
+	}
+	f.setHeaders(req)
+	req.ContentLength = size
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("remoteFile.Update: %w", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("remoteFile.Update: %s (status %d)", resp.Status, resp.StatusCode)
+		if rejected(resp.StatusCode) {
+			err = fmt.Errorf("%w: %w", types.ErrRejected, err)
+		}
+		return nil, err
+	}
+
+	updated := newHTTPFile(f.url, f.headers, size, time.Time{}, "", f.client)
+	updated.stat(ctx)
+	return updated, nil
+}
+
+// rejected returns true if an upload which got status was refused for
+// good rather than failing in a way which may pass if tried again
+func rejected(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 400 && status <= 499
+}
+
 // Open opens the remote file for reading, supporting Range requests
 // via types.RangeOption.
 func (f *remoteFile) Open(ctx context.Context, options ...types.OpenOption) (io.ReadCloser, error) {
@@ -52,11 +174,7 @@ func (f *remoteFile) Open(ctx context.Context, options ...types.OpenOption) (io.
 	}
 
 	// Apply stored headers
-	for k, vv := range f.headers {
-		for _, v := range vv {
-			req.Header.Add(k, v)
-		}
-	}
+	f.setHeaders(req)
 
 	// Apply open options (e.g., RangeOption)
 	for _, opt := range options {
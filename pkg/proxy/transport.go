@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Defaults of the upstream transport options
+const (
+	DefaultConnectTimeout        = 10 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+	DefaultIdleConnTimeout       = 90 * time.Second
+)
+
+// proxyInEnvironment returns true if a proxy for the upstream may be
+// set in the environment, see http.ProxyFromEnvironment
+func proxyInEnvironment() bool {
+	for _, name := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		if os.Getenv(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamTransport builds the transport requests to the upstream are
+// made with from the options.
+//
+// There is no limit on how long a whole request takes so large bodies
+// can stream as slowly as they need to. Each phase up to the response
+// headers has its own timeout instead, and reads are cancelled when
+// the clients waiting on them go away. All the problems found are
+// returned together.
+func (opt *Options) upstreamTransport() (*http.Transport, error) {
+	var errs []error
+	invalid := func(name, value string, err error) {
+		errs = append(errs, fmt.Errorf("invalid %s %q: %w", name, value, err))
+	}
+	duration := func(name, value string, def time.Duration) time.Duration {
+		if value == "" {
+			return def
+		}
+		d, err := time.ParseDuration(value)
+		if err == nil && d < 0 {
+			err = errors.New("must not be negative")
+		}
+		if err != nil {
+			invalid(name, value, err)
+		}
+		return d
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   duration("connect_timeout", opt.ConnectTimeout, DefaultConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	hosts, nets, _ := parseAllowHosts(opt.AllowHosts)
+	if (opt.BlockPrivate || len(nets) > 0) && opt.UpstreamProxy == "" && !proxyInEnvironment() {
+		// Checked again on connecting in case the name resolves
+		// differently to when the request was allowed. Through a proxy
+		// it is the proxy which connects.
+		dial = (&accessControl{hosts: hosts, nets: nets, blockPrivate: opt.BlockPrivate}).dialContext(dialer)
+	}
+	if opt.BindAddress != "" {
+		if ip := net.ParseIP(opt.BindAddress); ip != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		} else {
+			invalid("bind_address", opt.BindAddress, errors.New("expecting an IP address"))
+		}
+	}
+
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		TLSHandshakeTimeout:   duration("tls_handshake_timeout", opt.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: duration("response_header_timeout", opt.ResponseHeaderTimeout, DefaultResponseHeaderTimeout),
+		IdleConnTimeout:       duration("idle_conn_timeout", opt.IdleConnTimeout, DefaultIdleConnTimeout),
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+		TLSClientConfig:       &tls.Config{},
+		Protocols:             new(http.Protocols),
+	}
+	if opt.MaxConnsPerHost < 0 {
+		invalid("max_conns_per_host", strconv.Itoa(opt.MaxConnsPerHost), errors.New("must not be negative"))
+	} else if opt.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = opt.MaxConnsPerHost
+		t.MaxIdleConnsPerHost = opt.MaxConnsPerHost
+	}
+	t.Protocols.SetHTTP1(true)
+	t.Protocols.SetHTTP2(!opt.DisableHTTP2)
+
+	if opt.UpstreamProxy != "" {
+		u, err := url.Parse(opt.UpstreamProxy)
+		if err == nil && (u.Scheme == "" || u.Host == "") {
+			err = errors.New("expecting a URL like http://host:port")
+		}
+		if err != nil {
+			invalid("upstream_proxy", opt.UpstreamProxy, err)
+		} else {
+			t.Proxy = http.ProxyURL(u)
+		}
+	}
+
+	if opt.CACert != "" {
+		pem, err := os.ReadFile(opt.CACert)
+		if err != nil {
+			invalid("ca_cert", opt.CACert, err)
+		} else {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if pool.AppendCertsFromPEM(pem) {
+				t.TLSClientConfig.RootCAs = pool
+			} else {
+				invalid("ca_cert", opt.CACert, errors.New("no PEM certificates found"))
+			}
+		}
+	}
+
+	switch {
+	case opt.ClientCert != "" && opt.ClientKey != "":
+		cert, err := tls.LoadX509KeyPair(opt.ClientCert, opt.ClientKey)
+		if err != nil {
+			invalid("client_cert", opt.ClientCert, err)
+		} else {
+			t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+	case opt.ClientCert != "":
+		invalid("client_cert", opt.ClientCert, errors.New("needs client_key"))
+	case opt.ClientKey != "":
+		invalid("client_key", opt.ClientKey, errors.New("needs client_cert"))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return t, nil
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writePEM writes a PEM block of typ holding der to a file in dir
+func writePEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600))
+	return path
+}
+
+// clientCert makes a self signed client certificate, returning it and
+// the paths of its certificate and key files
+func clientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "varc"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return cert, writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// serveGet serves a GET of targetURL through a handler made with opt
+func serveGet(t *testing.T, opt Options, targetURL string) *httptest.ResponseRecorder {
+	opt.CacheDir = t.TempDir()
+	handler, err := NewHandler(opt)
+	require.NoError(t, err)
+	defer handler.Shutdown()
+	w := httptest.NewRecorder()
+	handler.Serve(w, httptest.NewRequest(http.MethodGet, "/", nil), targetURL)
+	return w
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("served over mTLS")
+	cert, certFile, keyFile := clientCert(t, dir)
+	var protos atomic.Value
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos.Store(r.Proto)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	upstream.EnableHTTP2 = true
+	upstream.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", upstream.Certificate().Raw)
+
+	// The origin's CA isn't trusted without ca_cert
+	w := serveGet(t, Options{ClientCert: certFile, ClientKey: keyFile}, upstream.URL+"/a")
+	assert.NotEqual(t, http.StatusOK, w.Code)
+
+	// Nor is it reachable without a client certificate
+	w = serveGet(t, Options{CACert: caFile}, upstream.URL+"/b")
+	assert.NotEqual(t, http.StatusOK, w.Code)
+
+	w = serveGet(t, Options{CACert: caFile, ClientCert: certFile, ClientKey: keyFile}, upstream.URL+"/c")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+	assert.Equal(t, "HTTP/2.0", protos.Load())
+
+	w = serveGet(t, Options{CACert: caFile, ClientCert: certFile, ClientKey: keyFile, DisableHTTP2: true}, upstream.URL+"/d")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "HTTP/1.1", protos.Load())
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	data := []byte("fetched through the proxy")
+	var proxied atomic.Int64
+	outbound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Requests for the origin arrive with its absolute URL
+		if r.URL.Host == "origin.invalid" {
+			proxied.Add(1)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer outbound.Close()
+
+	w := serveGet(t, Options{UpstreamProxy: outbound.URL, BindAddress: "127.0.0.1"}, "http://origin.invalid/file")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.Bytes())
+	assert.Greater(t, proxied.Load(), int64(0))
+}
+
+func TestUpstreamTransportOptions(t *testing.T) {
+	tr, err := (&Options{}).upstreamTransport()
+	require.NoError(t, err)
+	assert.Equal(t, DefaultResponseHeaderTimeout, tr.ResponseHeaderTimeout)
+	assert.Equal(t, DefaultIdleConnTimeout, tr.IdleConnTimeout)
+	assert.True(t, tr.Protocols.HTTP2())
+
+	tr, err = (&Options{ResponseHeaderTimeout: "2m", MaxConnsPerHost: 4}).upstreamTransport()
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, tr.ResponseHeaderTimeout)
+	assert.Equal(t, 4, tr.MaxConnsPerHost)
+	assert.Equal(t, 4, tr.MaxIdleConnsPerHost)
+
+	// All the problems are reported together
+	opt := Options{
+		ConnectTimeout:  "soon",
+		IdleConnTimeout: "-1s",
+		MaxConnsPerHost: -1,
+		UpstreamProxy:   "proxy:3128",
+		BindAddress:     "eth0",
+		CACert:          filepath.Join(t.TempDir(), "missing.pem"),
+		ClientKey:       "key.pem",
+	}
+	err = opt.Validate()
+	require.Error(t, err)
+	for _, name := range []string{"connect_timeout", "idle_conn_timeout", "max_conns_per_host", "upstream_proxy", "bind_address", "ca_cert", "client_key"} {
+		assert.Contains(t, err.Error(), "invalid "+name, name)
+	}
+	_, err = NewHandler(opt)
+	assert.Error(t, err)
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Ways a PUT to a cacheable URL can be written to the cache
+const (
+	WriteCacheOff     = "off"     // PUTs bypass the cache
+	WriteCacheThrough = "through" // stored then uploaded before replying
+	WriteCacheBack    = "back"    // stored then uploaded in the background
+)
+
+// writeCacheMode returns how PUTs are cached
+func (opt *Options) writeCacheMode() string {
+	if opt.WriteCache == "" {
+		return WriteCacheOff
+	}
+	return opt.WriteCache
+}
+
+// serveWrite stores the body of a PUT in the cache as the new content
+// of targetURL and uploads it to the upstream, returning the status
+// sent and the size of the body stored.
+//
+// With write through the upload is done before replying, and if it
+// fails the cached copy is dropped and the error returned to the
+// client. With write back the reply is sent once the body is stored
+// and the upload is queued, to be retried until it works.
+func (h *Handler) serveWrite(w http.ResponseWriter, r *http.Request, targetURL, cachePath string) (status int, size int64) {
+	headers := upstreamHeaders(r)
+	obj := newHTTPFile(targetURL, headers, r.ContentLength, time.Time{}, "", h.client)
+	writeThrough := h.writeCache == WriteCacheThrough
+	fh, err := h.Engine.OpenWrite(cachePath, obj, writeThrough)
+	if err != nil {
+		http.Error(w, "Failed to open file: "+err.Error(), http.StatusInternalServerError)
+		return http.StatusInternalServerError, 0
+	}
+	h.mapping.put(targetURL, cachePath, headers)
+	if len(h.quotaRules) > 0 {
+		h.Engine.CacheItem(cachePath).SetGroup(h.quotaGroup(r, targetURL))
+	}
+
+	size, err = io.Copy(fh, r.Body)
+	if err == nil && size != r.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		_ = fh.Abort()
+		http.Error(w, "Failed to read request body: "+err.Error(), http.StatusBadRequest)
+		return http.StatusBadRequest, 0
+	}
+	if err = fh.Close(); err != nil {
+		if writeThrough {
+			// Don't serve what the upstream doesn't have
+			_ = h.Engine.Remove(cachePath)
+			http.Error(w, "Upload failed: "+err.Error(), http.StatusBadGateway)
+			return http.StatusBadGateway, 0
+		}
+		http.Error(w, "Failed to store file: "+err.Error(), http.StatusInternalServerError)
+		return http.StatusInternalServerError, 0
+	}
+
+	h.metrics.mu.Lock()
+	h.metrics.Writes++
+	h.metrics.BytesWritten += size
+	h.metrics.mu.Unlock()
+
+	if !writeThrough {
+		w.WriteHeader(http.StatusAccepted)
+		return http.StatusAccepted, size
+	}
+	item := h.Engine.CacheItem(cachePath)
+	if etag, _ := h.validators(item, size); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, size
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writableUpstream serves the last thing PUT to it with a new ETag
+// for each version
+type writableUpstream struct {
+	mu      sync.Mutex
+	data    []byte
+	version int
+	gets    int
+	puts    int
+	fail    int // status PUTs fail with, if set
+}
+
+func (u *writableUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		u.puts++
+		if u.fail != 0 {
+			http.Error(w, "read only", u.fail)
+			return
+		}
+		u.data, _ = io.ReadAll(r.Body)
+		u.version++
+		w.WriteHeader(http.StatusCreated)
+		return
+	case http.MethodGet:
+		u.gets++
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, u.version))
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(u.data)))
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(u.data))
+}
+
+func (u *writableUpstream) state() (data []byte, gets, puts int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.data, u.gets, u.puts
+}
+
+func newWriteHandler(t *testing.T, mode, writeBack string) *Handler {
+	handler, err := NewHandler(Options{
+		CacheDir:          t.TempDir(),
+		CacheChunkStreams: 1,
+		WriteCache:        mode,
+		WriteBack:         writeBack,
+		AdminKeys:         "admin-key",
+	})
+	require.NoError(t, err)
+	t.Cleanup(handler.Shutdown)
+	return handler
+}
+
+func put(handler *Handler, url string, data []byte) *http.Response {
+	w := httptest.NewRecorder()
+	handler.Serve(w, httptest.NewRequest(http.MethodPut, "/", bytes.NewReader(data)), url)
+	return w.Result()
+}
+
+func get(handler *Handler, url string) (*http.Response, []byte) {
+	w := httptest.NewRecorder()
+	handler.Serve(w, httptest.NewRequest(http.MethodGet, "/", nil), url)
+	body, _ := io.ReadAll(w.Result().Body)
+	return w.Result(), body
+}
+
+func TestWriteThrough(t *testing.T) {
+	origin := &writableUpstream{data: []byte("old")}
+	upstream := httptest.NewServer(origin)
+	defer upstream.Close()
+	handler := newWriteHandler(t, WriteCacheThrough, "")
+
+	data := []byte("the new content of the file")
+	resp := put(handler, upstream.URL, data)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	got, _, puts := origin.state()
+	assert.Equal(t, data, got)
+	assert.Equal(t, 1, puts)
+
+	// Read back from the cache without fetching it again
+	resp, body := get(handler, upstream.URL)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	_, gets, _ := origin.state()
+	assert.Equal(t, 0, gets)
+	snap := handler.Metrics().Snapshot()
+	assert.Equal(t, int64(1), snap["hits"])
+	assert.Equal(t, int64(1), snap["writes"])
+	assert.Equal(t, int64(len(data)), snap["bytes_written"])
+
+	// A failed upload isn't cached
+	origin.mu.Lock()
+	origin.fail = http.StatusForbidden
+	origin.mu.Unlock()
+	resp = put(handler, upstream.URL, []byte("rejected"))
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	resp, body = get(handler, upstream.URL)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, body)
+	_, gets, _ = origin.state()
+	assert.Equal(t, 1, gets)
+}
+
+func TestWriteBack(t *testing.T) {
+	origin := &writableUpstream{data: []byte("old")}
+	upstream := httptest.NewServer(origin)
+	defer upstream.Close()
+	handler := newWriteHandler(t, WriteCacheBack, "100ms")
+
+	data := []byte("the new content of the file")
+	resp := put(handler, upstream.URL, data)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// Not served from the cache before the upstream has it
+	resp, body := get(handler, upstream.URL)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []byte("old"), body)
+	_, gets, _ := origin.state()
+	assert.Equal(t, 1, gets)
+
+	require.Eventually(t, func() bool {
+		got, _, _ := origin.state()
+		return bytes.Equal(got, data)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return handler.Engine.Stats()["uploads"] == int64(1)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Still a hit once uploaded
+	resp, body = get(handler, upstream.URL)
+	assert.Equal(t, data, body)
+	assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	_, gets, puts := origin.state()
+	assert.Equal(t, 1, gets)
+	assert.Equal(t, 1, puts)
+}
+
+func TestWriteBackRetries(t *testing.T) {
+	origin := &writableUpstream{data: []byte("old"), fail: http.StatusServiceUnavailable}
+	upstream := httptest.NewServer(origin)
+	defer upstream.Close()
+	handler := newWriteHandler(t, WriteCacheBack, "10ms")
+
+	data := []byte("the new content of the file")
+	assert.Equal(t, http.StatusAccepted, put(handler, upstream.URL, data).StatusCode)
+	require.Eventually(t, func() bool {
+		return handler.Engine.Stats()["uploadErrors"] == int64(1)
+	}, 5*time.Second, 10*time.Millisecond)
+	origin.mu.Lock()
+	origin.fail = 0
+	origin.mu.Unlock()
+	require.Eventually(t, func() bool {
+		got, _, _ := origin.state()
+		return bytes.Equal(got, data)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWriteBackRejected(t *testing.T) {
+	origin := &writableUpstream{data: []byte("old"), fail: http.StatusForbidden}
+	upstream := httptest.NewServer(origin)
+	defer upstream.Close()
+	handler := newWriteHandler(t, WriteCacheBack, "10ms")
+
+	assert.Equal(t, http.StatusAccepted, put(handler, upstream.URL, []byte("refused")).StatusCode)
+	require.Eventually(t, func() bool {
+		return handler.Engine.Stats()["uploadErrors"] == int64(1)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Dropped from the cache and the queue rather than retried
+	cachePath := handler.hashCachePath(upstream.URL)
+	require.Eventually(t, func() bool {
+		return !handler.Engine.CacheItem(cachePath).Exists()
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	_, _, puts := origin.state()
+	assert.Equal(t, 1, puts)
+	assert.Empty(t, queue(t, handler))
+
+	_, body := get(handler, upstream.URL)
+	assert.Equal(t, []byte("old"), body)
+}
+
+func TestWriteCacheOff(t *testing.T) {
+	origin := &writableUpstream{data: []byte("old")}
+	upstream := httptest.NewServer(origin)
+	defer upstream.Close()
+	handler := newWriteHandler(t, "", "")
+
+	data := []byte("new")
+	resp := put(handler, upstream.URL, data)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, int64(0), handler.Metrics().Snapshot()["writes"])
+	_, body := get(handler, upstream.URL)
+	assert.Equal(t, data, body)
+	_, gets, _ := origin.state()
+	assert.Equal(t, 1, gets)
+
+	assert.Error(t, (&Options{WriteCache: "sometimes"}).Validate())
+}
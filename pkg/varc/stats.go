@@ -0,0 +1,121 @@
+package varc
+
+// Stats is a snapshot of the counters of a Cache
+type Stats struct {
+	// Requests served over HTTP
+	Requests          int64
+	Hits              int64
+	Misses            int64
+	HitRatio          float64 // Hits / (Hits + Misses), 0 before any lookups
+	BytesServed       int64
+	BytesFromUpstream int64
+	Purges            int64
+	Writes            int64 // PUTs written into the cache
+	BytesWritten      int64
+	Denied            int64 // requests refused by the access control
+	RateLimited       int64 // requests refused for going over a client limit
+
+	// Contents of the cache
+	Ready          bool   // set once the cache has finished loading
+	Files          int64  // number of files known to the cache
+	BytesUsed      int64  // bytes the files take on disk
+	OutOfSpace     bool   // set if the cache disks ran out of space
+	EvictionPolicy string // which files are evicted first
+	Evictions      int64  // files evicted to free space
+	EvictedBytes   int64  // bytes freed by evictions
+	EvictedRanges  int64  // chunks evicted from inside files
+	CorruptChunks  int64  // chunks which failed their checksums
+	Nodes          int64  // files in the in-memory index
+
+	// Uploads of files written through the cache
+	UploadsInProgress int64
+	UploadsQueued     int64
+	Uploads           int64
+	UploadedBytes     int64
+	UploadErrors      int64
+
+	// DownloadsCancelled counts the upstream downloads stopped after
+	// all the clients reading them had gone
+	DownloadsCancelled int64
+
+	// EventsDropped counts the events subscribers were too far behind
+	// to be sent
+	EventsDropped int64
+
+	// Groups holds the usage of each quota group by name
+	Groups map[string]GroupStats
+}
+
+// GroupStats is the usage of a quota group
+type GroupStats struct {
+	Files        int64
+	BytesUsed    int64
+	MaxSize      int64 // 0 if not limited
+	MaxAge       int64 // seconds, 0 if the global max age is used
+	Evictions    int64
+	EvictedBytes int64
+}
+
+// Stats returns a snapshot of the counters of the cache
+func (c *Cache) Stats() Stats {
+	snap := c.h.Metrics().Snapshot()
+	engine := c.h.Engine.Stats()
+	n := func(key string) int64 {
+		switch v := engine[key].(type) {
+		case int64:
+			return v
+		case int:
+			return int64(v)
+		}
+		return 0
+	}
+	s := Stats{
+		Requests:          snap["requests"],
+		Hits:              snap["hits"],
+		Misses:            snap["misses"],
+		BytesServed:       snap["bytes_served"],
+		BytesFromUpstream: snap["bytes_from_upstream"],
+		Purges:            snap["purges"],
+		Writes:            snap["writes"],
+		BytesWritten:      snap["bytes_written"],
+		Denied:            snap["denied"],
+		RateLimited:       snap["rate_limited"],
+
+		Files:         n("files"),
+		BytesUsed:     n("bytesUsed"),
+		Evictions:     n("evictions"),
+		EvictedBytes:  n("evictedBytes"),
+		EvictedRanges: n("evictedRanges"),
+		CorruptChunks: n("corruptChunks"),
+		Nodes:         n("nodes"),
+
+		UploadsInProgress: n("uploadsInProgress"),
+		UploadsQueued:     n("uploadsQueued"),
+		Uploads:           n("uploads"),
+		UploadedBytes:     n("uploadedBytes"),
+		UploadErrors:      n("uploadErrors"),
+		EventsDropped:     n("eventsDropped"),
+
+		DownloadsCancelled: n("downloadsCancelled"),
+	}
+	if lookups := s.Hits + s.Misses; lookups > 0 {
+		s.HitRatio = float64(s.Hits) / float64(lookups)
+	}
+	s.Ready, _ = engine["ready"].(bool)
+	s.OutOfSpace, _ = engine["outOfSpace"].(bool)
+	s.EvictionPolicy, _ = engine["evictionPolicy"].(string)
+	if groups, ok := engine["groups"].(map[string]map[string]int64); ok {
+		s.Groups = make(map[string]GroupStats, len(groups))
+		for name, g := range groups {
+			s.Groups[name] = GroupStats{
+				Files:        g["files"],
+				BytesUsed:    g["bytesUsed"],
+				MaxSize:      g["maxSize"],
+				MaxAge:       g["maxAge"],
+				Evictions:    g["evictions"],
+				EvictedBytes: g["evictedBytes"],
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,300 @@
+// Package varc is the Go API for embedding the varc range caching proxy.
+//
+// A Cache reads upstream URLs through the disk cache as io.ReaderAt,
+// prefetches and purges them, lists what is cached and reports what
+// happens to it, and serves HTTP like the standalone proxy does.
+//
+//	c, err := varc.New(varc.DefaultOptions())
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	r, err := c.Open(ctx, "https://example.com/video.mp4", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer r.Close()
+//	n, err := r.ReadAt(buf, 1<<20)
+package varc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"net/http"
+	"time"
+
+	"github.com/tgdrive/varc/internal"
+	"github.com/tgdrive/varc/internal/cache"
+	"github.com/tgdrive/varc/pkg/proxy"
+)
+
+// Options configures a Cache. The fields are the options of the
+// standalone proxy and the Caddy module.
+type Options = proxy.Options
+
+// DefaultOptions returns the options used when none are given
+func DefaultOptions() Options {
+	return proxy.DefaultOptions()
+}
+
+// Cache is a disk cache of upstream URLs
+type Cache struct {
+	h *proxy.Handler
+}
+
+// New creates a Cache, loading what is already cached in the cache
+// directories. Close must be called to stop it.
+func New(opt Options) (*Cache, error) {
+	h, err := proxy.NewHandler(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{h: h}, nil
+}
+
+// Close stops the background work of the cache
+func (c *Cache) Close() error {
+	c.h.Shutdown()
+	return nil
+}
+
+// Handler returns the HTTP handler the cache serves requests with, for
+// serving targets resolved some other way with its Serve method.
+func (c *Cache) Handler() *proxy.Handler {
+	return c.h
+}
+
+// ServeHTTP serves the upstream URL given by the url query parameter,
+// or base64 encoded in a path after /stream/, through the cache.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	targetURL := proxy.TargetURL(r)
+	if targetURL == "" {
+		http.Error(w, "Missing 'url' parameter or base64 path", http.StatusBadRequest)
+		return
+	}
+	c.h.Serve(w, r, targetURL)
+}
+
+// Ready returns true once the cache has finished loading, which is
+// straight away unless LazyReload is set
+func (c *Cache) Ready() bool {
+	return c.h.Ready()
+}
+
+// Reader reads an upstream URL through the cache. What isn't cached
+// is fetched from the upstream as it is read and cached.
+type Reader struct {
+	ctx     context.Context
+	fh      internal.Handle
+	size    int64
+	etag    string
+	modTime time.Time
+}
+
+// Check interfaces
+var (
+	_ io.ReaderAt = (*Reader)(nil)
+	_ io.Closer   = (*Reader)(nil)
+)
+
+// Open opens url for reading through the cache, fetching what isn't
+// cached with header sent to the upstream.
+//
+// Reads fail with the error of ctx once it is done. The Reader must be
+// closed after use.
+func (c *Cache) Open(ctx context.Context, url string, header http.Header) (*Reader, error) {
+	fh, err := c.h.Open(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fh.Stat()
+	if err != nil {
+		_ = fh.Close()
+		return nil, err
+	}
+	etag, modTime := c.h.Engine.CacheItem(c.h.CachePath(url)).GetValidators()
+	return &Reader{
+		ctx:     ctx,
+		fh:      fh,
+		size:    info.Size(),
+		etag:    etag,
+		modTime: modTime,
+	}, nil
+}
+
+// ReadAt reads len(p) bytes from off in the file
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.fh.ReadAt(p, off)
+}
+
+// Size returns the size of the file, -1 if it isn't known
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+// ETag returns the entity tag of the upstream file, if it has one
+func (r *Reader) ETag() string {
+	return r.etag
+}
+
+// ModTime returns the modification time of the upstream file, if known
+func (r *Reader) ModTime() time.Time {
+	return r.modTime
+}
+
+// Close closes the Reader
+func (r *Reader) Close() error {
+	return r.fh.Close()
+}
+
+// prefetchBufferSize is the size of the reads which fill the cache
+const prefetchBufferSize = 1 << 20
+
+// Prefetch fetches all of url into the cache, returning when it is all
+// cached or ctx is done.
+func (c *Cache) Prefetch(ctx context.Context, url string, header http.Header) (err error) {
+	r, err := c.Open(ctx, url, header)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := r.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	size := r.size
+	if size < 0 {
+		size = 1<<63 - 1
+	}
+	_, err = io.CopyBuffer(io.Discard, io.NewSectionReader(r, 0, size), make([]byte, prefetchBufferSize))
+	return err
+}
+
+// Purge removes url from the cache so the next read of it is fetched
+// from the upstream again
+func (c *Cache) Purge(url string) error {
+	return c.h.Purge(url)
+}
+
+// Entry describes a file stored in the cache
+type Entry struct {
+	Key          string    // path the file is cached under
+	URL          string    // upstream URL, if it has been used since the cache was created
+	Size         int64     // size of the file, -1 if not known
+	Cached       int64     // bytes of the file present in the cache
+	LastAccess   time.Time // last time it was read
+	ETag         string    // entity tag of the upstream file, if any
+	LastModified time.Time // modification time of the upstream file, if known
+	Group        string    // quota group it is in, if any
+	Dirty        bool      // set if it is waiting to be uploaded
+	InUse        bool      // set if it is open
+}
+
+// Entries returns an iterator over the files stored in the cache in
+// Key order
+func (c *Cache) Entries() iter.Seq[Entry] {
+	return func(yield func(Entry) bool) {
+		c.h.Engine.Entries(func(e cache.Entry) bool {
+			return yield(c.entry(e))
+		})
+	}
+}
+
+// entry converts an Entry of the cache engine
+func (c *Cache) entry(e cache.Entry) Entry {
+	url, _ := c.h.URL(e.Name)
+	return Entry{
+		Key:          e.Name,
+		URL:          url,
+		Size:         e.Size,
+		Cached:       e.Cached,
+		LastAccess:   e.ATime,
+		ETag:         e.ETag,
+		LastModified: e.RemoteTime,
+		Group:        e.Group,
+		Dirty:        e.Dirty,
+		InUse:        e.InUse,
+	}
+}
+
+// EventType is the kind of change to the cache an Event reports
+type EventType string
+
+// Kinds of Event
+const (
+	EventRemoved  EventType = "removed"  // a file was purged or deleted
+	EventEvicted  EventType = "evicted"  // a file expired or was removed to free space
+	EventUploaded EventType = "uploaded" // a file written through the cache was uploaded
+)
+
+// Event is a change to a file in the cache
+type Event struct {
+	Type EventType
+	Key  string    // path the file is cached under
+	URL  string    // upstream URL, if known
+	Size int64     // bytes freed by an eviction or uploaded
+	Time time.Time // when it happened
+}
+
+// Subscribe returns a channel the events of the cache are sent to
+// until ctx is done, when it is closed.
+//
+// Events are dropped rather than wait for a subscriber which is behind
+// by more than buffer events. The EventsDropped stat counts them.
+func (c *Cache) Subscribe(ctx context.Context, buffer int) <-chan Event {
+	events, cancel := c.h.Engine.Subscribe(buffer)
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		defer cancel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-events:
+				url, _ := c.h.URL(e.Name)
+				ev := Event{Type: EventType(e.Type.String()), Key: e.Name, URL: url, Size: e.Size, Time: e.Time}
+				select {
+				case out <- ev:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// ErrNotCached is returned by Stat for a URL which isn't in the cache
+var ErrNotCached = errors.New("varc: not cached")
+
+// Stat returns the Entry of url, or ErrNotCached if it isn't cached
+func (c *Cache) Stat(url string) (Entry, error) {
+	e, ok := c.h.Engine.Entry(c.h.CachePath(url))
+	if !ok {
+		return Entry{}, ErrNotCached
+	}
+	return c.entry(e), nil
+}
+
+// Link is a signed link reading an upstream URL through varc, which
+// may be bound to a client address and limited to part of the file
+type Link = proxy.Link
+
+// SignLink returns the /stream/ path and query of link signed with
+// key, to be appended to the address varc is served on. Caches with
+// key in their SigningKeys option serve it until it expires.
+func SignLink(key string, link Link) (string, error) {
+	return proxy.SignLink(key, link)
+}
+
+// SignLink signs link with the first of the SigningKeys of the cache,
+// see SignLink
+func (c *Cache) SignLink(link Link) (string, error) {
+	return c.h.SignLink(link)
+}
@@ -0,0 +1,167 @@
+package varc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCache(t *testing.T) *Cache {
+	opt := DefaultOptions()
+	opt.CacheDir = t.TempDir()
+	c, err := New(opt)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func newUpstream(t *testing.T, data []byte) (*httptest.Server, *atomic.Int64) {
+	var gets atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &gets
+}
+
+func TestOpen(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	upstream, gets := newUpstream(t, data)
+	c := newTestCache(t)
+	ctx := context.Background()
+
+	r, err := c.Open(ctx, upstream.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), r.Size())
+	assert.Equal(t, `"v1"`, r.ETag())
+	buf := make([]byte, 100)
+	n, err := r.ReadAt(buf, 5000)
+	require.NoError(t, err)
+	assert.Equal(t, data[5000:5000+n], buf[:n])
+	require.NoError(t, r.Close())
+
+	entry, err := c.Stat(upstream.URL)
+	require.NoError(t, err)
+	assert.Equal(t, upstream.URL, entry.URL)
+	assert.Equal(t, c.Handler().CachePath(upstream.URL), entry.Key)
+	assert.Equal(t, int64(len(data)), entry.Size)
+	assert.Greater(t, entry.Cached, int64(0))
+	assert.Equal(t, `"v1"`, entry.ETag)
+
+	// Reads fail once the context is done
+	ctx, cancel := context.WithCancel(ctx)
+	r, err = c.Open(ctx, upstream.URL, nil)
+	require.NoError(t, err)
+	cancel()
+	_, err = r.ReadAt(buf, 0)
+	assert.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, r.Close())
+
+	// Prefetch fills in the rest then reads are hits
+	require.NoError(t, c.Prefetch(context.Background(), upstream.URL, nil))
+	entry, err = c.Stat(upstream.URL)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), entry.Cached)
+	before := gets.Load()
+	r, err = c.Open(context.Background(), upstream.URL, nil)
+	require.NoError(t, err)
+	got, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	require.NoError(t, r.Close())
+	assert.Equal(t, before, gets.Load())
+}
+
+func TestEntriesAndEvents(t *testing.T) {
+	upstream, _ := newUpstream(t, []byte("hello"))
+	c := newTestCache(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := c.Subscribe(ctx, 10)
+
+	for _, path := range []string{"/a", "/b"} {
+		require.NoError(t, c.Prefetch(ctx, upstream.URL+path, nil))
+	}
+	var urls []string
+	for entry := range c.Entries() {
+		urls = append(urls, entry.URL)
+		assert.Equal(t, int64(5), entry.Cached)
+	}
+	assert.ElementsMatch(t, []string{upstream.URL + "/a", upstream.URL + "/b"}, urls)
+
+	require.NoError(t, c.Purge(upstream.URL+"/a"))
+	select {
+	case ev := <-events:
+		assert.Equal(t, EventRemoved, ev.Type)
+		assert.Equal(t, c.Handler().CachePath(upstream.URL+"/a"), ev.Key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	_, err := c.Stat(upstream.URL + "/a")
+	assert.ErrorIs(t, err, ErrNotCached)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats.Purges)
+	assert.True(t, stats.Ready)
+	assert.Equal(t, "lru", stats.EvictionPolicy)
+	assert.Equal(t, int64(1), stats.Nodes)
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	upstream, _ := newUpstream(t, []byte("hello"))
+	c := newTestCache(t)
+
+	for _, target := range []string{
+		"/stream?url=" + upstream.URL,
+		"/stream/" + base64.RawURLEncoding.EncodeToString([]byte(upstream.URL)),
+	} {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, w.Code, target)
+		assert.Equal(t, "hello", w.Body.String(), target)
+	}
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSignLink(t *testing.T) {
+	upstream, _ := newUpstream(t, []byte("signed"))
+	opt := DefaultOptions()
+	opt.CacheDir = t.TempDir()
+	opt.SigningKeys = "new,old"
+	c, err := New(opt)
+	require.NoError(t, err)
+	defer c.Close()
+
+	link, err := c.SignLink(Link{URL: upstream.URL, Expires: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	old, err := SignLink("old", Link{URL: upstream.URL, Expires: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	for _, target := range []string{link, old} {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusOK, w.Code, target)
+		assert.Equal(t, "signed", w.Body.String(), target)
+	}
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream?url="+upstream.URL, nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, int64(1), c.Stats().Denied)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tgdrive/varc/pkg/proxy"
+
+	"github.com/spf13/pflag"
+)
+
+// runSign runs "varc sign [flags] <url>" which prints a signed link
+// reading url through varc, returning the exit code
+func runSign(args []string) int {
+	expires := pflag.String("expires", "24h", "How long the link works for, or the RFC 3339 time it stops working")
+	clientIP := pflag.String("client-ip", "", "Address or CIDR the link may only be used from")
+	byteRange := pflag.String("byte-range", "", "Bytes the link may read as first-last or first-, all if not set")
+	baseURL := pflag.String("base-url", "", "Address varc is served on to put in front of the link (e.g., https://varc.example.com)")
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s sign [flags] <url>\n\nPrints a link to url signed with the first of the --signing-keys.\n\n", os.Args[0])
+		pflag.PrintDefaults()
+	}
+	if err := pflag.CommandLine.Parse(args); err != nil {
+		return 2
+	}
+	if pflag.NArg() != 1 {
+		pflag.Usage()
+		return 2
+	}
+	opt, err := loadOptions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+	expiry, err := parseExpiry(*expires)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --expires: %v\n", err)
+		return 2
+	}
+	key, _, _ := strings.Cut(opt.SigningKeys, ",")
+	if key = strings.TrimSpace(key); key == "" {
+		fmt.Fprintln(os.Stderr, "No --signing-keys to sign with")
+		return 2
+	}
+	link, err := proxy.SignLink(key, proxy.Link{
+		URL:      pflag.Arg(0),
+		Expires:  expiry,
+		ClientIP: *clientIP,
+		Range:    *byteRange,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to sign link: %v\n", err)
+		return 1
+	}
+	fmt.Println(strings.TrimSuffix(*baseURL, "/") + link)
+	return 0
+}
+
+// parseExpiry parses an expiry given as a duration from now or an
+// RFC 3339 time
+func parseExpiry(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("%q is not in the future", s)
+		}
+		return time.Now().Add(d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}